@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// errAdminDisabled and errAdminToken are reported by checkAdminToken
+var (
+	errAdminDisabled = status.Error(codes.FailedPrecondition, "admin API is disabled")
+	errAdminToken    = status.Error(codes.Unauthenticated, "invalid admin token")
+)
+
+// checkAdminToken compares a bearer token with the configured admin token.
+// The admin API is disabled while no token is configured.
+func checkAdminToken(authorization string) error {
+	token := currentConfig().AdminToken
+	if token == "" {
+		return errAdminDisabled
+	}
+	got, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return errAdminToken
+	}
+	return nil
+}
+
+// adminAuth guards the /api/admin routes
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch checkAdminToken(c.GetHeader("Authorization")) {
+		case nil:
+			c.Next()
+		case errAdminDisabled:
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "admin API is disabled", "request_id": requestID(c)})
+		default:
+			GetLogger().Warn("Admin request rejected: invalid token",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("client_ip", c.ClientIP()))
+			recordRejection(transportREST, rejectUnauthorized)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid admin token", "request_id": requestID(c)})
+		}
+	}
+}
+
+// logLevelResponse is the JSON form of LogLevelState
+type logLevelResponse struct {
+	Level    string `json:"level"`
+	RevertTo string `json:"revert_to,omitempty"`
+	RevertAt string `json:"revert_at,omitempty"`
+}
+
+func newLogLevelResponse(state LogLevelState) logLevelResponse {
+	resp := logLevelResponse{Level: state.Level.String()}
+	if !state.RevertAt.IsZero() {
+		resp.RevertTo = state.RevertTo.String()
+		resp.RevertAt = state.RevertAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// handleGetLogLevel reports the log level in effect
+func handleGetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, newLogLevelResponse(logLevelState()))
+}
+
+// handleSetLogLevel changes the log level, reverting to the configured
+// level after revert_after seconds if given
+func handleSetLogLevel(c *gin.Context) {
+	var req struct {
+		Level       string `json:"level"`
+		RevertAfter int64  `json:"revert_after"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid request body", "request_id": requestID(c)})
+		return
+	}
+	level, revertAfter, err := parseLogLevelChange(req.Level, req.RevertAfter)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "request_id": requestID(c)})
+		return
+	}
+
+	state := overrideLogLevel(level, revertAfter)
+	logLevelChanged(state, c.ClientIP())
+	c.JSON(http.StatusOK, newLogLevelResponse(state))
+}
+
+// parseLogLevelChange validates a requested level and revert delay
+func parseLogLevelChange(name string, revertAfterSeconds int64) (zapcore.Level, time.Duration, error) {
+	level, err := zapcore.ParseLevel(name)
+	if err != nil || name == "" {
+		return level, 0, fmt.Errorf("level must be one of debug, info, warn, error, got %q", name)
+	}
+	if revertAfterSeconds < 0 {
+		return level, 0, fmt.Errorf("revert_after must be >= 0, got %d", revertAfterSeconds)
+	}
+	return level, time.Duration(revertAfterSeconds) * time.Second, nil
+}
+
+// logLevelChanged records a runtime level change, at warn so it is kept
+// whatever the new level
+func logLevelChanged(state LogLevelState, client string) {
+	fields := []zap.Field{
+		zap.Stringer("level", state.Level),
+		zap.String("client", client),
+	}
+	if !state.RevertAt.IsZero() {
+		fields = append(fields, zap.Stringer("revert_to", state.RevertTo), zap.Time("revert_at", state.RevertAt))
+	}
+	GetLogger().Warn("Log level changed through the admin API", fields...)
+}
+
+// adminCancelReason is what a client whose scan an administrator canceled
+// is told
+const adminCancelReason = "canceled by an administrator"
+
+// handleListScans reports the scans in progress
+func handleListScans(c *gin.Context) {
+	scans := scanTracker.List()
+	c.JSON(http.StatusOK, gin.H{"scans": scans, "count": len(scans)})
+}
+
+// handleCancelScan cancels the scan with the ID in the path
+func handleCancelScan(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "scan ID must be a positive integer", "request_id": requestID(c)})
+		return
+	}
+	scan, ok := scanTracker.Cancel(id, adminCancelReason)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no scan %d in progress", id), "request_id": requestID(c)})
+		return
+	}
+	scanCanceled(scan, c.ClientIP())
+	c.JSON(http.StatusOK, scan)
+}
+
+// scanCanceled records a scan canceled through the admin API
+func scanCanceled(scan ActiveScan, client string) {
+	GetLogger().Warn("Scan canceled through the admin API",
+		zap.Uint64("scan_id", scan.ID),
+		zap.String("request_id", scan.RequestID),
+		zap.String("transport", scan.Transport),
+		zap.String("filename", scan.Filename),
+		zap.Float64("elapsed_seconds", scan.ElapsedSeconds),
+		zap.String("client", client))
+}
+
+// allowlistRequest is a new allowlist entry as the admin API receives it
+type allowlistRequest struct {
+	Signature string     `json:"signature"`
+	SHA256    string     `json:"sha256"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// handleListAllowlist reports the allowlist entries
+func handleListAllowlist(c *gin.Context) {
+	entries := allowlist.List()
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "count": len(entries)})
+}
+
+// handleAddAllowlistEntry adds an entry to the allowlist
+func handleAddAllowlistEntry(c *gin.Context) {
+	var req allowlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid request body", "request_id": requestID(c)})
+		return
+	}
+	entry, err := allowlist.Add(AllowlistEntry{
+		Signature: req.Signature,
+		SHA256:    req.SHA256,
+		Reason:    req.Reason,
+		CreatedBy: c.ClientIP(),
+		ExpiresAt: req.ExpiresAt,
+	})
+	var invalid *AllowlistError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "request_id": requestID(c)})
+		return
+	}
+	if err != nil {
+		requestLogger(c).Error("Failed to save allowlist", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to save allowlist", "request_id": requestID(c)})
+		return
+	}
+	allowlistChanged("Allowlist entry added through the admin API", entry, c.ClientIP())
+	c.JSON(http.StatusCreated, entry)
+}
+
+// handleDeleteAllowlistEntry removes the entry with the ID in the path
+func handleDeleteAllowlistEntry(c *gin.Context) {
+	id := c.Param("id")
+	entry, ok, err := allowlist.Delete(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("no allowlist entry %s", id), "request_id": requestID(c)})
+		return
+	}
+	if err != nil {
+		requestLogger(c).Error("Failed to save allowlist", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to save allowlist", "request_id": requestID(c)})
+		return
+	}
+	allowlistChanged("Allowlist entry removed through the admin API", entry, c.ClientIP())
+	c.JSON(http.StatusOK, entry)
+}
+
+// allowlistChanged audit-logs a change to the allowlist
+func allowlistChanged(msg string, entry AllowlistEntry, client string) {
+	fields := []zap.Field{
+		zap.String("entry_id", entry.ID),
+		zap.String("kind", entry.Kind()),
+		zap.String("signature", entry.Signature),
+		zap.String("sha256", entry.SHA256),
+		zap.String("reason", entry.Reason),
+		zap.String("client", client),
+	}
+	if entry.ExpiresAt != nil {
+		fields = append(fields, zap.Time("expires_at", *entry.ExpiresAt))
+	}
+	GetLogger().Warn(msg, fields...)
+}
+
+// errSignaturesDisabled is reported while no signature directory is set
+var errSignaturesDisabled = errors.New("signature management is disabled")
+
+// signatureDir returns the directory custom signatures are installed in
+func signatureDir() (string, error) {
+	dir := currentConfig().SignatureDir
+	if dir == "" {
+		return "", errSignaturesDisabled
+	}
+	return dir, nil
+}
+
+// readSignatureUpload reads an uploaded signature file of up to max-size
+// bytes
+func readSignatureUpload(c *gin.Context) ([]byte, bool) {
+	limit := currentConfig().MaxContentLength
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "failed to read request body", "request_id": requestID(c)})
+		return nil, false
+	}
+	if int64(len(data)) > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("File too large. Maximum size is %d bytes", limit), "request_id": requestID(c)})
+		return nil, false
+	}
+	return data, true
+}
+
+// respondSignatureError maps a signature management error to a response
+func respondSignatureError(c *gin.Context, err error) {
+	var invalid *SignatureValidationError
+	var reload *SignatureReloadError
+	switch {
+	case errors.Is(err, errSignaturesDisabled):
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error(), "request_id": requestID(c)})
+	case errors.Is(err, errSignatureNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("signatures %s are not installed", signaturePath(c)), "request_id": requestID(c)})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "errors": invalid.Errors, "request_id": requestID(c)})
+	case errors.As(err, &reload):
+		requestLogger(c).Error("clamd reload failed after a signature change", zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{"message": err.Error(), "request_id": requestID(c)})
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		requestLogger(c).Error("Signature directory unusable", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "signature directory unusable", "request_id": requestID(c)})
+	default:
+		// Set and file name errors
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "request_id": requestID(c)})
+	}
+}
+
+// signaturePath names the set or file in the request path
+func signaturePath(c *gin.Context) string {
+	if file := c.Param("file"); file != "" {
+		return c.Param("set") + "/" + file
+	}
+	return c.Param("set")
+}
+
+// handleListSignatures reports the custom signature sets installed
+func handleListSignatures(c *gin.Context) {
+	dir, err := signatureDir()
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	sets, err := listSignatureSets(dir)
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sets": sets, "count": len(sets)})
+}
+
+// handleValidateSignatures syntax-checks a signature file without
+// installing it
+func handleValidateSignatures(c *gin.Context) {
+	if _, err := signatureDir(); err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	_, format, err := parseSignatureFileName(c.Param("file"))
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	data, ok := readSignatureUpload(c)
+	if !ok {
+		return
+	}
+	_, count, errs := validateSignatures(format, data)
+	if errs == nil {
+		errs = []SignatureError{}
+	}
+	c.JSON(http.StatusOK, gin.H{"valid": len(errs) == 0, "signatures": count, "errors": errs})
+}
+
+// handleInstallSignatures installs a signature file into a set and reloads
+// clamd
+func handleInstallSignatures(c *gin.Context) {
+	dir, err := signatureDir()
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	data, ok := readSignatureUpload(c)
+	if !ok {
+		return
+	}
+	file, state, err := installSignatures(dir, c.Param("set"), c.Param("file"), data)
+	if file.Name != "" {
+		signaturesChanged("Custom signatures installed through the admin API", []SignatureFile{file}, c.ClientIP())
+	}
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file": file, "database": state})
+}
+
+// handleDeleteSignatures removes a file of a set, or the whole set, and
+// reloads clamd
+func handleDeleteSignatures(c *gin.Context) {
+	dir, err := signatureDir()
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	removed, state, err := deleteSignatures(dir, c.Param("set"), c.Param("file"))
+	if len(removed) > 0 {
+		signaturesChanged("Custom signatures removed through the admin API", removed, c.ClientIP())
+	}
+	if err != nil {
+		respondSignatureError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed, "database": state})
+}
+
+// signaturesChanged audit-logs custom signature files written or removed
+func signaturesChanged(msg string, files []SignatureFile, client string) {
+	for _, file := range files {
+		GetLogger().Warn(msg,
+			zap.String("set", file.Set),
+			zap.String("file", file.Name),
+			zap.Int("signatures", file.Signatures),
+			zap.String("client", client))
+	}
+}
+
+// AdminServer implements the gRPC admin service
+type AdminServer struct {
+	pb.UnimplementedClamAVAdminServer
+}
+
+// NewAdminServer creates the gRPC admin service
+func NewAdminServer() *AdminServer {
+	return &AdminServer{}
+}
+
+// authorize checks the admin token in the request metadata
+func (s *AdminServer) authorize(ctx context.Context) error {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	err := checkAdminToken(authorization)
+	if err == errAdminToken {
+		GetLogger().Warn("Admin RPC rejected: invalid token")
+		recordRejection(transportGRPC, rejectUnauthorized)
+	}
+	return err
+}
+
+// GetLogLevel implements the GetLogLevel RPC
+func (s *AdminServer) GetLogLevel(ctx context.Context, req *pb.GetLogLevelRequest) (*pb.LogLevelResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return logLevelToProto(logLevelState()), nil
+}
+
+// SetLogLevel implements the SetLogLevel RPC
+func (s *AdminServer) SetLogLevel(ctx context.Context, req *pb.SetLogLevelRequest) (*pb.LogLevelResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	level, revertAfter, err := parseLogLevelChange(req.Level, req.RevertAfterSeconds)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	client := adminClient(ctx)
+	state := overrideLogLevel(level, revertAfter)
+	logLevelChanged(state, client)
+	return logLevelToProto(state), nil
+}
+
+func logLevelToProto(state LogLevelState) *pb.LogLevelResponse {
+	resp := newLogLevelResponse(state)
+	return &pb.LogLevelResponse{Level: resp.Level, RevertTo: resp.RevertTo, RevertAt: resp.RevertAt}
+}
+
+// ListScans implements the ListScans RPC
+func (s *AdminServer) ListScans(ctx context.Context, req *pb.ListScansRequest) (*pb.ListScansResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	scans := scanTracker.List()
+	resp := &pb.ListScansResponse{Scans: make([]*pb.ActiveScan, 0, len(scans))}
+	for _, scan := range scans {
+		resp.Scans = append(resp.Scans, activeScanToProto(scan))
+	}
+	return resp, nil
+}
+
+// CancelScan implements the CancelScan RPC
+func (s *AdminServer) CancelScan(ctx context.Context, req *pb.CancelScanRequest) (*pb.ActiveScan, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	scan, ok := scanTracker.Cancel(req.Id, adminCancelReason)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no scan %d in progress", req.Id)
+	}
+	client := adminClient(ctx)
+	scanCanceled(scan, client)
+	return activeScanToProto(scan), nil
+}
+
+func activeScanToProto(scan ActiveScan) *pb.ActiveScan {
+	return &pb.ActiveScan{
+		Id:             scan.ID,
+		RequestId:      scan.RequestID,
+		Transport:      scan.Transport,
+		Filename:       scan.Filename,
+		Client:         scan.Client,
+		BytesReceived:  scan.BytesReceived,
+		StartedAt:      scan.StartedAt.UTC().Format(time.RFC3339),
+		ElapsedSeconds: scan.ElapsedSeconds,
+		Backend:        scan.Backend,
+	}
+}
+
+// ListAllowlist implements the ListAllowlist RPC
+func (s *AdminServer) ListAllowlist(ctx context.Context, req *pb.ListAllowlistRequest) (*pb.ListAllowlistResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	entries := allowlist.List()
+	resp := &pb.ListAllowlistResponse{Entries: make([]*pb.AllowlistEntry, 0, len(entries))}
+	for _, entry := range entries {
+		resp.Entries = append(resp.Entries, allowlistEntryToProto(entry))
+	}
+	return resp, nil
+}
+
+// AddAllowlistEntry implements the AddAllowlistEntry RPC
+func (s *AdminServer) AddAllowlistEntry(ctx context.Context, req *pb.AddAllowlistEntryRequest) (*pb.AllowlistEntry, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	client := adminClient(ctx)
+	entry := AllowlistEntry{
+		Signature: req.Signature,
+		SHA256:    req.Sha256,
+		Reason:    req.Reason,
+		CreatedBy: client,
+	}
+	if req.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "expires_at must be an RFC 3339 time, got %q", req.ExpiresAt)
+		}
+		entry.ExpiresAt = &expiresAt
+	}
+
+	entry, err := allowlist.Add(entry)
+	var invalid *AllowlistError
+	if errors.As(err, &invalid) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error("Failed to save allowlist", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to save allowlist")
+	}
+	allowlistChanged("Allowlist entry added through the admin API", entry, client)
+	return allowlistEntryToProto(entry), nil
+}
+
+// DeleteAllowlistEntry implements the DeleteAllowlistEntry RPC
+func (s *AdminServer) DeleteAllowlistEntry(ctx context.Context, req *pb.DeleteAllowlistEntryRequest) (*pb.AllowlistEntry, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	entry, ok, err := allowlist.Delete(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no allowlist entry %s", req.Id)
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error("Failed to save allowlist", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to save allowlist")
+	}
+	client := adminClient(ctx)
+	allowlistChanged("Allowlist entry removed through the admin API", entry, client)
+	return allowlistEntryToProto(entry), nil
+}
+
+func allowlistEntryToProto(entry AllowlistEntry) *pb.AllowlistEntry {
+	resp := &pb.AllowlistEntry{
+		Id:        entry.ID,
+		Signature: entry.Signature,
+		Sha256:    entry.SHA256,
+		Reason:    entry.Reason,
+		CreatedAt: entry.CreatedAt.UTC().Format(time.RFC3339),
+		CreatedBy: entry.CreatedBy,
+	}
+	if entry.ExpiresAt != nil {
+		resp.ExpiresAt = entry.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// signatureStatus maps a signature management error to a gRPC status
+func signatureStatus(ctx context.Context, err error) error {
+	var invalid *SignatureValidationError
+	var reload *SignatureReloadError
+	switch {
+	case errors.Is(err, errSignaturesDisabled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errSignatureNotFound):
+		return status.Error(codes.NotFound, "signatures are not installed")
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &reload):
+		loggerFromContext(ctx).Error("clamd reload failed after a signature change", zap.Error(err))
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		loggerFromContext(ctx).Error("Signature directory unusable", zap.Error(err))
+		return status.Error(codes.Internal, "signature directory unusable")
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+// ListSignatures implements the ListSignatures RPC
+func (s *AdminServer) ListSignatures(ctx context.Context, req *pb.ListSignaturesRequest) (*pb.ListSignaturesResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	dir, err := signatureDir()
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	sets, err := listSignatureSets(dir)
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	resp := &pb.ListSignaturesResponse{Sets: make([]*pb.SignatureSet, 0, len(sets))}
+	for _, set := range sets {
+		resp.Sets = append(resp.Sets, &pb.SignatureSet{
+			Name:       set.Name,
+			Signatures: int64(set.Signatures),
+			Files:      signatureFilesToProto(set.Files),
+		})
+	}
+	return resp, nil
+}
+
+// ValidateSignatures implements the ValidateSignatures RPC
+func (s *AdminServer) ValidateSignatures(ctx context.Context, req *pb.ValidateSignaturesRequest) (*pb.ValidateSignaturesResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := signatureDir(); err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	_, format, err := parseSignatureFileName(req.File)
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	_, count, errs := validateSignatures(format, req.Data)
+	resp := &pb.ValidateSignaturesResponse{Valid: len(errs) == 0, Signatures: int64(count)}
+	for _, e := range errs {
+		resp.Errors = append(resp.Errors, &pb.SignatureError{Line: int64(e.Line), Message: e.Message})
+	}
+	return resp, nil
+}
+
+// InstallSignatures implements the InstallSignatures RPC
+func (s *AdminServer) InstallSignatures(ctx context.Context, req *pb.InstallSignaturesRequest) (*pb.InstallSignaturesResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	dir, err := signatureDir()
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	file, state, err := installSignatures(dir, req.Set, req.File, req.Data)
+	if file.Name != "" {
+		signaturesChanged("Custom signatures installed through the admin API", []SignatureFile{file}, adminClient(ctx))
+	}
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	return &pb.InstallSignaturesResponse{
+		File:     signatureFilesToProto([]SignatureFile{file})[0],
+		Database: databaseStateToProto(state),
+	}, nil
+}
+
+// DeleteSignatures implements the DeleteSignatures RPC
+func (s *AdminServer) DeleteSignatures(ctx context.Context, req *pb.DeleteSignaturesRequest) (*pb.DeleteSignaturesResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	dir, err := signatureDir()
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	removed, state, err := deleteSignatures(dir, req.Set, req.File)
+	if len(removed) > 0 {
+		signaturesChanged("Custom signatures removed through the admin API", removed, adminClient(ctx))
+	}
+	if err != nil {
+		return nil, signatureStatus(ctx, err)
+	}
+	return &pb.DeleteSignaturesResponse{
+		Removed:  signatureFilesToProto(removed),
+		Database: databaseStateToProto(state),
+	}, nil
+}
+
+// adminClient names the client of an admin RPC for the audit log
+func adminClient(ctx context.Context) string {
+	if client := peerAddress(ctx); client != "" {
+		return client
+	}
+	return "unknown"
+}
+
+func signatureFilesToProto(files []SignatureFile) []*pb.SignatureFile {
+	resp := make([]*pb.SignatureFile, 0, len(files))
+	for _, file := range files {
+		resp = append(resp, &pb.SignatureFile{
+			Set:        file.Set,
+			Name:       file.Name,
+			Signatures: int64(file.Signatures),
+			Size:       file.Size,
+			ModifiedAt: file.ModifiedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return resp
+}
+
+func databaseStateToProto(state DatabaseState) *pb.DatabaseState {
+	return &pb.DatabaseState{
+		Version:          state.Version,
+		DatabaseVersion:  state.DatabaseVersion,
+		CustomSignatures: int64(state.CustomSignatures),
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// withAdminToken configures the admin token for the duration of a test
+func withAdminToken(t *testing.T, token string) {
+	t.Helper()
+	restoreLogger(t)
+	orig := config.AdminToken
+	config.AdminToken = token
+	t.Cleanup(func() { config.AdminToken = orig })
+}
+
+func newAdminRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/api/admin", adminAuth())
+	admin.GET("/log-level", handleGetLogLevel)
+	admin.PUT("/log-level", handleSetLogLevel)
+	return router
+}
+
+func adminRequest(router *gin.Engine, method, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/admin/log-level", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	router := newAdminRouter()
+
+	t.Run("disabled without a token", func(t *testing.T) {
+		withAdminToken(t, "")
+		w := adminRequest(router, http.MethodGet, "anything", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		withAdminToken(t, "s3cret")
+		w := adminRequest(router, http.MethodGet, "guess", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		withAdminToken(t, "s3cret")
+		w := adminRequest(router, http.MethodGet, "", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestAdminLogLevelREST(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	require.NoError(t, InitLogger(false, "production"))
+	router := newAdminRouter()
+
+	w := adminRequest(router, http.MethodGet, "s3cret", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level":"info"}`, w.Body.String())
+
+	w = adminRequest(router, http.MethodPut, "s3cret", `{"level":"debug","revert_after":600}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp logLevelResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "debug", resp.Level)
+	assert.Equal(t, "info", resp.RevertTo)
+	revertAt, err := time.Parse(time.RFC3339, resp.RevertAt)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(600*time.Second), revertAt, 5*time.Second)
+	assert.True(t, GetLogger().Core().Enabled(zapcore.DebugLevel))
+
+	for _, body := range []string{`{"level":"verbose"}`, `{"level":""}`, `{"level":"warn","revert_after":-1}`, `not json`} {
+		w = adminRequest(router, http.MethodPut, "s3cret", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	assert.Equal(t, zapcore.DebugLevel, logLevelState().Level, "rejected changes keep the level")
+}
+
+func TestAdminLogLevelGRPC(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	require.NoError(t, InitLogger(false, "production"))
+	server := NewAdminServer()
+	authed := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	_, err := server.GetLogLevel(context.Background(), &pb.GetLogLevelRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	resp, err := server.SetLogLevel(authed, &pb.SetLogLevelRequest{Level: "warn"})
+	require.NoError(t, err)
+	assert.Equal(t, "warn", resp.Level)
+	assert.Empty(t, resp.RevertAt)
+
+	resp, err = server.GetLogLevel(authed, &pb.GetLogLevelRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "warn", resp.Level)
+
+	_, err = server.SetLogLevel(authed, &pb.SetLogLevelRequest{Level: "loud"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	config.AdminToken = ""
+	_, err = server.GetLogLevel(authed, &pb.GetLogLevelRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// startSlowScan runs a scan of an endless upload named filename and
+// returns the channel its error is sent on once it is canceled
+func startSlowScan(t *testing.T, tracker *ScanTracker, filename string) <-chan error {
+	t.Helper()
+	ctx := withScanSource(withRequestID(context.Background(), "slow-"+filename), transportREST, "192.0.2.10")
+	scanErr := make(chan error, 1)
+	go func() {
+		_, err := performScan(withScanFilename(ctx, filename), endlessReader{}, 30*time.Second)
+		scanErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		scans := tracker.List()
+		return len(scans) == 1 && scans[0].BytesReceived > 0
+	}, 5*time.Second, time.Millisecond)
+	return scanErr
+}
+
+// requireScanCanceled waits for a scan started by startSlowScan to fail
+func requireScanCanceled(t *testing.T, scanErr <-chan error) {
+	t.Helper()
+	select {
+	case err := <-scanErr:
+		var canceledErr *ScanCanceledError
+		require.ErrorAs(t, err, &canceledErr)
+		assert.Equal(t, adminCancelReason, canceledErr.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled scan did not return")
+	}
+}
+
+func TestAdminScansREST(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withFakeClamd(t, "stream: OK")
+	tracker := NewScanTracker()
+	withScanTracker(t, tracker)
+	router := newAdminRouter()
+	router.GET("/api/admin/scans", adminAuth(), handleListScans)
+	router.DELETE("/api/admin/scans/:id", adminAuth(), handleCancelScan)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	scanErr := startSlowScan(t, tracker, "big.iso")
+
+	w := request(http.MethodGet, "/api/admin/scans")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Scans []ActiveScan `json:"scans"`
+		Count int          `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, 1, list.Count)
+	scan := list.Scans[0]
+	assert.Equal(t, "slow-big.iso", scan.RequestID)
+	assert.Equal(t, transportREST, scan.Transport)
+	assert.Equal(t, "big.iso", scan.Filename)
+	assert.Equal(t, "192.0.2.10", scan.Client)
+	assert.Positive(t, scan.BytesReceived)
+	assert.Equal(t, clamdAddress(), scan.Backend)
+	assert.WithinDuration(t, time.Now(), scan.StartedAt, 5*time.Second)
+
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/api/admin/scans/first").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/api/admin/scans/999").Code)
+
+	w = request(http.MethodDelete, "/api/admin/scans/"+strconv.FormatUint(scan.ID, 10))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"filename":"big.iso"`)
+	requireScanCanceled(t, scanErr)
+	assert.Zero(t, tracker.Len())
+}
+
+func TestAdminScansGRPC(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withFakeClamd(t, "stream: OK")
+	tracker := NewScanTracker()
+	withScanTracker(t, tracker)
+	server := NewAdminServer()
+	authed := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	_, err := server.ListScans(context.Background(), &pb.ListScansRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	scanErr := startSlowScan(t, tracker, "mail.eml")
+	resp, err := server.ListScans(authed, &pb.ListScansRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Scans, 1)
+	assert.Equal(t, "mail.eml", resp.Scans[0].Filename)
+	assert.Equal(t, "slow-mail.eml", resp.Scans[0].RequestId)
+	assert.Positive(t, resp.Scans[0].BytesReceived)
+	_, err = time.Parse(time.RFC3339, resp.Scans[0].StartedAt)
+	assert.NoError(t, err)
+
+	_, err = server.CancelScan(authed, &pb.CancelScanRequest{Id: resp.Scans[0].Id + 1})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	canceled, err := server.CancelScan(authed, &pb.CancelScanRequest{Id: resp.Scans[0].Id})
+	require.NoError(t, err)
+	assert.Equal(t, "mail.eml", canceled.Filename)
+	requireScanCanceled(t, scanErr)
+}
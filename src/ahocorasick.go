@@ -0,0 +1,71 @@
+package main
+
+// ahoCorasick finds every occurrence of a set of byte strings in one pass
+// over the input, keeping its state between calls so a stream can be fed
+// in chunks
+type ahoCorasick struct {
+	// next is the full transition table, 256 entries per state
+	next []int32
+	// out lists the patterns ending at each state, longest first
+	out [][]int
+}
+
+// newAhoCorasick builds the automaton for patterns, identified in matches
+// by their index. Empty patterns never match.
+func newAhoCorasick(patterns [][]byte) *ahoCorasick {
+	ac := &ahoCorasick{}
+	ac.addState()
+	for i, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+		state := int32(0)
+		for _, b := range pattern {
+			next := ac.next[int(state)*256+int(b)]
+			if next == 0 {
+				next = ac.addState()
+				ac.next[int(state)*256+int(b)] = next
+			}
+			state = next
+		}
+		ac.out[state] = append(ac.out[state], i)
+	}
+
+	// Breadth-first, turn the trie into a full transition table: a byte
+	// without a child follows the failure link of its state
+	fail := make([]int32, len(ac.out))
+	var queue []int32
+	for b := 0; b < 256; b++ {
+		if child := ac.next[b]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		ac.out[state] = append(ac.out[state], ac.out[fail[state]]...)
+		for b := 0; b < 256; b++ {
+			child := ac.next[int(state)*256+b]
+			if child == 0 {
+				ac.next[int(state)*256+b] = ac.next[int(fail[state])*256+b]
+				continue
+			}
+			fail[child] = ac.next[int(fail[state])*256+b]
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+func (ac *ahoCorasick) addState() int32 {
+	ac.next = append(ac.next, make([]int32, 256)...)
+	ac.out = append(ac.out, nil)
+	return int32(len(ac.out) - 1)
+}
+
+// step moves from state on b and returns the new state with the patterns
+// that end there
+func (ac *ahoCorasick) step(state int32, b byte) (int32, []int) {
+	state = ac.next[int(state)*256+int(b)]
+	return state, ac.out[state]
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"go.uber.org/zap"
+)
+
+// Kinds of allowlist entry, by what they match
+const (
+	allowlistKindSignature = "signature"
+	allowlistKindHash      = "sha256"
+	allowlistKindPair      = "pair"
+)
+
+// AllowlistEntry clears detections of a signature, of any signature in a
+// file with a given SHA-256, or of one signature in one file
+type AllowlistEntry struct {
+	ID        string     `json:"id"`
+	Signature string     `json:"signature,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Kind reports what the entry matches: a signature, a hash or both
+func (e *AllowlistEntry) Kind() string {
+	switch {
+	case e.Signature != "" && e.SHA256 != "":
+		return allowlistKindPair
+	case e.SHA256 != "":
+		return allowlistKindHash
+	default:
+		return allowlistKindSignature
+	}
+}
+
+// expired reports whether the entry no longer applies at now
+func (e *AllowlistEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// matches reports whether the entry clears virus in a file hashing to
+// sha256. A hash entry never matches a file that was not hashed.
+func (e *AllowlistEntry) matches(virus, sha256 string) bool {
+	if e.Signature != "" && e.Signature != virus {
+		return false
+	}
+	if e.SHA256 != "" && e.SHA256 != sha256 {
+		return false
+	}
+	return true
+}
+
+// AllowlistOverride records the allowlist entry that cleared a detection
+type AllowlistOverride struct {
+	EntryID   string     `json:"entry_id"`
+	Virus     string     `json:"virus"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// overrideToProto converts an override for a gRPC response
+func overrideToProto(override *AllowlistOverride) *pb.AllowlistOverride {
+	if override == nil {
+		return nil
+	}
+	resp := &pb.AllowlistOverride{EntryId: override.EntryID, Virus: override.Virus, Reason: override.Reason}
+	if override.ExpiresAt != nil {
+		resp.ExpiresAt = override.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// allowlistFile is the on-disk form of the allowlist
+type allowlistFile struct {
+	Entries []AllowlistEntry `json:"entries"`
+}
+
+// Allowlist holds the false-positive overrides managed through the admin
+// API. Changes are written to its file, if it has one, before they apply.
+type Allowlist struct {
+	mu      sync.RWMutex
+	path    string
+	entries []AllowlistEntry
+	now     func() time.Time
+}
+
+// allowlist is the allowlist consulted by every scan
+var allowlist = newAllowlist()
+
+func newAllowlist() *Allowlist {
+	return &Allowlist{now: time.Now}
+}
+
+// Load reads the allowlist from path, which later changes are written
+// to. A file that does not exist yet is an empty allowlist; an empty path
+// keeps the allowlist in memory only.
+func (a *Allowlist) Load(path string) error {
+	var file allowlistFile
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &file); err != nil {
+				return fmt.Errorf("allowlist file %s: %w", path, err)
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.path = path
+	a.entries = file.Entries
+	return nil
+}
+
+// List returns the entries, oldest first, including expired ones
+func (a *Allowlist) List() []AllowlistEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entries := append([]AllowlistEntry(nil), a.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	return entries
+}
+
+// Add validates entry, gives it an ID and creation time and saves it
+func (a *Allowlist) Add(entry AllowlistEntry) (AllowlistEntry, error) {
+	entry.Signature = strings.TrimSpace(entry.Signature)
+	entry.SHA256 = strings.ToLower(strings.TrimSpace(entry.SHA256))
+	entry.Reason = strings.TrimSpace(entry.Reason)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if err := validateAllowlistEntry(entry, now); err != nil {
+		return entry, err
+	}
+	for _, existing := range a.entries {
+		if existing.Signature == entry.Signature && existing.SHA256 == entry.SHA256 && !existing.expired(now) {
+			return entry, &AllowlistError{Message: fmt.Sprintf("already allowlisted by entry %s", existing.ID)}
+		}
+	}
+
+	entry.ID = newRequestID()[:16]
+	entry.CreatedAt = now.UTC()
+	entries := append(append([]AllowlistEntry(nil), a.entries...), entry)
+	if err := a.save(entries); err != nil {
+		return entry, err
+	}
+	a.entries = entries
+	return entry, nil
+}
+
+// Delete removes the entry with the given ID, reporting whether it existed
+func (a *Allowlist) Delete(id string) (AllowlistEntry, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, entry := range a.entries {
+		if entry.ID != id {
+			continue
+		}
+		entries := append(append([]AllowlistEntry(nil), a.entries[:i]...), a.entries[i+1:]...)
+		if err := a.save(entries); err != nil {
+			return entry, true, err
+		}
+		a.entries = entries
+		return entry, true, nil
+	}
+	return AllowlistEntry{}, false, nil
+}
+
+// hasHashes reports whether any entry needs the SHA-256 of scanned files
+func (a *Allowlist) hasHashes() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, entry := range a.entries {
+		if entry.SHA256 != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the entry that clears virus in a file hashing to sha256,
+// preferring a (hash, signature) pair over a hash over a signature
+func (a *Allowlist) match(virus, sha256 string) *AllowlistEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := a.now()
+	var best *AllowlistEntry
+	for i := range a.entries {
+		entry := &a.entries[i]
+		if entry.expired(now) || !entry.matches(virus, sha256) {
+			continue
+		}
+		if best == nil || allowlistKindRank(entry.Kind()) > allowlistKindRank(best.Kind()) {
+			best = entry
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	found := *best
+	return &found
+}
+
+func allowlistKindRank(kind string) int {
+	switch kind {
+	case allowlistKindPair:
+		return 2
+	case allowlistKindHash:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// save writes entries to the allowlist file through a temporary file, so
+// a crash never leaves it half written
+func (a *Allowlist) save(entries []AllowlistEntry) error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(allowlistFile{Entries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("saving allowlist: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("saving allowlist: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("saving allowlist: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("saving allowlist: %w", err)
+	}
+	return nil
+}
+
+// AllowlistError is an allowlist entry the admin API refuses
+type AllowlistError struct {
+	Message string
+}
+
+func (e *AllowlistError) Error() string {
+	return e.Message
+}
+
+// validateAllowlistEntry checks an entry before it is added
+func validateAllowlistEntry(entry AllowlistEntry, now time.Time) error {
+	if entry.Signature == "" && entry.SHA256 == "" {
+		return &AllowlistError{Message: "an entry needs a signature, a sha256 or both"}
+	}
+	if entry.SHA256 != "" {
+		if _, err := hex.DecodeString(entry.SHA256); err != nil || len(entry.SHA256) != 64 {
+			return &AllowlistError{Message: fmt.Sprintf("sha256 must be 64 hex digits, got %q", entry.SHA256)}
+		}
+	}
+	if entry.Reason == "" {
+		return &AllowlistError{Message: "an entry needs a reason"}
+	}
+	if entry.expired(now) {
+		return &AllowlistError{Message: "expires_at must be in the future"}
+	}
+	return nil
+}
+
+// applyAllowlist turns a detection the allowlist clears into a clean
+// result carrying the override, and audit-logs the override. A result
+// with several detections is only cleared if every one of them is
+// allowlisted; its engine verdicts and rule matches are then cleared too.
+// sha256 is empty when the file was not hashed.
+func applyAllowlist(ctx context.Context, result *ScanResult, sha256 string) {
+	if result.Status != "FOUND" {
+		return
+	}
+	detections := scanDetections(result)
+	entries := make([]*AllowlistEntry, len(detections))
+	for i, virus := range detections {
+		if entries[i] = allowlist.match(virus, sha256); entries[i] == nil {
+			return
+		}
+	}
+
+	result.Override = &AllowlistOverride{
+		EntryID:   entries[0].ID,
+		Virus:     result.Description,
+		Reason:    entries[0].Reason,
+		ExpiresAt: entries[0].ExpiresAt,
+	}
+	result.Status = "OK"
+	result.Description = ""
+	result.Matches = nil
+	for i := range result.Engines {
+		if result.Engines[i].Status == "FOUND" {
+			result.Engines[i] = EngineVerdict{Engine: result.Engines[i].Engine, Status: "OK", ScanTime: result.Engines[i].ScanTime}
+		}
+	}
+
+	source, _ := ctx.Value(scanSourceKey{}).(scanSource)
+	for i, entry := range entries {
+		allowlistOverridesTotal.WithLabelValues(entry.Kind()).Inc()
+		fields := []zap.Field{
+			zap.String("entry_id", entry.ID),
+			zap.String("kind", entry.Kind()),
+			zap.String("virus", detections[i]),
+			zap.String("sha256", sha256),
+			zap.String("reason", entry.Reason),
+			zap.String("filename", source.filename),
+			zap.String("caller", callerFromContext(ctx)),
+		}
+		if entry.ExpiresAt != nil {
+			fields = append(fields, zap.Time("expires_at", *entry.ExpiresAt))
+		}
+		loggerFromContext(ctx).Warn("Detection overridden by allowlist", fields...)
+	}
+}
+
+// scanDetections lists what a FOUND result detected: its description,
+// then every other rule the rules engine matched and every other engine's
+// detection
+func scanDetections(result *ScanResult) []string {
+	detections := []string{result.Description}
+	seen := map[string]bool{result.Description: true}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			detections = append(detections, name)
+		}
+	}
+	for _, match := range result.Matches {
+		add(match.Rule)
+	}
+	for _, verdict := range result.Engines {
+		// A rules engine verdict's matches are already in result.Matches
+		if verdict.Status == "FOUND" && len(verdict.Matches) == 0 {
+			add(verdict.Description)
+		}
+	}
+	return detections
+}
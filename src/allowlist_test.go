@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// withAllowlist makes list the allowlist scans consult for the duration
+// of a test
+func withAllowlist(t *testing.T, list *Allowlist) {
+	t.Helper()
+	original := allowlist
+	allowlist = list
+	t.Cleanup(func() { allowlist = original })
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAllowlistAddInvalid(t *testing.T) {
+	list := newAllowlist()
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		entry   AllowlistEntry
+		wantErr string
+	}{
+		{"nothing to match", AllowlistEntry{Reason: "signed installer"}, "needs a signature, a sha256 or both"},
+		{"short hash", AllowlistEntry{SHA256: "abc123", Reason: "signed installer"}, "64 hex digits"},
+		{"not hex", AllowlistEntry{SHA256: strings.Repeat("z", 64), Reason: "signed installer"}, "64 hex digits"},
+		{"no reason", AllowlistEntry{Signature: "Win.Trojan.Agent"}, "needs a reason"},
+		{"already expired", AllowlistEntry{Signature: "Win.Trojan.Agent", Reason: "signed installer", ExpiresAt: &past}, "must be in the future"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := list.Add(tt.entry)
+			var invalid *AllowlistError
+			require.ErrorAs(t, err, &invalid)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	entry, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", Reason: "signed installer"})
+	require.NoError(t, err)
+	_, err = list.Add(AllowlistEntry{Signature: " Win.Trojan.Agent ", Reason: "again"})
+	assert.ErrorContains(t, err, "already allowlisted by entry "+entry.ID)
+}
+
+func TestAllowlistMatch(t *testing.T) {
+	list := newAllowlist()
+	now := time.Now()
+	list.now = func() time.Time { return now }
+	hash := sha256Hex("installer")
+	soon := now.Add(time.Hour)
+
+	signature, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", Reason: "vendor confirmed", ExpiresAt: &soon})
+	require.NoError(t, err)
+	byHash, err := list.Add(AllowlistEntry{SHA256: strings.ToUpper(hash), Reason: "signed installer"})
+	require.NoError(t, err)
+	pair, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", SHA256: hash, Reason: "known build"})
+	require.NoError(t, err)
+	assert.Equal(t, hash, byHash.SHA256)
+	assert.Equal(t, allowlistKindPair, pair.Kind())
+
+	assert.Equal(t, pair.ID, list.match("Win.Trojan.Agent", hash).ID)
+	assert.Equal(t, byHash.ID, list.match("PUA.Win.Tool.Packed", hash).ID)
+	assert.Equal(t, signature.ID, list.match("Win.Trojan.Agent", "").ID)
+	assert.Nil(t, list.match("PUA.Win.Tool.Packed", sha256Hex("other")))
+	assert.True(t, list.hasHashes())
+
+	// An expired entry stays listed but no longer matches
+	now = soon
+	assert.Nil(t, list.match("Win.Trojan.Agent", ""))
+	assert.Len(t, list.List(), 3)
+}
+
+func TestAllowlistPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.json")
+	list := newAllowlist()
+	require.NoError(t, list.Load(path))
+	assert.Empty(t, list.List())
+
+	first, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", Reason: "vendor confirmed", CreatedBy: "192.0.2.10"})
+	require.NoError(t, err)
+	second, err := list.Add(AllowlistEntry{SHA256: sha256Hex("installer"), Reason: "signed installer"})
+	require.NoError(t, err)
+
+	reloaded := newAllowlist()
+	require.NoError(t, reloaded.Load(path))
+	assert.Equal(t, list.List(), reloaded.List())
+
+	_, ok, err := reloaded.Delete(first.ID)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, ok, err = reloaded.Delete(first.ID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, list.Load(path))
+	entries := list.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, second.ID, entries[0].ID)
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	assert.ErrorContains(t, list.Load(path), "allowlist file")
+}
+
+func TestScanAllowlistOverride(t *testing.T) {
+	restoreLogger(t)
+	withFakeClamd(t, "stream: Win.Trojan.Agent FOUND")
+	list := newAllowlist()
+	withAllowlist(t, list)
+	entry, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", SHA256: sha256Hex("installer"), Reason: "signed installer"})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/stream-scan", handleStreamScan)
+	scan := func(payload string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", bytes.NewReader([]byte(payload)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	before := getCounterValue(t, allowlistOverridesTotal, allowlistKindPair)
+	w := scan("installer")
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Status   string            `json:"status"`
+		Action   string            `json:"action"`
+		Override AllowlistOverride `json:"override"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "OK", body.Status)
+	assert.Equal(t, actionAllow, body.Action)
+	assert.Equal(t, AllowlistOverride{EntryID: entry.ID, Virus: "Win.Trojan.Agent", Reason: "signed installer"}, body.Override)
+	assert.Equal(t, before+1, getCounterValue(t, allowlistOverridesTotal, allowlistKindPair))
+
+	w = scan("something else")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"FOUND"`)
+	assert.NotContains(t, w.Body.String(), "override")
+}
+
+func TestAllowlistNeedsEveryDetectionCleared(t *testing.T) {
+	restoreLogger(t)
+	list := newAllowlist()
+	withAllowlist(t, list)
+	newResult := func() *ScanResult {
+		return &ScanResult{
+			Status:      "FOUND",
+			Description: "Win.Trojan.Agent",
+			Matches:     []RuleMatch{{Rule: "InHouse_Dropper"}, {Rule: "Macro_Loader"}},
+			Engines: []EngineVerdict{
+				{Engine: engineClamd, Status: "FOUND", Description: "Win.Trojan.Agent", ScanTime: 0.5},
+				{Engine: engineRules, Status: "FOUND", Description: "InHouse_Dropper", Matches: []RuleMatch{{Rule: "InHouse_Dropper"}, {Rule: "Macro_Loader"}}},
+				{Engine: "in-house", Status: "OK"},
+			},
+		}
+	}
+	assert.Equal(t, []string{"Win.Trojan.Agent", "InHouse_Dropper", "Macro_Loader"}, scanDetections(newResult()))
+
+	for _, signature := range []string{"Win.Trojan.Agent", "InHouse_Dropper"} {
+		_, err := list.Add(AllowlistEntry{Signature: signature, Reason: "vetted"})
+		require.NoError(t, err)
+		result := newResult()
+		applyAllowlist(context.Background(), result, "")
+		assert.Equal(t, newResult(), result, "a detection is left that is not allowlisted")
+	}
+
+	entry, err := list.Add(AllowlistEntry{Signature: "Macro_Loader", Reason: "vetted"})
+	require.NoError(t, err)
+	result := newResult()
+	applyAllowlist(context.Background(), result, "")
+	assert.Equal(t, "OK", result.Status)
+	assert.Empty(t, result.Description)
+	assert.Equal(t, "Win.Trojan.Agent", result.Override.Virus)
+	assert.NotEqual(t, entry.ID, result.Override.EntryID, "the override names the entry clearing the reported detection")
+	assert.Nil(t, result.Matches)
+	assert.Equal(t, []EngineVerdict{
+		{Engine: engineClamd, Status: "OK", ScanTime: 0.5},
+		{Engine: engineRules, Status: "OK"},
+		{Engine: "in-house", Status: "OK"},
+	}, result.Engines)
+}
+
+func TestAdminAllowlistREST(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withAllowlist(t, newAllowlist())
+	router := newAdminRouter()
+	router.GET("/api/admin/allowlist", adminAuth(), handleListAllowlist)
+	router.POST("/api/admin/allowlist", adminAuth(), handleAddAllowlistEntry)
+	router.DELETE("/api/admin/allowlist/:id", adminAuth(), handleDeleteAllowlistEntry)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/api/admin/allowlist", `{"signature":"Win.Trojan.Agent"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "needs a reason")
+
+	w = request(http.MethodPost, "/api/admin/allowlist",
+		`{"signature":"Win.Trojan.Agent","reason":"signed installer","expires_at":"2099-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var entry AllowlistEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.NotEmpty(t, entry.ID)
+	assert.Equal(t, "192.0.2.1", entry.CreatedBy)
+	require.NotNil(t, entry.ExpiresAt)
+	assert.Equal(t, 2099, entry.ExpiresAt.Year())
+
+	w = request(http.MethodGet, "/api/admin/allowlist", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+	assert.Contains(t, w.Body.String(), `"reason":"signed installer"`)
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/api/admin/allowlist/missing", "").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodDelete, "/api/admin/allowlist/"+entry.ID, "").Code)
+	assert.Empty(t, allowlist.List())
+}
+
+func TestAdminAllowlistGRPC(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withAllowlist(t, newAllowlist())
+	server := NewAdminServer()
+	authed := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	_, err := server.ListAllowlist(context.Background(), &pb.ListAllowlistRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = server.AddAllowlistEntry(authed, &pb.AddAllowlistEntryRequest{Signature: "Win.Trojan.Agent", Reason: "x", ExpiresAt: "tomorrow"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.AddAllowlistEntry(authed, &pb.AddAllowlistEntryRequest{Sha256: "abc", Reason: "x"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	hash := sha256Hex("installer")
+	added, err := server.AddAllowlistEntry(authed, &pb.AddAllowlistEntryRequest{Sha256: hash, Reason: "signed installer", ExpiresAt: "2099-01-01T00:00:00Z"})
+	require.NoError(t, err)
+	assert.Equal(t, hash, added.Sha256)
+	assert.Equal(t, "2099-01-01T00:00:00Z", added.ExpiresAt)
+
+	resp, err := server.ListAllowlist(authed, &pb.ListAllowlistRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Entries, 1)
+	assert.Equal(t, added.Id, resp.Entries[0].Id)
+
+	_, err = server.DeleteAllowlistEntry(authed, &pb.DeleteAllowlistEntryRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	deleted, err := server.DeleteAllowlistEntry(authed, &pb.DeleteAllowlistEntryRequest{Id: added.Id})
+	require.NoError(t, err)
+	assert.Equal(t, "signed installer", deleted.Reason)
+}
+
+func TestGRPCScanAllowlistOverride(t *testing.T) {
+	withFakeClamd(t, "stream: Win.Trojan.Agent FOUND")
+	list := newAllowlist()
+	withAllowlist(t, list)
+	_, err := list.Add(AllowlistEntry{Signature: "Win.Trojan.Agent", Reason: "vendor confirmed"})
+	require.NoError(t, err)
+	client := getTestClient(t)
+
+	resp, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte("installer"), Filename: "setup.exe"})
+	require.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+	require.NotNil(t, resp.Override)
+	assert.Equal(t, "Win.Trojan.Agent", resp.Override.Virus)
+	assert.Equal(t, "vendor confirmed", resp.Override.Reason)
+}
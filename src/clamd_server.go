@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clamd protocol replies (see clamd(8))
+const (
+	clamdReplyPong          = "PONG"
+	clamdReplyUnknown       = "UNKNOWN COMMAND"
+	clamdReplySizeExceeded  = "INSTREAM size limit exceeded. ERROR"
+	clamdReplyStreamPrefix  = "stream: "
+	clamdReplyVersionFailed = "Can't get version. ERROR"
+	clamdReplyScanFailed    = "Can't scan stream. ERROR"
+)
+
+// errClamdChunkTooLarge indicates an INSTREAM chunk length above the size limit
+var errClamdChunkTooLarge = errors.New("INSTREAM chunk exceeds maximum allowed size")
+
+// ClamdServer speaks the subset of the clamd TCP protocol used by clamdscan,
+// Nextcloud and mail filters (PING, VERSION, INSTREAM, IDSESSION/END) and
+// routes scans through this service.
+type ClamdServer struct {
+	config  *liveConfig
+	allowed atomic.Pointer[[]netip.Prefix]
+	scan    scanFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewClamdServer creates a clamd-protocol server with the given config
+func NewClamdServer(cfg *Config) (*ClamdServer, error) {
+	allowed, err := parseAllowedNets(cfg.ClamdAllowedNets)
+	if err != nil {
+		return nil, err
+	}
+	live := newLiveConfig(cfg)
+	s := &ClamdServer{
+		config: live,
+		scan:   live.scan,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	s.allowed.Store(&allowed)
+	return s, nil
+}
+
+// Reload applies a reloaded configuration. The allowed networks apply to
+// new connections.
+func (s *ClamdServer) Reload(cfg *Config) error {
+	allowed, err := parseAllowedNets(cfg.ClamdAllowedNets)
+	if err != nil {
+		return err
+	}
+	s.allowed.Store(&allowed)
+	s.config.Store(cfg)
+	return nil
+}
+
+// parseAllowedNets parses a list of IP addresses and CIDR ranges
+func parseAllowedNets(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// isAllowed reports whether a client at addr may use the listener
+func (s *ClamdServer) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range *s.allowed.Load() {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve accepts clamd clients on lis until Shutdown is called
+func (s *ClamdServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	s.listener = lis
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		if !s.isAllowed(conn.RemoteAddr()) {
+			GetLogger().Warn("clamd connection rejected: source address not allowed",
+				zap.String("remote_addr", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for active sessions to finish.
+// Sessions still running when ctx expires are closed forcibly.
+func (s *ClamdServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// clamdSession holds per-connection state
+type clamdSession struct {
+	server *ClamdServer
+	conn   net.Conn
+	reader *bufio.Reader
+	// ctx carries the connection's request ID and logger, and is canceled
+	// when the client disconnects
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// IDSESSION state: replies are prefixed with the command's sequence number
+	inSession bool
+	commandID int
+}
+
+// handleConn serves one client. Each connection gets a request ID; the
+// scans of an IDSESSION share it.
+func (s *ClamdServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	ctx := withScanSource(withRequestID(context.Background(), newRequestID()), transportClamd, conn.RemoteAddr().String())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sess := &clamdSession{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if err := sess.run(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		loggerFromContext(ctx).Warn("clamd session ended with error",
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+			zap.Error(err))
+	}
+}
+
+// run processes commands until the client disconnects. Outside IDSESSION
+// clamd answers a single command and closes the connection.
+func (c *clamdSession) run() error {
+	for {
+		// Bound idle time between commands by the scan timeout
+		c.conn.SetReadDeadline(time.Now().Add(c.server.config.Load().ScanTimeout))
+
+		command, delim, prefixed, err := readClamdCommand(c.reader)
+		if err != nil {
+			return err
+		}
+
+		if c.inSession {
+			c.commandID++
+			// Only z/n-prefixed commands are valid inside a session
+			if !prefixed {
+				return c.reply(clamdReplyUnknown, delim)
+			}
+		}
+
+		keepOpen, err := c.dispatch(command, delim)
+		if err != nil || !keepOpen {
+			return err
+		}
+	}
+}
+
+// dispatch executes one command and reports whether the connection stays open
+func (c *clamdSession) dispatch(command string, delim byte) (bool, error) {
+	logger := loggerFromContext(c.ctx)
+
+	switch command {
+	case "PING":
+		return c.inSession, c.reply(clamdReplyPong, delim)
+
+	case "VERSION":
+		version, err := clamdVersion()
+		if err != nil {
+			logger.Warn("clamd VERSION failed", zap.Error(err))
+			return c.inSession, c.reply(clamdReplyVersionFailed, delim)
+		}
+		return c.inSession, c.reply(version, delim)
+
+	case "INSTREAM":
+		return c.instream(delim)
+
+	case "IDSESSION":
+		if c.inSession {
+			// Nested sessions are a protocol error
+			return false, c.reply(clamdReplyUnknown, delim)
+		}
+		c.inSession = true
+		return true, nil
+
+	case "END":
+		if !c.inSession {
+			return false, c.reply(clamdReplyUnknown, delim)
+		}
+		return false, nil
+
+	default:
+		logger.Debug("clamd command not supported",
+			zap.String("command", command),
+			zap.String("remote_addr", c.conn.RemoteAddr().String()))
+		return false, c.reply(clamdReplyUnknown, delim)
+	}
+}
+
+// instream reads an INSTREAM payload, scans it and sends the verdict. The
+// scan is canceled if the client disconnects while it runs.
+func (c *clamdSession) instream(delim byte) (bool, error) {
+	logger := loggerFromContext(c.ctx)
+	cfg := c.server.config.Load()
+
+	c.conn.SetReadDeadline(time.Now().Add(cfg.ScanTimeout))
+
+	spool := NewSpool(cfg.SpoolThreshold, "")
+	defer spool.Close()
+	stream := &instreamReader{reader: c.reader, maxChunk: cfg.MaxContentLength}
+	n, err := io.Copy(spool, io.LimitReader(stream, cfg.MaxContentLength+1))
+	if errors.Is(err, errClamdChunkTooLarge) || n > cfg.MaxContentLength {
+		logger.Warn("clamd INSTREAM rejected: size limit exceeded",
+			zap.Int64("max_allowed", cfg.MaxContentLength),
+			zap.String("remote_addr", c.conn.RemoteAddr().String()))
+		// clamd drops the connection after this reply since the stream is unread
+		return false, c.reply(clamdReplySizeExceeded, delim)
+	}
+	if err != nil {
+		return false, err
+	}
+	body, err := spool.Reader()
+	if err != nil {
+		return false, err
+	}
+
+	scansInProgress.Inc()
+	stop := c.watchDisconnect()
+	result, err := c.server.scan(c.ctx, body)
+	stop()
+	scansInProgress.Dec()
+	recordScanMetrics("clamd", result, err)
+
+	if err != nil && c.ctx.Err() != nil {
+		logger.Info("clamd INSTREAM scan canceled: client disconnected",
+			zap.Int64("size", n),
+			zap.String("remote_addr", c.conn.RemoteAddr().String()))
+		return false, net.ErrClosed
+	}
+	if err != nil {
+		// The error may name internal sockets and hosts, so it is only logged
+		logger.Error("clamd INSTREAM scan failed",
+			zap.Int64("size", n),
+			zap.String("remote_addr", c.conn.RemoteAddr().String()),
+			zap.Error(err))
+		return c.inSession, c.reply(clamdReplyScanFailed, delim)
+	}
+
+	logger.Info("clamd INSTREAM scan completed",
+		zap.Int64("size", n),
+		zap.String("status", result.Status),
+		zap.String("result", result.Description),
+		zap.String("action", result.Action),
+		zap.Float64("elapsed_seconds", result.ScanTime),
+		zap.String("remote_addr", c.conn.RemoteAddr().String()))
+
+	if result.Blocked() {
+		return c.inSession, c.reply(clamdReplyStreamPrefix+result.Description+" FOUND", delim)
+	}
+	return c.inSession, c.reply(clamdReplyStreamPrefix+"OK", delim)
+}
+
+// watchDisconnect cancels the session's context if the client closes the
+// connection while a scan runs. The returned stop waits for the watcher;
+// anything the client already sent stays buffered for the next command.
+func (c *clamdSession) watchDisconnect() (stop func()) {
+	c.conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			c.cancel()
+		}
+	}()
+	return func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+// reply writes a response, prefixed with the command ID inside a session
+func (c *clamdSession) reply(msg string, delim byte) error {
+	if c.inSession {
+		msg = fmt.Sprintf("%d: %s", c.commandID, msg)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.server.config.Load().ScanTimeout))
+	_, err := c.conn.Write(append([]byte(msg), delim))
+	return err
+}
+
+// readClamdCommand reads one command and returns it with its terminator.
+// Commands prefixed with 'z' are NUL-terminated and 'n' newline-terminated;
+// replies use the same terminator. Unprefixed legacy commands are
+// newline-terminated.
+func readClamdCommand(r *bufio.Reader) (command string, delim byte, prefixed bool, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	delim = '\n'
+	switch first[0] {
+	case 'z':
+		delim, prefixed = 0, true
+		r.Discard(1)
+	case 'n':
+		prefixed = true
+		r.Discard(1)
+	}
+
+	// ReadSlice bounds the command by the reader's buffer size
+	line, err := r.ReadSlice(delim)
+	if err != nil {
+		return "", 0, false, err
+	}
+	command = strings.TrimRight(string(line[:len(line)-1]), "\r")
+	return command, delim, prefixed, nil
+}
+
+// instreamReader decodes the INSTREAM chunk framing: a 4-byte big-endian
+// length followed by that many bytes, terminated by a zero-length chunk.
+type instreamReader struct {
+	reader    io.Reader
+	maxChunk  int64
+	remaining uint32
+	done      bool
+}
+
+func (s *instreamReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+	if s.remaining == 0 {
+		var length uint32
+		if err := binary.Read(s.reader, binary.BigEndian, &length); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if length == 0 {
+			s.done = true
+			return 0, io.EOF
+		}
+		if int64(length) > s.maxChunk {
+			return 0, errClamdChunkTooLarge
+		}
+		s.remaining = length
+	}
+
+	if uint32(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.reader.Read(p)
+	s.remaining -= uint32(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// clamdVersion returns the backend clamd version string
+func clamdVersion() (string, error) {
+	response, err := getClamdClient().Version()
+	if err != nil {
+		return "", err
+	}
+	var version string
+	for result := range response {
+		if version == "" {
+			version = result.Raw
+		}
+	}
+	if version == "" {
+		return "", errors.New("empty VERSION response from clamd")
+	}
+	return version, nil
+}
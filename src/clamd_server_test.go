@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClamdConfig() *Config {
+	cfg := config
+	cfg.MaxContentLength = 1024
+	cfg.ScanTimeout = 5 * time.Second
+	cfg.ClamdAllowedNets = []string{"127.0.0.1"}
+	return &cfg
+}
+
+// startTestClamdSession runs a clamd session over an in-memory pipe with a
+// fake scanner that flags payloads containing "EICAR"
+func startTestClamdSession(t *testing.T, cfg *Config) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	srv, err := NewClamdServer(cfg)
+	require.NoError(t, err)
+	srv.scan = fakeScan
+
+	server, client := net.Pipe()
+	go srv.handleConn(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+// instreamPayload frames data as INSTREAM chunks of chunkSize bytes
+func instreamPayload(data []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		binary.Write(&buf, binary.BigEndian, uint32(n))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	return buf.Bytes()
+}
+
+func writeClamd(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	go conn.Write(data)
+}
+
+func readClamdReply(t *testing.T, r *bufio.Reader, delim byte) string {
+	t.Helper()
+	line, err := r.ReadString(delim)
+	require.NoError(t, err)
+	return strings.TrimSuffix(line, string(delim))
+}
+
+func TestReadClamdCommand(t *testing.T) {
+	tests := []struct {
+		input        string
+		wantCommand  string
+		wantDelim    byte
+		wantPrefixed bool
+	}{
+		{"zPING\x00", "PING", 0, true},
+		{"nVERSION\n", "VERSION", '\n', true},
+		{"PING\r\n", "PING", '\n', false},
+	}
+	for _, tt := range tests {
+		command, delim, prefixed, err := readClamdCommand(bufio.NewReader(strings.NewReader(tt.input)))
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.wantCommand, command)
+		assert.Equal(t, tt.wantDelim, delim)
+		assert.Equal(t, tt.wantPrefixed, prefixed)
+	}
+
+	// Overlong commands are bounded by the reader buffer
+	_, _, _, err := readClamdCommand(bufio.NewReaderSize(strings.NewReader("z"+strings.Repeat("A", 100)), 16))
+	assert.Error(t, err)
+}
+
+func TestInstreamReader(t *testing.T) {
+	payload := []byte(strings.Repeat("chunked data ", 10))
+	data, err := io.ReadAll(&instreamReader{reader: bytes.NewReader(instreamPayload(payload, 7)), maxChunk: 1024})
+	require.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	// Missing terminating chunk
+	framed := instreamPayload(payload, 7)
+	_, err = io.ReadAll(&instreamReader{reader: bytes.NewReader(framed[:len(framed)-4]), maxChunk: 1024})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Chunk length above the limit
+	_, err = io.ReadAll(&instreamReader{reader: bytes.NewReader(instreamPayload(payload, 100)), maxChunk: 16})
+	assert.ErrorIs(t, err, errClamdChunkTooLarge)
+}
+
+func TestParseAllowedNets(t *testing.T) {
+	prefixes, err := parseAllowedNets([]string{"10.0.0.0/8", "192.168.1.7", "::1"})
+	require.NoError(t, err)
+	assert.Len(t, prefixes, 3)
+
+	_, err = parseAllowedNets([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = parseAllowedNets([]string{"localhost"})
+	assert.Error(t, err)
+}
+
+func TestClamdServerIsAllowed(t *testing.T) {
+	cfg := testClamdConfig()
+	cfg.ClamdAllowedNets = []string{"10.0.0.0/8", "::1"}
+	srv, err := NewClamdServer(cfg)
+	require.NoError(t, err)
+
+	assert.True(t, srv.isAllowed(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	assert.True(t, srv.isAllowed(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}))
+	assert.True(t, srv.isAllowed(&net.TCPAddr{IP: net.ParseIP("::1")}))
+	assert.False(t, srv.isAllowed(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+	assert.False(t, srv.isAllowed(&net.UnixAddr{Name: "/tmp/sock"}))
+}
+
+func TestClamdPing(t *testing.T) {
+	conn, reader := startTestClamdSession(t, testClamdConfig())
+	writeClamd(t, conn, []byte("zPING\x00"))
+	assert.Equal(t, "PONG", readClamdReply(t, reader, 0))
+
+	// Outside a session the connection is closed after one command
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestClamdLegacyPing(t *testing.T) {
+	conn, reader := startTestClamdSession(t, testClamdConfig())
+	writeClamd(t, conn, []byte("PING\n"))
+	assert.Equal(t, "PONG", readClamdReply(t, reader, '\n'))
+}
+
+func TestClamdVersionUnavailable(t *testing.T) {
+	withInvalidSocket(t)
+	conn, reader := startTestClamdSession(t, testClamdConfig())
+	writeClamd(t, conn, []byte("nVERSION\n"))
+	assert.Equal(t, clamdReplyVersionFailed, readClamdReply(t, reader, '\n'))
+}
+
+func TestClamdInstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"clean stream", "harmless content", "stream: OK"},
+		{"infected stream", "X5O!P%@AP EICAR", "stream: Eicar-Test-Signature FOUND"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, reader := startTestClamdSession(t, testClamdConfig())
+			writeClamd(t, conn, append([]byte("zINSTREAM\x00"), instreamPayload([]byte(tt.payload), 4)...))
+			assert.Equal(t, tt.want, readClamdReply(t, reader, 0))
+		})
+	}
+}
+
+func TestClamdInstreamSizeLimit(t *testing.T) {
+	cfg := testClamdConfig()
+	cfg.MaxContentLength = 16
+	conn, reader := startTestClamdSession(t, cfg)
+
+	writeClamd(t, conn, append([]byte("zINSTREAM\x00"), instreamPayload(bytes.Repeat([]byte("x"), 40), 8)...))
+	assert.Equal(t, clamdReplySizeExceeded, readClamdReply(t, reader, 0))
+}
+
+func TestClamdInstreamScanError(t *testing.T) {
+	withInvalidSocket(t)
+	srv, err := NewClamdServer(testClamdConfig())
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	go srv.handleConn(server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	writeClamd(t, client, append([]byte("nINSTREAM\n"), instreamPayload([]byte("data"), 4)...))
+	// Internal error details such as the clamd socket stay in the logs
+	assert.Equal(t, clamdReplyScanFailed, readClamdReply(t, bufio.NewReader(client), '\n'))
+}
+
+func TestClamdInstreamScanContext(t *testing.T) {
+	srv, err := NewClamdServer(testClamdConfig())
+	require.NoError(t, err)
+	ids := make(chan string, 1)
+	canceled := make(chan error, 1)
+	srv.scan = func(ctx context.Context, r io.Reader) (*ScanResult, error) {
+		ids <- requestIDFromContext(ctx)
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		srv.handleConn(server)
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	writeClamd(t, client, append([]byte("zINSTREAM\x00"), instreamPayload([]byte("data"), 4)...))
+
+	// Scans carry a request ID and stop when the client goes away
+	select {
+	case id := <-ids:
+		assert.True(t, validRequestID(id), "got %q", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan did not start")
+	}
+	client.Close()
+	select {
+	case err := <-canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan was not canceled on disconnect")
+	}
+	<-done
+}
+
+func TestClamdIDSession(t *testing.T) {
+	conn, reader := startTestClamdSession(t, testClamdConfig())
+
+	var session bytes.Buffer
+	session.WriteString("zIDSESSION\x00")
+	session.WriteString("zPING\x00")
+	session.WriteString("zINSTREAM\x00")
+	session.Write(instreamPayload([]byte("EICAR"), 2))
+	session.WriteString("zINSTREAM\x00")
+	session.Write(instreamPayload([]byte("clean"), 2))
+	session.WriteString("zEND\x00")
+	writeClamd(t, conn, session.Bytes())
+
+	assert.Equal(t, "1: PONG", readClamdReply(t, reader, 0))
+	assert.Equal(t, "2: stream: Eicar-Test-Signature FOUND", readClamdReply(t, reader, 0))
+	assert.Equal(t, "3: stream: OK", readClamdReply(t, reader, 0))
+
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestClamdUnknownCommand(t *testing.T) {
+	conn, reader := startTestClamdSession(t, testClamdConfig())
+	writeClamd(t, conn, []byte("zSCAN /etc/passwd\x00"))
+	assert.Equal(t, clamdReplyUnknown, readClamdReply(t, reader, 0))
+}
+
+func TestClamdServerRejectsDisallowedSource(t *testing.T) {
+	cfg := testClamdConfig()
+	cfg.ClamdAllowedNets = []string{"10.0.0.0/8"}
+	srv, err := NewClamdServer(cfg)
+	require.NoError(t, err)
+	srv.scan = fakeScan
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(lis)
+	defer srv.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("zPING\x00"))
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.Error(t, err, "connection from a disallowed source should be closed")
+}
+
+func TestClamdServerServeAndShutdown(t *testing.T) {
+	srv, err := NewClamdServer(testClamdConfig())
+	require.NoError(t, err)
+	srv.scan = fakeScan
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(lis) }()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("zPING\x00"))
+	assert.Equal(t, "PONG", readClamdReply(t, bufio.NewReader(conn), 0))
+	conn.Close()
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	assert.NoError(t, <-served)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"clamav-api/client"
+)
+
+// Exit codes of the client subcommands, matching clamdscan
+const (
+	exitClean    = 0
+	exitInfected = 1
+	exitError    = 2
+
+	// exitUnhealthy is returned by health when the server answers but
+	// clamd is unavailable
+	exitUnhealthy = 1
+)
+
+// Report formats of the scan subcommand
+const (
+	cliFormatText  = "text"
+	cliFormatJSON  = "json"
+	cliFormatJUnit = "junit"
+	cliFormatSARIF = "sarif"
+)
+
+const cliUsage = `Usage: clamav-api [command] [flags]
+
+Commands:
+  serve     Run the API server (default when no command is given)
+  scan      Scan files or directories using a running server
+  health    Check that a server and its clamd are healthy
+  version   Print version information
+
+Run 'clamav-api <command> -h' for the flags of a command.
+`
+
+// cliResult is the outcome of scanning one file with the client
+type cliResult struct {
+	Path     string  `json:"file"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	ScanTime float64 `json:"scan_time"`
+	Size     int64   `json:"size"`
+	// Action is what the server's policy does with a detection
+	Action string `json:"action,omitempty"`
+	// blocked is set for detections the server's policy blocks
+	blocked bool
+}
+
+// cliSummary totals a client scan run. Infected counts the detections the
+// server's policy blocks; Warned those it lets through with warn or allow.
+type cliSummary struct {
+	Scanned  int     `json:"scanned"`
+	Clean    int     `json:"clean"`
+	Infected int     `json:"infected"`
+	Warned   int     `json:"warned"`
+	Errors   int     `json:"errors"`
+	Time     float64 `json:"time"`
+}
+
+// exitCode maps a summary to the process exit code. Errors win over
+// infections because an incomplete scan cannot vouch for anything.
+func (s cliSummary) exitCode() int {
+	switch {
+	case s.Errors > 0:
+		return exitError
+	case s.Infected > 0:
+		return exitInfected
+	}
+	return exitClean
+}
+
+// runCLI runs a client subcommand and returns its exit code
+func runCLI(command string, args []string, stdout, stderr io.Writer) int {
+	switch command {
+	case "scan":
+		return runScanCommand(args, stdout, stderr)
+	case "health":
+		return runHealthCommand(args, stdout, stderr)
+	case "version":
+		return runVersionCommand(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, cliUsage)
+		return exitClean
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n\n%s", command, cliUsage)
+	return exitError
+}
+
+// cliConnFlags are the connection flags shared by the client subcommands
+type cliConnFlags struct {
+	protocol *string
+	server   *string
+	timeout  *time.Duration
+}
+
+func addConnFlags(fs *flag.FlagSet) cliConnFlags {
+	return cliConnFlags{
+		protocol: fs.String("protocol", cliProtocolREST, "Protocol used to reach the server (rest|grpc)"),
+		server:   fs.String("server", os.Getenv("CLAMAV_SERVER"), "Server address (default "+defaultRESTServer+" for rest, "+defaultGRPCServer+" for grpc)"),
+		timeout:  fs.Duration("timeout", 5*time.Minute, "Timeout for each request"),
+	}
+}
+
+// serverAddress returns the configured server or the protocol default
+func (f cliConnFlags) serverAddress() string {
+	if *f.server != "" {
+		return *f.server
+	}
+	if *f.protocol == cliProtocolGRPC {
+		return defaultGRPCServer
+	}
+	return defaultRESTServer
+}
+
+// parseCLIFlags parses args, returning false with the exit code to use
+// when parsing failed or help was requested
+func parseCLIFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitClean, false
+		}
+		return exitError, false
+	}
+	return 0, true
+}
+
+func runScanCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: clamav-api scan [flags] <file|dir>...\n\nFlags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(stderr, "\nExit codes: %d clean, %d infected, %d error\n", exitClean, exitInfected, exitError)
+	}
+	conn := addConnFlags(fs)
+	recursive := fs.Bool("recursive", false, "Scan directories recursively")
+	fs.BoolVar(recursive, "r", false, "Shorthand for -recursive")
+	parallel := fs.Int("parallel", 4, "Number of files scanned concurrently")
+	format := fs.String("format", cliFormatText, "Report format (text|json|junit|sarif)")
+	output := fs.String("output", "", "Write the report to this file instead of stdout")
+	streamThreshold := fs.Int64("stream-threshold", 4<<20, "Files larger than this many bytes use ScanStream over gRPC")
+	if code, ok := parseCLIFlags(fs, args); !ok {
+		return code
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError
+	}
+	if *parallel < 1 {
+		fmt.Fprintf(stderr, "parallel must be >= 1, got %d\n", *parallel)
+		return exitError
+	}
+	writeReport, ok := cliReportWriters[*format]
+	if !ok {
+		fmt.Fprintf(stderr, "format must be one of text, json, junit, sarif, got %q\n", *format)
+		return exitError
+	}
+
+	scanner, err := newCLIClient(*conn.protocol, conn.serverAddress(), &client.Options{StreamThreshold: *streamThreshold})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	defer scanner.Close()
+
+	start := time.Now()
+	results := scanPaths(scanner, fs.Args(), *recursive, *parallel, *conn.timeout)
+	summary := summarize(results, time.Since(start))
+
+	out := stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := writeReport(out, results, summary); err != nil {
+		fmt.Fprintf(stderr, "failed to write report: %v\n", err)
+		return exitError
+	}
+	return summary.exitCode()
+}
+
+// cliFile is a file queued for scanning
+type cliFile struct {
+	path string
+	size int64
+}
+
+// collectFiles expands paths into the regular files to scan. Paths that
+// cannot be read are returned as error results.
+func collectFiles(paths []string, recursive bool) ([]cliFile, []cliResult) {
+	var files []cliFile
+	var failed []cliResult
+	fail := func(path string, err error) {
+		failed = append(failed, cliResult{Path: path, Status: "ERROR", Message: err.Error()})
+	}
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			fail(root, err)
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, cliFile{path: root, size: info.Size()})
+			continue
+		}
+
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fail(path, err)
+				return nil
+			}
+			if d.IsDir() {
+				if path != root && !recursive {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			// Symlinks, sockets and devices inside directories are skipped
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				fail(path, err)
+				return nil
+			}
+			files = append(files, cliFile{path: path, size: info.Size()})
+			return nil
+		})
+	}
+	return files, failed
+}
+
+// scanPaths scans every file under paths with parallel workers. Results
+// are returned in the order the files were found.
+func scanPaths(scanner client.Scanner, paths []string, recursive bool, parallel int, timeout time.Duration) []cliResult {
+	files, failed := collectFiles(paths, recursive)
+	results := make([]cliResult, len(files))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = scanCLIFile(scanner, files[i], timeout)
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return append(results, failed...)
+}
+
+func scanCLIFile(scanner client.Scanner, file cliFile, timeout time.Duration) cliResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := cliResult{Path: file.path, Size: file.size}
+	scanned, err := scanner.ScanFile(ctx, file.path)
+	if err != nil {
+		result.Status = "ERROR"
+		result.Message = err.Error()
+		return result
+	}
+	result.Status = scanned.Status
+	result.Message = scanned.Description
+	result.ScanTime = scanned.ScanTime
+	result.Action = scanned.Action
+	result.blocked = scanned.Blocked()
+	return result
+}
+
+func summarize(results []cliResult, elapsed time.Duration) cliSummary {
+	summary := cliSummary{Time: elapsed.Seconds()}
+	for _, r := range results {
+		switch r.Status {
+		case "OK":
+			summary.Scanned++
+			summary.Clean++
+		case "FOUND":
+			summary.Scanned++
+			if r.blocked {
+				summary.Infected++
+			} else {
+				summary.Warned++
+			}
+		default:
+			summary.Errors++
+		}
+	}
+	return summary
+}
+
+func runHealthCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	conn := addConnFlags(fs)
+	if code, ok := parseCLIFlags(fs, args); !ok {
+		return code
+	}
+
+	scanner, err := newCLIClient(*conn.protocol, conn.serverAddress(), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	defer scanner.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *conn.timeout)
+	defer cancel()
+
+	message, err := scanner.Health(ctx)
+	switch {
+	case errors.Is(err, client.ErrUnhealthy):
+		fmt.Fprintf(stdout, "unhealthy: %s\n", message)
+		return exitUnhealthy
+	case err != nil:
+		fmt.Fprintf(stderr, "health check failed: %v\n", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "healthy: %s\n", message)
+	return exitClean
+}
+
+func runVersionCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	conn := addConnFlags(fs)
+	remote := fs.Bool("remote", false, "Also print the version of the server")
+	if code, ok := parseCLIFlags(fs, args); !ok {
+		return code
+	}
+
+	fmt.Fprintf(stdout, "client: %s (commit %s, built %s)\n", Version, CommitHash, BuildTime)
+	if !*remote {
+		return exitClean
+	}
+
+	scanner, err := newCLIClient(*conn.protocol, conn.serverAddress(), nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	defer scanner.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *conn.timeout)
+	defer cancel()
+
+	version, err := serverVersion(ctx, scanner)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to get server version: %v\n", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "server: %s (commit %s, built %s)\n", version["version"], version["commit"], version["build"])
+	return exitClean
+}
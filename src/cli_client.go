@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"clamav-api/client"
+)
+
+// Client protocols
+const (
+	cliProtocolREST = "rest"
+	cliProtocolGRPC = "grpc"
+)
+
+// Default server addresses used by the client subcommands
+const (
+	defaultRESTServer = "http://localhost:6000"
+	defaultGRPCServer = "localhost:9000"
+)
+
+// newCLIClient creates an SDK scanner for protocol talking to server
+func newCLIClient(protocol, server string, opts *client.Options) (client.Scanner, error) {
+	switch protocol {
+	case cliProtocolREST:
+		return client.NewRESTScanner(server, opts)
+	case cliProtocolGRPC:
+		return client.NewGRPCScanner(server, opts)
+	}
+	return nil, fmt.Errorf("protocol must be rest or grpc, got %q", protocol)
+}
+
+// serverVersion returns the build information of the server behind s,
+// which is only published over REST
+func serverVersion(ctx context.Context, s client.Scanner) (map[string]string, error) {
+	rest, ok := s.(*client.RESTScanner)
+	if !ok {
+		return nil, errors.New("server version is only available over REST")
+	}
+	return rest.Version(ctx)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+)
+
+// cliReportWriter renders the results of a client scan run
+type cliReportWriter func(w io.Writer, results []cliResult, summary cliSummary) error
+
+var cliReportWriters = map[string]cliReportWriter{
+	cliFormatText:  writeTextReport,
+	cliFormatJSON:  writeJSONReport,
+	cliFormatJUnit: writeJUnitReport,
+	cliFormatSARIF: writeSARIFReport,
+}
+
+// writeTextReport prints one line per file and a summary, like clamdscan
+func writeTextReport(w io.Writer, results []cliResult, summary cliSummary) error {
+	for _, r := range results {
+		switch r.Status {
+		case "OK":
+			fmt.Fprintf(w, "%s: OK\n", r.Path)
+		case "FOUND":
+			if r.blocked {
+				fmt.Fprintf(w, "%s: %s FOUND\n", r.Path, r.Message)
+			} else {
+				fmt.Fprintf(w, "%s: %s FOUND (%s)\n", r.Path, r.Message, r.Action)
+			}
+		default:
+			fmt.Fprintf(w, "%s: %s ERROR\n", r.Path, r.Message)
+		}
+	}
+	fmt.Fprintf(w, "\n----------- SCAN SUMMARY -----------\n"+
+		"Scanned files: %d\nInfected files: %d\n", summary.Scanned, summary.Infected)
+	if summary.Warned > 0 {
+		fmt.Fprintf(w, "Warned files: %d\n", summary.Warned)
+	}
+	_, err := fmt.Fprintf(w, "Errors: %d\nTime: %.3f sec\n", summary.Errors, summary.Time)
+	return err
+}
+
+func writeJSONReport(w io.Writer, results []cliResult, summary cliSummary) error {
+	if results == nil {
+		results = []cliResult{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Results []cliResult `json:"results"`
+		Summary cliSummary  `json:"summary"`
+	}{results, summary})
+}
+
+// JUnit XML report, one test case per file. Blocked detections are
+// failures and files that could not be scanned are errors.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnitReport(w io.Writer, results []cliResult, summary cliSummary) error {
+	suite := junitTestSuite{
+		Name:     "clamav-api scan",
+		Tests:    len(results),
+		Failures: summary.Infected,
+		Errors:   summary.Errors,
+		Time:     fmt.Sprintf("%.3f", summary.Time),
+	}
+	for _, r := range results {
+		tc := junitTestCase{ClassName: "clamav-api", Name: r.Path, Time: fmt.Sprintf("%.3f", r.ScanTime)}
+		switch r.Status {
+		case "OK":
+		case "FOUND":
+			if r.blocked {
+				tc.Failure = &junitProblem{Message: r.Message, Type: "FOUND", Text: r.Path + ": " + r.Message + " FOUND"}
+			}
+		default:
+			tc.Error = &junitProblem{Message: r.Message, Type: "ERROR", Text: r.Path + ": " + r.Message}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	report := junitTestSuites{
+		Name:     "clamav-api",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// SARIF 2.1.0 report. Each signature becomes a rule, each infected file a
+// result, and files that could not be scanned tool execution notifications.
+// Detections the server's policy lets through are warnings.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Results     []sarifResult     `json:"results"`
+	Invocations []sarifInvocation `json:"invocations"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications"`
+}
+
+type sarifNotification struct {
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+// sarifURI converts a scanned path to a SARIF artifact URI: relative paths
+// stay relative to the working directory, absolute ones become file URIs
+func sarifURI(path string) string {
+	slashed := filepath.ToSlash(path)
+	if filepath.IsAbs(path) {
+		if filepath.VolumeName(path) != "" {
+			slashed = "/" + slashed
+		}
+		return (&url.URL{Scheme: "file", Path: slashed}).String()
+	}
+	return (&url.URL{Path: slashed}).String()
+}
+
+func sarifLocations(path string) []sarifLocation {
+	return []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: sarifURI(path)}}}}
+}
+
+func writeSARIFReport(w io.Writer, results []cliResult, summary cliSummary) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "clamav-api",
+			Version:        Version,
+			InformationURI: "https://github.com/DevHatRo/ClamAV-API",
+			Rules:          []sarifRule{},
+		}},
+		Results:     []sarifResult{},
+		Invocations: []sarifInvocation{{ExecutionSuccessful: summary.Errors == 0, ToolExecutionNotifications: []sarifNotification{}}},
+	}
+
+	// Rules are listed in a stable order so reports diff cleanly
+	var signatures []string
+	for _, r := range results {
+		if r.Status == "FOUND" {
+			signatures = append(signatures, r.Message)
+		}
+	}
+	sort.Strings(signatures)
+	ruleIndex := make(map[string]int)
+	for _, sig := range signatures {
+		if _, ok := ruleIndex[sig]; ok {
+			continue
+		}
+		ruleIndex[sig] = len(run.Tool.Driver.Rules)
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+			ID:               sig,
+			ShortDescription: sarifMessage{Text: "ClamAV signature " + sig},
+		})
+	}
+
+	for _, r := range results {
+		switch r.Status {
+		case "OK":
+		case "FOUND":
+			level := "error"
+			if !r.blocked {
+				level = "warning"
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    r.Message,
+				RuleIndex: ruleIndex[r.Message],
+				Level:     level,
+				Message:   sarifMessage{Text: fmt.Sprintf("Malware detected: %s", r.Message)},
+				Locations: sarifLocations(r.Path),
+			})
+		default:
+			run.Invocations[0].ToolExecutionNotifications = append(run.Invocations[0].ToolExecutionNotifications, sarifNotification{
+				Level:     "error",
+				Message:   sarifMessage{Text: r.Message},
+				Locations: sarifLocations(r.Path),
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"clamav-api/client"
+	pb "clamav-api/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeVerdict mirrors fakeScan for the fake servers: payloads containing
+// "EICAR" are infected and payloads containing "BROKEN" fail to scan
+func fakeVerdict(data []byte) (string, string, bool) {
+	switch {
+	case bytes.Contains(data, []byte("BROKEN")):
+		return "", "clamd unavailable", false
+	case bytes.Contains(data, []byte("EICAR")):
+		return "FOUND", "Eicar-Test-Signature", true
+	}
+	return "OK", "", true
+}
+
+// fakeAction is the policy action of the fake servers: detections in
+// payloads containing "WARN" are warned, others are blocked
+func fakeAction(data []byte) string {
+	if bytes.Contains(data, []byte("WARN")) {
+		return "warn"
+	}
+	return "block"
+}
+
+// newFakeRESTServer serves the REST endpoints used by the client
+func newFakeRESTServer(t *testing.T, healthy bool) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	scan := func(w http.ResponseWriter, data []byte) {
+		w.Header().Set("Content-Type", "application/json")
+		scanStatus, message, ok := fakeVerdict(data)
+		if !ok {
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]string{"status": "Clamd service down", "message": message})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": scanStatus, "message": message, "time": 0.01, "action": fakeAction(data)})
+	}
+	mux.HandleFunc("POST /api/stream-scan", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		scan(w, data)
+	})
+	// Empty files are uploaded as a form
+	mux.HandleFunc("POST /api/scan", func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		scan(w, data)
+	})
+	mux.HandleFunc("GET /api/health-check", func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusBadGateway)
+			io.WriteString(w, `{"message":"Clamd service unavailable"}`)
+			return
+		}
+		io.WriteString(w, `{"message":"ok"}`)
+	})
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"version":"1.2.3","commit":"abc","build":"today"}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakeGRPCScanner records how files arrived over gRPC
+type fakeGRPCScanner struct {
+	pb.UnimplementedClamAVScannerServer
+	mu      sync.Mutex
+	unary   int
+	streams int
+	chunks  int
+}
+
+func (s *fakeGRPCScanner) respond(data []byte, filename string) (*pb.ScanResponse, error) {
+	scanStatus, message, ok := fakeVerdict(data)
+	if !ok {
+		return nil, status.Error(codes.Internal, "scan failed: "+message)
+	}
+	return &pb.ScanResponse{Status: scanStatus, Message: message, ScanTime: 0.01, Filename: filename, Action: fakeAction(data)}, nil
+}
+
+func (s *fakeGRPCScanner) HealthCheck(ctx context.Context, req *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	return &pb.HealthCheckResponse{Status: "healthy", Message: "ok"}, nil
+}
+
+func (s *fakeGRPCScanner) ScanFile(ctx context.Context, req *pb.ScanFileRequest) (*pb.ScanResponse, error) {
+	s.mu.Lock()
+	s.unary++
+	s.mu.Unlock()
+	return s.respond(req.Data, req.Filename)
+}
+
+func (s *fakeGRPCScanner) ScanStream(stream pb.ClamAVScanner_ScanStreamServer) error {
+	var data []byte
+	var filename string
+	chunks := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunks++
+		if req.Filename != "" {
+			filename = req.Filename
+		}
+		data = append(data, req.Chunk...)
+		if req.IsLast {
+			break
+		}
+	}
+	s.mu.Lock()
+	s.streams++
+	s.chunks += chunks
+	s.mu.Unlock()
+
+	resp, err := s.respond(data, filename)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+func newFakeGRPCServer(t *testing.T) (string, *fakeGRPCScanner) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fake := &fakeGRPCScanner{}
+	server := grpc.NewServer()
+	pb.RegisterClamAVScannerServer(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String(), fake
+}
+
+// writeTree creates files relative to a new temp dir and returns the dir
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func runCLIForTest(command string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI(command, args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCollectFiles(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"a.txt":          "a",
+		"sub/b.txt":      "bb",
+		"sub/deep/c.txt": "ccc",
+	})
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a.txt"), filepath.Join(dir, "link.txt")))
+
+	files, failed := collectFiles([]string{dir}, false)
+	assert.Empty(t, failed)
+	require.Len(t, files, 1)
+	assert.Equal(t, filepath.Join(dir, "a.txt"), files[0].path)
+	assert.Equal(t, int64(1), files[0].size)
+
+	files, _ = collectFiles([]string{dir}, true)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "sub", "b.txt"),
+		filepath.Join(dir, "sub", "deep", "c.txt"),
+	}, paths)
+
+	files, failed = collectFiles([]string{filepath.Join(dir, "link.txt"), filepath.Join(dir, "missing")}, false)
+	require.Len(t, files, 1, "an explicitly named symlink is followed")
+	require.Len(t, failed, 1)
+	assert.Equal(t, "ERROR", failed[0].Status)
+}
+
+func TestCLIScanExitCodes(t *testing.T) {
+	server := newFakeRESTServer(t, true)
+	dir := writeTree(t, map[string]string{
+		"clean.txt":  "hello",
+		"eicar.com":  "X5O EICAR",
+		"broken.bin": "BROKEN",
+		"empty.txt":  "",
+		"warned.doc": "EICAR WARN",
+	})
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  int
+	}{
+		{"clean", []string{filepath.Join(dir, "clean.txt"), filepath.Join(dir, "empty.txt")}, exitClean},
+		{"infected", []string{filepath.Join(dir, "clean.txt"), filepath.Join(dir, "eicar.com")}, exitInfected},
+		{"warned", []string{filepath.Join(dir, "clean.txt"), filepath.Join(dir, "warned.doc")}, exitClean},
+		{"warned and infected", []string{filepath.Join(dir, "warned.doc"), filepath.Join(dir, "eicar.com")}, exitInfected},
+		{"scan error", []string{filepath.Join(dir, "eicar.com"), filepath.Join(dir, "broken.bin")}, exitError},
+		{"missing file", []string{filepath.Join(dir, "nope")}, exitError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := runCLIForTest("scan", append([]string{"-server", server.URL}, tt.paths...)...)
+			assert.Equal(t, tt.want, code)
+		})
+	}
+}
+
+func TestCLIScanTextOutput(t *testing.T) {
+	server := newFakeRESTServer(t, true)
+	dir := writeTree(t, map[string]string{"clean.txt": "hello", "sub/eicar.com": "EICAR"})
+
+	code, stdout, _ := runCLIForTest("scan", "-server", server.URL, "-r", "-parallel", "2", dir)
+	assert.Equal(t, exitInfected, code)
+	assert.Contains(t, stdout, filepath.Join(dir, "clean.txt")+": OK\n")
+	assert.Contains(t, stdout, filepath.Join(dir, "sub", "eicar.com")+": Eicar-Test-Signature FOUND\n")
+	assert.Contains(t, stdout, "Scanned files: 2\nInfected files: 1\nErrors: 0\n")
+
+	// Detections the policy lets through are reported apart
+	dir = writeTree(t, map[string]string{"warned.doc": "EICAR WARN"})
+	code, stdout, _ = runCLIForTest("scan", "-server", server.URL, dir)
+	assert.Equal(t, exitClean, code)
+	assert.Contains(t, stdout, filepath.Join(dir, "warned.doc")+": Eicar-Test-Signature FOUND (warn)\n")
+	assert.Contains(t, stdout, "Scanned files: 1\nInfected files: 0\nWarned files: 1\nErrors: 0\n")
+}
+
+func TestCLIScanOutputFile(t *testing.T) {
+	server := newFakeRESTServer(t, true)
+	dir := writeTree(t, map[string]string{"clean.txt": "hello"})
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	code, stdout, _ := runCLIForTest("scan", "-server", server.URL, "-format", "json", "-output", report, dir)
+	assert.Equal(t, exitClean, code)
+	assert.Empty(t, stdout)
+
+	data, err := os.ReadFile(report)
+	require.NoError(t, err)
+	var parsed struct {
+		Results []cliResult `json:"results"`
+		Summary cliSummary  `json:"summary"`
+	}
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, 1, parsed.Summary.Clean)
+	assert.Equal(t, "OK", parsed.Results[0].Status)
+}
+
+func TestCLIScanOverGRPC(t *testing.T) {
+	addr, fake := newFakeGRPCServer(t)
+	dir := writeTree(t, map[string]string{
+		"small.txt": "hello",
+		"large.bin": strings.Repeat("x", 3*client.DefaultChunkSize) + "EICAR",
+	})
+
+	code, stdout, stderr := runCLIForTest("scan", "-protocol", "grpc", "-server", addr,
+		"-stream-threshold", "1024", "-format", "json", dir)
+	assert.Equal(t, exitInfected, code, stderr)
+
+	var parsed struct {
+		Results []cliResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &parsed))
+	require.Len(t, parsed.Results, 2)
+	assert.Equal(t, "FOUND", parsed.Results[0].Status)
+	assert.Equal(t, "OK", parsed.Results[1].Status)
+
+	assert.Equal(t, 1, fake.unary)
+	assert.Equal(t, 1, fake.streams)
+	assert.Equal(t, 4, fake.chunks)
+}
+
+func TestCLIScanOverGRPCError(t *testing.T) {
+	addr, _ := newFakeGRPCServer(t)
+	dir := writeTree(t, map[string]string{"broken.bin": "BROKEN"})
+
+	code, stdout, _ := runCLIForTest("scan", "-protocol", "grpc", "-server", addr, dir)
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stdout, "Internal: scan failed: clamd unavailable ERROR")
+}
+
+func TestCLIScanUsageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no paths", nil},
+		{"bad format", []string{"-format", "xml", "."}},
+		{"bad protocol", []string{"-protocol", "ftp", "."}},
+		{"bad parallel", []string{"-parallel", "0", "."}},
+		{"unknown flag", []string{"-bogus", "."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCLIForTest("scan", tt.args...)
+			assert.Equal(t, exitError, code)
+			assert.NotEmpty(t, stderr)
+		})
+	}
+
+	code, _, _ := runCLIForTest("scan", "-h")
+	assert.Equal(t, exitClean, code)
+}
+
+func TestCLIHealth(t *testing.T) {
+	code, stdout, _ := runCLIForTest("health", "-server", newFakeRESTServer(t, true).URL)
+	assert.Equal(t, exitClean, code)
+	assert.Equal(t, "healthy: ok\n", stdout)
+
+	code, stdout, _ = runCLIForTest("health", "-server", newFakeRESTServer(t, false).URL)
+	assert.Equal(t, exitUnhealthy, code)
+	assert.Equal(t, "unhealthy: Clamd service unavailable\n", stdout)
+
+	addr, _ := newFakeGRPCServer(t)
+	code, _, _ = runCLIForTest("health", "-protocol", "grpc", "-server", addr)
+	assert.Equal(t, exitClean, code)
+
+	// Nothing listening
+	unused := httptest.NewServer(http.NotFoundHandler())
+	unused.Close()
+	code, _, stderr := runCLIForTest("health", "-server", unused.URL)
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "health check failed")
+}
+
+func TestCLIVersion(t *testing.T) {
+	code, stdout, _ := runCLIForTest("version")
+	assert.Equal(t, exitClean, code)
+	assert.Equal(t, "client: "+Version+" (commit "+CommitHash+", built "+BuildTime+")\n", stdout)
+
+	code, stdout, _ = runCLIForTest("version", "-remote", "-server", newFakeRESTServer(t, true).URL)
+	assert.Equal(t, exitClean, code)
+	assert.Contains(t, stdout, "server: 1.2.3 (commit abc, built today)\n")
+}
+
+func TestCLIUnknownCommand(t *testing.T) {
+	code, _, stderr := runCLIForTest("frobnicate")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "unknown command")
+
+	code, stdout, _ := runCLIForTest("help")
+	assert.Equal(t, exitClean, code)
+	assert.Contains(t, stdout, "serve")
+}
+
+func TestCLIReportFormats(t *testing.T) {
+	results := []cliResult{
+		{Path: "clean.txt", Status: "OK", ScanTime: 0.01},
+		{Path: "dir/eicar.com", Status: "FOUND", Message: "Eicar-Test-Signature", Action: "block", blocked: true},
+		{Path: "/abs/other.com", Status: "FOUND", Message: "Eicar-Test-Signature", Action: "block", blocked: true},
+		{Path: "broken.bin", Status: "ERROR", Message: "clamd unavailable"},
+		{Path: "macro.doc", Status: "FOUND", Message: "Doc.Macro", Action: "warn"},
+	}
+	summary := summarize(results, 0)
+	assert.Equal(t, cliSummary{Scanned: 4, Clean: 1, Infected: 2, Warned: 1, Errors: 1}, summary)
+
+	var junit bytes.Buffer
+	require.NoError(t, writeJUnitReport(&junit, results, summary))
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(junit.Bytes(), &suites))
+	assert.Equal(t, 5, suites.Tests)
+	assert.Equal(t, 2, suites.Failures)
+	assert.Equal(t, 1, suites.Errors)
+	cases := suites.Suites[0].Cases
+	assert.Nil(t, cases[0].Failure)
+	assert.Equal(t, "Eicar-Test-Signature", cases[1].Failure.Message)
+	assert.Equal(t, "clamd unavailable", cases[3].Error.Message)
+	assert.Nil(t, cases[4].Failure, "warned detections do not fail")
+
+	var sarif bytes.Buffer
+	require.NoError(t, writeSARIFReport(&sarif, results, summary))
+	var log sarifLog
+	require.NoError(t, json.Unmarshal(sarif.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	run := log.Runs[0]
+	require.Len(t, run.Tool.Driver.Rules, 2, "one rule per distinct signature")
+	require.Len(t, run.Results, 3)
+	assert.Equal(t, "dir/eicar.com", run.Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, "file:///abs/other.com", run.Results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, "error", run.Results[0].Level)
+	assert.Equal(t, "warning", run.Results[2].Level)
+	assert.False(t, run.Invocations[0].ExecutionSuccessful)
+	require.Len(t, run.Invocations[0].ToolExecutionNotifications, 1)
+
+	var empty bytes.Buffer
+	require.NoError(t, writeJSONReport(&empty, nil, cliSummary{}))
+	assert.Contains(t, empty.String(), `"results": []`)
+}
@@ -0,0 +1,394 @@
+// Package client is the Go SDK for the ClamAV API. A Scanner scans files
+// and streams over either the REST or the gRPC API, switching to streaming
+// uploads for large payloads and retrying when the server is temporarily
+// unavailable.
+//
+//	scanner, err := client.NewRESTScanner("http://localhost:6000", nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer scanner.Close()
+//
+//	result, err := scanner.ScanFile(ctx, "upload.pdf")
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Default option values
+const (
+	DefaultStreamThreshold = 4 << 20
+	DefaultChunkSize       = 1 << 20
+	DefaultMaxRetries      = 2
+	DefaultRetryBackoff    = 200 * time.Millisecond
+	DefaultMaxRetryBackoff = 5 * time.Second
+)
+
+// Scan statuses reported in Result.Status
+const (
+	StatusClean    = "OK"
+	StatusInfected = "FOUND"
+)
+
+// ErrUnhealthy is returned by Health when the server is reachable but its
+// clamd is not
+var ErrUnhealthy = errors.New("server unhealthy")
+
+// Scanner scans content with a ClamAV API server
+type Scanner interface {
+	// Scan scans everything read from r. name is only used for logging on
+	// the server and may be empty.
+	Scan(ctx context.Context, name string, r io.Reader) (*Result, error)
+	// ScanFile scans the file at path
+	ScanFile(ctx context.Context, path string) (*Result, error)
+	// Health returns the server's health message. It returns ErrUnhealthy
+	// when the server answers but cannot reach clamd.
+	Health(ctx context.Context) (string, error)
+	// Close releases the connections held by the scanner
+	Close() error
+}
+
+// Options tune a Scanner. The zero value uses the defaults above.
+type Options struct {
+	// StreamThreshold is the payload size above which content is streamed
+	// in chunks (ScanStream over gRPC) instead of sent in one message.
+	// Payloads at or below it are buffered, so they can always be retried.
+	StreamThreshold int64
+	// ChunkSize is the size of each ScanStream chunk over gRPC
+	ChunkSize int
+	// MaxRetries is the number of times a request is retried after a
+	// 502/503 response, an UNAVAILABLE status or a connection failure.
+	// Set it to -1 to disable retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry. It doubles with
+	// each attempt, with jitter, up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// APIKey is sent with every request to select the server's scan
+	// policy for this caller. Empty uses the server's default policy.
+	APIKey string
+}
+
+// withDefaults returns a copy of opts with unset fields defaulted
+func (opts *Options) withDefaults() Options {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.StreamThreshold <= 0 {
+		o.StreamThreshold = DefaultStreamThreshold
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultMaxRetries
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = DefaultRetryBackoff
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	return o
+}
+
+// Result is the verdict for one scanned payload
+type Result struct {
+	// Status is StatusClean or StatusInfected
+	Status string
+	// Description is the signature name for infected content
+	Description string
+	// ScanTime is the time clamd spent scanning, in seconds
+	ScanTime float64
+	// Action is what the server's Policy does with the result: "allow",
+	// "warn" or "block". Only blocked detections should be rejected.
+	Action string
+	Policy string
+	// Override is set when the server's allowlist cleared a detection;
+	// Status is then StatusClean
+	Override *Override
+	// Engines holds each engine's verdict when the server scans with
+	// several engines
+	Engines []EngineVerdict
+	// Matches are the rules the server's rules engine matched
+	Matches []RuleMatch
+	// Reputation is set when a server hash list decided the verdict
+	// without scanning
+	Reputation *Reputation
+}
+
+// Reputation is the server hash list entry matching a payload's SHA-256
+// or MD5. Action is "block" for a blocklist, whose name is then the
+// Description, or "allow" for an allowlist.
+type Reputation struct {
+	List   string `json:"list"`
+	Action string `json:"action"`
+	Hash   string `json:"hash"`
+	Label  string `json:"label"`
+}
+
+// RuleMatch is a rule of the server's rules engine that matched, with
+// its tags
+type RuleMatch struct {
+	Rule string   `json:"rule"`
+	Tags []string `json:"tags"`
+}
+
+// EngineVerdict is one server scan engine's verdict. Status is
+// StatusClean, StatusInfected or "ERROR".
+type EngineVerdict struct {
+	Engine      string  `json:"engine"`
+	Status      string  `json:"status"`
+	Description string  `json:"message"`
+	ScanTime    float64 `json:"time"`
+	// Matches are the rules the engine matched
+	Matches []RuleMatch `json:"matches"`
+}
+
+// Override is the server allowlist entry that cleared a detection
+type Override struct {
+	EntryID string `json:"entry_id"`
+	// Virus is the signature clamd reported
+	Virus  string `json:"virus"`
+	Reason string `json:"reason"`
+	// ExpiresAt is zero for an entry that never expires
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Infected reports whether a signature matched
+func (r *Result) Infected() bool {
+	return r.Status == StatusInfected
+}
+
+// Blocked reports whether a signature matched and the server's policy
+// blocks it. Servers that predate policies block every detection.
+func (r *Result) Blocked() bool {
+	return r.Infected() && r.Action != "allow" && r.Action != "warn"
+}
+
+// ScanTimeoutError is returned when the server's scan timeout expired
+// before clamd finished
+type ScanTimeoutError struct {
+	Message string
+}
+
+func (e *ScanTimeoutError) Error() string {
+	return e.Message
+}
+
+// ScanEngineError is returned when clamd failed to scan the content
+type ScanEngineError struct {
+	Description string
+}
+
+func (e *ScanEngineError) Error() string {
+	return e.Description
+}
+
+// Error is a failed request that is neither a scan timeout nor an engine
+// error, such as a rejected payload. HTTPStatus is set for REST requests
+// and Code for gRPC ones.
+type Error struct {
+	HTTPStatus int
+	Code       codes.Code
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.HTTPStatus != 0 {
+		return fmt.Sprintf("HTTP %d: %s", e.HTTPStatus, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// retryableError marks failures that may succeed if the request is
+// repeated: 502 and 503 responses, UNAVAILABLE and connection failures
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// payload is the content of one scan. Small payloads are held in memory
+// and seekable ones are rewound, so both can be sent again on retry.
+type payload struct {
+	data   []byte // the whole payload, when it is small
+	reader io.Reader
+	seeker io.Seeker
+	start  int64
+	size   int64 // -1 when unknown
+	sent   bool
+}
+
+// newPayload inspects r, buffering it when it is at most threshold bytes
+func newPayload(r io.Reader, threshold int64) (*payload, error) {
+	p := &payload{reader: r, size: -1}
+	if seeker, ok := r.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			p.seeker, p.start, p.size = seeker, start, end-start
+		}
+	}
+	if p.size > threshold {
+		return p, nil
+	}
+
+	// Read one byte past the threshold to learn whether it is small
+	data, err := io.ReadAll(io.LimitReader(r, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) <= threshold {
+		p.data, p.size, p.reader = data, int64(len(data)), nil
+		return p, nil
+	}
+	p.reader = io.MultiReader(bytes.NewReader(data), r)
+	return p, nil
+}
+
+// small reports whether the payload is held in memory
+func (p *payload) small() bool {
+	return p.reader == nil
+}
+
+// body returns a reader over the payload for the next attempt
+func (p *payload) body() (io.Reader, error) {
+	defer func() { p.sent = true }()
+	switch {
+	case p.small():
+		return bytes.NewReader(p.data), nil
+	case !p.sent:
+		return p.reader, nil
+	case p.seeker != nil:
+		if _, err := p.seeker.Seek(p.start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return p.reader, nil
+	}
+	return nil, errors.New("payload cannot be replayed")
+}
+
+// replayable reports whether the payload can be sent again
+func (p *payload) replayable() bool {
+	return p.small() || p.seeker != nil
+}
+
+// retrier runs requests with exponential backoff
+type retrier struct {
+	opts Options
+}
+
+// do calls fn until it succeeds, fails permanently, or retries run out
+func (r retrier) do(ctx context.Context, p *payload, fn func(body io.Reader) (*Result, error)) (*Result, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := p.body()
+		if err != nil {
+			return nil, err
+		}
+		result, err := fn(body)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var retryErr *retryableError
+		if !errors.As(err, &retryErr) {
+			return nil, err
+		}
+		if attempt >= r.opts.MaxRetries || !p.replayable() {
+			return nil, retryErr.err
+		}
+		if err := r.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps before retry number attempt+1, or until ctx is done
+func (r retrier) wait(ctx context.Context, attempt int) error {
+	delay := r.opts.RetryBackoff << attempt
+	if delay <= 0 || delay > r.opts.MaxRetryBackoff {
+		delay = r.opts.MaxRetryBackoff
+	}
+	// Half fixed, half random, so clients do not retry in lockstep
+	delay = delay/2 + rand.N(delay/2+1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// scanFile opens path and scans it with s
+func scanFile(ctx context.Context, s Scanner, path string) (*Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return s.Scan(ctx, filepath.Base(path), file)
+}
+
+// FileResult is the outcome of scanning one file with ScanMultiple
+type FileResult struct {
+	Path   string
+	Result *Result
+	Err    error
+}
+
+// ScanMultiple scans the files at paths with up to concurrency scans in
+// flight. Results are returned in the order of paths; a failure of one
+// file is reported in its FileResult and does not stop the others.
+func ScanMultiple(ctx context.Context, s Scanner, paths []string, concurrency int) []FileResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]FileResult, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result, err := s.ScanFile(ctx, paths[i])
+				results[i] = FileResult{Path: paths[i], Result: result, Err: err}
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,581 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var fastRetries = &Options{RetryBackoff: time.Millisecond, MaxRetryBackoff: 5 * time.Millisecond}
+
+// verdict mirrors the server's fake scans: payloads containing "EICAR"
+// are infected
+func verdict(data []byte) (string, string) {
+	if bytes.Contains(data, []byte("EICAR")) {
+		return StatusInfected, "Eicar-Test-Signature"
+	}
+	return StatusClean, ""
+}
+
+// fakeREST serves /api/stream-scan and /api/scan. failures lists error
+// responses returned, in order, before scans succeed.
+type fakeREST struct {
+	mu        sync.Mutex
+	failures  []int
+	requests  []string
+	bodies    [][]byte
+	lengths   []int64
+	apiKeys   []string
+	action    string
+	responses map[int]string
+}
+
+func (f *fakeREST) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	scan := func(w http.ResponseWriter, r *http.Request, data []byte) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.URL.Path)
+		f.bodies = append(f.bodies, data)
+		f.lengths = append(f.lengths, r.ContentLength)
+		f.apiKeys = append(f.apiKeys, r.Header.Get("X-API-Key"))
+		var code int
+		if len(f.failures) > 0 {
+			code, f.failures = f.failures[0], f.failures[1:]
+		}
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if code != 0 {
+			w.WriteHeader(code)
+			body, ok := f.responses[code]
+			if !ok {
+				body = `{"message":"failed"}`
+			}
+			io.WriteString(w, body)
+			return
+		}
+		scanStatus, message := verdict(data)
+		json.NewEncoder(w).Encode(map[string]any{"status": scanStatus, "message": message, "time": 0.01, "action": f.action, "policy": "test"})
+	}
+	mux.HandleFunc("POST /api/stream-scan", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		scan(w, r, data)
+	})
+	mux.HandleFunc("POST /api/scan", func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		scan(w, r, data)
+	})
+	mux.HandleFunc("GET /api/health-check", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"message":"ok"}`)
+	})
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"version":"1.2.3","commit":"abc","build":"today"}`)
+	})
+	return mux
+}
+
+func newFakeREST(t *testing.T, f *fakeREST, opts *Options) *RESTScanner {
+	t.Helper()
+	server := httptest.NewServer(f.handler(t))
+	t.Cleanup(server.Close)
+	scanner, err := NewRESTScanner(server.URL, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { scanner.Close() })
+	return scanner
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sample.bin")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestRESTScan(t *testing.T) {
+	f := &fakeREST{}
+	scanner := newFakeREST(t, f, nil)
+
+	result, err := scanner.Scan(context.Background(), "clean.txt", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusClean, result.Status)
+	assert.False(t, result.Infected())
+
+	result, err = scanner.ScanFile(context.Background(), writeFile(t, "X5O EICAR"))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+	assert.Equal(t, "Eicar-Test-Signature", result.Description)
+
+	assert.Equal(t, []string{"/api/stream-scan", "/api/stream-scan"}, f.requests)
+	assert.Equal(t, []int64{5, 9}, f.lengths)
+}
+
+func TestRESTSendsAPIKey(t *testing.T) {
+	f := &fakeREST{action: "allow"}
+	scanner := newFakeREST(t, f, &Options{APIKey: "team-secret"})
+
+	result, err := scanner.Scan(context.Background(), "tool.exe", strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+	assert.False(t, result.Blocked())
+	assert.Equal(t, "allow", result.Action)
+	assert.Equal(t, "test", result.Policy)
+	assert.Equal(t, []string{"team-secret"}, f.apiKeys)
+
+	// Servers without policies report no action, and detections block
+	assert.True(t, (&Result{Status: StatusInfected}).Blocked())
+}
+
+func TestRESTScanLargePayloads(t *testing.T) {
+	f := &fakeREST{}
+	scanner := newFakeREST(t, f, &Options{StreamThreshold: 16})
+	content := strings.Repeat("x", 100) + "EICAR"
+
+	// A file has a known size and is streamed as is
+	result, err := scanner.ScanFile(context.Background(), writeFile(t, content))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+
+	// A plain reader of unknown size falls back to a multipart upload
+	result, err = scanner.Scan(context.Background(), "pipe", io.MultiReader(strings.NewReader(content)))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+
+	assert.Equal(t, []string{"/api/stream-scan", "/api/scan"}, f.requests)
+	assert.Equal(t, content, string(f.bodies[0]))
+	assert.Equal(t, content, string(f.bodies[1]))
+	assert.Equal(t, int64(len(content)), f.lengths[0])
+}
+
+func TestRESTScanEmpty(t *testing.T) {
+	f := &fakeREST{}
+	scanner := newFakeREST(t, f, nil)
+
+	result, err := scanner.Scan(context.Background(), "empty", strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, StatusClean, result.Status)
+	assert.Equal(t, "test", result.Policy, "the server decides on empty content")
+	assert.Equal(t, []string{"/api/scan"}, f.requests)
+	assert.Empty(t, f.bodies[0])
+
+	result, err = scanner.ScanFile(context.Background(), writeFile(t, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "test", result.Policy)
+	assert.Equal(t, []string{"/api/scan", "/api/scan"}, f.requests)
+}
+
+func TestGRPCScanEmpty(t *testing.T) {
+	f := &fakeGRPC{}
+	scanner := newFakeGRPC(t, f, nil)
+
+	result, err := scanner.ScanFile(context.Background(), writeFile(t, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "test", result.Policy, "the server decides on empty content")
+	assert.Equal(t, 0, f.unary)
+	assert.Equal(t, 1, f.streams)
+}
+
+func TestRESTRetries(t *testing.T) {
+	t.Run("retries 502 and 503 then succeeds", func(t *testing.T) {
+		f := &fakeREST{failures: []int{503, 502}}
+		scanner := newFakeREST(t, f, fastRetries)
+
+		// Retrying a file rewinds it so every attempt sends the same bytes
+		path := writeFile(t, strings.Repeat("y", DefaultStreamThreshold+1))
+		result, err := scanner.ScanFile(context.Background(), path)
+		require.NoError(t, err)
+		assert.Equal(t, StatusClean, result.Status)
+		require.Len(t, f.bodies, 3)
+		for _, body := range f.bodies {
+			assert.Len(t, body, DefaultStreamThreshold+1)
+		}
+	})
+
+	t.Run("gives up after MaxRetries", func(t *testing.T) {
+		f := &fakeREST{
+			failures:  []int{502, 502, 502, 502},
+			responses: map[int]string{502: `{"status":"Clamd service down","message":"connection refused"}`},
+		}
+		scanner := newFakeREST(t, f, &Options{MaxRetries: 1, RetryBackoff: time.Millisecond})
+
+		_, err := scanner.Scan(context.Background(), "", strings.NewReader("data"))
+		var engineErr *ScanEngineError
+		require.ErrorAs(t, err, &engineErr)
+		assert.Equal(t, "connection refused", engineErr.Description)
+		assert.Len(t, f.requests, 2)
+	})
+
+	t.Run("does not retry a stream it cannot replay", func(t *testing.T) {
+		f := &fakeREST{failures: []int{503}}
+		scanner := newFakeREST(t, f, &Options{StreamThreshold: 4, RetryBackoff: time.Millisecond})
+
+		_, err := scanner.Scan(context.Background(), "", io.MultiReader(strings.NewReader("streamed data")))
+		var apiErr *Error
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusServiceUnavailable, apiErr.HTTPStatus)
+		assert.Len(t, f.requests, 1)
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		f := &fakeREST{failures: []int{413}}
+		scanner := newFakeREST(t, f, fastRetries)
+
+		_, err := scanner.Scan(context.Background(), "", strings.NewReader("data"))
+		var apiErr *Error
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.HTTPStatus)
+		assert.Len(t, f.requests, 1)
+	})
+
+	t.Run("retries connection failures", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		scanner, err := NewRESTScanner(server.URL, fastRetries)
+		require.NoError(t, err)
+
+		_, err = scanner.Scan(context.Background(), "", strings.NewReader("data"))
+		require.Error(t, err)
+		assert.NotErrorAs(t, err, new(*retryableError), "the retry marker is not exposed")
+	})
+}
+
+func TestRESTTypedErrors(t *testing.T) {
+	f := &fakeREST{
+		failures:  []int{504},
+		responses: map[int]string{504: `{"status":"Scan timeout","message":"scan operation timed out after 300 seconds"}`},
+	}
+	scanner := newFakeREST(t, f, fastRetries)
+
+	_, err := scanner.Scan(context.Background(), "", strings.NewReader("data"))
+	var timeoutErr *ScanTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "scan operation timed out after 300 seconds", timeoutErr.Error())
+	assert.Len(t, f.requests, 1, "scan timeouts are not retried")
+}
+
+func TestRESTContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	scanner, err := NewRESTScanner(server.URL, fastRetries)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = scanner.Scan(ctx, "", strings.NewReader("data"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRESTHealthAndVersion(t *testing.T) {
+	scanner := newFakeREST(t, &fakeREST{}, nil)
+
+	message, err := scanner.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", message)
+
+	version, err := scanner.Version(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", version["version"])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, `{"message":"Clamd service unavailable"}`)
+	}))
+	t.Cleanup(server.Close)
+	unhealthy, err := NewRESTScanner(server.URL, nil)
+	require.NoError(t, err)
+	message, err = unhealthy.Health(context.Background())
+	assert.ErrorIs(t, err, ErrUnhealthy)
+	assert.Equal(t, "Clamd service unavailable", message)
+}
+
+func TestNewRESTScannerRejectsBadURL(t *testing.T) {
+	_, err := NewRESTScanner("localhost:6000", nil)
+	assert.Error(t, err)
+}
+
+// fakeGRPC answers scans, failing the first calls with failures
+type fakeGRPC struct {
+	pb.UnimplementedClamAVScannerServer
+	mu       sync.Mutex
+	failures []error
+	unary    int
+	streams  int
+	chunks   int
+	healthy  bool
+	apiKeys  []string
+	action   string
+}
+
+func (f *fakeGRPC) next() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failures) == 0 {
+		return nil
+	}
+	err := f.failures[0]
+	f.failures = f.failures[1:]
+	return err
+}
+
+func (f *fakeGRPC) respond(data []byte, filename string) (*pb.ScanResponse, error) {
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	scanStatus, message := verdict(data)
+	return &pb.ScanResponse{Status: scanStatus, Message: message, ScanTime: 0.01, Filename: filename, Action: f.action, Policy: "test"}, nil
+}
+
+// recordAPIKey notes the API key a call was made with
+func (f *fakeGRPC) recordAPIKey(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apiKeys = append(f.apiKeys, strings.Join(md.Get("x-api-key"), ","))
+}
+
+func (f *fakeGRPC) HealthCheck(ctx context.Context, req *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	if !f.healthy {
+		return &pb.HealthCheckResponse{Status: "unhealthy", Message: "ClamAV service unavailable"}, nil
+	}
+	return &pb.HealthCheckResponse{Status: "healthy", Message: "ok"}, nil
+}
+
+func (f *fakeGRPC) ScanFile(ctx context.Context, req *pb.ScanFileRequest) (*pb.ScanResponse, error) {
+	f.recordAPIKey(ctx)
+	f.mu.Lock()
+	f.unary++
+	f.mu.Unlock()
+	return f.respond(req.Data, req.Filename)
+}
+
+func (f *fakeGRPC) ScanStream(stream pb.ClamAVScanner_ScanStreamServer) error {
+	f.recordAPIKey(stream.Context())
+	var data []byte
+	var filename string
+	chunks := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunks++
+		if req.Filename != "" {
+			filename = req.Filename
+		}
+		data = append(data, req.Chunk...)
+		if req.IsLast {
+			break
+		}
+	}
+	f.mu.Lock()
+	f.streams++
+	f.chunks += chunks
+	f.mu.Unlock()
+
+	resp, err := f.respond(data, filename)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
+func newFakeGRPC(t *testing.T, f *fakeGRPC, opts *Options) *GRPCScanner {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb.RegisterClamAVScannerServer(server, f)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	scanner, err := NewGRPCScanner(lis.Addr().String(), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { scanner.Close() })
+	return scanner
+}
+
+func TestGRPCScanChoosesStreaming(t *testing.T) {
+	f := &fakeGRPC{}
+	scanner := newFakeGRPC(t, f, &Options{StreamThreshold: 64, ChunkSize: 32})
+
+	result, err := scanner.Scan(context.Background(), "small", strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+
+	result, err = scanner.ScanFile(context.Background(), writeFile(t, strings.Repeat("z", 100)))
+	require.NoError(t, err)
+	assert.Equal(t, StatusClean, result.Status)
+
+	assert.Equal(t, 1, f.unary)
+	assert.Equal(t, 1, f.streams)
+	assert.Equal(t, 4, f.chunks, "100 bytes in 32 byte chunks")
+}
+
+func TestGRPCSendsAPIKey(t *testing.T) {
+	f := &fakeGRPC{action: "warn"}
+	scanner := newFakeGRPC(t, f, &Options{StreamThreshold: 64, APIKey: "team-secret"})
+
+	result, err := scanner.Scan(context.Background(), "small", strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	assert.True(t, result.Infected())
+	assert.False(t, result.Blocked())
+	assert.Equal(t, "warn", result.Action)
+	assert.Equal(t, "test", result.Policy)
+
+	_, err = scanner.Scan(context.Background(), "large", strings.NewReader(strings.Repeat("z", 100)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team-secret", "team-secret"}, f.apiKeys)
+}
+
+func TestGRPCRetriesUnavailable(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "clamd restarting")
+	f := &fakeGRPC{failures: []error{unavailable, unavailable}}
+	scanner := newFakeGRPC(t, f, fastRetries)
+
+	result, err := scanner.Scan(context.Background(), "", strings.NewReader("data"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusClean, result.Status)
+	assert.Equal(t, 3, f.unary)
+
+	f.failures = []error{unavailable, unavailable, unavailable}
+	_, err = scanner.Scan(context.Background(), "", strings.NewReader("data"))
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, codes.Unavailable, apiErr.Code)
+	assert.Equal(t, "Unavailable: clamd restarting", apiErr.Error())
+}
+
+func TestGRPCTypedErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		check func(t *testing.T, err error)
+	}{
+		{
+			"scan timeout",
+			status.Error(codes.DeadlineExceeded, "scan operation timed out after 300 seconds"),
+			func(t *testing.T, err error) {
+				var timeoutErr *ScanTimeoutError
+				require.ErrorAs(t, err, &timeoutErr)
+				assert.Equal(t, "scan operation timed out after 300 seconds", timeoutErr.Message)
+			},
+		},
+		{
+			"engine error",
+			status.Error(codes.Internal, "scan error: lstat() failed"),
+			func(t *testing.T, err error) {
+				var engineErr *ScanEngineError
+				require.ErrorAs(t, err, &engineErr)
+				assert.Equal(t, "lstat() failed", engineErr.Description)
+			},
+		},
+		{
+			"rejected payload",
+			status.Error(codes.InvalidArgument, "file too large, maximum size is 10 bytes"),
+			func(t *testing.T, err error) {
+				var apiErr *Error
+				require.ErrorAs(t, err, &apiErr)
+				assert.Equal(t, codes.InvalidArgument, apiErr.Code)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeGRPC{failures: []error{tt.err}}
+			scanner := newFakeGRPC(t, f, fastRetries)
+			_, err := scanner.Scan(context.Background(), "", strings.NewReader("data"))
+			tt.check(t, err)
+			assert.Equal(t, 1, f.unary, "not retried")
+		})
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	scanner := newFakeGRPC(t, &fakeGRPC{healthy: true}, nil)
+	message, err := scanner.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", message)
+
+	scanner = newFakeGRPC(t, &fakeGRPC{}, nil)
+	message, err = scanner.Health(context.Background())
+	assert.True(t, errors.Is(err, ErrUnhealthy))
+	assert.Equal(t, "ClamAV service unavailable", message)
+}
+
+func TestScanMultiple(t *testing.T) {
+	f := &fakeREST{}
+	scanner := newFakeREST(t, f, nil)
+	dir := t.TempDir()
+	var paths []string
+	for i, content := range []string{"a", "EICAR", "c", "d", "EICAR"} {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		paths = append(paths, path)
+	}
+	paths = append(paths, filepath.Join(dir, "missing"))
+
+	var inFlight, peak atomic.Int32
+	counting := &countingScanner{Scanner: scanner, inFlight: &inFlight, peak: &peak}
+	results := ScanMultiple(context.Background(), counting, paths, 2)
+
+	require.Len(t, results, len(paths))
+	for i, r := range results {
+		assert.Equal(t, paths[i], r.Path)
+	}
+	assert.False(t, results[0].Result.Infected())
+	assert.True(t, results[1].Result.Infected())
+	assert.True(t, results[4].Result.Infected())
+	assert.ErrorIs(t, results[5].Err, os.ErrNotExist)
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+// countingScanner records the peak number of concurrent scans
+type countingScanner struct {
+	Scanner
+	inFlight *atomic.Int32
+	peak     *atomic.Int32
+}
+
+func (c *countingScanner) ScanFile(ctx context.Context, path string) (*Result, error) {
+	n := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return c.Scanner.ScanFile(ctx, path)
+}
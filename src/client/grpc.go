@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCScanner scans over the gRPC API. Payloads up to StreamThreshold are
+// sent with ScanFile and larger ones in chunks with ScanStream.
+type GRPCScanner struct {
+	conn   *grpc.ClientConn
+	client pb.ClamAVScannerClient
+	opts   Options
+	retry  retrier
+}
+
+// NewGRPCScanner creates a scanner for the server at target, such as
+// "localhost:9000". Without dialOpts the connection is plaintext; pass
+// grpc.WithTransportCredentials to use TLS. opts may be nil.
+func NewGRPCScanner(target string, opts *Options, dialOpts ...grpc.DialOption) (*GRPCScanner, error) {
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	o := opts.withDefaults()
+	if o.APIKey != "" {
+		dialOpts = append(dialOpts[:len(dialOpts):len(dialOpts)],
+			grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+				return invoker(withAPIKey(ctx, o.APIKey), method, req, reply, cc, callOpts...)
+			}),
+			grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return streamer(withAPIKey(ctx, o.APIKey), desc, cc, method, callOpts...)
+			}))
+	}
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gRPC server %q: %w", target, err)
+	}
+	return &GRPCScanner{
+		conn:   conn,
+		client: pb.NewClamAVScannerClient(conn),
+		opts:   o,
+		retry:  retrier{opts: o},
+	}, nil
+}
+
+// Scan implements Scanner
+func (s *GRPCScanner) Scan(ctx context.Context, name string, r io.Reader) (*Result, error) {
+	p, err := newPayload(r, s.opts.StreamThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return s.retry.do(ctx, p, func(body io.Reader) (*Result, error) {
+		// ScanFile needs data, so empty content is streamed. The server
+		// still decides: its hash lists, rules and policy apply to empty
+		// files too.
+		if p.small() && len(p.data) > 0 {
+			resp, err := s.client.ScanFile(ctx, &pb.ScanFileRequest{Data: p.data, Filename: name})
+			if err != nil {
+				return nil, grpcError(ctx, err)
+			}
+			return resultFromProto(resp), nil
+		}
+		return s.scanStream(ctx, name, body)
+	})
+}
+
+// scanStream sends body in ChunkSize chunks with ScanStream
+func (s *GRPCScanner) scanStream(ctx context.Context, name string, body io.Reader) (*Result, error) {
+	stream, err := s.client.ScanStream(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	buf := make([]byte, s.opts.ChunkSize)
+	first := true
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			stream.CloseSend()
+			return nil, readErr
+		}
+		last := readErr != nil
+		req := &pb.ScanStreamRequest{Chunk: buf[:n], IsLast: last}
+		if first {
+			req.Filename = name
+			first = false
+		}
+		// A send error means the server closed the stream; the real
+		// status is reported by CloseAndRecv
+		if err := stream.Send(req); err != nil || last {
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return resultFromProto(resp), nil
+}
+
+// ScanFile implements Scanner
+func (s *GRPCScanner) ScanFile(ctx context.Context, path string) (*Result, error) {
+	return scanFile(ctx, s, path)
+}
+
+// Health implements Scanner
+func (s *GRPCScanner) Health(ctx context.Context) (string, error) {
+	resp, err := s.client.HealthCheck(ctx, &pb.HealthCheckRequest{})
+	if err != nil {
+		return "", unwrapRetryable(grpcError(ctx, err))
+	}
+	if resp.Status != "healthy" {
+		return resp.Message, fmt.Errorf("%w: %s", ErrUnhealthy, resp.Message)
+	}
+	return resp.Message, nil
+}
+
+// Close implements Scanner
+func (s *GRPCScanner) Close() error {
+	return s.conn.Close()
+}
+
+func resultFromProto(resp *pb.ScanResponse) *Result {
+	result := &Result{Status: resp.Status, Description: resp.Message, ScanTime: resp.ScanTime, Action: resp.Action, Policy: resp.Policy}
+	if o := resp.Override; o != nil {
+		result.Override = &Override{EntryID: o.EntryId, Virus: o.Virus, Reason: o.Reason}
+		result.Override.ExpiresAt, _ = time.Parse(time.RFC3339, o.ExpiresAt)
+	}
+	for _, v := range resp.Engines {
+		result.Engines = append(result.Engines, EngineVerdict{Engine: v.Engine, Status: v.Status, Description: v.Message, ScanTime: v.ScanTime, Matches: matchesFromProto(v.Matches)})
+	}
+	result.Matches = matchesFromProto(resp.Matches)
+	if h := resp.Reputation; h != nil {
+		result.Reputation = &Reputation{List: h.List, Action: h.Action, Hash: h.Hash, Label: h.Label}
+	}
+	return result
+}
+
+func matchesFromProto(matches []*pb.RuleMatch) []RuleMatch {
+	var result []RuleMatch
+	for _, m := range matches {
+		result = append(result, RuleMatch{Rule: m.Rule, Tags: m.Tags})
+	}
+	return result
+}
+
+// withAPIKey adds the API key selecting the caller's scan policy to the
+// outgoing metadata
+func withAPIKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+}
+
+// grpcError maps a status error to the matching typed error, mirroring how
+// the server's mapScanErrorToGRPC produced it
+func grpcError(ctx context.Context, err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Canceled, codes.DeadlineExceeded:
+		// The caller's own deadline or cancellation, not the server's
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if st.Code() == codes.Canceled {
+			return context.Canceled
+		}
+		return &ScanTimeoutError{Message: st.Message()}
+	case codes.Internal:
+		if description, ok := strings.CutPrefix(st.Message(), "scan error: "); ok {
+			return &ScanEngineError{Description: description}
+		}
+	case codes.Unavailable:
+		return &retryableError{err: &Error{Code: st.Code(), Message: st.Message()}}
+	}
+	return &Error{Code: st.Code(), Message: st.Message()}
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RESTScanner scans over the REST API. Payloads of known size are streamed
+// to /api/stream-scan; large payloads of unknown size are uploaded to
+// /api/scan as a chunked multipart body.
+type RESTScanner struct {
+	base  string
+	http  *http.Client
+	opts  Options
+	retry retrier
+}
+
+// NewRESTScanner creates a scanner for the server at baseURL, such as
+// "http://localhost:6000". opts may be nil.
+func NewRESTScanner(baseURL string, opts *Options) (*RESTScanner, error) {
+	return NewRESTScannerWithClient(baseURL, nil, opts)
+}
+
+// NewRESTScannerWithClient is NewRESTScanner with a caller-provided HTTP
+// client, for custom TLS or proxy settings
+func NewRESTScannerWithClient(baseURL string, httpClient *http.Client, opts *Options) (*RESTScanner, error) {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("REST server must be an http or https URL, got %q", baseURL)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	o := opts.withDefaults()
+	return &RESTScanner{
+		base:  strings.TrimSuffix(baseURL, "/"),
+		http:  httpClient,
+		opts:  o,
+		retry: retrier{opts: o},
+	}, nil
+}
+
+// Scan implements Scanner
+func (s *RESTScanner) Scan(ctx context.Context, name string, r io.Reader) (*Result, error) {
+	p, err := newPayload(r, s.opts.StreamThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return s.retry.do(ctx, p, func(body io.Reader) (*Result, error) {
+		// /api/stream-scan needs a body, so empty content is uploaded as
+		// a form like content of unknown size. The server still decides:
+		// its hash lists, rules and policy apply to empty files too.
+		if p.size <= 0 {
+			return s.scanMultipart(ctx, name, body)
+		}
+		// The transport closes the body, possibly after Do returns. A file
+		// must stay open for retries and must not be read by a finished
+		// attempt after it is rewound, so wait for that close instead.
+		tracked := &trackedBody{Reader: body, closed: make(chan struct{})}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/api/stream-scan", tracked)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = p.size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		result, err := s.doScan(req)
+		if err != nil {
+			<-tracked.closed
+		}
+		return result, err
+	})
+}
+
+// trackedBody is a request body whose Close only records that the
+// transport is done with it
+type trackedBody struct {
+	io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// scanMultipart uploads body to /api/scan without knowing its size
+func (s *RESTScanner) scanMultipart(ctx context.Context, name string, body io.Reader) (*Result, error) {
+	if name == "" {
+		name = "stream"
+	}
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, body)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/api/scan", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	result, err := s.doScan(req)
+	// Unblock the writer if the request ended before consuming the body
+	pr.CloseWithError(errors.New("request finished"))
+	return result, err
+}
+
+// ScanFile implements Scanner
+func (s *RESTScanner) ScanFile(ctx context.Context, path string) (*Result, error) {
+	return scanFile(ctx, s, path)
+}
+
+// Health implements Scanner
+func (s *RESTScanner) Health(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/api/health-check", nil)
+	if err != nil {
+		return "", err
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	err = s.do(req, &body)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.HTTPStatus == http.StatusBadGateway {
+		return apiErr.Message, fmt.Errorf("%w: %s", ErrUnhealthy, apiErr.Message)
+	}
+	if err != nil {
+		return "", unwrapRetryable(err)
+	}
+	return body.Message, nil
+}
+
+// Version returns the server's build information: its version, commit and
+// build time. It is only available over REST.
+func (s *RESTScanner) Version(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/api/version", nil)
+	if err != nil {
+		return nil, err
+	}
+	version := make(map[string]string)
+	if err := s.do(req, &version); err != nil {
+		return nil, unwrapRetryable(err)
+	}
+	return version, nil
+}
+
+// Close implements Scanner
+func (s *RESTScanner) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+// doScan sends a scan request and maps the response to a result or a
+// typed error
+func (s *RESTScanner) doScan(req *http.Request) (*Result, error) {
+	var body struct {
+		Status     string          `json:"status"`
+		Message    string          `json:"message"`
+		Time       float64         `json:"time"`
+		Action     string          `json:"action"`
+		Policy     string          `json:"policy"`
+		Override   *Override       `json:"override"`
+		Engines    []EngineVerdict `json:"engines"`
+		Matches    []RuleMatch     `json:"matches"`
+		Reputation *Reputation     `json:"reputation"`
+	}
+	if err := s.do(req, &body); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Status:      body.Status,
+		Description: body.Message,
+		ScanTime:    body.Time,
+		Action:      body.Action,
+		Policy:      body.Policy,
+		Override:    body.Override,
+		Engines:     body.Engines,
+		Matches:     body.Matches,
+		Reputation:  body.Reputation,
+	}, nil
+}
+
+// do sends req and decodes a 200 JSON response into out. Failures worth
+// retrying are wrapped in retryableError.
+func (s *RESTScanner) do(req *http.Request, out any) error {
+	if s.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", s.opts.APIKey)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return req.Context().Err()
+		}
+		return &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return restError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response from server: %w", err)
+	}
+	return nil
+}
+
+// restError maps an error response to the matching typed error, mirroring
+// how the server's respondScanError produced it
+func restError(statusCode int, data []byte) error {
+	var body struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+
+	switch {
+	case statusCode == http.StatusGatewayTimeout && body.Status == "Scan timeout":
+		return &ScanTimeoutError{Message: body.Message}
+	case statusCode == http.StatusBadGateway && body.Status == "Clamd service down":
+		return &retryableError{err: &ScanEngineError{Description: body.Message}}
+	}
+	err := &Error{HTTPStatus: statusCode, Message: body.Message}
+	if statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable {
+		return &retryableError{err: err}
+	}
+	return err
+}
+
+// unwrapRetryable drops the retry marker from errors returned to callers
+func unwrapRetryable(err error) error {
+	var retryErr *retryableError
+	if errors.As(err, &retryErr) {
+		return retryErr.err
+	}
+	return err
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,14 +24,129 @@ var (
 
 // Config holds the application configuration
 type Config struct {
-	Debug            bool
-	ClamdUnixSocket  string
-	MaxContentLength int64
-	Host             string
-	Port             string
-	GRPCPort         string
-	ScanTimeout      time.Duration
-	EnableGRPC       bool
+	// ConfigFile is the YAML or TOML file the settings were read from
+	ConfigFile string
+
+	Debug               bool
+	ClamdUnixSocket     string
+	MaxContentLength    int64
+	Host                string
+	Port                string
+	GRPCPort            string
+	ScanTimeout         time.Duration
+	ShutdownTimeout     time.Duration
+	DrainDelay          time.Duration
+	DrainTimeout        time.Duration
+	ScanDurationBuckets []float64
+	EnableGRPC          bool
+
+	// Buffering of payloads that must be held before scanning: those over
+	// SpoolThreshold, or over what remains of MemoryBudget, go to SpoolDir
+	SpoolThreshold int64
+	SpoolDir       string
+	MemoryBudget   int64
+
+	// Policies map detections to allow, warn or block actions per API key.
+	// They are read from PolicyFile; nil blocks every detection.
+	PolicyFile string
+	Policies   *PolicySet
+
+	// AllowlistFile keeps the false-positive allowlist across restarts
+	AllowlistFile string
+
+	// SignatureDir is clamd's database directory, where custom signatures
+	// uploaded through the admin API are installed
+	SignatureDir string
+
+	// Engines scan every payload; with more than one, EngineMode runs them
+	// in parallel or in sequence and EngineStrategy combines their verdicts
+	Engines        []string
+	EngineMode     string
+	EngineStrategy string
+	// Rules are what the rules engine matches payloads against. They are
+	// read from RuleFiles, each a path or a glob.
+	RuleFiles []string
+	Rules     *RuleSet
+
+	// Hash lists decide a payload's verdict by its SHA-256 or MD5 before
+	// the engines: a blocklisted hash is FOUND, an allowlisted one clean.
+	// The files are checked for changes every HashListInterval.
+	HashBlocklists   []string
+	HashAllowlists   []string
+	HashListInterval time.Duration
+
+	// Log output and the admin API
+	LogFormat     string
+	LogFile       string
+	LogMaxSize    int64 // megabytes
+	LogMaxBackups int
+	LogMaxAge     time.Duration
+	AdminToken    string
+
+	// OpenTelemetry tracing (exported when OTLPEndpoint is set)
+	OTLPEndpoint     string
+	OTLPInsecure     bool
+	TraceSampleRatio float64
+
+	// Background health prober behind /readyz and grpc.health.v1
+	HealthProbeInterval    time.Duration
+	HealthFailureThreshold int
+	HealthSuccessThreshold int
+	HealthMaxSignatureAge  time.Duration
+	HealthMaxScans         int
+
+	// Milter listener for MTA integration
+	EnableMilter         bool
+	MilterPort           string
+	MilterInfectedAction string
+	MilterErrorAction    string
+	MilterOversizeAction string
+	MilterAddHeader      bool
+	// MilterIdleTimeout bounds the wait for the MTA's next command, which
+	// may come after a slow SMTP client; scans keep ScanTimeout
+	MilterIdleTimeout time.Duration
+
+	// Upload-gateway reverse proxy (enabled when ProxyUpstream is set)
+	ProxyUpstream       string
+	ProxyPort           string
+	ProxyRoutes         []string
+	ProxyRejectStatus   int
+	ProxySpillThreshold int64
+	ProxyTempDir        string
+
+	// clamd-protocol listener for clamdscan-compatible clients
+	EnableClamdListener bool
+	ClamdListenerPort   string
+	ClamdAllowedNets    []string
+
+	// Watch-folder mode (enabled when WatchDirs is set)
+	WatchDirs         []string
+	WatchCleanDir     string
+	WatchInfectedDir  string
+	WatchSidecar      bool
+	WatchSettle       time.Duration
+	WatchPollInterval time.Duration
+	WatchUsePolling   bool
+
+	// S3-compatible object storage integration (enabled when S3Endpoint is set)
+	S3Endpoint         string
+	S3Region           string
+	S3AccessKey        string
+	S3SecretKey        string
+	S3PathStyle        bool
+	S3VerdictMode      string
+	S3QuarantineBucket string
+	S3WebhookToken     string
+	// S3AllowedBuckets are the only buckets the API and the event webhook
+	// may scan and write verdicts to
+	S3AllowedBuckets []string
+
+	// Scan-by-URL endpoint
+	EnableURLScan       bool
+	URLScanSchemes      []string
+	URLScanAllowedHosts []string
+	URLScanMaxRedirects int
+	URLScanFetchTimeout time.Duration
 }
 
 // getEnvWithDefault gets an environment variable or returns the default value
@@ -52,6 +169,23 @@ func getEnvBoolWithDefault(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// isValidPort reports whether port is a valid TCP port number
+func isValidPort(port string) bool {
+	portNum, err := strconv.Atoi(port)
+	return err == nil && portNum >= 1 && portNum <= 65535
+}
+
 // getEnvInt64WithDefault gets an int64 environment variable or returns the default value
 func getEnvInt64WithDefault(key string, defaultValue int64) int64 {
 	if value, exists := os.LookupEnv(key); exists {
@@ -64,63 +198,500 @@ func getEnvInt64WithDefault(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
-var config = Config{
-	Debug:            false,
-	ClamdUnixSocket:  getEnvWithDefault("CLAMAV_SOCKET", "/run/clamav/clamd.ctl"),
-	MaxContentLength: 209715200, // 200MB
-	Host:             "0.0.0.0",
-	Port:             "6000",
-	GRPCPort:         "9000",
-	ScanTimeout:      300 * time.Second, // 5 minutes
-	EnableGRPC:       true,
+// defaultConfig returns the built-in defaults, the lowest precedence level
+func defaultConfig() Config {
+	return Config{
+		Debug:               false,
+		ClamdUnixSocket:     "/run/clamav/clamd.ctl",
+		MaxContentLength:    209715200, // 200MB
+		Host:                "0.0.0.0",
+		Port:                "6000",
+		GRPCPort:            "9000",
+		ScanTimeout:         300 * time.Second, // 5 minutes
+		ShutdownTimeout:     30 * time.Second,
+		DrainDelay:          0,
+		DrainTimeout:        30 * time.Second,
+		ScanDurationBuckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		EnableGRPC:          true,
+
+		SpoolThreshold: 10485760, // 10MB
+		SpoolDir:       "",
+		MemoryBudget:   536870912, // 512MB
+
+		SignatureDir: "/var/lib/clamav",
+
+		Engines:        []string{engineClamd},
+		EngineMode:     engineModeParallel,
+		EngineStrategy: engineStrategyAny,
+
+		HashListInterval: 30 * time.Second,
+
+		LogFormat:     logFormatConsole,
+		LogMaxSize:    100,
+		LogMaxBackups: 5,
+
+		TraceSampleRatio: 1,
+
+		HealthProbeInterval:    5 * time.Second,
+		HealthFailureThreshold: 3,
+		HealthSuccessThreshold: 1,
+		HealthMaxSignatureAge:  0,
+		HealthMaxScans:         0,
+
+		EnableMilter:         false,
+		MilterPort:           "7357",
+		MilterInfectedAction: milterActionReject,
+		MilterErrorAction:    milterActionTempfail,
+		MilterOversizeAction: milterActionReject,
+		MilterAddHeader:      true,
+		MilterIdleTimeout:    10 * time.Minute,
+
+		ProxyUpstream:       "",
+		ProxyPort:           "8080",
+		ProxyRoutes:         []string{"/"},
+		ProxyRejectStatus:   403,
+		ProxySpillThreshold: 10485760, // 10MB
+		ProxyTempDir:        "",
+
+		EnableClamdListener: false,
+		ClamdListenerPort:   "3310",
+		ClamdAllowedNets:    []string{"127.0.0.0/8", "::1/128"},
+
+		WatchDirs:         nil,
+		WatchSidecar:      false,
+		WatchSettle:       5 * time.Second,
+		WatchPollInterval: 10 * time.Second,
+		WatchUsePolling:   false,
+
+		S3Endpoint:    "",
+		S3Region:      "us-east-1",
+		S3PathStyle:   true,
+		S3VerdictMode: s3VerdictTags,
+
+		EnableURLScan:       false,
+		URLScanSchemes:      []string{"https"},
+		URLScanAllowedHosts: nil,
+		URLScanMaxRedirects: 3,
+		URLScanFetchTimeout: 60 * time.Second,
+	}
 }
 
-func parseConfig() {
+var config = func() Config {
+	cfg := defaultConfig()
+	cfg.ClamdUnixSocket = getEnvWithDefault("CLAMAV_SOCKET", cfg.ClamdUnixSocket)
+	return cfg
+}()
+
+// formatBuckets formats histogram buckets as a comma-separated list
+func formatBuckets(buckets []float64) string {
+	items := make([]string, len(buckets))
+	for i, b := range buckets {
+		items[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return strings.Join(items, ",")
+}
+
+// parseBuckets parses a comma-separated list of histogram buckets
+func parseBuckets(value string) ([]float64, error) {
+	var buckets []float64
+	for _, item := range splitList(value) {
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("scan duration buckets must be numbers, got %q", item)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// loadConfig registers the configuration flags on fs, parses args and
+// resolves every setting with the precedence flag > env > config file >
+// default. The config file is named by -config or CLAMAV_CONFIG.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+
 	// Command line flags
-	debug := flag.Bool("debug", config.Debug, "Enable debug mode")
-	socket := flag.String("socket", config.ClamdUnixSocket, "ClamAV Unix socket path")
-	maxSize := flag.Int64("max-size", config.MaxContentLength, "Maximum file size in bytes")
-	host := flag.String("host", config.Host, "Host to listen on")
-	port := flag.String("port", config.Port, "Port to listen on")
-	grpcPort := flag.String("grpc-port", config.GRPCPort, "gRPC server port")
-	scanTimeout := flag.Int64("scan-timeout", int64(config.ScanTimeout.Seconds()), "Scan timeout in seconds")
-	enableGRPC := flag.Bool("enable-grpc", config.EnableGRPC, "Enable gRPC server")
-
-	// Parse flags
-	flag.Parse()
-
-	// Update config with environment variables or flags
-	config.Debug = getEnvBoolWithDefault("CLAMAV_DEBUG", *debug)
-	config.ClamdUnixSocket = getEnvWithDefault("CLAMAV_SOCKET", *socket)
-	config.MaxContentLength = getEnvInt64WithDefault("CLAMAV_MAX_SIZE", *maxSize)
-	config.Host = getEnvWithDefault("CLAMAV_HOST", *host)
-	config.Port = getEnvWithDefault("CLAMAV_PORT", *port)
-	config.GRPCPort = getEnvWithDefault("CLAMAV_GRPC_PORT", *grpcPort)
-	config.EnableGRPC = getEnvBoolWithDefault("CLAMAV_ENABLE_GRPC", *enableGRPC)
-	timeoutSeconds := getEnvInt64WithDefault("CLAMAV_SCAN_TIMEOUT", *scanTimeout)
-	config.ScanTimeout = time.Duration(timeoutSeconds) * time.Second
-
-	// Validate configuration values
-	if config.ScanTimeout <= 0 {
-		fmt.Fprintf(os.Stderr, "FATAL: scan timeout must be > 0, got %v\n", config.ScanTimeout)
-		os.Exit(1)
+	configFile := fs.String("config", "", "Path to a YAML or TOML config file (.yaml, .yml or .toml)")
+	debug := fs.Bool("debug", cfg.Debug, "Enable debug mode")
+	socket := fs.String("socket", cfg.ClamdUnixSocket, "ClamAV Unix socket path")
+	maxSize := fs.Int64("max-size", cfg.MaxContentLength, "Maximum file size in bytes")
+	host := fs.String("host", cfg.Host, "Host to listen on")
+	port := fs.String("port", cfg.Port, "Port to listen on")
+	grpcPort := fs.String("grpc-port", cfg.GRPCPort, "gRPC server port")
+	scanTimeout := fs.Int64("scan-timeout", int64(cfg.ScanTimeout.Seconds()), "Scan timeout in seconds")
+	shutdownTimeout := fs.Int64("shutdown-timeout", int64(cfg.ShutdownTimeout.Seconds()), "Seconds allowed for in-flight requests to finish on shutdown")
+	drainDelay := fs.Int64("drain-delay", int64(cfg.DrainDelay.Seconds()), "Seconds to keep accepting scans after readiness fails on shutdown")
+	drainTimeout := fs.Int64("drain-timeout", int64(cfg.DrainTimeout.Seconds()), "Seconds to wait for in-flight scans on shutdown before canceling them")
+	scanDurationBuckets := fs.String("scan-duration-buckets", formatBuckets(cfg.ScanDurationBuckets), "Comma-separated upper bounds in seconds of the scan duration histogram buckets")
+	enableGRPC := fs.Bool("enable-grpc", cfg.EnableGRPC, "Enable gRPC server")
+	spoolThreshold := fs.Int64("spool-threshold", cfg.SpoolThreshold, "Payload bytes held in memory before spilling to disk")
+	spoolDir := fs.String("spool-dir", cfg.SpoolDir, "Private directory for payloads spilled to disk (default clamav-api-spool in the system temp dir)")
+	memoryBudget := fs.Int64("memory-budget", cfg.MemoryBudget, "Bytes all buffered payloads may hold in memory before spilling to disk (0 is unlimited)")
+	policyFile := fs.String("policy-file", cfg.PolicyFile, "YAML or TOML file of scan policies and API keys (empty blocks every detection)")
+	allowlistFile := fs.String("allowlist-file", cfg.AllowlistFile, "JSON file the false-positive allowlist is kept in (empty keeps it in memory only)")
+	signatureDir := fs.String("signature-dir", cfg.SignatureDir, "clamd database directory custom signatures are installed in (empty disables signature management)")
+	engines := fs.String("engines", strings.Join(cfg.Engines, ","), "Comma-separated scan engines every payload goes through (clamd, rules)")
+	engineMode := fs.String("engine-mode", cfg.EngineMode, "How several engines scan a payload (parallel|sequence)")
+	engineStrategy := fs.String("engine-strategy", cfg.EngineStrategy, "How several engines' verdicts combine (any|majority|first-match)")
+	ruleFiles := fs.String("rule-files", strings.Join(cfg.RuleFiles, ","), "Comma-separated YARA-style rule files or globs for the rules engine")
+	hashBlocklists := fs.String("hash-blocklists", strings.Join(cfg.HashBlocklists, ","), "Comma-separated SHA-256/MD5 hash list files whose payloads are FOUND without scanning")
+	hashAllowlists := fs.String("hash-allowlists", strings.Join(cfg.HashAllowlists, ","), "Comma-separated SHA-256/MD5 hash list files whose payloads are clean without scanning")
+	hashListInterval := fs.Int64("hash-list-interval", int64(cfg.HashListInterval.Seconds()), "Seconds between checks of the hash list files for changes")
+	logFormat := fs.String("log-format", cfg.LogFormat, "Log encoding (console|json|ecs)")
+	logFile := fs.String("log-file", cfg.LogFile, "Log file path (empty logs to stderr)")
+	logMaxSize := fs.Int64("log-max-size", cfg.LogMaxSize, "Megabytes a log file may reach before it is rotated (0 disables rotation)")
+	logMaxBackups := fs.Int64("log-max-backups", int64(cfg.LogMaxBackups), "Rotated log files to keep (0 keeps all)")
+	logMaxAge := fs.Int64("log-max-age", int64(cfg.LogMaxAge.Hours()/24), "Days to keep rotated log files (0 keeps them forever)")
+	otlpEndpoint := fs.String("otlp-endpoint", cfg.OTLPEndpoint, "OTLP/gRPC collector address for traces, such as localhost:4317 (empty disables export)")
+	otlpInsecure := fs.Bool("otlp-insecure", cfg.OTLPInsecure, "Export traces without TLS")
+	traceSampleRatio := fs.Float64("trace-sample-ratio", cfg.TraceSampleRatio, "Fraction of new traces to sample (0-1); incoming sampling decisions are kept")
+	healthProbeInterval := fs.Int64("health-probe-interval", int64(cfg.HealthProbeInterval.Seconds()), "Seconds between background clamd health probes")
+	healthFailureThreshold := fs.Int64("health-failure-threshold", int64(cfg.HealthFailureThreshold), "Consecutive failed probes before clamd is reported unreachable")
+	healthSuccessThreshold := fs.Int64("health-success-threshold", int64(cfg.HealthSuccessThreshold), "Consecutive successful probes before clamd is reported reachable again")
+	healthMaxSignatureAge := fs.Int64("health-max-signature-age", int64(cfg.HealthMaxSignatureAge.Hours()), "Hours old the signature database may be before readiness fails (0 disables the check)")
+	healthMaxScans := fs.Int64("health-max-scans", int64(cfg.HealthMaxScans), "Scans in progress at which readiness fails (0 disables the check)")
+	enableMilter := fs.Bool("enable-milter", cfg.EnableMilter, "Enable milter server for MTA integration")
+	milterPort := fs.String("milter-port", cfg.MilterPort, "Milter server port")
+	milterInfected := fs.String("milter-infected-action", cfg.MilterInfectedAction, "Milter action for infected mail (accept|reject|tempfail|discard)")
+	milterError := fs.String("milter-error-action", cfg.MilterErrorAction, "Milter action when scanning fails (accept|reject|tempfail|discard)")
+	milterOversize := fs.String("milter-oversize-action", cfg.MilterOversizeAction, "Milter action for mail larger than max-size (accept|reject|tempfail|discard)")
+	milterAddHeader := fs.Bool("milter-add-header", cfg.MilterAddHeader, "Add X-Virus-Status headers to accepted mail")
+	milterIdleTimeout := fs.Int64("milter-idle-timeout", int64(cfg.MilterIdleTimeout.Seconds()), "Seconds a milter connection may wait for the MTA's next command")
+	proxyUpstream := fs.String("proxy-upstream", cfg.ProxyUpstream, "Upstream URL for the upload-gateway proxy (empty disables it)")
+	proxyPort := fs.String("proxy-port", cfg.ProxyPort, "Upload-gateway proxy port")
+	proxyRoutes := fs.String("proxy-routes", strings.Join(cfg.ProxyRoutes, ","), "Comma-separated path prefixes whose uploads are scanned")
+	proxyRejectStatus := fs.Int64("proxy-reject-status", int64(cfg.ProxyRejectStatus), "HTTP status returned for infected uploads (400-499)")
+	proxySpillThreshold := fs.Int64("proxy-spill-threshold", cfg.ProxySpillThreshold, "Upload bytes held in memory before spilling to disk")
+	proxyTempDir := fs.String("proxy-temp-dir", cfg.ProxyTempDir, "Directory for spilled upload bodies (default spool-dir)")
+	enableClamdListener := fs.Bool("enable-clamd-listener", cfg.EnableClamdListener, "Enable clamd-protocol listener for clamdscan-compatible clients")
+	clamdListenerPort := fs.String("clamd-listener-port", cfg.ClamdListenerPort, "clamd-protocol listener port")
+	watchDirs := fs.String("watch-dirs", strings.Join(cfg.WatchDirs, ","), "Comma-separated inbox directories to watch for new files (empty disables watch mode)")
+	watchCleanDir := fs.String("watch-clean-dir", cfg.WatchCleanDir, "Directory for clean watched files (default <inbox>/clean)")
+	watchInfectedDir := fs.String("watch-infected-dir", cfg.WatchInfectedDir, "Directory for infected watched files (default <inbox>/infected)")
+	watchSidecar := fs.Bool("watch-sidecar", cfg.WatchSidecar, "Write a <file>.json verdict next to each sorted file")
+	watchSettle := fs.Int64("watch-settle", int64(cfg.WatchSettle.Seconds()), "Seconds a watched file must stay unchanged before it is scanned")
+	watchPollInterval := fs.Int64("watch-poll-interval", int64(cfg.WatchPollInterval.Seconds()), "Seconds between directory polls when inotify is unavailable")
+	watchUsePolling := fs.Bool("watch-use-polling", cfg.WatchUsePolling, "Poll watch directories instead of using inotify (e.g. for NFS)")
+	s3Endpoint := fs.String("s3-endpoint", cfg.S3Endpoint, "S3-compatible endpoint URL (empty disables the S3 integration)")
+	s3Region := fs.String("s3-region", cfg.S3Region, "S3 region used for request signing")
+	s3AccessKey := fs.String("s3-access-key", cfg.S3AccessKey, "S3 access key ID (secret key is read from CLAMAV_S3_SECRET_KEY or the config file)")
+	s3PathStyle := fs.Bool("s3-path-style", cfg.S3PathStyle, "Use path-style bucket addressing (required by most S3-compatible stores)")
+	s3VerdictMode := fs.String("s3-verdict-mode", cfg.S3VerdictMode, "Where to record scan verdicts on objects (tags|metadata|none)")
+	s3QuarantineBucket := fs.String("s3-quarantine-bucket", cfg.S3QuarantineBucket, "Bucket infected objects are copied to (empty disables quarantine)")
+	s3AllowedBuckets := fs.String("s3-allowed-buckets", strings.Join(cfg.S3AllowedBuckets, ","), "Comma-separated buckets the S3 scan API and event webhook may scan (required with the S3 endpoint)")
+	enableURLScan := fs.Bool("enable-url-scan", cfg.EnableURLScan, "Enable the scan-by-URL endpoint")
+	urlScanSchemes := fs.String("url-scan-schemes", strings.Join(cfg.URLScanSchemes, ","), "Comma-separated URL schemes the scan-by-URL endpoint may fetch (http,https)")
+	urlScanAllowedHosts := fs.String("url-scan-allowed-hosts", strings.Join(cfg.URLScanAllowedHosts, ","), "Comma-separated hosts the scan-by-URL endpoint may fetch; *.example.com matches subdomains (empty allows any public host)")
+	urlScanMaxRedirects := fs.Int64("url-scan-max-redirects", int64(cfg.URLScanMaxRedirects), "Maximum redirects followed when fetching a URL")
+	urlScanFetchTimeout := fs.Int64("url-scan-fetch-timeout", int64(cfg.URLScanFetchTimeout.Seconds()), "Seconds allowed for downloading a URL")
+	clamdAllowedNets := fs.String("clamd-allowed-nets", strings.Join(cfg.ClamdAllowedNets, ","), "Comma-separated IPs/CIDRs allowed to use the clamd-protocol listener")
+
+	// Parse flags. Like flag.Parse, a parse error leaves the remaining
+	// flags at their defaults; with ExitOnError it never returns.
+	_ = fs.Parse(args)
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	// Config file values apply to settings not given as flags
+	secrets := make(map[string]string)
+	path := *configFile
+	if !explicit["config"] {
+		path = getEnvWithDefault("CLAMAV_CONFIG", path)
 	}
-	if config.MaxContentLength <= 0 {
-		fmt.Fprintf(os.Stderr, "FATAL: max content length must be > 0, got %d\n", config.MaxContentLength)
-		os.Exit(1)
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		for name, value := range values {
+			if secretSettings[name] {
+				secrets[name] = value
+				continue
+			}
+			if fs.Lookup(name) == nil || name == "config" {
+				return cfg, fmt.Errorf("config file %s: unknown setting %q", path, name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return cfg, fmt.Errorf("config file %s: invalid value %q for %s: %w", path, value, name, err)
+			}
+		}
 	}
-	if config.ClamdUnixSocket == "" {
-		fmt.Fprintf(os.Stderr, "FATAL: ClamAV Unix socket path must not be empty\n")
-		os.Exit(1)
+
+	// Environment variables override the config file but not flags
+	for _, s := range settings {
+		value, exists := os.LookupEnv(s.env)
+		if !exists || explicit[s.name] {
+			continue
+		}
+		if secretSettings[s.name] {
+			secrets[s.name] = value
+			continue
+		}
+		if err := fs.Set(s.name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: invalid value %q for env var %s: %v; ignoring it\n", value, s.env, err)
+		}
 	}
-	if portNum, err := strconv.Atoi(config.Port); err != nil || portNum < 1 || portNum > 65535 {
-		fmt.Fprintf(os.Stderr, "FATAL: port must be a valid TCP port (1-65535), got %q\n", config.Port)
-		os.Exit(1)
+
+	cfg.ConfigFile = path
+	cfg.Debug = *debug
+	cfg.ClamdUnixSocket = *socket
+	cfg.MaxContentLength = *maxSize
+	cfg.Host = *host
+	cfg.Port = *port
+	cfg.GRPCPort = *grpcPort
+	cfg.ScanTimeout = time.Duration(*scanTimeout) * time.Second
+	cfg.ShutdownTimeout = time.Duration(*shutdownTimeout) * time.Second
+	cfg.DrainDelay = time.Duration(*drainDelay) * time.Second
+	cfg.DrainTimeout = time.Duration(*drainTimeout) * time.Second
+	cfg.EnableGRPC = *enableGRPC
+	cfg.SpoolThreshold = *spoolThreshold
+	cfg.SpoolDir = *spoolDir
+	cfg.MemoryBudget = *memoryBudget
+	cfg.PolicyFile = *policyFile
+	cfg.AllowlistFile = *allowlistFile
+	cfg.SignatureDir = *signatureDir
+	cfg.Engines = splitList(*engines)
+	cfg.EngineMode = strings.ToLower(*engineMode)
+	cfg.EngineStrategy = strings.ToLower(*engineStrategy)
+	cfg.RuleFiles = splitList(*ruleFiles)
+	cfg.HashBlocklists = splitList(*hashBlocklists)
+	cfg.HashAllowlists = splitList(*hashAllowlists)
+	cfg.HashListInterval = time.Duration(*hashListInterval) * time.Second
+	cfg.LogFormat = strings.ToLower(*logFormat)
+	cfg.LogFile = *logFile
+	cfg.LogMaxSize = *logMaxSize
+	cfg.LogMaxBackups = int(*logMaxBackups)
+	cfg.LogMaxAge = time.Duration(*logMaxAge) * 24 * time.Hour
+	cfg.OTLPEndpoint = *otlpEndpoint
+	cfg.OTLPInsecure = *otlpInsecure
+	cfg.TraceSampleRatio = *traceSampleRatio
+	cfg.HealthProbeInterval = time.Duration(*healthProbeInterval) * time.Second
+	cfg.HealthFailureThreshold = int(*healthFailureThreshold)
+	cfg.HealthSuccessThreshold = int(*healthSuccessThreshold)
+	cfg.HealthMaxSignatureAge = time.Duration(*healthMaxSignatureAge) * time.Hour
+	cfg.HealthMaxScans = int(*healthMaxScans)
+	cfg.EnableMilter = *enableMilter
+	cfg.MilterPort = *milterPort
+	cfg.MilterInfectedAction = *milterInfected
+	cfg.MilterErrorAction = *milterError
+	cfg.MilterOversizeAction = *milterOversize
+	cfg.MilterAddHeader = *milterAddHeader
+	cfg.MilterIdleTimeout = time.Duration(*milterIdleTimeout) * time.Second
+	cfg.ProxyUpstream = *proxyUpstream
+	cfg.ProxyPort = *proxyPort
+	cfg.ProxyRoutes = splitList(*proxyRoutes)
+	cfg.ProxyRejectStatus = int(*proxyRejectStatus)
+	cfg.ProxySpillThreshold = *proxySpillThreshold
+	cfg.ProxyTempDir = *proxyTempDir
+	cfg.EnableClamdListener = *enableClamdListener
+	cfg.ClamdListenerPort = *clamdListenerPort
+	cfg.ClamdAllowedNets = splitList(*clamdAllowedNets)
+	cfg.S3Endpoint = *s3Endpoint
+	cfg.S3Region = *s3Region
+	cfg.S3AccessKey = *s3AccessKey
+	cfg.S3PathStyle = *s3PathStyle
+	cfg.S3VerdictMode = *s3VerdictMode
+	cfg.S3QuarantineBucket = *s3QuarantineBucket
+	cfg.S3AllowedBuckets = splitList(*s3AllowedBuckets)
+	// Secrets have no flag so they stay out of ps output
+	cfg.S3SecretKey = secrets["s3-secret-key"]
+	cfg.S3WebhookToken = secrets["s3-webhook-token"]
+	cfg.AdminToken = secrets["admin-token"]
+	cfg.EnableURLScan = *enableURLScan
+	cfg.URLScanSchemes = splitList(strings.ToLower(*urlScanSchemes))
+	cfg.URLScanAllowedHosts = splitList(*urlScanAllowedHosts)
+	cfg.URLScanMaxRedirects = int(*urlScanMaxRedirects)
+	cfg.URLScanFetchTimeout = time.Duration(*urlScanFetchTimeout) * time.Second
+	cfg.WatchDirs = splitList(*watchDirs)
+	cfg.WatchCleanDir = *watchCleanDir
+	cfg.WatchInfectedDir = *watchInfectedDir
+	cfg.WatchSidecar = *watchSidecar
+	cfg.WatchSettle = time.Duration(*watchSettle) * time.Second
+	cfg.WatchPollInterval = time.Duration(*watchPollInterval) * time.Second
+	cfg.WatchUsePolling = *watchUsePolling
+
+	buckets, err := parseBuckets(*scanDurationBuckets)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ScanDurationBuckets = buckets
+
+	if cfg.PolicyFile != "" {
+		policies, err := loadPolicyFile(cfg.PolicyFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Policies = policies
 	}
-	if grpcPortNum, err := strconv.Atoi(config.GRPCPort); err != nil || grpcPortNum < 1 || grpcPortNum > 65535 {
-		fmt.Fprintf(os.Stderr, "FATAL: gRPC port must be a valid TCP port (1-65535), got %q\n", config.GRPCPort)
+	if len(cfg.RuleFiles) > 0 {
+		rules, err := loadRuleFiles(cfg.RuleFiles)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Rules = rules
+	}
+
+	return cfg, validateConfig(&cfg)
+}
+
+// validateConfig checks that the configuration values are usable
+func validateConfig(cfg *Config) error {
+	if cfg.ScanTimeout <= 0 {
+		return fmt.Errorf("scan timeout must be > 0, got %v", cfg.ScanTimeout)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be > 0, got %v", cfg.ShutdownTimeout)
+	}
+	if cfg.DrainDelay < 0 || cfg.DrainTimeout < 0 {
+		return fmt.Errorf("drain delay and timeout must be >= 0")
+	}
+	if len(cfg.ScanDurationBuckets) == 0 {
+		return fmt.Errorf("scan duration buckets must not be empty")
+	}
+	for i, b := range cfg.ScanDurationBuckets {
+		if b <= 0 || (i > 0 && b <= cfg.ScanDurationBuckets[i-1]) {
+			return fmt.Errorf("scan duration buckets must be positive and increasing, got %s", formatBuckets(cfg.ScanDurationBuckets))
+		}
+	}
+	if cfg.LogFormat != logFormatConsole && cfg.LogFormat != logFormatJSON && cfg.LogFormat != logFormatECS {
+		return fmt.Errorf("log format must be one of console, json, ecs, got %q", cfg.LogFormat)
+	}
+	if cfg.LogMaxSize < 0 || cfg.LogMaxBackups < 0 || cfg.LogMaxAge < 0 {
+		return fmt.Errorf("log rotation limits must be >= 0")
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio must be between 0 and 1, got %v", cfg.TraceSampleRatio)
+	}
+	if cfg.HealthProbeInterval <= 0 {
+		return fmt.Errorf("health probe interval must be > 0, got %v", cfg.HealthProbeInterval)
+	}
+	if cfg.HealthFailureThreshold < 1 || cfg.HealthSuccessThreshold < 1 {
+		return fmt.Errorf("health probe thresholds must be >= 1")
+	}
+	if cfg.HealthMaxSignatureAge < 0 || cfg.HealthMaxScans < 0 {
+		return fmt.Errorf("health signature age and scan limits must be >= 0")
+	}
+	if cfg.MaxContentLength <= 0 {
+		return fmt.Errorf("max content length must be > 0, got %d", cfg.MaxContentLength)
+	}
+	if cfg.SpoolThreshold < 0 || cfg.MemoryBudget < 0 {
+		return fmt.Errorf("spool threshold and memory budget must be >= 0")
+	}
+	if cfg.ClamdUnixSocket == "" {
+		return fmt.Errorf("ClamAV Unix socket path must not be empty")
+	}
+	if err := validateEngines(cfg); err != nil {
+		return err
+	}
+	if cfg.HashListInterval <= 0 {
+		return fmt.Errorf("hash list interval must be > 0, got %v", cfg.HashListInterval)
+	}
+	if !isValidPort(cfg.Port) {
+		return fmt.Errorf("port must be a valid TCP port (1-65535), got %q", cfg.Port)
+	}
+	if !isValidPort(cfg.GRPCPort) {
+		return fmt.Errorf("gRPC port must be a valid TCP port (1-65535), got %q", cfg.GRPCPort)
+	}
+	if !isValidPort(cfg.MilterPort) {
+		return fmt.Errorf("milter port must be a valid TCP port (1-65535), got %q", cfg.MilterPort)
+	}
+	for _, action := range []string{cfg.MilterInfectedAction, cfg.MilterErrorAction, cfg.MilterOversizeAction} {
+		if !validMilterAction(action) {
+			return fmt.Errorf("milter action must be one of accept, reject, tempfail, discard, got %q", action)
+		}
+	}
+	if cfg.MilterIdleTimeout <= 0 {
+		return fmt.Errorf("milter idle timeout must be > 0, got %v", cfg.MilterIdleTimeout)
+	}
+	if cfg.ProxyUpstream != "" {
+		if u, err := url.Parse(cfg.ProxyUpstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("proxy upstream must be an http or https URL, got %q", cfg.ProxyUpstream)
+		}
+		if !isValidPort(cfg.ProxyPort) {
+			return fmt.Errorf("proxy port must be a valid TCP port (1-65535), got %q", cfg.ProxyPort)
+		}
+		if len(cfg.ProxyRoutes) == 0 {
+			return fmt.Errorf("proxy routes must not be empty")
+		}
+	}
+	if cfg.ProxyRejectStatus < 400 || cfg.ProxyRejectStatus > 499 {
+		return fmt.Errorf("proxy reject status must be a 4xx code, got %d", cfg.ProxyRejectStatus)
+	}
+	if cfg.ProxySpillThreshold < 0 {
+		return fmt.Errorf("proxy spill threshold must be >= 0, got %d", cfg.ProxySpillThreshold)
+	}
+	if !isValidPort(cfg.ClamdListenerPort) {
+		return fmt.Errorf("clamd listener port must be a valid TCP port (1-65535), got %q", cfg.ClamdListenerPort)
+	}
+	if _, err := parseAllowedNets(cfg.ClamdAllowedNets); err != nil {
+		return fmt.Errorf("clamd allowed nets must be IP addresses or CIDR ranges: %v", err)
+	}
+	if cfg.S3Endpoint != "" {
+		if u, err := url.Parse(cfg.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("S3 endpoint must be an http or https URL, got %q", cfg.S3Endpoint)
+		}
+		if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			return fmt.Errorf("S3 access key and secret key must be set when the S3 endpoint is configured")
+		}
+		if len(cfg.S3AllowedBuckets) == 0 {
+			return fmt.Errorf("S3 allowed buckets must be set when the S3 endpoint is configured")
+		}
+	}
+	if !validS3VerdictMode(cfg.S3VerdictMode) {
+		return fmt.Errorf("S3 verdict mode must be one of tags, metadata, none, got %q", cfg.S3VerdictMode)
+	}
+	if len(cfg.URLScanSchemes) == 0 {
+		return fmt.Errorf("URL scan schemes must not be empty")
+	}
+	for _, scheme := range cfg.URLScanSchemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("URL scan schemes must be http or https, got %q", scheme)
+		}
+	}
+	if cfg.URLScanMaxRedirects < 0 {
+		return fmt.Errorf("URL scan max redirects must be >= 0, got %d", cfg.URLScanMaxRedirects)
+	}
+	if cfg.URLScanFetchTimeout <= 0 {
+		return fmt.Errorf("URL scan fetch timeout must be > 0, got %v", cfg.URLScanFetchTimeout)
+	}
+	if cfg.WatchSettle <= 0 {
+		return fmt.Errorf("watch settle time must be > 0, got %v", cfg.WatchSettle)
+	}
+	if cfg.WatchPollInterval <= 0 {
+		return fmt.Errorf("watch poll interval must be > 0, got %v", cfg.WatchPollInterval)
+	}
+	return nil
+}
+
+// logOutput returns the log encoding and destination configured in cfg
+func logOutput(cfg *Config) LogOutput {
+	return LogOutput{
+		Format:     cfg.LogFormat,
+		File:       cfg.LogFile,
+		MaxSize:    cfg.LogMaxSize << 20,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAge:     cfg.LogMaxAge,
+	}
+}
+
+// logEnv returns the logging environment selected by ENV
+func logEnv() string {
+	if os.Getenv("ENV") == "production" {
+		return "production"
+	}
+	return "development"
+}
+
+func parseConfig() {
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FATAL: %v\n", err)
 		os.Exit(1)
 	}
+	config = cfg
 
 	// Set Gin mode based on environment variables
 	if mode := os.Getenv("GIN_MODE"); mode != "" {
@@ -132,11 +703,7 @@ func parseConfig() {
 	}
 
 	// Initialize logger
-	env := "development"
-	if os.Getenv("ENV") == "production" {
-		env = "production"
-	}
-	if err := InitLogger(config.Debug, env); err != nil {
+	if err := InitLoggerWithOutput(config.Debug, logEnv(), logOutput(&config)); err != nil {
 		fmt.Printf("Failed to initialize logger: %v\n", err)
 		os.Exit(1)
 	}
@@ -146,13 +713,44 @@ func parseConfig() {
 	logger.Info("Configuration loaded",
 		zap.String("version", Version),
 		zap.String("commit", CommitHash),
+		zap.String("config_file", config.ConfigFile),
 		zap.Bool("debug", config.Debug),
+		zap.String("log_format", config.LogFormat),
+		zap.String("log_file", config.LogFile),
+		zap.Bool("admin_api_enabled", config.AdminToken != ""),
+		zap.String("otlp_endpoint", config.OTLPEndpoint),
+		zap.Float64("trace_sample_ratio", config.TraceSampleRatio),
+		zap.Float64("health_probe_interval_seconds", config.HealthProbeInterval.Seconds()),
 		zap.String("clamav_socket", config.ClamdUnixSocket),
 		zap.Int64("max_content_length", config.MaxContentLength),
+		zap.Int64("memory_budget", config.MemoryBudget),
+		zap.String("spool_dir", spoolDirectory(&config)),
+		zap.String("policy_file", config.PolicyFile),
+		zap.String("allowlist_file", config.AllowlistFile),
+		zap.String("signature_dir", config.SignatureDir),
+		zap.Strings("engines", config.Engines),
+		zap.String("engine_mode", config.EngineMode),
+		zap.String("engine_strategy", config.EngineStrategy),
+		zap.Strings("rule_files", config.RuleFiles),
+		zap.Strings("hash_blocklists", config.HashBlocklists),
+		zap.Strings("hash_allowlists", config.HashAllowlists),
 		zap.Float64("scan_timeout_seconds", config.ScanTimeout.Seconds()),
+		zap.Float64("shutdown_timeout_seconds", config.ShutdownTimeout.Seconds()),
+		zap.Float64("drain_delay_seconds", config.DrainDelay.Seconds()),
+		zap.Float64("drain_timeout_seconds", config.DrainTimeout.Seconds()),
 		zap.String("rest_api_address", fmt.Sprintf("%s:%s", config.Host, config.Port)),
 		zap.Bool("grpc_enabled", config.EnableGRPC),
 		zap.String("grpc_address", fmt.Sprintf("%s:%s", config.Host, config.GRPCPort)),
+		zap.Bool("milter_enabled", config.EnableMilter),
+		zap.String("milter_address", fmt.Sprintf("%s:%s", config.Host, config.MilterPort)),
+		zap.String("proxy_upstream", config.ProxyUpstream),
+		zap.String("proxy_address", fmt.Sprintf("%s:%s", config.Host, config.ProxyPort)),
+		zap.Bool("clamd_listener_enabled", config.EnableClamdListener),
+		zap.String("clamd_listener_address", fmt.Sprintf("%s:%s", config.Host, config.ClamdListenerPort)),
+		zap.Strings("watch_dirs", config.WatchDirs),
+		zap.String("s3_endpoint", config.S3Endpoint),
+		zap.Strings("s3_allowed_buckets", config.S3AllowedBuckets),
+		zap.Bool("url_scan_enabled", config.EnableURLScan),
 		zap.String("gin_mode", gin.Mode()),
 	)
 }
@@ -166,7 +764,12 @@ var (
 
 // initClamdClient creates the ClamAV client (call once at startup)
 func initClamdClient() {
-	clamdClient = clamd.NewClamd("unix://" + config.ClamdUnixSocket)
+	clamdClient = clamd.NewClamd(clamdAddress())
+}
+
+// clamdAddress is the address of the clamd scans are sent to
+func clamdAddress() string {
+	return "unix://" + currentConfig().ClamdUnixSocket
 }
 
 // getClamdClient returns the shared ClamAV client instance.
@@ -180,7 +783,7 @@ func getClamdClient() *clamd.Clamd {
 }
 
 // resetClamdClient resets the client so the next getClamdClient call
-// re-initializes it. Intended for tests that need to swap the socket path.
+// re-initializes it, after a reload or in tests that swap the socket path.
 func resetClamdClient() {
 	clamdMu.Lock()
 	defer clamdMu.Unlock()
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// readConfigFile reads a YAML or TOML config file, chosen by extension,
+// into flag-style string values keyed by setting name. Lists become
+// comma-separated values, as in the environment variables.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := configFileValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+// configFileValue formats a decoded scalar or list as a flag value
+func configFileValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configFileValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q must not contain a comma", s)
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("must be a value or a list, not a table")
+	}
+	return fmt.Sprint(value), nil
+}
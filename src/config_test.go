@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -252,14 +253,77 @@ func TestParseConfigEnvOverrides(t *testing.T) {
 
 	// Set env vars to override defaults
 	envVars := map[string]string{
-		"CLAMAV_DEBUG":        "true",
-		"CLAMAV_SOCKET":       "/custom/clamd.sock",
-		"CLAMAV_MAX_SIZE":     "1048576",
-		"CLAMAV_HOST":         "127.0.0.1",
-		"CLAMAV_PORT":         "7000",
-		"CLAMAV_GRPC_PORT":    "9500",
-		"CLAMAV_ENABLE_GRPC":  "false",
-		"CLAMAV_SCAN_TIMEOUT": "60",
+		"CLAMAV_DEBUG":           "true",
+		"CLAMAV_SOCKET":          "/custom/clamd.sock",
+		"CLAMAV_MAX_SIZE":        "1048576",
+		"CLAMAV_HOST":            "127.0.0.1",
+		"CLAMAV_PORT":            "7000",
+		"CLAMAV_GRPC_PORT":       "9500",
+		"CLAMAV_ENABLE_GRPC":     "false",
+		"CLAMAV_SCAN_TIMEOUT":    "60",
+		"CLAMAV_DRAIN_DELAY":     "5",
+		"CLAMAV_DRAIN_TIMEOUT":   "45",
+		"CLAMAV_SPOOL_THRESHOLD": "1048576",
+		"CLAMAV_SPOOL_DIR":       "/var/spool/clamav-api",
+		"CLAMAV_MEMORY_BUDGET":   "67108864",
+
+		"CLAMAV_LOG_FORMAT":      "JSON",
+		"CLAMAV_LOG_MAX_SIZE":    "50",
+		"CLAMAV_LOG_MAX_BACKUPS": "3",
+		"CLAMAV_LOG_MAX_AGE":     "7",
+		"CLAMAV_ADMIN_TOKEN":     "admin-token",
+
+		"CLAMAV_OTLP_ENDPOINT":      "otel-collector:4317",
+		"CLAMAV_OTLP_INSECURE":      "true",
+		"CLAMAV_TRACE_SAMPLE_RATIO": "0.25",
+
+		"CLAMAV_HEALTH_PROBE_INTERVAL":    "10",
+		"CLAMAV_HEALTH_FAILURE_THRESHOLD": "5",
+		"CLAMAV_HEALTH_SUCCESS_THRESHOLD": "2",
+		"CLAMAV_HEALTH_MAX_SIGNATURE_AGE": "48",
+		"CLAMAV_HEALTH_MAX_SCANS":         "64",
+
+		"CLAMAV_ENABLE_MILTER":          "true",
+		"CLAMAV_MILTER_PORT":            "8891",
+		"CLAMAV_MILTER_INFECTED_ACTION": "discard",
+		"CLAMAV_MILTER_ERROR_ACTION":    "accept",
+		"CLAMAV_MILTER_OVERSIZE_ACTION": "tempfail",
+		"CLAMAV_MILTER_ADD_HEADER":      "false",
+
+		"CLAMAV_PROXY_UPSTREAM":        "http://app.internal:3000",
+		"CLAMAV_PROXY_PORT":            "8088",
+		"CLAMAV_PROXY_ROUTES":          "/upload, /api/files",
+		"CLAMAV_PROXY_REJECT_STATUS":   "422",
+		"CLAMAV_PROXY_SPILL_THRESHOLD": "4096",
+		"CLAMAV_PROXY_TEMP_DIR":        "/var/spool/clamav-api",
+
+		"CLAMAV_ENABLE_CLAMD_LISTENER": "true",
+		"CLAMAV_CLAMD_LISTENER_PORT":   "3311",
+		"CLAMAV_CLAMD_ALLOWED_NETS":    "10.0.0.0/8, 192.168.1.7",
+
+		"CLAMAV_WATCH_DIRS":          "/data/inbox-a,/data/inbox-b",
+		"CLAMAV_WATCH_CLEAN_DIR":     "/data/clean",
+		"CLAMAV_WATCH_INFECTED_DIR":  "/data/quarantine",
+		"CLAMAV_WATCH_SIDECAR":       "true",
+		"CLAMAV_WATCH_SETTLE":        "30",
+		"CLAMAV_WATCH_POLL_INTERVAL": "60",
+		"CLAMAV_WATCH_USE_POLLING":   "true",
+
+		"CLAMAV_S3_ENDPOINT":          "http://minio:9000",
+		"CLAMAV_S3_REGION":            "eu-central-1",
+		"CLAMAV_S3_ACCESS_KEY":        "scanner",
+		"CLAMAV_S3_SECRET_KEY":        "scanner-secret",
+		"CLAMAV_S3_PATH_STYLE":        "false",
+		"CLAMAV_S3_VERDICT_MODE":      "metadata",
+		"CLAMAV_S3_QUARANTINE_BUCKET": "quarantine",
+		"CLAMAV_S3_WEBHOOK_TOKEN":     "hook-token",
+		"CLAMAV_S3_ALLOWED_BUCKETS":   "uploads, invoices",
+
+		"CLAMAV_ENABLE_URL_SCAN":        "true",
+		"CLAMAV_URL_SCAN_SCHEMES":       "HTTPS,http",
+		"CLAMAV_URL_SCAN_ALLOWED_HOSTS": "files.example.com, *.s3.amazonaws.com",
+		"CLAMAV_URL_SCAN_MAX_REDIRECTS": "0",
+		"CLAMAV_URL_SCAN_FETCH_TIMEOUT": "15",
 	}
 	for k, v := range envVars {
 		os.Setenv(k, v)
@@ -280,6 +344,69 @@ func TestParseConfigEnvOverrides(t *testing.T) {
 	assert.Equal(t, "9500", config.GRPCPort)
 	assert.False(t, config.EnableGRPC)
 	assert.Equal(t, 60*time.Second, config.ScanTimeout)
+	assert.Equal(t, 5*time.Second, config.DrainDelay)
+	assert.Equal(t, 45*time.Second, config.DrainTimeout)
+	assert.Equal(t, int64(1048576), config.SpoolThreshold)
+	assert.Equal(t, "/var/spool/clamav-api", config.SpoolDir)
+	assert.Equal(t, int64(67108864), config.MemoryBudget)
+
+	assert.Equal(t, "json", config.LogFormat)
+	assert.Equal(t, int64(50), config.LogMaxSize)
+	assert.Equal(t, 3, config.LogMaxBackups)
+	assert.Equal(t, 7*24*time.Hour, config.LogMaxAge)
+	assert.Equal(t, "admin-token", config.AdminToken)
+
+	assert.Equal(t, "otel-collector:4317", config.OTLPEndpoint)
+	assert.True(t, config.OTLPInsecure)
+	assert.Equal(t, 0.25, config.TraceSampleRatio)
+
+	assert.Equal(t, 10*time.Second, config.HealthProbeInterval)
+	assert.Equal(t, 5, config.HealthFailureThreshold)
+	assert.Equal(t, 2, config.HealthSuccessThreshold)
+	assert.Equal(t, 48*time.Hour, config.HealthMaxSignatureAge)
+	assert.Equal(t, 64, config.HealthMaxScans)
+
+	assert.True(t, config.EnableMilter)
+	assert.Equal(t, "8891", config.MilterPort)
+	assert.Equal(t, "discard", config.MilterInfectedAction)
+	assert.Equal(t, "accept", config.MilterErrorAction)
+	assert.Equal(t, "tempfail", config.MilterOversizeAction)
+	assert.False(t, config.MilterAddHeader)
+
+	assert.Equal(t, "http://app.internal:3000", config.ProxyUpstream)
+	assert.Equal(t, "8088", config.ProxyPort)
+	assert.Equal(t, []string{"/upload", "/api/files"}, config.ProxyRoutes)
+	assert.Equal(t, 422, config.ProxyRejectStatus)
+	assert.Equal(t, int64(4096), config.ProxySpillThreshold)
+	assert.Equal(t, "/var/spool/clamav-api", config.ProxyTempDir)
+
+	assert.True(t, config.EnableClamdListener)
+	assert.Equal(t, "3311", config.ClamdListenerPort)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.7"}, config.ClamdAllowedNets)
+
+	assert.Equal(t, []string{"/data/inbox-a", "/data/inbox-b"}, config.WatchDirs)
+	assert.Equal(t, "/data/clean", config.WatchCleanDir)
+	assert.Equal(t, "/data/quarantine", config.WatchInfectedDir)
+	assert.True(t, config.WatchSidecar)
+	assert.Equal(t, 30*time.Second, config.WatchSettle)
+	assert.Equal(t, 60*time.Second, config.WatchPollInterval)
+	assert.True(t, config.WatchUsePolling)
+
+	assert.Equal(t, "http://minio:9000", config.S3Endpoint)
+	assert.Equal(t, "eu-central-1", config.S3Region)
+	assert.Equal(t, "scanner", config.S3AccessKey)
+	assert.Equal(t, "scanner-secret", config.S3SecretKey)
+	assert.False(t, config.S3PathStyle)
+	assert.Equal(t, "metadata", config.S3VerdictMode)
+	assert.Equal(t, "quarantine", config.S3QuarantineBucket)
+	assert.Equal(t, "hook-token", config.S3WebhookToken)
+	assert.Equal(t, []string{"uploads", "invoices"}, config.S3AllowedBuckets)
+
+	assert.True(t, config.EnableURLScan)
+	assert.Equal(t, []string{"https", "http"}, config.URLScanSchemes)
+	assert.Equal(t, []string{"files.example.com", "*.s3.amazonaws.com"}, config.URLScanAllowedHosts)
+	assert.Equal(t, 0, config.URLScanMaxRedirects)
+	assert.Equal(t, 15*time.Second, config.URLScanFetchTimeout)
 }
 
 func TestParseConfigGinModes(t *testing.T) {
@@ -399,6 +526,120 @@ func TestParseConfigValidationExits(t *testing.T) {
 			envValue:   "99999",
 			wantStderr: "FATAL: gRPC port must be a valid TCP port",
 		},
+		{
+			name:       "invalid milter port exits",
+			envKey:     "CLAMAV_MILTER_PORT",
+			envValue:   "0",
+			wantStderr: "FATAL: milter port must be a valid TCP port",
+		},
+		{
+			name:       "invalid milter action exits",
+			envKey:     "CLAMAV_MILTER_INFECTED_ACTION",
+			envValue:   "quarantine",
+			wantStderr: "FATAL: milter action must be one of",
+		},
+		{
+			name:       "invalid proxy upstream exits",
+			envKey:     "CLAMAV_PROXY_UPSTREAM",
+			envValue:   "ftp://files.internal",
+			wantStderr: "FATAL: proxy upstream must be an http or https URL",
+		},
+		{
+			name:       "non-4xx proxy reject status exits",
+			envKey:     "CLAMAV_PROXY_REJECT_STATUS",
+			envValue:   "500",
+			wantStderr: "FATAL: proxy reject status must be a 4xx code",
+		},
+		{
+			name:       "negative proxy spill threshold exits",
+			envKey:     "CLAMAV_PROXY_SPILL_THRESHOLD",
+			envValue:   "-1",
+			wantStderr: "FATAL: proxy spill threshold must be >= 0",
+		},
+		{
+			name:       "invalid clamd listener port exits",
+			envKey:     "CLAMAV_CLAMD_LISTENER_PORT",
+			envValue:   "65536",
+			wantStderr: "FATAL: clamd listener port must be a valid TCP port",
+		},
+		{
+			name:       "invalid clamd allowed nets exits",
+			envKey:     "CLAMAV_CLAMD_ALLOWED_NETS",
+			envValue:   "10.0.0.0/8,intranet",
+			wantStderr: "FATAL: clamd allowed nets must be IP addresses or CIDR ranges",
+		},
+		{
+			name:       "zero watch settle time exits",
+			envKey:     "CLAMAV_WATCH_SETTLE",
+			envValue:   "0",
+			wantStderr: "FATAL: watch settle time must be > 0",
+		},
+		{
+			name:       "invalid URL scan scheme exits",
+			envKey:     "CLAMAV_URL_SCAN_SCHEMES",
+			envValue:   "https,file",
+			wantStderr: "FATAL: URL scan schemes must be http or https",
+		},
+		{
+			name:       "zero shutdown timeout exits",
+			envKey:     "CLAMAV_SHUTDOWN_TIMEOUT",
+			envValue:   "0",
+			wantStderr: "FATAL: shutdown timeout must be > 0",
+		},
+		{
+			name:       "negative memory budget exits",
+			envKey:     "CLAMAV_MEMORY_BUDGET",
+			envValue:   "-1",
+			wantStderr: "FATAL: spool threshold and memory budget must be >= 0",
+		},
+		{
+			name:       "missing policy file exits",
+			envKey:     "CLAMAV_POLICY_FILE",
+			envValue:   "/nonexistent/policy.yaml",
+			wantStderr: "FATAL: open /nonexistent/policy.yaml",
+		},
+		{
+			name:       "negative drain delay exits",
+			envKey:     "CLAMAV_DRAIN_DELAY",
+			envValue:   "-1",
+			wantStderr: "FATAL: drain delay and timeout must be >= 0",
+		},
+		{
+			name:       "decreasing scan duration buckets exits",
+			envKey:     "CLAMAV_SCAN_DURATION_BUCKETS",
+			envValue:   "1,5,2",
+			wantStderr: "FATAL: scan duration buckets must be positive and increasing",
+		},
+		{
+			name:       "unknown log format exits",
+			envKey:     "CLAMAV_LOG_FORMAT",
+			envValue:   "xml",
+			wantStderr: "FATAL: log format must be one of console, json, ecs",
+		},
+		{
+			name:       "trace sample ratio above 1 exits",
+			envKey:     "CLAMAV_TRACE_SAMPLE_RATIO",
+			envValue:   "1.5",
+			wantStderr: "FATAL: trace sample ratio must be between 0 and 1",
+		},
+		{
+			name:       "zero health failure threshold exits",
+			envKey:     "CLAMAV_HEALTH_FAILURE_THRESHOLD",
+			envValue:   "0",
+			wantStderr: "FATAL: health probe thresholds must be >= 1",
+		},
+		{
+			name:       "missing config file exits",
+			envKey:     "CLAMAV_CONFIG",
+			envValue:   "/nonexistent/clamav-api.yaml",
+			wantStderr: "FATAL: open /nonexistent/clamav-api.yaml",
+		},
+		{
+			name:       "zero URL scan fetch timeout exits",
+			envKey:     "CLAMAV_URL_SCAN_FETCH_TIMEOUT",
+			envValue:   "0",
+			wantStderr: "FATAL: URL scan fetch timeout must be > 0",
+		},
 	}
 
 	for _, tt := range tests {
@@ -443,3 +684,109 @@ func TestParseConfigValidationExits(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+max-size: 4096
+scan-timeout: 20
+port: "7100"
+proxy-routes:
+  - /upload
+  - /files
+scan-duration-buckets: [0.5, 1, 5]
+s3-secret-key: file-secret
+`,
+		"config.toml": `
+max-size = 4096
+scan-timeout = 20
+port = "7100"
+proxy-routes = ["/upload", "/files"]
+scan-duration-buckets = [0.5, 1, 5]
+s3-secret-key = "file-secret"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+			t.Setenv("CLAMAV_CONFIG", path)
+			t.Setenv("CLAMAV_SCAN_TIMEOUT", "40")
+			t.Setenv("CLAMAV_PORT", "7200")
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+			cfg, err := loadConfig(fs, []string{"-port", "7300"})
+			assert.NoError(t, err)
+
+			assert.Equal(t, path, cfg.ConfigFile)
+			assert.Equal(t, "7300", cfg.Port, "flag beats env and file")
+			assert.Equal(t, 40*time.Second, cfg.ScanTimeout, "env beats file")
+			assert.Equal(t, int64(4096), cfg.MaxContentLength, "file beats default")
+			assert.Equal(t, "9000", cfg.GRPCPort, "default when unset")
+			assert.Equal(t, []string{"/upload", "/files"}, cfg.ProxyRoutes)
+			assert.Equal(t, []float64{0.5, 1, 5}, cfg.ScanDurationBuckets)
+			assert.Equal(t, "file-secret", cfg.S3SecretKey)
+			assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "unknown setting",
+			file:    "config.yaml",
+			content: "max-sise: 10\n",
+			wantErr: `unknown setting "max-sise"`,
+		},
+		{
+			name:    "nested table",
+			file:    "config.toml",
+			content: "[milter]\nport = \"7357\"\n",
+			wantErr: "must be a value or a list, not a table",
+		},
+		{
+			name:    "invalid value",
+			file:    "config.yaml",
+			content: "scan-timeout: soon\n",
+			wantErr: "scan-timeout",
+		},
+		{
+			name:    "unsupported format",
+			file:    "config.json",
+			content: "{}",
+			wantErr: "unsupported format",
+		},
+		{
+			name:    "validation failure",
+			file:    "config.yaml",
+			content: "shutdown-timeout: 0\n",
+			wantErr: "shutdown timeout must be > 0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+
+			_, err := loadConfig(fs, []string{"-config", path})
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err := loadConfig(fs, []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Scan engine names, modes and strategies
+const (
+	engineClamd     = "clamd"
+	engineComposite = "composite"
+
+	engineModeParallel = "parallel"
+	engineModeSequence = "sequence"
+
+	engineStrategyAny        = "any"
+	engineStrategyMajority   = "majority"
+	engineStrategyFirstMatch = "first-match"
+)
+
+// ScanEngine produces a verdict for a payload. clamd is one engine; a
+// CompositeEngine combines several.
+type ScanEngine interface {
+	// Name identifies the engine in results, logs and metrics
+	Name() string
+	// Scan reads the payload from r and returns its verdict, OK or FOUND.
+	// timeout bounds the wait for the verdict once the payload is read.
+	Scan(ctx context.Context, r io.Reader, timeout time.Duration) (*EngineVerdict, error)
+}
+
+// EngineVerdict is one engine's finding on a payload. In the per-engine
+// list of a combined verdict, an engine that failed has Status ERROR and
+// the error as its Description.
+type EngineVerdict struct {
+	Engine      string  `json:"engine"`
+	Status      string  `json:"status"`
+	Description string  `json:"message"`
+	ScanTime    float64 `json:"time"`
+	// Matches are the rules that matched, for engines built on rules
+	Matches []RuleMatch `json:"matches,omitempty"`
+	// Engines holds each engine's verdict for a combined verdict
+	Engines []EngineVerdict `json:"-"`
+}
+
+// scanEngines builds the engines that may be listed in the engines setting
+var scanEngines = map[string]func(cfg *Config) ScanEngine{
+	engineClamd: func(*Config) ScanEngine { return clamdEngine{} },
+	engineRules: func(cfg *Config) ScanEngine { return ruleEngine{rules: cfg.Rules} },
+}
+
+// newScanEngine returns the engine configured to scan payloads: the one
+// engine listed, or a CompositeEngine over several
+func newScanEngine(cfg *Config) ScanEngine {
+	if len(cfg.Engines) == 0 {
+		return clamdEngine{}
+	}
+	if len(cfg.Engines) == 1 {
+		return scanEngines[cfg.Engines[0]](cfg)
+	}
+	composite := &CompositeEngine{Mode: cfg.EngineMode, Strategy: cfg.EngineStrategy}
+	for _, name := range cfg.Engines {
+		composite.Engines = append(composite.Engines, scanEngines[name](cfg))
+	}
+	return composite
+}
+
+// validateEngines checks the engines setting and, for several engines,
+// the mode and strategy
+func validateEngines(cfg *Config) error {
+	if len(cfg.Engines) == 0 {
+		return errors.New("engines must not be empty")
+	}
+	seen := make(map[string]bool)
+	for _, name := range cfg.Engines {
+		if scanEngines[name] == nil {
+			return fmt.Errorf("unknown scan engine %q, want one of %s", name, strings.Join(engineNames(), ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("scan engine %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	if seen[engineRules] && cfg.Rules == nil {
+		return errors.New("the rules engine needs rule-files")
+	}
+	if !seen[engineRules] && len(cfg.RuleFiles) > 0 {
+		return errors.New("rule-files are only used by the rules engine, add rules to engines")
+	}
+	if cfg.EngineMode != engineModeParallel && cfg.EngineMode != engineModeSequence {
+		return fmt.Errorf("engine mode must be parallel or sequence, got %q", cfg.EngineMode)
+	}
+	switch cfg.EngineStrategy {
+	case engineStrategyAny, engineStrategyMajority:
+		return nil
+	case engineStrategyFirstMatch:
+		// In parallel every engine runs anyway, which makes it any
+		if cfg.EngineMode != engineModeSequence {
+			return errors.New("engine strategy first-match needs engine mode sequence")
+		}
+		return nil
+	}
+	return fmt.Errorf("engine strategy must be one of any, majority, first-match, got %q", cfg.EngineStrategy)
+}
+
+// engineNames lists the known engines in order
+func engineNames() []string {
+	names := make([]string, 0, len(scanEngines))
+	for name := range scanEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CompositeEngine runs several engines on a payload, all at once or one
+// after another, and combines their verdicts with a strategy: any
+// detection, a majority of the engines, or the first detection in order,
+// which in sequence skips the engines after it
+type CompositeEngine struct {
+	Engines  []ScanEngine
+	Mode     string
+	Strategy string
+}
+
+// engineOutcome is what one engine of a composite returned
+type engineOutcome struct {
+	engine  string
+	verdict *EngineVerdict
+	err     error
+}
+
+// Name implements ScanEngine
+func (c *CompositeEngine) Name() string {
+	return engineComposite
+}
+
+// Scan implements ScanEngine
+func (c *CompositeEngine) Scan(ctx context.Context, r io.Reader, timeout time.Duration) (*EngineVerdict, error) {
+	startTime := time.Now()
+	var outcomes []engineOutcome
+	var err error
+	if c.Mode == engineModeSequence {
+		outcomes, err = c.scanSequence(ctx, r, timeout)
+	} else {
+		outcomes, err = c.scanParallel(ctx, r, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range outcomes {
+		status := "ERROR"
+		if o.err == nil {
+			status = o.verdict.Status
+		}
+		engineVerdictsTotal.WithLabelValues(o.engine, status).Inc()
+	}
+	verdict, err := c.combine(outcomes)
+	if verdict != nil {
+		verdict.ScanTime = time.Since(startTime).Seconds()
+	}
+	return verdict, err
+}
+
+// scanEngine runs one engine of the composite in its own span
+func (c *CompositeEngine) scanEngine(ctx context.Context, engine ScanEngine, r io.Reader, timeout time.Duration) engineOutcome {
+	ctx, span := tracer().Start(ctx, "scan.engine", trace.WithAttributes(attrScanEngine.String(engine.Name())))
+	defer span.End()
+
+	verdict, err := engine.Scan(ctx, r, timeout)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		loggerFromContext(ctx).Debug("Scan engine failed", zap.String("engine", engine.Name()), zap.Error(err))
+	} else {
+		span.SetAttributes(attrScanVerdict.String(verdict.Status))
+	}
+	return engineOutcome{engine: engine.Name(), verdict: verdict, err: err}
+}
+
+// scanParallel streams the payload to every engine at once. An engine
+// that stops reading early no longer holds up the others.
+func (c *CompositeEngine) scanParallel(ctx context.Context, r io.Reader, timeout time.Duration) ([]engineOutcome, error) {
+	outcomes := make([]engineOutcome, len(c.Engines))
+	writers := make([]*io.PipeWriter, len(c.Engines))
+	var wg sync.WaitGroup
+	for i, engine := range c.Engines {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes[i] = c.scanEngine(ctx, engine, pr, timeout)
+			pr.CloseWithError(errEngineDone)
+		}()
+	}
+
+	buf := make([]byte, 32*1024)
+	var readErr error
+	for listening := len(writers); readErr == nil && listening > 0; {
+		var n int
+		n, readErr = r.Read(buf)
+		for i, w := range writers {
+			if w == nil || n == 0 {
+				continue
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				writers[i] = nil
+				listening--
+			}
+		}
+	}
+	if readErr == io.EOF {
+		readErr = nil
+	}
+	for _, w := range writers {
+		if w != nil {
+			w.CloseWithError(readErr)
+		}
+	}
+	wg.Wait()
+
+	// The engines only saw part of a payload that could not be read
+	if readErr != nil {
+		return nil, readErr
+	}
+	return outcomes, nil
+}
+
+// errEngineDone stops the copy to an engine that returned
+var errEngineDone = errors.New("scan engine done")
+
+// scanSequence buffers the payload, spilling to disk like other buffered
+// payloads, and replays it to each engine in turn. A payload over
+// MaxContentLength fails with errPayloadTooLarge.
+func (c *CompositeEngine) scanSequence(ctx context.Context, r io.Reader, timeout time.Duration) ([]engineOutcome, error) {
+	cfg := currentConfig()
+	spool, err := spoolReader(r, cfg.MaxContentLength, cfg.SpoolThreshold, cfg.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Close()
+
+	var outcomes []engineOutcome
+	for _, engine := range c.Engines {
+		payload, err := spool.Reader()
+		if err != nil {
+			return nil, err
+		}
+		outcome := c.scanEngine(ctx, engine, payload, timeout)
+		outcomes = append(outcomes, outcome)
+		if c.Strategy == engineStrategyFirstMatch && outcome.err == nil && outcome.verdict.Status == "FOUND" {
+			break
+		}
+	}
+	return outcomes, nil
+}
+
+// combine reduces the outcomes to one verdict with the composite's
+// strategy, keeping the rules every engine matched. Failed engines cannot
+// vouch for a payload: when they could have changed the verdict, the
+// first failure is returned instead.
+func (c *CompositeEngine) combine(outcomes []engineOutcome) (*EngineVerdict, error) {
+	verdict := &EngineVerdict{Engine: engineComposite, Status: "OK"}
+	var found *EngineVerdict
+	var firstErr error
+	detections, failures := 0, 0
+	for _, o := range outcomes {
+		if o.err != nil {
+			failures++
+			if firstErr == nil {
+				firstErr = o.err
+			}
+			verdict.Engines = append(verdict.Engines, EngineVerdict{Engine: o.engine, Status: "ERROR", Description: o.err.Error()})
+			continue
+		}
+		verdict.Engines = append(verdict.Engines, *o.verdict)
+		verdict.Matches = append(verdict.Matches, o.verdict.Matches...)
+		if o.verdict.Status == "FOUND" {
+			detections++
+			if found == nil {
+				found = o.verdict
+			}
+		}
+	}
+
+	needed := 1
+	if c.Strategy == engineStrategyMajority {
+		needed = len(c.Engines)/2 + 1
+	}
+	switch {
+	case detections >= needed:
+		verdict.Status = "FOUND"
+		verdict.Description = found.Description
+	case detections+failures >= needed:
+		return nil, firstErr
+	}
+	return verdict, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngine returns a fixed verdict or error, after reading the payload
+// unless skipRead is set
+type fakeEngine struct {
+	name        string
+	status      string
+	description string
+	err         error
+	skipRead    bool
+	payload     []byte
+}
+
+func (e *fakeEngine) Name() string {
+	return e.name
+}
+
+func (e *fakeEngine) Scan(ctx context.Context, r io.Reader, timeout time.Duration) (*EngineVerdict, error) {
+	if !e.skipRead {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		e.payload = data
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return &EngineVerdict{Engine: e.name, Status: e.status, Description: e.description}, nil
+}
+
+func found(name, virus string) *fakeEngine {
+	return &fakeEngine{name: name, status: "FOUND", description: virus}
+}
+
+func clean(name string) *fakeEngine {
+	return &fakeEngine{name: name, status: "OK"}
+}
+
+func failing(name string) *fakeEngine {
+	return &fakeEngine{name: name, err: &ScanEngineError{Description: name + " failed"}}
+}
+
+// withEngines scans with the given engines for the duration of a test,
+// registering the fakes among them
+func withEngines(t *testing.T, mode, strategy string, engines ...ScanEngine) {
+	t.Helper()
+	origEngines, origMode, origStrategy := config.Engines, config.EngineMode, config.EngineStrategy
+	config.Engines, config.EngineMode, config.EngineStrategy = nil, mode, strategy
+	for _, engine := range engines {
+		name := engine.Name()
+		if _, ok := scanEngines[name]; !ok {
+			scanEngines[name] = func(*Config) ScanEngine { return engine }
+			t.Cleanup(func() { delete(scanEngines, name) })
+		}
+		config.Engines = append(config.Engines, name)
+	}
+	t.Cleanup(func() { config.Engines, config.EngineMode, config.EngineStrategy = origEngines, origMode, origStrategy })
+}
+
+func TestCompositeEngineStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		engines  []ScanEngine
+		want     string
+		virus    string
+		wantErr  bool
+	}{
+		{"any detects", engineStrategyAny, []ScanEngine{clean("a"), found("b", "Incident.B"), clean("c")}, "FOUND", "Incident.B", false},
+		{"any clean", engineStrategyAny, []ScanEngine{clean("a"), clean("b")}, "OK", "", false},
+		{"any detection outweighs a failure", engineStrategyAny, []ScanEngine{failing("a"), found("b", "Incident.B")}, "FOUND", "Incident.B", false},
+		{"any failure cannot vouch", engineStrategyAny, []ScanEngine{clean("a"), failing("b")}, "", "", true},
+		{"majority reached", engineStrategyMajority, []ScanEngine{found("a", "Incident.A"), found("b", "Incident.B"), clean("c")}, "FOUND", "Incident.A", false},
+		{"majority missed", engineStrategyMajority, []ScanEngine{found("a", "Incident.A"), clean("b"), clean("c")}, "OK", "", false},
+		{"majority missed despite a failure", engineStrategyMajority, []ScanEngine{clean("a"), clean("b"), failing("c")}, "OK", "", false},
+		{"majority undecided", engineStrategyMajority, []ScanEngine{found("a", "Incident.A"), failing("b"), clean("c")}, "", "", true},
+		{"first match", engineStrategyFirstMatch, []ScanEngine{clean("a"), found("b", "Incident.B"), found("c", "Incident.C")}, "FOUND", "Incident.B", false},
+	}
+
+	for _, tt := range tests {
+		for _, mode := range []string{engineModeParallel, engineModeSequence} {
+			if tt.strategy == engineStrategyFirstMatch && mode == engineModeParallel {
+				continue
+			}
+			t.Run(tt.name+" "+mode, func(t *testing.T) {
+				composite := &CompositeEngine{Engines: tt.engines, Mode: mode, Strategy: tt.strategy}
+				verdict, err := composite.Scan(context.Background(), strings.NewReader("payload"), time.Second)
+				if tt.wantErr {
+					var engineErr *ScanEngineError
+					assert.ErrorAs(t, err, &engineErr)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, verdict.Status)
+				assert.Equal(t, tt.virus, verdict.Description)
+			})
+		}
+	}
+}
+
+func TestCompositeEngineReportsEachEngine(t *testing.T) {
+	composite := &CompositeEngine{
+		Engines:  []ScanEngine{clean("a"), found("b", "Incident.B"), failing("c")},
+		Mode:     engineModeParallel,
+		Strategy: engineStrategyAny,
+	}
+	before := getCounterValue(t, engineVerdictsTotal, "c", "ERROR")
+	verdict, err := composite.Scan(context.Background(), strings.NewReader("payload"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Incident.B", verdict.Description)
+	assert.Equal(t, []EngineVerdict{
+		{Engine: "a", Status: "OK"},
+		{Engine: "b", Status: "FOUND", Description: "Incident.B"},
+		{Engine: "c", Status: "ERROR", Description: "c failed"},
+	}, verdict.Engines)
+	assert.Equal(t, before+1, getCounterValue(t, engineVerdictsTotal, "c", "ERROR"))
+}
+
+func TestCompositeEngineSequenceFirstMatchSkipsRest(t *testing.T) {
+	first, second, third := clean("a"), found("b", "Incident.B"), clean("c")
+	composite := &CompositeEngine{Engines: []ScanEngine{first, second, third}, Mode: engineModeSequence, Strategy: engineStrategyFirstMatch}
+	verdict, err := composite.Scan(context.Background(), strings.NewReader("payload"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", verdict.Status)
+	assert.Len(t, verdict.Engines, 2)
+	assert.Equal(t, "payload", string(first.payload))
+	assert.Equal(t, "payload", string(second.payload))
+	assert.Nil(t, third.payload)
+}
+
+func TestCompositeEngineSequenceSizeLimit(t *testing.T) {
+	origMax := config.MaxContentLength
+	config.MaxContentLength = 16
+	t.Cleanup(func() { config.MaxContentLength = origMax })
+
+	reader := clean("reader")
+	composite := &CompositeEngine{Engines: []ScanEngine{reader, clean("b")}, Mode: engineModeSequence, Strategy: engineStrategyAny}
+	_, err := composite.Scan(context.Background(), strings.NewReader(strings.Repeat("x", 17)), time.Second)
+	assert.ErrorIs(t, err, errPayloadTooLarge)
+	assert.Nil(t, reader.payload)
+
+	verdict, err := composite.Scan(context.Background(), strings.NewReader(strings.Repeat("x", 16)), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "OK", verdict.Status)
+}
+
+func TestCompositeEngineParallelStreamsPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 20000)
+	early := &fakeEngine{name: "early", status: "OK", skipRead: true}
+	reader := clean("reader")
+	composite := &CompositeEngine{Engines: []ScanEngine{early, reader}, Mode: engineModeParallel, Strategy: engineStrategyAny}
+
+	verdict, err := composite.Scan(context.Background(), bytes.NewReader(payload), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "OK", verdict.Status)
+	assert.Equal(t, payload, reader.payload, "an engine that stops reading does not hold up the others")
+
+	readErr := errors.New("connection reset")
+	_, err = composite.Scan(context.Background(), io.MultiReader(bytes.NewReader(payload), iotest.ErrReader(readErr)), time.Second)
+	assert.ErrorIs(t, err, readErr)
+}
+
+func TestValidateEngines(t *testing.T) {
+	tests := []struct {
+		name      string
+		engines   []string
+		ruleFiles []string
+		mode      string
+		strategy  string
+		wantErr   string
+	}{
+		{"default", []string{engineClamd}, nil, engineModeParallel, engineStrategyAny, ""},
+		{"empty", nil, nil, engineModeParallel, engineStrategyAny, "engines must not be empty"},
+		{"unknown", []string{"clamd", "sophos"}, nil, engineModeParallel, engineStrategyAny, `unknown scan engine "sophos"`},
+		{"duplicate", []string{"clamd", "clamd"}, nil, engineModeParallel, engineStrategyAny, "listed more than once"},
+		{"bad mode", []string{engineClamd}, nil, "random", engineStrategyAny, "engine mode must be parallel or sequence"},
+		{"bad strategy", []string{engineClamd}, nil, engineModeSequence, "all", "engine strategy must be one of"},
+		{"first match in sequence", []string{engineClamd}, nil, engineModeSequence, engineStrategyFirstMatch, ""},
+		{"first match in parallel", []string{engineClamd}, nil, engineModeParallel, engineStrategyFirstMatch, "first-match needs engine mode sequence"},
+		{"rules without rule files", []string{engineClamd, engineRules}, nil, engineModeParallel, engineStrategyAny, "the rules engine needs rule-files"},
+		{"rule files without rules", []string{engineClamd}, []string{"/etc/rules/*.yar"}, engineModeParallel, engineStrategyAny, "add rules to engines"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEngines(&Config{Engines: tt.engines, RuleFiles: tt.ruleFiles, EngineMode: tt.mode, EngineStrategy: tt.strategy})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestScanWithSeveralEngines(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	inHouse := found("in-house", "InHouse.Dropper")
+	withEngines(t, engineModeParallel, engineStrategyAny, clamdEngine{}, inHouse)
+
+	result, err := performScan(context.Background(), strings.NewReader("payload"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", result.Status)
+	assert.Equal(t, "InHouse.Dropper", result.Description)
+	assert.Equal(t, int64(7), result.Size)
+	require.Len(t, result.Engines, 2)
+	assert.Equal(t, EngineVerdict{Engine: engineClamd, Status: "OK", ScanTime: result.Engines[0].ScanTime}, result.Engines[0])
+	assert.Equal(t, "payload", string(inHouse.payload))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/stream-scan", handleStreamScan)
+	req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"engines":[{"engine":"clamd","status":"OK"`)
+	assert.Contains(t, w.Body.String(), `{"engine":"in-house","status":"FOUND","message":"InHouse.Dropper","time":0}`)
+
+	client := getTestClient(t)
+	resp, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte("payload"), Filename: "setup.exe"})
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", resp.Status)
+	require.Len(t, resp.Engines, 2)
+	assert.Equal(t, "in-house", resp.Engines[1].Engine)
+	assert.Equal(t, "InHouse.Dropper", resp.Engines[1].Message)
+}
+
+func TestScanWithOneEngineOmitsEngines(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	result, err := performScan(context.Background(), strings.NewReader("payload"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "OK", result.Status)
+	assert.Empty(t, result.Engines)
+}
+
+func TestScanDetailsOnEveryScan(t *testing.T) {
+	detailed := func(ctx context.Context, r io.Reader) (*ScanResult, error) {
+		io.Copy(io.Discard, r)
+		return &ScanResult{
+			Status:      "FOUND",
+			Description: "Incident.B",
+			Engines:     []EngineVerdict{{Engine: "a", Status: "OK"}, {Engine: "b", Status: "FOUND", Description: "Incident.B"}},
+			Matches:     []RuleMatch{{Rule: "Incident.B"}},
+			Reputation:  &HashListHit{List: "intel", Action: hashListAllow, Hash: sha256Hex("payload")},
+			Override:    &AllowlistOverride{EntryID: "1", Virus: "Incident.A", Reason: "vetted"},
+		}, nil
+	}
+	objects, objectServer := newFakeS3(t)
+	objects.put("uploads", "file.bin", "payload", nil)
+	fileServer, _ := newFileServer(t, "payload")
+	server := &GRPCServer{
+		config: newLiveConfig(&config),
+		s3:     newTestS3Scanner(t, objectServer.URL, nil),
+		urls:   newTestURLScanner(t, nil),
+	}
+	server.s3.scan, server.urls.scan = detailed, detailed
+
+	object, err := server.ScanObject(context.Background(), &pb.ScanObjectRequest{Bucket: "uploads", Key: "file.bin"})
+	require.NoError(t, err)
+	assert.Len(t, object.Engines, 2)
+	assert.Len(t, object.Matches, 1)
+	assert.Equal(t, "intel", object.Reputation.GetList())
+	assert.Equal(t, "Incident.A", object.Override.GetVirus())
+
+	before := getCounterValue(t, scanRequestsTotal, "grpc_url", "found")
+	fetched, err := server.ScanURL(context.Background(), &pb.ScanURLRequest{Url: fileServer.URL + "/file.bin"})
+	require.NoError(t, err)
+	assert.Equal(t, before+1, getCounterValue(t, scanRequestsTotal, "grpc_url", "found"))
+	assert.Len(t, fetched.Engines, 2)
+	assert.Len(t, fetched.Matches, 1)
+	assert.Equal(t, "intel", fetched.Reputation.GetList())
+	assert.Equal(t, "Incident.A", fetched.Override.GetVirus())
+
+	withEngines(t, engineModeParallel, engineStrategyAny, clean("a"), found("b", "Incident.B"))
+	message, err := server.ScanMessage(context.Background(), &pb.ScanMessageRequest{Data: []byte(testMultipartMessage), Filename: "message.eml"})
+	require.NoError(t, err)
+	require.NotEmpty(t, message.Attachments)
+	for _, attachment := range message.Attachments {
+		require.Len(t, attachment.Engines, 2)
+		assert.Equal(t, "Incident.B", attachment.Engines[1].Message)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/scan-message", handleScanMessage)
+	req := httptest.NewRequest(http.MethodPost, "/api/scan-message", strings.NewReader(testMultipartMessage))
+	req.Header.Set("Content-Type", "message/rfc822")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `{"engine":"b","status":"FOUND","message":"Incident.B","time":0}`)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "clamav-api/proto"
+
+	"google.golang.org/grpc/health"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthServices are the services the health service reports on; ""
+// is the server as a whole
+var grpcHealthServices = []string{"", pb.ClamAVScanner_ServiceDesc.ServiceName}
+
+// GRPCHealth implements grpc.health.v1.Health, serving while the health
+// prober reports the server ready. Probes from Kubernetes or Envoy read
+// its cached state and never reach clamd.
+type GRPCHealth struct {
+	*health.Server
+	draining chan struct{}
+	once     sync.Once
+}
+
+// NewGRPCHealth creates the health service with every service NOT_SERVING
+// until setReady is called
+func NewGRPCHealth() *GRPCHealth {
+	h := &GRPCHealth{
+		Server:   health.NewServer(),
+		draining: make(chan struct{}),
+	}
+	h.setReady(false)
+	return h
+}
+
+// setReady updates the serving status of every service. It is a
+// HealthProber subscriber.
+func (h *GRPCHealth) setReady(ready bool) {
+	servingStatus := healthgrpc.HealthCheckResponse_NOT_SERVING
+	if ready {
+		servingStatus = healthgrpc.HealthCheckResponse_SERVING
+	}
+	for _, service := range grpcHealthServices {
+		h.SetServingStatus(service, servingStatus)
+	}
+}
+
+// Shutdown sets every service NOT_SERVING for good; later readiness
+// changes cannot bring it back. Watch streams end once they have delivered
+// NOT_SERVING, so they do not hold up GracefulStop.
+func (h *GRPCHealth) Shutdown() {
+	h.once.Do(func() {
+		h.Server.Shutdown()
+		close(h.draining)
+	})
+}
+
+// Watch implements the Watch RPC, ending the stream after shutdown
+func (h *GRPCHealth) Watch(req *healthgrpc.HealthCheckRequest, stream healthgrpc.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	watch := &healthWatchStream{Health_WatchServer: stream, ctx: ctx, cancel: cancel}
+
+	go func() {
+		select {
+		case <-h.draining:
+			watch.endOnNotServing()
+		case <-ctx.Done():
+		}
+	}()
+
+	return h.Server.Watch(req, watch)
+}
+
+// healthWatchStream cancels a Watch stream once a status other than
+// SERVING has been sent after shutdown
+type healthWatchStream struct {
+	healthgrpc.Health_WatchServer
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	sent    bool
+	serving bool
+	ending  bool
+}
+
+func (s *healthWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *healthWatchStream) Send(resp *healthgrpc.HealthCheckResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.Health_WatchServer.Send(resp)
+	s.sent = true
+	s.serving = resp.Status == healthgrpc.HealthCheckResponse_SERVING
+	if s.ending && !s.serving {
+		s.cancel()
+	}
+	return err
+}
+
+// endOnNotServing ends the stream now if the client already knows the
+// service is not serving, or after the pending NOT_SERVING update is sent
+func (s *healthWatchStream) endOnNotServing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ending = true
+	if s.sent && !s.serving {
+		s.cancel()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startHealthServer serves h on an in-memory listener and returns the
+// server and a client for it
+func startHealthServer(t *testing.T, h *GRPCHealth) (*grpc.Server, healthgrpc.HealthClient) {
+	t.Helper()
+	lis := bufconn.Listen(bufSize)
+	srv := grpc.NewServer()
+	healthgrpc.RegisterHealthServer(srv, h)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return srv, healthgrpc.NewHealthClient(conn)
+}
+
+func TestGRPCHealthFollowsReadiness(t *testing.T) {
+	h := NewGRPCHealth()
+	_, client := startHealthServer(t, h)
+	ctx := context.Background()
+	scanner := pb.ClamAVScanner_ServiceDesc.ServiceName
+
+	resp, err := client.Check(ctx, &healthgrpc.HealthCheckRequest{Service: scanner})
+	require.NoError(t, err)
+	assert.Equal(t, healthgrpc.HealthCheckResponse_NOT_SERVING, resp.Status, "not serving before the first probe")
+
+	cfg := defaultConfig()
+	cfg.HealthFailureThreshold = 1
+	prober := NewHealthProber(newLiveConfig(&cfg))
+	withFakeClamd(t, "stream: OK")
+	prober.probe()
+	prober.Subscribe(h.setReady)
+	for _, service := range []string{"", scanner} {
+		resp, err := client.Check(ctx, &healthgrpc.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		assert.Equal(t, healthgrpc.HealthCheckResponse_SERVING, resp.Status, service)
+	}
+
+	withInvalidSocket(t)
+	prober.probe()
+	resp, err = client.Check(ctx, &healthgrpc.HealthCheckRequest{Service: scanner})
+	require.NoError(t, err)
+	assert.Equal(t, healthgrpc.HealthCheckResponse_NOT_SERVING, resp.Status)
+}
+
+func TestGRPCHealthWatchEndsOnShutdown(t *testing.T) {
+	h := NewGRPCHealth()
+	h.setReady(true)
+	srv, client := startHealthServer(t, h)
+
+	stream, err := client.Watch(context.Background(), &healthgrpc.HealthCheckRequest{})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthgrpc.HealthCheckResponse_SERVING, resp.Status)
+
+	h.Shutdown()
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthgrpc.HealthCheckResponse_NOT_SERVING, resp.Status)
+	_, err = stream.Recv()
+	assert.Error(t, err, "stream ends after NOT_SERVING")
+
+	// Readiness changes after shutdown cannot bring the service back
+	h.setReady(true)
+	check, err := client.Check(context.Background(), &healthgrpc.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthgrpc.HealthCheckResponse_NOT_SERVING, check.Status)
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GracefulStop blocked by a Watch stream")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	pb "clamav-api/proto"
 
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -17,29 +18,54 @@ import (
 // GRPCServer implements the ClamAV gRPC service
 type GRPCServer struct {
 	pb.UnimplementedClamAVScannerServer
-	config *Config
+	config *liveConfig
+	s3     *S3Scanner
+	urls   *URLScanner
 }
 
 // NewGRPCServer creates a new gRPC server instance with the given config
 func NewGRPCServer(cfg *Config) *GRPCServer {
-	return &GRPCServer{config: cfg}
+	s := &GRPCServer{config: newLiveConfig(cfg)}
+	if cfg.S3Endpoint != "" {
+		s3Scanner, err := NewS3Scanner(cfg)
+		if err != nil {
+			GetLogger().Error("S3 integration disabled for gRPC", zap.Error(err))
+		}
+		s.s3 = s3Scanner
+	}
+	if cfg.EnableURLScan {
+		s.urls = NewURLScanner(cfg)
+	}
+	return s
+}
+
+// Reload applies a reloaded configuration, including to the S3 and URL
+// scanners
+func (s *GRPCServer) Reload(cfg *Config) error {
+	s.config.Store(cfg)
+	if s.urls != nil {
+		if err := s.urls.Reload(cfg); err != nil {
+			return err
+		}
+	}
+	if s.s3 != nil {
+		return s.s3.Reload(cfg)
+	}
+	return nil
 }
 
 // HealthCheck implements the health check RPC
 func (s *GRPCServer) HealthCheck(ctx context.Context, req *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
-	logger := GetLogger()
+	logger := loggerFromContext(ctx)
 
-	// Single ping to check ClamAV availability
-	if err := pingClamd(); err != nil {
-		healthCheckStatus.Set(0)
-		logger.Warn("gRPC health check failed", zap.Error(err))
+	if check := healthProber.ClamdCheck(); !check.Healthy {
+		logger.Warn("gRPC health check failed", zap.String("last_error", check.LastError))
 		return &pb.HealthCheckResponse{
 			Status:  "unhealthy",
-			Message: fmt.Sprintf("ClamAV service unavailable: %v", err),
+			Message: fmt.Sprintf("ClamAV service unavailable: %s", check.LastError),
 		}, nil
 	}
 
-	healthCheckStatus.Set(1)
 	logger.Debug("gRPC health check passed")
 	return &pb.HealthCheckResponse{
 		Status:  "healthy",
@@ -49,56 +75,71 @@ func (s *GRPCServer) HealthCheck(ctx context.Context, req *pb.HealthCheckRequest
 
 // ScanFile implements the unary scan RPC
 func (s *GRPCServer) ScanFile(ctx context.Context, req *pb.ScanFileRequest) (*pb.ScanResponse, error) {
-	logger := GetLogger()
+	logger := loggerFromContext(ctx)
 
 	// Validate request
 	if len(req.Data) == 0 {
 		logger.Warn("gRPC scan rejected: empty file data")
+		recordRejection(transportGRPC, rejectInvalid)
 		return nil, status.Error(codes.InvalidArgument, "file data is required")
 	}
 
 	dataSize := int64(len(req.Data))
-	if dataSize > s.config.MaxContentLength {
+	if dataSize > s.config.Load().MaxContentLength {
 		logger.Warn("gRPC scan rejected: file too large",
 			zap.Int64("size", dataSize),
-			zap.Int64("max_allowed", s.config.MaxContentLength),
+			zap.Int64("max_allowed", s.config.Load().MaxContentLength),
 			zap.String("filename", req.Filename))
-		return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.MaxContentLength)
+		recordRejection(transportGRPC, rejectTooLarge)
+		return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
 	}
 
 	logger.Debug("gRPC scan started",
 		zap.String("filename", req.Filename),
 		zap.Int64("size", dataSize))
 
+	// The message is already in memory; holding it against the memory
+	// budget makes other payloads spill to disk while it is scanned
+	spoolBudget.hold(dataSize)
+	defer spoolBudget.release(dataSize)
+
 	reader := bytes.NewReader(req.Data)
 
 	scansInProgress.Inc()
 	defer scansInProgress.Dec()
-	result, err := performScan(ctx, reader, s.config.ScanTimeout)
+	result, err := performScan(withScanFilename(ctx, req.Filename), reader, s.config.Load().ScanTimeout)
 	recordScanMetrics("grpc_scan", result, err)
 
 	if err != nil {
-		return nil, mapScanErrorToGRPC(err)
+		return nil, mapScanErrorToGRPC(ctx, err)
 	}
 
 	logger.Info("gRPC scan completed",
 		zap.String("filename", req.Filename),
 		zap.String("status", result.Status),
 		zap.String("result", result.Description),
+		zap.String("action", result.Action),
 		zap.Float64("elapsed_seconds", result.ScanTime))
 
 	return &pb.ScanResponse{
-		Status:   result.Status,
-		Message:  result.Description,
-		ScanTime: result.ScanTime,
-		Filename: req.Filename,
+		Status:     result.Status,
+		Message:    result.Description,
+		ScanTime:   result.ScanTime,
+		Filename:   req.Filename,
+		Action:     result.Action,
+		Policy:     result.Policy,
+		Override:   overrideToProto(result.Override),
+		Engines:    enginesToProto(result.Engines),
+		Matches:    matchesToProto(result.Matches),
+		Reputation: reputationToProto(result.Reputation),
 	}, nil
 }
 
 // ScanStream implements the client streaming scan RPC
 func (s *GRPCServer) ScanStream(stream pb.ClamAVScanner_ScanStreamServer) error {
-	logger := GetLogger()
-	var buffer bytes.Buffer
+	logger := loggerFromContext(stream.Context())
+	spool := NewSpool(s.config.Load().SpoolThreshold, "")
+	defer spool.Close()
 	var filename string
 	var totalSize int64
 
@@ -119,15 +160,16 @@ func (s *GRPCServer) ScanStream(stream pb.ClamAVScanner_ScanStreamServer) error
 		}
 
 		chunkSize := int64(len(req.Chunk))
-		if totalSize+chunkSize > s.config.MaxContentLength {
+		if totalSize+chunkSize > s.config.Load().MaxContentLength {
 			logger.Warn("gRPC stream scan rejected: file too large",
 				zap.String("filename", filename),
 				zap.Int64("total_size", totalSize+chunkSize),
-				zap.Int64("max_allowed", s.config.MaxContentLength))
-			return status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.MaxContentLength)
+				zap.Int64("max_allowed", s.config.Load().MaxContentLength))
+			recordRejection(transportGRPC, rejectTooLarge)
+			return status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
 		}
 
-		if _, err := buffer.Write(req.Chunk); err != nil {
+		if _, err := spool.Write(req.Chunk); err != nil {
 			return status.Errorf(codes.Internal, "failed to write chunk: %v", err)
 		}
 
@@ -138,28 +180,38 @@ func (s *GRPCServer) ScanStream(stream pb.ClamAVScanner_ScanStreamServer) error
 		}
 	}
 
-	reader := bytes.NewReader(buffer.Bytes())
+	reader, err := spool.Reader()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read buffered file: %v", err)
+	}
 
 	scansInProgress.Inc()
 	defer scansInProgress.Dec()
-	result, err := performScan(stream.Context(), reader, s.config.ScanTimeout)
+	result, err := performScan(withScanFilename(stream.Context(), filename), reader, s.config.Load().ScanTimeout)
 	recordScanMetrics("grpc_stream_scan", result, err)
 
 	if err != nil {
-		return mapScanErrorToGRPC(err)
+		return mapScanErrorToGRPC(stream.Context(), err)
 	}
 
 	return stream.SendAndClose(&pb.ScanResponse{
-		Status:   result.Status,
-		Message:  result.Description,
-		ScanTime: result.ScanTime,
-		Filename: filename,
+		Status:     result.Status,
+		Message:    result.Description,
+		ScanTime:   result.ScanTime,
+		Filename:   filename,
+		Action:     result.Action,
+		Policy:     result.Policy,
+		Override:   overrideToProto(result.Override),
+		Engines:    enginesToProto(result.Engines),
+		Matches:    matchesToProto(result.Matches),
+		Reputation: reputationToProto(result.Reputation),
 	})
 }
 
 // ScanMultiple implements the bidirectional streaming scan RPC
 func (s *GRPCServer) ScanMultiple(stream pb.ClamAVScanner_ScanMultipleServer) error {
-	var buffer bytes.Buffer
+	spool := NewSpool(s.config.Load().SpoolThreshold, "")
+	defer spool.Close()
 	var filename string
 	var totalSize int64
 
@@ -173,26 +225,27 @@ func (s *GRPCServer) ScanMultiple(stream pb.ClamAVScanner_ScanMultipleServer) er
 		}
 
 		chunkSize := int64(len(req.Chunk))
-		if totalSize+chunkSize > s.config.MaxContentLength {
-			return status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.MaxContentLength)
+		if totalSize+chunkSize > s.config.Load().MaxContentLength {
+			recordRejection(transportGRPC, rejectTooLarge)
+			return status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
 		}
 
 		if filename == "" && req.Filename != "" {
 			filename = req.Filename
 		}
 
-		if _, err := buffer.Write(req.Chunk); err != nil {
+		if _, err := spool.Write(req.Chunk); err != nil {
 			return status.Errorf(codes.Internal, "failed to write chunk: %v", err)
 		}
 
 		totalSize += chunkSize
 
 		if req.IsLast {
-			if err := s.scanAndRespond(&buffer, filename, stream); err != nil {
+			if err := s.scanAndRespond(spool, filename, stream); err != nil {
 				return err
 			}
 
-			buffer.Reset()
+			spool.Close()
 			filename = ""
 			totalSize = 0
 		}
@@ -201,12 +254,15 @@ func (s *GRPCServer) ScanMultiple(stream pb.ClamAVScanner_ScanMultipleServer) er
 
 // scanAndRespond scans buffered data and sends the result on the stream.
 // Using a separate method scopes the defer for scansInProgress correctly per file.
-func (s *GRPCServer) scanAndRespond(buffer *bytes.Buffer, filename string, stream pb.ClamAVScanner_ScanMultipleServer) error {
+func (s *GRPCServer) scanAndRespond(spool *Spool, filename string, stream pb.ClamAVScanner_ScanMultipleServer) error {
 	scansInProgress.Inc()
 	defer scansInProgress.Dec()
 
-	reader := bytes.NewReader(buffer.Bytes())
-	result, err := performScan(stream.Context(), reader, s.config.ScanTimeout)
+	reader, err := spool.Reader()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read buffered file: %v", err)
+	}
+	result, err := performScan(withScanFilename(stream.Context(), filename), reader, s.config.Load().ScanTimeout)
 	recordScanMetrics("grpc_scan_multiple", result, err)
 
 	if err != nil {
@@ -218,27 +274,245 @@ func (s *GRPCServer) scanAndRespond(buffer *bytes.Buffer, filename string, strea
 	}
 
 	return stream.Send(&pb.ScanResponse{
-		Status:   result.Status,
-		Message:  result.Description,
-		ScanTime: result.ScanTime,
-		Filename: filename,
+		Status:     result.Status,
+		Message:    result.Description,
+		ScanTime:   result.ScanTime,
+		Filename:   filename,
+		Action:     result.Action,
+		Policy:     result.Policy,
+		Override:   overrideToProto(result.Override),
+		Engines:    enginesToProto(result.Engines),
+		Matches:    matchesToProto(result.Matches),
+		Reputation: reputationToProto(result.Reputation),
 	})
 }
 
+// ScanMessage implements the RFC 5322/MIME message scan RPC
+func (s *GRPCServer) ScanMessage(ctx context.Context, req *pb.ScanMessageRequest) (*pb.ScanMessageResponse, error) {
+	logger := loggerFromContext(ctx)
+
+	if len(req.Data) == 0 {
+		logger.Warn("gRPC message scan rejected: empty message data")
+		recordRejection(transportGRPC, rejectInvalid)
+		return nil, status.Error(codes.InvalidArgument, "message data is required")
+	}
+	if int64(len(req.Data)) > s.config.Load().MaxContentLength {
+		logger.Warn("gRPC message scan rejected: message too large",
+			zap.Int("size", len(req.Data)),
+			zap.Int64("max_allowed", s.config.Load().MaxContentLength),
+			zap.String("filename", req.Filename))
+		recordRejection(transportGRPC, rejectTooLarge)
+		return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
+	}
+
+	msg, err := parseMessage(bytes.NewReader(req.Data), s.config.Load().MaxContentLength)
+	if errors.Is(err, errMessageTooLarge) {
+		recordRejection(transportGRPC, rejectTooLarge)
+		return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
+	}
+	if err != nil {
+		recordRejection(transportGRPC, rejectInvalid)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid message: %v", err)
+	}
+
+	results := scanMessageParts(ctx, msg, "grpc_scan_message", s.config.Load().ScanTimeout)
+	summary, err := summarizeMessageResults(results)
+	if err != nil {
+		return nil, mapScanErrorToGRPC(ctx, err)
+	}
+
+	logger.Info("gRPC message scan completed",
+		zap.String("filename", req.Filename),
+		zap.String("subject", msg.Subject),
+		zap.Int("parts", len(results)),
+		zap.String("status", summary.Status),
+		zap.String("result", summary.Description),
+		zap.String("action", summary.Action),
+		zap.Float64("elapsed_seconds", summary.ScanTime))
+
+	attachments := make([]*pb.AttachmentResult, 0, len(results))
+	for _, r := range results {
+		partStatus, message, scanTime := partVerdict(r)
+		action, policy := partPolicy(r)
+		attachment := &pb.AttachmentResult{
+			Part:        r.Part.Path,
+			Filename:    r.Part.Filename,
+			ContentType: r.Part.ContentType,
+			Size:        int64(len(r.Part.Data)),
+			Status:      partStatus,
+			Message:     message,
+			ScanTime:    scanTime,
+			Action:      action,
+			Policy:      policy,
+		}
+		if r.Err == nil {
+			attachment.Override = overrideToProto(r.Result.Override)
+			attachment.Engines = enginesToProto(r.Result.Engines)
+			attachment.Matches = matchesToProto(r.Result.Matches)
+			attachment.Reputation = reputationToProto(r.Result.Reputation)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return &pb.ScanMessageResponse{
+		Status:      summary.Status,
+		Message:     summary.Description,
+		ScanTime:    summary.ScanTime,
+		Filename:    req.Filename,
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		MessageId:   msg.MessageID,
+		Date:        msg.Date,
+		Attachments: attachments,
+		Action:      summary.Action,
+		Policy:      summary.Policy,
+	}, nil
+}
+
+// ScanObject implements the S3 object scan RPC
+func (s *GRPCServer) ScanObject(ctx context.Context, req *pb.ScanObjectRequest) (*pb.ScanObjectResponse, error) {
+	if s.s3 == nil {
+		return nil, status.Error(codes.FailedPrecondition, "S3 integration is not configured")
+	}
+	if req.Bucket == "" || req.Key == "" {
+		recordRejection(transportGRPC, rejectInvalid)
+		return nil, status.Error(codes.InvalidArgument, "bucket and key are required")
+	}
+
+	scanned, err := s.s3.ScanObject(ctx, req.Bucket, req.Key)
+	if err != nil {
+		var s3Err *S3Error
+		switch {
+		case errors.Is(err, errPayloadTooLarge):
+			recordRejection(transportGRPC, rejectTooLarge)
+			return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
+		case errors.Is(err, errBucketNotAllowed):
+			recordRejection(transportGRPC, rejectUnauthorized)
+			return nil, status.Errorf(codes.PermissionDenied, "bucket %q is not allowed", req.Bucket)
+		case errors.As(err, &s3Err) && s3Err.StatusCode == 404:
+			return nil, status.Error(codes.NotFound, "object not found")
+		case errors.Is(err, errObjectStorage):
+			return nil, status.Errorf(codes.Unavailable, "%v", err)
+		}
+		return nil, mapScanErrorToGRPC(ctx, err)
+	}
+
+	return &pb.ScanObjectResponse{
+		Status:      scanned.Result.Status,
+		Message:     scanned.Result.Description,
+		ScanTime:    scanned.Result.ScanTime,
+		Bucket:      scanned.Bucket,
+		Key:         scanned.Key,
+		Size:        scanned.Size,
+		Quarantined: scanned.Quarantined,
+		Action:      scanned.Result.Action,
+		Policy:      scanned.Result.Policy,
+		Override:    overrideToProto(scanned.Result.Override),
+		Engines:     enginesToProto(scanned.Result.Engines),
+		Matches:     matchesToProto(scanned.Result.Matches),
+		Reputation:  reputationToProto(scanned.Result.Reputation),
+	}, nil
+}
+
+// ScanURL implements the scan-by-URL RPC
+func (s *GRPCServer) ScanURL(ctx context.Context, req *pb.ScanURLRequest) (*pb.ScanURLResponse, error) {
+	if s.urls == nil {
+		return nil, status.Error(codes.FailedPrecondition, "URL scanning is not enabled")
+	}
+	if req.Url == "" {
+		recordRejection(transportGRPC, rejectInvalid)
+		return nil, status.Error(codes.InvalidArgument, "url is required")
+	}
+
+	scanned, err := s.urls.ScanURL(ctx, req.Url, "grpc_url")
+	if err != nil {
+		switch {
+		case errors.Is(err, errURLNotAllowed):
+			recordRejection(transportGRPC, rejectInvalid)
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		case errors.Is(err, errPayloadTooLarge):
+			recordRejection(transportGRPC, rejectTooLarge)
+			return nil, status.Errorf(codes.InvalidArgument, "file too large, maximum size is %d bytes", s.config.Load().MaxContentLength)
+		case errors.Is(err, errURLFetchTimeout):
+			return nil, status.Errorf(codes.DeadlineExceeded, "%v", err)
+		case errors.Is(err, errURLFetch):
+			return nil, status.Errorf(codes.Unavailable, "%v", err)
+		}
+		return nil, mapScanErrorToGRPC(ctx, err)
+	}
+
+	return &pb.ScanURLResponse{
+		Status:     scanned.Result.Status,
+		Message:    scanned.Result.Description,
+		ScanTime:   scanned.Result.ScanTime,
+		Url:        scanned.URL,
+		Size:       scanned.Size,
+		Action:     scanned.Result.Action,
+		Policy:     scanned.Result.Policy,
+		Override:   overrideToProto(scanned.Result.Override),
+		Engines:    enginesToProto(scanned.Result.Engines),
+		Matches:    matchesToProto(scanned.Result.Matches),
+		Reputation: reputationToProto(scanned.Result.Reputation),
+	}, nil
+}
+
 // mapScanErrorToGRPC converts scan errors to appropriate gRPC status errors.
-// Uses errors.As/errors.Is so wrapped errors are recognized.
-func mapScanErrorToGRPC(err error) error {
+// Uses errors.As/errors.Is so wrapped errors are recognized. The request ID
+// in ctx is attached as a RequestInfo detail.
+func mapScanErrorToGRPC(ctx context.Context, err error) error {
 	var timeoutErr *ScanTimeoutError
 	var engineErr *ScanEngineError
+	var canceledErr *ScanCanceledError
 
+	var st *status.Status
 	switch {
+	case errors.Is(err, errServerDraining):
+		recordRejection(transportGRPC, rejectDraining)
+		st = status.New(codes.Unavailable, err.Error())
+	case errors.As(err, &canceledErr):
+		st = status.New(codes.Unavailable, canceledErr.Error())
 	case errors.Is(err, context.Canceled):
-		return status.Error(codes.Canceled, "request canceled by client")
+		st = status.New(codes.Canceled, "request canceled by client")
 	case errors.As(err, &timeoutErr):
-		return status.Error(codes.DeadlineExceeded, timeoutErr.Error())
+		st = status.New(codes.DeadlineExceeded, timeoutErr.Error())
 	case errors.As(err, &engineErr):
-		return status.Errorf(codes.Internal, "scan error: %s", engineErr.Error())
+		st = status.Newf(codes.Internal, "scan error: %s", engineErr.Error())
 	default:
-		return status.Errorf(codes.Internal, "scan failed: %v", err)
+		st = status.Newf(codes.Internal, "scan failed: %v", err)
+	}
+
+	if id := requestIDFromContext(ctx); id != "" {
+		if detailed, detailErr := st.WithDetails(&errdetails.RequestInfo{RequestId: id}); detailErr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+// enginesToProto converts each engine's verdict for a gRPC response
+func enginesToProto(verdicts []EngineVerdict) []*pb.EngineVerdict {
+	var resp []*pb.EngineVerdict
+	for _, v := range verdicts {
+		resp = append(resp, &pb.EngineVerdict{Engine: v.Engine, Status: v.Status, Message: v.Description, ScanTime: v.ScanTime, Matches: matchesToProto(v.Matches)})
+	}
+	return resp
+}
+
+// reputationToProto converts the hash list entry that decided a verdict
+// for a gRPC response
+func reputationToProto(hit *HashListHit) *pb.HashListHit {
+	if hit == nil {
+		return nil
+	}
+	return &pb.HashListHit{List: hit.List, Action: hit.Action, Hash: hit.Hash, Label: hit.Label}
+}
+
+// matchesToProto converts the rules matched for a gRPC response
+func matchesToProto(matches []RuleMatch) []*pb.RuleMatch {
+	var resp []*pb.RuleMatch
+	for _, m := range matches {
+		resp = append(resp, &pb.RuleMatch{Rule: m.Rule, Tags: m.Tags})
 	}
+	return resp
 }
@@ -27,14 +27,43 @@ var lis *bufconn.Listener
 func init() {
 	// Initialize config for tests
 	config = Config{
-		Debug:            false,
-		ClamdUnixSocket:  getEnvWithDefault("CLAMAV_SOCKET", "/var/run/clamav/clamd.ctl"),
-		MaxContentLength: 209715200,
-		Host:             "0.0.0.0",
-		Port:             "6000",
-		GRPCPort:         "9000",
-		ScanTimeout:      300 * time.Second,
-		EnableGRPC:       true,
+		Debug:               false,
+		ClamdUnixSocket:     getEnvWithDefault("CLAMAV_SOCKET", "/var/run/clamav/clamd.ctl"),
+		MaxContentLength:    209715200,
+		Host:                "0.0.0.0",
+		Port:                "6000",
+		GRPCPort:            "9000",
+		ScanTimeout:         300 * time.Second,
+		ShutdownTimeout:     30 * time.Second,
+		ScanDurationBuckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		EnableGRPC:          true,
+		SpoolThreshold:      10485760,
+		MemoryBudget:        536870912,
+
+		MilterPort:           "7357",
+		MilterInfectedAction: milterActionReject,
+		MilterErrorAction:    milterActionTempfail,
+		MilterOversizeAction: milterActionReject,
+		MilterAddHeader:      true,
+
+		ProxyPort:           "8080",
+		ProxyRoutes:         []string{"/"},
+		ProxyRejectStatus:   403,
+		ProxySpillThreshold: 10485760,
+
+		ClamdListenerPort: "3310",
+		ClamdAllowedNets:  []string{"127.0.0.0/8", "::1/128"},
+
+		WatchSettle:       5 * time.Second,
+		WatchPollInterval: 10 * time.Second,
+
+		S3Region:      "us-east-1",
+		S3PathStyle:   true,
+		S3VerdictMode: s3VerdictTags,
+
+		URLScanSchemes:      []string{"https"},
+		URLScanMaxRedirects: 3,
+		URLScanFetchTimeout: 60 * time.Second,
 	}
 
 	lis = bufconn.Listen(bufSize)
@@ -42,6 +71,8 @@ func init() {
 	s := grpc.NewServer(
 		grpc.MaxRecvMsgSize(maxMsgSize),
 		grpc.MaxSendMsgSize(maxMsgSize),
+		grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, requestIDUnaryInterceptor, apiKeyUnaryInterceptor),
+		grpc.ChainStreamInterceptor(metricsStreamInterceptor, requestIDStreamInterceptor, apiKeyStreamInterceptor),
 	)
 	pb.RegisterClamAVScannerServer(s, NewGRPCServer(&config))
 	go func() {
@@ -629,7 +660,7 @@ func TestMapScanErrorToGRPC(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			grpcErr := mapScanErrorToGRPC(tt.err)
+			grpcErr := mapScanErrorToGRPC(context.Background(), tt.err)
 			assert.Error(t, grpcErr)
 
 			st, ok := status.FromError(grpcErr)
@@ -705,3 +736,92 @@ func TestGRPCScanMultipleWithInvalidSocket(t *testing.T) {
 	assert.Equal(t, "ERROR", resp.Status)
 	assert.Contains(t, resp.Message, "clamd unavailable")
 }
+
+func TestGRPCScanMessageEmpty(t *testing.T) {
+	client := getTestClient(t)
+
+	_, err := client.ScanMessage(context.Background(), &pb.ScanMessageRequest{})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestGRPCScanMessageInvalid(t *testing.T) {
+	client := getTestClient(t)
+
+	_, err := client.ScanMessage(context.Background(), &pb.ScanMessageRequest{
+		Data: []byte("no headers here"),
+	})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), "invalid message")
+}
+
+func TestGRPCScanMessageWithInvalidSocket(t *testing.T) {
+	withInvalidSocket(t)
+
+	server := NewGRPCServer(&config)
+	_, err := server.ScanMessage(context.Background(), &pb.ScanMessageRequest{
+		Data:     []byte(testMultipartMessage),
+		Filename: "message.eml",
+	})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Internal, st.Code())
+}
+
+func TestGRPCScanObjectNotConfigured(t *testing.T) {
+	client := getTestClient(t)
+
+	_, err := client.ScanObject(context.Background(), &pb.ScanObjectRequest{Bucket: "uploads", Key: "file.bin"})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestGRPCScanURLNotEnabled(t *testing.T) {
+	client := getTestClient(t)
+
+	_, err := client.ScanURL(context.Background(), &pb.ScanURLRequest{Url: "https://example.com/file.bin"})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestGRPCScanURLRejectsBlockedAddress(t *testing.T) {
+	cfg := config
+	cfg.EnableURLScan = true
+	cfg.URLScanSchemes = []string{"http"}
+	server := NewGRPCServer(&cfg)
+
+	_, err := server.ScanURL(context.Background(), &pb.ScanURLRequest{Url: "http://169.254.169.254/latest/meta-data/"})
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), "is not public")
+}
+
+func TestGRPCScanMessageReportsAttachments(t *testing.T) {
+	client := getTestClient(t)
+
+	resp, err := client.ScanMessage(context.Background(), &pb.ScanMessageRequest{
+		Data:     []byte(testMultipartMessage),
+		Filename: "message.eml",
+	})
+	if err != nil {
+		t.Logf("ScanMessage failed (ClamAV may not be running): %v", err)
+		return
+	}
+
+	assert.Equal(t, "OK", resp.Status)
+	assert.Equal(t, "Quarterly report", resp.Subject)
+	assert.Len(t, resp.Attachments, 3)
+	assert.Equal(t, "message.eml", resp.Filename)
+}
@@ -5,13 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
 func handleScan(c *gin.Context) {
-	logger := GetLogger()
+	logger := requestLogger(c)
+	cfg := currentConfig()
 
 	// Get the uploaded file
 	file, header, err := c.Request.FormFile("file")
@@ -19,22 +21,26 @@ func handleScan(c *gin.Context) {
 		logger.Warn("File upload failed",
 			zap.String("client_ip", c.ClientIP()),
 			zap.Error(err))
+		recordRejection(transportREST, rejectInvalid)
 		c.JSON(400, gin.H{
-			"message": "Provide a single file",
+			"message":    "Provide a single file",
+			"request_id": requestID(c),
 		})
 		return
 	}
 	defer file.Close()
 
 	// Check file size against maximum allowed
-	if header.Size > config.MaxContentLength {
+	if header.Size > cfg.MaxContentLength {
 		logger.Warn("Scan rejected: file too large",
 			zap.String("filename", header.Filename),
 			zap.Int64("file_size", header.Size),
-			zap.Int64("max_allowed", config.MaxContentLength),
+			zap.Int64("max_allowed", cfg.MaxContentLength),
 			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectTooLarge)
 		c.JSON(413, gin.H{
-			"message": fmt.Sprintf("File too large. Maximum size is %d bytes", config.MaxContentLength),
+			"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", cfg.MaxContentLength),
+			"request_id": requestID(c),
 		})
 		return
 	}
@@ -46,7 +52,7 @@ func handleScan(c *gin.Context) {
 
 	scansInProgress.Inc()
 	defer scansInProgress.Dec()
-	result, scanErr := performScan(c.Request.Context(), file, config.ScanTimeout)
+	result, scanErr := performScan(withScanFilename(c.Request.Context(), header.Filename), file, cfg.ScanTimeout)
 	recordScanMetrics("rest_scan", result, scanErr)
 
 	if scanErr != nil {
@@ -58,18 +64,23 @@ func handleScan(c *gin.Context) {
 		zap.String("filename", header.Filename),
 		zap.String("status", result.Status),
 		zap.String("result", result.Description),
+		zap.String("action", result.Action),
 		zap.Float64("elapsed_seconds", result.ScanTime),
 		zap.String("client_ip", c.ClientIP()))
 
-	c.JSON(200, gin.H{
-		"status":  result.Status,
-		"message": result.Description,
-		"time":    result.ScanTime,
-	})
+	c.JSON(200, withScanDetails(gin.H{
+		"status":     result.Status,
+		"message":    result.Description,
+		"time":       result.ScanTime,
+		"action":     result.Action,
+		"policy":     result.Policy,
+		"request_id": requestID(c),
+	}, result))
 }
 
 func handleStreamScan(c *gin.Context) {
-	logger := GetLogger()
+	logger := requestLogger(c)
+	cfg := currentConfig()
 
 	// Validate request before doing any work
 	contentLength := c.Request.ContentLength
@@ -77,18 +88,22 @@ func handleStreamScan(c *gin.Context) {
 		logger.Warn("Stream scan rejected: missing or invalid Content-Length",
 			zap.Int64("content_length", contentLength),
 			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectInvalid)
 		c.JSON(400, gin.H{
-			"message": "Content-Length header is required and must be greater than 0",
+			"message":    "Content-Length header is required and must be greater than 0",
+			"request_id": requestID(c),
 		})
 		return
 	}
-	if contentLength > config.MaxContentLength {
+	if contentLength > cfg.MaxContentLength {
 		logger.Warn("Stream scan rejected: file too large",
 			zap.Int64("content_length", contentLength),
-			zap.Int64("max_allowed", config.MaxContentLength),
+			zap.Int64("max_allowed", cfg.MaxContentLength),
 			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectTooLarge)
 		c.JSON(413, gin.H{
-			"message": fmt.Sprintf("File too large. Maximum size is %d bytes", config.MaxContentLength),
+			"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", cfg.MaxContentLength),
+			"request_id": requestID(c),
 		})
 		return
 	}
@@ -102,12 +117,12 @@ func handleStreamScan(c *gin.Context) {
 	defer body.Close()
 	limitedReader := &io.LimitedReader{
 		R: body,
-		N: config.MaxContentLength,
+		N: cfg.MaxContentLength,
 	}
 
 	scansInProgress.Inc()
 	defer scansInProgress.Dec()
-	result, scanErr := performScan(c.Request.Context(), limitedReader, config.ScanTimeout)
+	result, scanErr := performScan(c.Request.Context(), limitedReader, cfg.ScanTimeout)
 	recordScanMetrics("rest_stream_scan", result, scanErr)
 
 	if scanErr != nil {
@@ -118,77 +133,163 @@ func handleStreamScan(c *gin.Context) {
 	logger.Info("Stream scan completed",
 		zap.String("status", result.Status),
 		zap.String("result", result.Description),
+		zap.String("action", result.Action),
 		zap.Int64("content_length", contentLength),
 		zap.Float64("elapsed_seconds", result.ScanTime),
 		zap.String("client_ip", c.ClientIP()))
 
-	c.JSON(200, gin.H{
-		"status":  result.Status,
-		"message": result.Description,
-		"time":    result.ScanTime,
-	})
+	c.JSON(200, withScanDetails(gin.H{
+		"status":     result.Status,
+		"message":    result.Description,
+		"time":       result.ScanTime,
+		"action":     result.Action,
+		"policy":     result.Policy,
+		"request_id": requestID(c),
+	}, result))
+}
+
+// withScanDetails adds to a REST response the allowlist override that
+// cleared a detection, each engine's verdict, the rules matched and the
+// hash list entry that decided the verdict, when there are any
+func withScanDetails(body gin.H, result *ScanResult) gin.H {
+	if result.Override != nil {
+		body["override"] = result.Override
+	}
+	if len(result.Engines) > 0 {
+		body["engines"] = result.Engines
+	}
+	if len(result.Matches) > 0 {
+		body["matches"] = result.Matches
+	}
+	if result.Reputation != nil {
+		body["reputation"] = result.Reputation
+	}
+	return body
 }
 
-// respondScanError maps scan errors to appropriate HTTP responses
+// respondScanError maps scan errors to appropriate HTTP responses. The
+// body carries the request ID so a failure reported by a client can be
+// matched with the server log.
 func respondScanError(c *gin.Context, logger *zap.Logger, err error, filename string) {
 	var timeoutErr *ScanTimeoutError
 	var engineErr *ScanEngineError
+	var canceledErr *ScanCanceledError
 
 	switch {
+	case errors.Is(err, errServerDraining):
+		recordRejection(transportREST, rejectDraining)
+		logger.Info("Scan rejected: server is shutting down",
+			zap.String("filename", filename))
+		c.JSON(503, gin.H{
+			"status":     "Service unavailable",
+			"message":    err.Error(),
+			"request_id": requestID(c),
+		})
+	case errors.As(err, &canceledErr):
+		logger.Warn("Scan canceled by server",
+			zap.String("filename", filename),
+			zap.String("reason", canceledErr.Reason))
+		c.JSON(503, gin.H{
+			"status":     "Scan canceled",
+			"message":    canceledErr.Error(),
+			"request_id": requestID(c),
+		})
 	case errors.As(err, &timeoutErr):
 		logger.Warn("Scan timeout",
 			zap.String("filename", filename),
 			zap.Float64("timeout_seconds", timeoutErr.Timeout.Seconds()))
 		c.JSON(504, gin.H{
-			"status":  "Scan timeout",
-			"message": timeoutErr.Error(),
+			"status":     "Scan timeout",
+			"message":    timeoutErr.Error(),
+			"request_id": requestID(c),
 		})
 	case errors.As(err, &engineErr):
 		logger.Error("Scan error",
 			zap.String("filename", filename),
 			zap.String("error", engineErr.Description))
 		c.JSON(502, gin.H{
-			"status":  "Clamd service down",
-			"message": engineErr.Description,
+			"status":     "Clamd service down",
+			"message":    engineErr.Description,
+			"request_id": requestID(c),
 		})
 	case errors.Is(err, context.Canceled):
 		logger.Info("Scan canceled by client",
 			zap.String("filename", filename))
 		c.JSON(499, gin.H{
-			"status":  "Client closed request",
-			"message": "request canceled by client",
+			"status":     "Client closed request",
+			"message":    "request canceled by client",
+			"request_id": requestID(c),
 		})
 	default:
 		logger.Error("Scan failed",
 			zap.String("filename", filename),
 			zap.Error(err))
 		c.JSON(502, gin.H{
-			"status":  "Clamd service down",
-			"message": "Scanning service unavailable",
+			"status":     "Clamd service down",
+			"message":    "Scanning service unavailable",
+			"request_id": requestID(c),
 		})
 	}
 }
 
+// handleHealthCheck reports whether clamd is reachable, as last seen by
+// the health prober
 func handleHealthCheck(c *gin.Context) {
-	logger := GetLogger()
+	logger := requestLogger(c)
 
-	// Single ping to check ClamAV availability
-	if err := pingClamd(); err != nil {
-		healthCheckStatus.Set(0)
-		logger.Warn("Health check failed", zap.Error(err))
+	if check := healthProber.ClamdCheck(); !check.Healthy {
+		logger.Warn("Health check failed", zap.String("last_error", check.LastError))
 		c.JSON(502, gin.H{
-			"message": "Clamd service unavailable",
+			"message":    "Clamd service unavailable",
+			"request_id": requestID(c),
 		})
 		return
 	}
 
-	healthCheckStatus.Set(1)
 	logger.Debug("Health check passed")
 	c.JSON(200, gin.H{
 		"message": "ok",
 	})
 }
 
+// handleLivez reports that the process is up. It does not depend on
+// clamd, so an orchestrator does not restart the API while clamd reloads.
+func handleLivez(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status": "alive",
+	})
+}
+
+// handleReadyz answers 200 while the server should receive traffic: clamd
+// is reachable, its signatures are fresh, the server is not draining and
+// the scan queue is not saturated. Otherwise it answers 503 naming the
+// failing checks.
+func handleReadyz(c *gin.Context) {
+	report := healthProber.Report()
+	if !report.Ready {
+		c.JSON(503, gin.H{
+			"status":     report.Status,
+			"failing":    report.failing(),
+			"request_id": requestID(c),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"status": report.Status,
+	})
+}
+
+// handleHealthReport returns every readiness check with its latency and
+// last error, with the status code of /readyz
+func handleHealthReport(c *gin.Context) {
+	report := healthProber.Report()
+	status := 200
+	if !report.Ready {
+		status = 503
+	}
+	c.JSON(status, report)
+}
+
 func handleVersion(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"version": Version,
@@ -196,3 +297,145 @@ func handleVersion(c *gin.Context) {
 		"build":   BuildTime,
 	})
 }
+
+func handleScanMessage(c *gin.Context) {
+	logger := requestLogger(c)
+	cfg := currentConfig()
+
+	// Accept either a multipart upload or the raw message as the request body
+	var body io.Reader
+	filename := "message.eml"
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			logger.Warn("Message upload failed",
+				zap.String("client_ip", c.ClientIP()),
+				zap.Error(err))
+			recordRejection(transportREST, rejectInvalid)
+			c.JSON(400, gin.H{
+				"message":    "Provide a single file",
+				"request_id": requestID(c),
+			})
+			return
+		}
+		defer file.Close()
+
+		if header.Size > cfg.MaxContentLength {
+			respondTooLarge(c, logger, header.Size)
+			return
+		}
+		body = file
+		filename = header.Filename
+	} else {
+		contentLength := c.Request.ContentLength
+		if contentLength <= 0 {
+			recordRejection(transportREST, rejectInvalid)
+			c.JSON(400, gin.H{
+				"message":    "Content-Length header is required and must be greater than 0",
+				"request_id": requestID(c),
+			})
+			return
+		}
+		if contentLength > cfg.MaxContentLength {
+			respondTooLarge(c, logger, contentLength)
+			return
+		}
+		defer c.Request.Body.Close()
+		body = &io.LimitedReader{R: c.Request.Body, N: cfg.MaxContentLength}
+	}
+
+	msg, err := parseMessage(body, cfg.MaxContentLength)
+	if errors.Is(err, errMessageTooLarge) {
+		// Decoding stops at the limit, so the decoded size is not known
+		logger.Warn("Message scan rejected: decoded parts too large",
+			zap.String("filename", filename),
+			zap.Int64("max_allowed", cfg.MaxContentLength),
+			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectTooLarge)
+		c.JSON(413, gin.H{
+			"message":    fmt.Sprintf("Message too large. Its decoded parts may total at most %d bytes", cfg.MaxContentLength),
+			"request_id": requestID(c),
+		})
+		return
+	}
+	if err != nil {
+		logger.Warn("Message scan rejected: invalid message",
+			zap.String("filename", filename),
+			zap.String("client_ip", c.ClientIP()),
+			zap.Error(err))
+		recordRejection(transportREST, rejectInvalid)
+		c.JSON(400, gin.H{
+			"message":    fmt.Sprintf("Invalid message: %v", err),
+			"request_id": requestID(c),
+		})
+		return
+	}
+
+	results := scanMessageParts(c.Request.Context(), msg, "rest_scan_message", cfg.ScanTimeout)
+	summary, scanErr := summarizeMessageResults(results)
+	if scanErr != nil {
+		respondScanError(c, logger, scanErr, filename)
+		return
+	}
+
+	logger.Info("Message scan completed",
+		zap.String("filename", filename),
+		zap.String("subject", msg.Subject),
+		zap.Int("parts", len(results)),
+		zap.String("status", summary.Status),
+		zap.String("result", summary.Description),
+		zap.String("action", summary.Action),
+		zap.Float64("elapsed_seconds", summary.ScanTime),
+		zap.String("client_ip", c.ClientIP()))
+
+	attachments := make([]gin.H, 0, len(results))
+	for _, r := range results {
+		status, message, scanTime := partVerdict(r)
+		action, policy := partPolicy(r)
+		attachment := gin.H{
+			"part":         r.Part.Path,
+			"filename":     r.Part.Filename,
+			"content_type": r.Part.ContentType,
+			"size":         len(r.Part.Data),
+			"status":       status,
+			"message":      message,
+			"time":         scanTime,
+			"action":       action,
+			"policy":       policy,
+		}
+		if r.Err == nil {
+			attachment = withScanDetails(attachment, r.Result)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	c.JSON(200, gin.H{
+		"status":      summary.Status,
+		"message":     summary.Description,
+		"time":        summary.ScanTime,
+		"action":      summary.Action,
+		"policy":      summary.Policy,
+		"from":        msg.From,
+		"to":          msg.To,
+		"subject":     msg.Subject,
+		"message_id":  msg.MessageID,
+		"date":        msg.Date,
+		"attachments": attachments,
+		"request_id":  requestID(c),
+	})
+}
+
+// respondTooLarge rejects a request whose payload of size bytes exceeds
+// MaxContentLength
+func respondTooLarge(c *gin.Context, logger *zap.Logger, size int64) {
+	cfg := currentConfig()
+	logger.Warn("Scan rejected: file too large",
+		zap.Int64("size", size),
+		zap.Int64("max_allowed", cfg.MaxContentLength),
+		zap.String("client_ip", c.ClientIP()))
+	recordRejection(transportREST, rejectTooLarge)
+	c.JSON(413, gin.H{
+		"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", cfg.MaxContentLength),
+		"request_id": requestID(c),
+	})
+}
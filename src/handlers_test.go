@@ -414,3 +414,110 @@ func TestHandleScanFileTooLarge(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, response["message"], "too large")
 }
+
+func TestHandleScanMessageInvalidMessage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/api/scan-message", handleScanMessage)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/scan-message", strings.NewReader("no headers here"))
+	req.Header.Set("Content-Type", "message/rfc822")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Contains(t, response["message"], "Invalid message")
+}
+
+func TestHandleScanMessageNoContentLength(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/api/scan-message", handleScanMessage)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/scan-message", strings.NewReader(testMultipartMessage))
+	req.ContentLength = -1
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestHandleScanMessageTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/api/scan-message", handleScanMessage)
+
+	originalMax := config.MaxContentLength
+	config.MaxContentLength = 64
+	defer func() { config.MaxContentLength = originalMax }()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/scan-message", strings.NewReader(testMultipartMessage))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 413, w.Code)
+}
+
+func TestHandleScanMessageWithInvalidSocket(t *testing.T) {
+	withInvalidSocket(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/api/scan-message", handleScanMessage)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "message.eml")
+	io.WriteString(part, testMultipartMessage)
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/scan-message", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 502, w.Code)
+
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, "Clamd service down", response["status"])
+}
+
+func TestHandleScanMessageReportsAttachments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.POST("/api/scan-message", handleScanMessage)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/scan-message", strings.NewReader(testMultipartMessage))
+	req.Header.Set("Content-Type", "message/rfc822")
+	router.ServeHTTP(w, req)
+
+	if w.Code == 502 {
+		t.Log("Message scan returned 502 (ClamAV may not be running)")
+		return
+	}
+
+	assert.Equal(t, 200, w.Code)
+
+	var response struct {
+		Status      string `json:"status"`
+		Subject     string `json:"subject"`
+		Attachments []struct {
+			Part     string `json:"part"`
+			Filename string `json:"filename"`
+			Status   string `json:"status"`
+		} `json:"attachments"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", response.Status)
+	assert.Equal(t, "Quarterly report", response.Subject)
+	assert.Len(t, response.Attachments, 3)
+	assert.Equal(t, "report.bin", response.Attachments[2].Filename)
+}
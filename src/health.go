@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// Names of the readiness checks in the health report
+const (
+	checkClamd      = "clamd"
+	checkSignatures = "signatures"
+	checkDraining   = "draining"
+	checkScanQueue  = "scan_queue"
+)
+
+// signatureDateLayout is the database date in clamd's VERSION reply,
+// such as "ClamAV 1.4.1/27400/Tue Sep 23 10:31:14 2025"
+const signatureDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// HealthCheck is the latest outcome of one readiness check
+type HealthCheck struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMs float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	Detail    string    `json:"detail,omitempty"`
+	// LastError is kept after the check recovers, until the next failure
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+	// ConsecutiveFailures counts failed probes since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+}
+
+// HealthReport is the detailed state behind /readyz
+type HealthReport struct {
+	Status string        `json:"status"`
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// failing returns the names of the checks that fail
+func (r HealthReport) failing() []string {
+	var names []string
+	for _, check := range r.Checks {
+		if !check.Healthy {
+			names = append(names, check.Name)
+		}
+	}
+	return names
+}
+
+// HealthProber probes clamd in the background and keeps the result, so
+// liveness, readiness and health check requests never reach clamd
+// themselves. clamd is reported unreachable after HealthFailureThreshold
+// consecutive failed probes and reachable again after
+// HealthSuccessThreshold consecutive successful ones.
+type HealthProber struct {
+	config *liveConfig
+
+	mu         sync.RWMutex
+	clamd      HealthCheck
+	signatures HealthCheck
+	successes  int
+	ready      bool
+	listeners  []func(ready bool)
+
+	probed   atomic.Bool
+	draining atomic.Bool
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// healthProber serves the REST and gRPC health endpoints
+var healthProber = NewHealthProber(serverConfig)
+
+// NewHealthProber creates a prober that reports clamd unreachable until
+// its first successful probe
+func NewHealthProber(cfg *liveConfig) *HealthProber {
+	return &HealthProber{
+		config:     cfg,
+		clamd:      HealthCheck{Name: checkClamd, Detail: "not probed yet"},
+		signatures: HealthCheck{Name: checkSignatures, Detail: "not probed yet"},
+		stop:       make(chan struct{}),
+	}
+}
+
+// Run probes clamd every HealthProbeInterval until Stop. The interval is
+// read before each wait so reloads take effect.
+func (p *HealthProber) Run() {
+	for {
+		p.probe()
+		timer := time.NewTimer(p.config.Load().HealthProbeInterval)
+		select {
+		case <-timer.C:
+		case <-p.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Stop ends Run
+func (p *HealthProber) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// probe pings clamd, reads its signature version and updates the cached
+// checks
+func (p *HealthProber) probe() {
+	cfg := p.config.Load()
+	clamd := pingCheck()
+	reachable := clamd.Healthy
+
+	p.mu.Lock()
+	previous := p.clamd
+	clamd = followOn(clamd, previous)
+	if reachable {
+		p.successes++
+		clamd.Healthy = previous.Healthy || p.successes >= cfg.HealthSuccessThreshold
+	} else {
+		p.successes = 0
+		clamd.Healthy = previous.Healthy && clamd.ConsecutiveFailures < cfg.HealthFailureThreshold
+	}
+	p.clamd = clamd
+	p.mu.Unlock()
+	p.probed.Store(true)
+
+	// The version is only worth asking for while clamd answers
+	if reachable {
+		signatures := signatureCheck(cfg.HealthMaxSignatureAge, time.Now())
+		p.mu.Lock()
+		p.signatures = followOn(signatures, p.signatures)
+		p.mu.Unlock()
+	}
+
+	if clamd.Healthy {
+		healthCheckStatus.Set(1)
+	} else {
+		healthCheckStatus.Set(0)
+	}
+	if clamd.Healthy != previous.Healthy {
+		GetLogger().Info("clamd health changed",
+			zap.Bool("healthy", clamd.Healthy),
+			zap.String("last_error", clamd.LastError))
+	}
+	p.notify()
+}
+
+// followOn counts a failed check on top of the failures of the previous
+// one, and keeps the previous error on a successful check
+func followOn(check, previous HealthCheck) HealthCheck {
+	if check.LastError != "" {
+		check.ConsecutiveFailures = previous.ConsecutiveFailures + 1
+	} else {
+		check.LastError = previous.LastError
+		check.LastErrorAt = previous.LastErrorAt
+	}
+	return check
+}
+
+// pingCheck times a single clamd ping
+func pingCheck() HealthCheck {
+	start := time.Now()
+	err := pingClamd()
+	check := HealthCheck{
+		Name:      checkClamd,
+		Healthy:   err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: start,
+	}
+	if err != nil {
+		check.LastError = err.Error()
+		check.LastErrorAt = start
+	}
+	return check
+}
+
+// signatureCheck asks clamd for its version and fails when the signature
+// database is older than maxAge. A maxAge of 0 only reports the version.
+func signatureCheck(maxAge time.Duration, now time.Time) HealthCheck {
+	start := time.Now()
+	version, err := clamdVersion()
+	check := HealthCheck{
+		Name:      checkSignatures,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: start,
+		Detail:    version,
+	}
+	if err == nil && maxAge > 0 {
+		var date time.Time
+		if date, err = parseSignatureDate(version); err == nil && now.Sub(date) > maxAge {
+			err = fmt.Errorf("signatures are %s old, more than %s", now.Sub(date).Round(time.Minute), maxAge)
+		}
+	}
+	if err != nil {
+		check.LastError = err.Error()
+		check.LastErrorAt = start
+	}
+	check.Healthy = err == nil
+	return check
+}
+
+// parseSignatureDate extracts the database date from a clamd VERSION reply
+func parseSignatureDate(version string) (time.Time, error) {
+	parts := strings.SplitN(version, "/", 3)
+	if len(parts) < 3 {
+		return time.Time{}, errors.New("clamd did not report a signature date")
+	}
+	date, err := time.ParseInLocation(signatureDateLayout, strings.TrimSpace(parts[2]), time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid signature date %q", parts[2])
+	}
+	return date, nil
+}
+
+// ClamdCheck returns the state of clamd. Before the first probe, as when
+// the handlers run without the prober, it pings clamd on demand.
+func (p *HealthProber) ClamdCheck() HealthCheck {
+	if !p.probed.Load() {
+		return pingCheck()
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clamd
+}
+
+// Report returns the state of every readiness check. The draining and
+// scan queue checks are evaluated on each call; the clamd ones are cached.
+func (p *HealthProber) Report() HealthReport {
+	cfg := p.config.Load()
+	clamd := p.ClamdCheck()
+	p.mu.RLock()
+	signatures := p.signatures
+	p.mu.RUnlock()
+
+	draining := HealthCheck{Name: checkDraining, Healthy: !p.draining.Load()}
+	if !draining.Healthy {
+		draining.LastError = "server is shutting down"
+	}
+
+	inProgress := scansInProgressValue()
+	queue := HealthCheck{
+		Name:    checkScanQueue,
+		Healthy: cfg.HealthMaxScans == 0 || inProgress < cfg.HealthMaxScans,
+		Detail:  fmt.Sprintf("%d scans in progress", inProgress),
+	}
+	if !queue.Healthy {
+		queue.LastError = fmt.Sprintf("%d scans in progress, limit is %d", inProgress, cfg.HealthMaxScans)
+	}
+
+	report := HealthReport{Checks: []HealthCheck{clamd, signatures, draining, queue}}
+	report.Ready = len(report.failing()) == 0
+	report.Status = "ready"
+	if !report.Ready {
+		report.Status = "not ready"
+	}
+	return report
+}
+
+// SetDraining fails readiness from now on, so load balancers stop
+// sending requests while the server shuts down
+func (p *HealthProber) SetDraining() {
+	p.draining.Store(true)
+	p.notify()
+}
+
+// Subscribe calls fn with the current readiness and again whenever it
+// changes after a probe or when draining starts
+func (p *HealthProber) Subscribe(fn func(ready bool)) {
+	p.mu.Lock()
+	p.listeners = append(p.listeners, fn)
+	p.mu.Unlock()
+	fn(p.Report().Ready)
+}
+
+// notify tells the subscribers about a change in readiness
+func (p *HealthProber) notify() {
+	ready := p.Report().Ready
+	p.mu.Lock()
+	changed := ready != p.ready
+	p.ready = ready
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	if changed {
+		for _, fn := range listeners {
+			fn(ready)
+		}
+	}
+}
+
+// scansInProgressValue reads the clamav_scans_in_progress gauge
+func scansInProgressValue() int {
+	var m dto.Metric
+	if err := scansInProgress.Write(&m); err != nil {
+		return 0
+	}
+	return int(m.GetGauge().GetValue())
+}
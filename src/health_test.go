@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withHealthProber makes p the prober behind the health endpoints
+func withHealthProber(t *testing.T, p *HealthProber) {
+	t.Helper()
+	original := healthProber
+	healthProber = p
+	t.Cleanup(func() { healthProber = original })
+}
+
+// newTestProber returns a prober over a copy of the defaults changed by edit
+func newTestProber(edit func(cfg *Config)) *HealthProber {
+	cfg := defaultConfig()
+	if edit != nil {
+		edit(&cfg)
+	}
+	return NewHealthProber(newLiveConfig(&cfg))
+}
+
+// reportCheck returns the check called name in report
+func reportCheck(t *testing.T, report HealthReport, name string) HealthCheck {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("check %s missing from report", name)
+	return HealthCheck{}
+}
+
+func TestHealthProberThresholds(t *testing.T) {
+	p := newTestProber(func(cfg *Config) {
+		cfg.HealthFailureThreshold = 2
+		cfg.HealthSuccessThreshold = 2
+	})
+
+	withFakeClamd(t, "stream: OK")
+	p.probe()
+	assert.False(t, p.ClamdCheck().Healthy, "one success is below the success threshold")
+	p.probe()
+	assert.True(t, p.ClamdCheck().Healthy)
+
+	withInvalidSocket(t)
+	p.probe()
+	check := p.ClamdCheck()
+	assert.True(t, check.Healthy, "one failure is below the failure threshold")
+	assert.Equal(t, 1, check.ConsecutiveFailures)
+	assert.NotEmpty(t, check.LastError)
+	p.probe()
+	check = p.ClamdCheck()
+	assert.False(t, check.Healthy)
+	assert.Equal(t, 2, check.ConsecutiveFailures)
+	assert.False(t, check.LastErrorAt.IsZero())
+
+	// The last error outlives the recovery
+	withFakeClamd(t, "stream: OK")
+	p.probe()
+	p.probe()
+	check = p.ClamdCheck()
+	assert.True(t, check.Healthy)
+	assert.Zero(t, check.ConsecutiveFailures)
+	assert.NotEmpty(t, check.LastError)
+}
+
+func TestHealthProberReadiness(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	p := newTestProber(func(cfg *Config) { cfg.HealthMaxScans = 1 })
+
+	var notified []bool
+	p.Subscribe(func(ready bool) { notified = append(notified, ready) })
+	p.probe()
+	report := p.Report()
+	assert.True(t, report.Ready, "failing: %v", report.failing())
+	assert.Contains(t, reportCheck(t, report, checkSignatures).Detail, "ClamAV 1.4.1/27400/")
+
+	scansInProgress.Inc()
+	report = p.Report()
+	scansInProgress.Dec()
+	assert.False(t, report.Ready)
+	assert.Equal(t, []string{checkScanQueue}, report.failing())
+
+	p.SetDraining()
+	report = p.Report()
+	assert.Equal(t, []string{checkDraining}, report.failing())
+	assert.Equal(t, "not ready", report.Status)
+	assert.Equal(t, []bool{false, true, false}, notified)
+}
+
+func TestSignatureCheck(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+
+	check := signatureCheck(0, time.Now().Add(48*time.Hour))
+	assert.True(t, check.Healthy, "age is not checked when disabled")
+
+	check = signatureCheck(24*time.Hour, time.Now())
+	assert.True(t, check.Healthy)
+
+	check = signatureCheck(24*time.Hour, time.Now().Add(48*time.Hour))
+	assert.False(t, check.Healthy)
+	assert.Contains(t, check.LastError, "signatures are 48h0m0s old")
+}
+
+func TestParseSignatureDate(t *testing.T) {
+	date, err := parseSignatureDate("ClamAV 1.0.5/27345/Tue Jul  2 10:26:35 2024")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, time.July, 2, 10, 26, 35, 0, time.Local), date)
+
+	_, err = parseSignatureDate("ClamAV 1.0.5")
+	assert.Error(t, err)
+	_, err = parseSignatureDate("ClamAV 1.0.5/27345/yesterday")
+	assert.Error(t, err)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	p := newTestProber(nil)
+	p.probe()
+	withHealthProber(t, p)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/health-check", handleHealthCheck)
+	router.GET("/api/health", handleHealthReport)
+	router.GET("/livez", handleLivez)
+	router.GET("/readyz", handleReadyz)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Served from the cached probe, even once clamd goes away
+	withInvalidSocket(t)
+	assert.Equal(t, http.StatusOK, get("/api/health-check").Code)
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+
+	w := get("/api/health")
+	require.Equal(t, http.StatusOK, w.Code)
+	var report HealthReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Ready)
+	require.Len(t, report.Checks, 4)
+	assert.Equal(t, checkClamd, report.Checks[0].Name)
+	assert.Positive(t, report.Checks[0].LatencyMs)
+
+	p.SetDraining()
+	w = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), checkDraining)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/api/health").Code)
+	assert.Equal(t, http.StatusOK, get("/livez").Code, "liveness does not depend on readiness")
+}
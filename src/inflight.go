@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errServerDraining rejects scans that start once shutdown has begun
+var errServerDraining = errors.New("server is shutting down")
+
+// ScanCanceledError indicates the server canceled a scan in progress
+type ScanCanceledError struct {
+	Reason string
+}
+
+func (e *ScanCanceledError) Error() string {
+	return "scan canceled: " + e.Reason
+}
+
+// ActiveScan is a scan in progress as reported by the admin API
+type ActiveScan struct {
+	ID             uint64    `json:"id"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Transport      string    `json:"transport"`
+	Filename       string    `json:"filename,omitempty"`
+	Client         string    `json:"client,omitempty"`
+	BytesReceived  int64     `json:"bytes_received"`
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Backend        string    `json:"backend"`
+}
+
+// inFlightScan is a scan tracked from the start of performScan until it
+// returns
+type inFlightScan struct {
+	ActiveScan
+	bytes  atomic.Int64
+	cancel context.CancelCauseFunc
+}
+
+// snapshot returns the scan as of now
+func (s *inFlightScan) snapshot(now time.Time) ActiveScan {
+	scan := s.ActiveScan
+	scan.BytesReceived = s.bytes.Load()
+	scan.ElapsedSeconds = now.Sub(scan.StartedAt).Seconds()
+	return scan
+}
+
+// scanSourceKey keys the scanSource stored in a request context
+type scanSourceKey struct{}
+
+// scanSource is where a scan comes from: the transport, the client address
+// and the name of what is scanned
+type scanSource struct {
+	transport string
+	client    string
+	filename  string
+}
+
+// withScanSource returns ctx tagged with the transport and client address
+// that scans started under it are reported with
+func withScanSource(ctx context.Context, transport, client string) context.Context {
+	return context.WithValue(ctx, scanSourceKey{}, scanSource{transport: transport, client: client})
+}
+
+// withScanFilename returns ctx naming the file, part or object scanned
+// under it, keeping its transport and client
+func withScanFilename(ctx context.Context, filename string) context.Context {
+	source, _ := ctx.Value(scanSourceKey{}).(scanSource)
+	source.filename = filename
+	return context.WithValue(ctx, scanSourceKey{}, source)
+}
+
+// ScanTracker keeps the scans in progress so shutdown can stop accepting
+// new ones, wait for the rest and cancel those that outlast the drain
+type ScanTracker struct {
+	mu       sync.Mutex
+	scans    map[uint64]*inFlightScan
+	nextID   uint64
+	draining bool
+	// idle is closed when the last scan ends while draining
+	idle chan struct{}
+}
+
+// scanTracker tracks every scan run through performScan
+var scanTracker = NewScanTracker()
+
+// NewScanTracker creates a tracker that accepts scans until Drain
+func NewScanTracker() *ScanTracker {
+	return &ScanTracker{scans: make(map[uint64]*inFlightScan)}
+}
+
+// begin registers a scan of what ctx describes and returns its context,
+// which Drain and Cancel may cancel, and the scan to pass to end once it
+// is done. It fails with errServerDraining once Drain has been called.
+func (t *ScanTracker) begin(ctx context.Context) (context.Context, *inFlightScan, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, nil, errServerDraining
+	}
+
+	source, _ := ctx.Value(scanSourceKey{}).(scanSource)
+	if source.transport == "" {
+		source.transport = transportInternal
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	t.nextID++
+	scan := &inFlightScan{
+		ActiveScan: ActiveScan{
+			ID:        t.nextID,
+			RequestID: requestIDFromContext(ctx),
+			Transport: source.transport,
+			Filename:  source.filename,
+			Client:    source.client,
+			StartedAt: time.Now(),
+			Backend:   clamdAddress(),
+		},
+		cancel: cancel,
+	}
+	t.scans[scan.ID] = scan
+	return ctx, scan, nil
+}
+
+// end removes a finished scan
+func (t *ScanTracker) end(scan *inFlightScan) {
+	scan.cancel(nil)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.scans, scan.ID)
+	if len(t.scans) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// List returns the scans in progress, oldest first
+func (t *ScanTracker) List() []ActiveScan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshotLocked()
+}
+
+// snapshotLocked returns the scans in progress, oldest first. t.mu must be
+// held.
+func (t *ScanTracker) snapshotLocked() []ActiveScan {
+	now := time.Now()
+	scans := make([]ActiveScan, 0, len(t.scans))
+	for _, scan := range t.scans {
+		scans = append(scans, scan.snapshot(now))
+	}
+	sort.Slice(scans, func(i, j int) bool { return scans[i].ID < scans[j].ID })
+	return scans
+}
+
+// Cancel cancels the scan with the given ID through its context. It
+// returns the scan, or false when no such scan is in progress.
+func (t *ScanTracker) Cancel(id uint64, reason string) (ActiveScan, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scan, ok := t.scans[id]
+	if !ok {
+		return ActiveScan{}, false
+	}
+	scan.cancel(&ScanCanceledError{Reason: reason})
+	return scan.snapshot(time.Now()), true
+}
+
+// Len returns the number of scans in progress
+func (t *ScanTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.scans)
+}
+
+// Drain stops accepting scans and waits for those in progress until ctx
+// is done. It then cancels the scans still running and returns them,
+// oldest first.
+func (t *ScanTracker) Drain(ctx context.Context) []ActiveScan {
+	t.mu.Lock()
+	t.draining = true
+	if len(t.scans) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, scan := range t.scans {
+		scan.cancel(&ScanCanceledError{Reason: "server shut down before the scan finished"})
+	}
+	return t.snapshotLocked()
+}
+
+// drainScans stops new scans, gives those in progress up to timeout to
+// finish and logs the ones it had to cancel
+func drainScans(logger *zap.Logger, timeout time.Duration) {
+	logger.Info("Draining in-flight scans",
+		zap.Int("scans", scanTracker.Len()),
+		zap.Duration("timeout", timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, scan := range scanTracker.Drain(ctx) {
+		logger.Warn("Canceled scan still in progress at the drain timeout",
+			zap.String("request_id", scan.RequestID),
+			zap.String("transport", scan.Transport),
+			zap.String("filename", scan.Filename),
+			zap.String("client", scan.Client),
+			zap.Int64("bytes_received", scan.BytesReceived),
+			zap.Time("started_at", scan.StartedAt),
+			zap.Float64("elapsed_seconds", scan.ElapsedSeconds))
+	}
+}
+
+// scanReader counts the bytes of a tracked scan and stops reading once
+// its context is done, so a canceled scan stops sending its body to clamd
+type scanReader struct {
+	ctx    context.Context
+	scan   *inFlightScan
+	reader io.Reader
+}
+
+func (r *scanReader) Read(p []byte) (int, error) {
+	if cause := context.Cause(r.ctx); cause != nil {
+		return 0, cause
+	}
+	n, err := r.reader.Read(p)
+	r.scan.bytes.Add(int64(n))
+	return n, err
+}
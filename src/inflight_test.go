@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withScanTracker makes tracker the one behind performScan
+func withScanTracker(t *testing.T, tracker *ScanTracker) {
+	t.Helper()
+	original := scanTracker
+	scanTracker = tracker
+	t.Cleanup(func() { scanTracker = original })
+}
+
+// endlessReader yields a chunk of data every few milliseconds, like a slow
+// upload that never ends
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return copy(p, "data"), nil
+}
+
+func TestScanTrackerDrainWaitsForScans(t *testing.T) {
+	tracker := NewScanTracker()
+	_, scan, err := tracker.begin(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, tracker.Len())
+
+	drained := make(chan []ActiveScan)
+	go func() { drained <- tracker.Drain(context.Background()) }()
+
+	// New scans are refused as soon as the drain starts
+	require.Eventually(t, func() bool {
+		_, early, err := tracker.begin(context.Background())
+		if err == nil {
+			tracker.end(early)
+		}
+		return errors.Is(err, errServerDraining)
+	}, time.Second, time.Millisecond)
+
+	tracker.end(scan)
+	select {
+	case canceled := <-drained:
+		assert.Empty(t, canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return once the last scan ended")
+	}
+	assert.Zero(t, tracker.Len())
+}
+
+func TestScanTrackerDrainCancelsAtDeadline(t *testing.T) {
+	tracker := NewScanTracker()
+	scanCtx, scan, err := tracker.begin(withRequestID(context.Background(), "slow-scan"))
+	require.NoError(t, err)
+	defer tracker.end(scan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	canceled := tracker.Drain(ctx)
+	require.Len(t, canceled, 1)
+	assert.Equal(t, "slow-scan", canceled[0].RequestID)
+
+	var canceledErr *ScanCanceledError
+	assert.ErrorAs(t, context.Cause(scanCtx), &canceledErr)
+}
+
+func TestPerformScanCanceledByDrain(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	tracker := NewScanTracker()
+	withScanTracker(t, tracker)
+
+	scanErr := make(chan error)
+	go func() {
+		_, err := performScan(context.Background(), endlessReader{}, 5*time.Second)
+		scanErr <- err
+	}()
+	require.Eventually(t, func() bool { return tracker.Len() == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Len(t, tracker.Drain(ctx), 1)
+
+	select {
+	case err := <-scanErr:
+		var canceledErr *ScanCanceledError
+		assert.ErrorAs(t, err, &canceledErr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled scan did not return")
+	}
+}
+
+func TestScansRejectedWhileDraining(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	tracker := NewScanTracker()
+	tracker.Drain(context.Background())
+	withScanTracker(t, tracker)
+
+	t.Run("REST", func(t *testing.T) {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.POST("/api/stream-scan", handleStreamScan)
+
+		before := getCounterValue(t, rejectedRequestsTotal, transportREST, rejectDraining)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/stream-scan", bytes.NewReader([]byte("clean"))))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), "server is shutting down")
+		assert.Equal(t, before+1, getCounterValue(t, rejectedRequestsTotal, transportREST, rejectDraining))
+	})
+
+	t.Run("gRPC", func(t *testing.T) {
+		client := getTestClient(t)
+		_, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte("clean"), Filename: "clean.txt"})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestScanSourceFromRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	var source scanSource
+	router.GET("/", func(c *gin.Context) {
+		ctx := withScanFilename(c.Request.Context(), "report.pdf")
+		source, _ = ctx.Value(scanSourceKey{}).(scanSource)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.7:51234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, scanSource{transport: transportREST, client: "192.0.2.7", filename: "report.pdf"}, source)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logBackupTimeFormat names rotated log files so they sort by age
+const logBackupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is renamed to <path>.<timestamp> once it
+// reaches maxSize bytes. At most maxBackups rotated files younger than
+// maxAge are kept; zero disables the respective limit.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	now        func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens path for appending, creating it if needed
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past maxSize
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, starts a new one and prunes backups
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backup := f.path + "." + f.now().UTC().Format(logBackupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes backups beyond maxBackups or older than maxAge
+func (f *rotatingFile) prune() {
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	cutoff := f.now().Add(-f.maxAge)
+	kept := 0
+	for _, backup := range backups {
+		stamp := strings.TrimPrefix(backup, f.path+".")
+		rotated, err := time.Parse(logBackupTimeFormat, stamp)
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		if (f.maxBackups > 0 && kept >= f.maxBackups) || (f.maxAge > 0 && rotated.Before(cutoff)) {
+			os.Remove(backup)
+			continue
+		}
+		kept++
+	}
+}
+
+// Sync flushes the current file to disk
+func (f *rotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFileRotatesAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "clamav-api.log")
+	f, err := openRotatingFile(path, 10, 2, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	clock := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "dddddddd\n", string(data))
+
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, backups, 2, "only maxBackups rotated files are kept")
+	newest, err := os.ReadFile(backups[1])
+	require.NoError(t, err)
+	assert.Equal(t, "cccccccc\n", string(newest))
+}
+
+func TestRotatingFilePrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clamav-api.log")
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	old := path + "." + now.Add(-48*time.Hour).Format(logBackupTimeFormat)
+	recent := path + "." + now.Add(-time.Hour).Format(logBackupTimeFormat)
+	unrelated := path + ".keep"
+	for _, name := range []string{old, recent, unrelated} {
+		require.NoError(t, os.WriteFile(name, []byte("x"), 0644))
+	}
+
+	f, err := openRotatingFile(path, 4, 0, 24*time.Hour)
+	require.NoError(t, err)
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	_, err = f.Write([]byte("first\n"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("second\n"))
+	require.NoError(t, err)
+
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, recent)
+	assert.FileExists(t, unrelated, "files not named by rotation are left alone")
+	assert.FileExists(t, path+"."+now.Format(logBackupTimeFormat))
+}
+
+func TestRotatingFileAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamav-api.log")
+	require.NoError(t, os.WriteFile(path, []byte("12345678"), 0644))
+
+	f, err := openRotatingFile(path, 10, 0, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("abc"))
+	require.NoError(t, err)
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Len(t, backups, 1, "the existing size counts towards maxSize")
+}
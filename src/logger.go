@@ -1,44 +1,235 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// Log encodings
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+	logFormatECS     = "ecs"
+)
+
+// ecsVersion is the Elastic Common Schema version of the ecs encoding
+const ecsVersion = "1.6.0"
+
 var logger *zap.Logger
 
-// InitLogger initializes the zap logger based on configuration
+// logFile is the rotating file the logger writes to, if any
+var logFile *rotatingFile
+
+// logLevel is shared by every logger built by InitLogger so it can be
+// changed on reload and through the admin API
+var logLevel = zap.NewAtomicLevel()
+
+// levelOverride tracks a log level set through the admin API, which takes
+// precedence over the configured level until it reverts
+var levelOverride struct {
+	mu         sync.Mutex
+	base       zapcore.Level
+	overridden bool
+	timer      *time.Timer
+	revertAt   time.Time
+}
+
+// LogOutput selects the log encoding and destination
+type LogOutput struct {
+	// Format is console, json or ecs
+	Format string
+	// File is the log file path; empty logs to stderr
+	File string
+	// MaxSize is the size in bytes at which the file is rotated, 0 never
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept, 0 keeps all
+	MaxBackups int
+	// MaxAge is how long rotated files are kept, 0 keeps them forever
+	MaxAge time.Duration
+}
+
+// LogLevelState describes the log level in effect
+type LogLevelState struct {
+	Level zapcore.Level
+	// RevertTo and RevertAt are set while a temporary level is in effect
+	RevertTo zapcore.Level
+	RevertAt time.Time
+}
+
+// levelFor returns the minimum log level for the debug flag and environment
+func levelFor(debug bool, env string) zapcore.Level {
+	if env == "production" && !debug {
+		return zapcore.InfoLevel
+	}
+	return zapcore.DebugLevel
+}
+
+// InitLogger initializes the zap logger writing console output to stderr
 func InitLogger(debug bool, env string) error {
+	return InitLoggerWithOutput(debug, env, LogOutput{})
+}
+
+// InitLoggerWithOutput initializes the zap logger based on configuration
+func InitLoggerWithOutput(debug bool, env string, out LogOutput) error {
 	var cfg zap.Config
 
 	if env == "production" && !debug {
 		// Production configuration
 		cfg = zap.NewProductionConfig()
-		cfg.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
 	} else {
 		// Development configuration
 		cfg = zap.NewDevelopmentConfig()
-		cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
-		cfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		if out.File == "" && out.Format != logFormatJSON && out.Format != logFormatECS {
+			cfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
 	}
-
-	// Always use console encoder for better readability
-	cfg.Encoding = "console"
 	cfg.EncoderConfig.TimeKey = "timestamp"
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
-	var err error
-	logger, err = cfg.Build(
-		zap.AddCallerSkip(0),
+	var encoder zapcore.Encoder
+	var fields []zap.Field
+	switch out.Format {
+	case logFormatJSON:
+		encoder = zapcore.NewJSONEncoder(cfg.EncoderConfig)
+	case logFormatECS:
+		encoder = zapcore.NewJSONEncoder(ecsEncoderConfig())
+		fields = append(fields, zap.String("ecs.version", ecsVersion))
+	case "", logFormatConsole:
+		encoder = zapcore.NewConsoleEncoder(cfg.EncoderConfig)
+	default:
+		return fmt.Errorf("unknown log format %q", out.Format)
+	}
+
+	var sink zapcore.WriteSyncer = zapcore.Lock(os.Stderr)
+	var file *rotatingFile
+	if out.File != "" {
+		var err error
+		file, err = openRotatingFile(out.File, out.MaxSize, out.MaxBackups, out.MaxAge)
+		if err != nil {
+			return err
+		}
+		sink = file
+	}
+
+	core := zapcore.NewCore(encoder, sink, logLevel)
+	if cfg.Sampling != nil {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.Sampling.Initial, cfg.Sampling.Thereafter)
+	}
+	opts := []zap.Option{
+		zap.AddCaller(),
 		zap.AddStacktrace(zapcore.ErrorLevel),
-	)
-	if err != nil {
-		return err
+		zap.ErrorOutput(zapcore.Lock(os.Stderr)),
+		zap.Fields(fields...),
+	}
+	if cfg.Development {
+		opts = append(opts, zap.Development())
 	}
 
+	levelOverride.mu.Lock()
+	levelOverride.base = levelFor(debug, env)
+	clearLevelOverride()
+	logLevel.SetLevel(levelOverride.base)
+	levelOverride.mu.Unlock()
+
+	previous := logFile
+	logger = zap.New(core, opts...)
+	logFile = file
+	if previous != nil {
+		previous.Close()
+	}
 	return nil
 }
 
+// ecsEncoderConfig maps zap's fields onto Elastic Common Schema names
+func ecsEncoderConfig() zapcore.EncoderConfig {
+	return zapcore.EncoderConfig{
+		TimeKey:        "@timestamp",
+		LevelKey:       "log.level",
+		NameKey:        "log.logger",
+		CallerKey:      "log.origin.file.name",
+		FunctionKey:    "log.origin.function",
+		MessageKey:     "message",
+		StacktraceKey:  "error.stack_trace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.SecondsDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	}
+}
+
+// SetLogLevel sets the configured level of the running logger. The
+// encoding chosen at startup is kept, and a level set through the admin
+// API stays in effect until it reverts.
+func SetLogLevel(debug bool, env string) {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	levelOverride.base = levelFor(debug, env)
+	if !levelOverride.overridden {
+		logLevel.SetLevel(levelOverride.base)
+	}
+}
+
+// overrideLogLevel sets the log level at runtime. With a positive
+// revertAfter the configured level is restored once it elapses.
+func overrideLogLevel(level zapcore.Level, revertAfter time.Duration) LogLevelState {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+
+	clearLevelOverride()
+	levelOverride.overridden = true
+	logLevel.SetLevel(level)
+	if revertAfter > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(revertAfter, func() {
+			levelOverride.mu.Lock()
+			defer levelOverride.mu.Unlock()
+			// A later change replaced this one
+			if levelOverride.timer != timer {
+				return
+			}
+			clearLevelOverride()
+			logLevel.SetLevel(levelOverride.base)
+			GetLogger().Info("Log level reverted", zap.Stringer("level", levelOverride.base))
+		})
+		levelOverride.timer = timer
+		levelOverride.revertAt = time.Now().Add(revertAfter)
+	}
+	return currentLogLevelState()
+}
+
+// logLevelState returns the log level in effect
+func logLevelState() LogLevelState {
+	levelOverride.mu.Lock()
+	defer levelOverride.mu.Unlock()
+	return currentLogLevelState()
+}
+
+// currentLogLevelState is logLevelState with levelOverride.mu held
+func currentLogLevelState() LogLevelState {
+	state := LogLevelState{Level: logLevel.Level()}
+	if levelOverride.timer != nil {
+		state.RevertTo = levelOverride.base
+		state.RevertAt = levelOverride.revertAt
+	}
+	return state
+}
+
+// clearLevelOverride drops any override, with levelOverride.mu held
+func clearLevelOverride() {
+	if levelOverride.timer != nil {
+		levelOverride.timer.Stop()
+	}
+	levelOverride.timer = nil
+	levelOverride.revertAt = time.Time{}
+	levelOverride.overridden = false
+}
+
 // GetLogger returns the global logger instance
 func GetLogger() *zap.Logger {
 	if logger == nil {
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestInitLoggerDevelopment(t *testing.T) {
@@ -78,3 +86,121 @@ func TestSyncLoggerWithNilLogger(t *testing.T) {
 		SyncLogger()
 	})
 }
+
+func TestSetLogLevel(t *testing.T) {
+	origLogger := logger
+	defer func() {
+		logger = origLogger
+		SetLogLevel(config.Debug, logEnv())
+	}()
+
+	assert.NoError(t, InitLogger(false, "production"))
+	assert.False(t, GetLogger().Core().Enabled(zapcore.DebugLevel))
+
+	SetLogLevel(true, "production")
+	assert.True(t, GetLogger().Core().Enabled(zapcore.DebugLevel))
+
+	SetLogLevel(false, "production")
+	assert.False(t, GetLogger().Core().Enabled(zapcore.DebugLevel))
+}
+
+// restoreLogger puts back the global logger and level after a test
+func restoreLogger(t *testing.T) {
+	t.Helper()
+	origLogger, origFile := logger, logFile
+	t.Cleanup(func() {
+		if logFile != nil && logFile != origFile {
+			logFile.Close()
+		}
+		logger, logFile = origLogger, origFile
+		levelOverride.mu.Lock()
+		clearLevelOverride()
+		levelOverride.mu.Unlock()
+		SetLogLevel(config.Debug, logEnv())
+	})
+}
+
+// readLogLines decodes the JSON log lines written to path
+func readLogLines(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := make(map[string]any)
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), "line %q", line)
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestInitLoggerJSONToFile(t *testing.T) {
+	restoreLogger(t)
+	path := filepath.Join(t.TempDir(), "clamav-api.log")
+
+	require.NoError(t, InitLoggerWithOutput(false, "production", LogOutput{Format: logFormatJSON, File: path}))
+	GetLogger().Info("scan finished", zap.String("status", "OK"))
+	GetLogger().Debug("not logged at info")
+	SyncLogger()
+
+	lines := readLogLines(t, path)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "scan finished", lines[0]["msg"])
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "OK", lines[0]["status"])
+	assert.Contains(t, lines[0], "timestamp")
+}
+
+func TestInitLoggerECS(t *testing.T) {
+	restoreLogger(t)
+	path := filepath.Join(t.TempDir(), "clamav-api.log")
+
+	require.NoError(t, InitLoggerWithOutput(true, "development", LogOutput{Format: logFormatECS, File: path}))
+	GetLogger().Warn("clamd slow")
+	SyncLogger()
+
+	lines := readLogLines(t, path)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "clamd slow", lines[0]["message"])
+	assert.Equal(t, "warn", lines[0]["log.level"])
+	assert.Equal(t, ecsVersion, lines[0]["ecs.version"])
+	assert.Contains(t, lines[0], "@timestamp")
+	assert.Contains(t, lines[0], "log.origin.file.name")
+}
+
+func TestInitLoggerUnknownFormat(t *testing.T) {
+	restoreLogger(t)
+	assert.Error(t, InitLoggerWithOutput(false, "production", LogOutput{Format: "xml"}))
+}
+
+func TestOverrideLogLevelReverts(t *testing.T) {
+	restoreLogger(t)
+	require.NoError(t, InitLogger(false, "production"))
+
+	state := overrideLogLevel(zapcore.DebugLevel, 50*time.Millisecond)
+	assert.Equal(t, zapcore.DebugLevel, state.Level)
+	assert.Equal(t, zapcore.InfoLevel, state.RevertTo)
+	assert.False(t, state.RevertAt.IsZero())
+
+	// A reload changes the configured level but not the override
+	SetLogLevel(false, "development")
+	assert.Equal(t, zapcore.DebugLevel, logLevelState().Level)
+	SetLogLevel(false, "production")
+
+	assert.Eventually(t, func() bool {
+		return logLevelState().Level == zapcore.InfoLevel
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, logLevelState().RevertAt.IsZero())
+}
+
+func TestOverrideLogLevelReplacesPendingRevert(t *testing.T) {
+	restoreLogger(t)
+	require.NoError(t, InitLogger(false, "production"))
+
+	overrideLogLevel(zapcore.DebugLevel, 20*time.Millisecond)
+	state := overrideLogLevel(zapcore.ErrorLevel, 0)
+	assert.True(t, state.RevertAt.IsZero())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, zapcore.ErrorLevel, logLevelState().Level, "the first timer must not revert the second change")
+}
@@ -14,12 +14,31 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 )
 
 func main() {
+	// The server is the default so existing deployments keep working;
+	// client subcommands never touch the server configuration
+	if len(os.Args) > 1 {
+		switch command := os.Args[1]; command {
+		case "serve":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "scan", "health", "version", "help":
+			os.Exit(runCLI(command, os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	serve()
+}
+
+// serve runs the API server until it receives a shutdown signal
+func serve() {
 	// Parse configuration
 	parseConfig()
 
@@ -28,37 +47,129 @@ func main() {
 
 	logger := GetLogger()
 
+	setScanDurationBuckets(config.ScanDurationBuckets)
+
+	// Tracing must be set up before the servers install their instrumentation
+	shutdownTracing, err := initTracing(context.Background(), &config)
+	if err != nil {
+		logger.Fatal("Failed to initialize tracing", zap.Error(err))
+	}
+
+	// Payloads spill to a private directory; clear what a crash left there
+	spoolDir := spoolDirectory(&config)
+	removed, err := prepareSpoolDir(spoolDir)
+	if err != nil {
+		logger.Fatal("Failed to prepare spool directory", zap.String("spool_dir", spoolDir), zap.Error(err))
+	}
+	if removed > 0 {
+		logger.Info("Removed spool files left by a previous run",
+			zap.String("spool_dir", spoolDir),
+			zap.Int("files", removed))
+	}
+
+	// Allowlist overrides added through the admin API survive restarts
+	if err := allowlist.Load(config.AllowlistFile); err != nil {
+		logger.Fatal("Failed to load allowlist", zap.String("allowlist_file", config.AllowlistFile), zap.Error(err))
+	}
+
+	// Hash lists are checked before every scan and reloaded when they change
+	if err := hashReputation.Reload(&config); err != nil {
+		logger.Fatal("Failed to load hash lists", zap.Error(err))
+	}
+	registerReloader("hash-reputation", hashReputation)
+	go hashReputation.Run()
+	defer hashReputation.Stop()
+
 	// Initialize ClamAV client (reused across all requests)
 	getClamdClient()
 	logger.Info("ClamAV client initialized", zap.String("socket", config.ClamdUnixSocket))
 
+	// Probe clamd in the background for the health endpoints
+	go healthProber.Run()
+	defer healthProber.Stop()
+
 	// Create error channel
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 6)
 
 	// Start gRPC server if enabled
 	var grpcSrv *grpc.Server
+	var grpcHealth *GRPCHealth
 	if config.EnableGRPC {
-		grpcSrv = startGRPCServer(errChan)
+		grpcSrv, grpcHealth = startGRPCServer(errChan)
+	}
+
+	// Start milter server if enabled
+	var milterSrv *MilterServer
+	if config.EnableMilter {
+		milterSrv = startMilterServer(errChan)
+	}
+
+	// Start upload-gateway proxy if an upstream is configured
+	var proxySrv *http.Server
+	if config.ProxyUpstream != "" {
+		proxySrv = startProxyServer(errChan)
+	}
+
+	// Start clamd-protocol listener if enabled
+	var clamdSrv *ClamdServer
+	if config.EnableClamdListener {
+		clamdSrv = startClamdServer(errChan)
+	}
+
+	// Start watch-folder mode if inbox directories are configured
+	var watcher *Watcher
+	if len(config.WatchDirs) > 0 {
+		watcher = startWatcher(errChan)
 	}
 
 	// Start REST API server
 	httpSrv := startRESTServer(errChan)
 
-	// Wait for interrupt signal or error
+	// Wait for interrupt signal or error, reloading the configuration on SIGHUP
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	var serverErr error
-	select {
-	case serverErr = <-errChan:
-		logger.Error("Server error, initiating shutdown", zap.Error(serverErr))
-	case sig := <-sigChan:
-		logger.Info("Received shutdown signal", zap.String("signal", sig.String()))
+wait:
+	for {
+		select {
+		case serverErr = <-errChan:
+			logger.Error("Server error, initiating shutdown", zap.Error(serverErr))
+			break wait
+		case sig := <-sigChan:
+			logger.Info("Received shutdown signal", zap.String("signal", sig.String()))
+			break wait
+		case <-hupChan:
+			logger.Info("Received SIGHUP, reloading configuration")
+			if err := reloadConfig(os.Args[1:]); err != nil {
+				logger.Error("Config reload failed, keeping current configuration", zap.Error(err))
+			}
+		}
 	}
 
 	// Graceful shutdown with timeout
 	logger.Info("Initiating graceful shutdown...")
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+	// Fail readiness and report NOT_SERVING to gRPC health checkers while
+	// the servers drain
+	healthProber.SetDraining()
+	if grpcHealth != nil {
+		grpcHealth.Shutdown()
+	}
+
+	// Keep scanning until load balancers have seen readiness fail, then
+	// refuse new scans and give those in progress time to finish
+	drainCfg := currentConfig()
+	if drainCfg.DrainDelay > 0 {
+		logger.Info("Waiting for load balancers to stop sending requests",
+			zap.Duration("drain_delay", drainCfg.DrainDelay))
+		time.Sleep(drainCfg.DrainDelay)
+	}
+	drainScans(logger, drainCfg.DrainTimeout)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), drainCfg.ShutdownTimeout)
 	defer shutdownCancel()
 
 	// Shut down REST server
@@ -69,6 +180,14 @@ func main() {
 		}
 	}
 
+	// Shut down upload-gateway proxy
+	if proxySrv != nil {
+		logger.Info("Shutting down upload-gateway proxy...")
+		if err := proxySrv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Upload-gateway proxy forced to shutdown", zap.Error(err))
+		}
+	}
+
 	// Shut down gRPC server
 	if grpcSrv != nil {
 		logger.Info("Shutting down gRPC server...")
@@ -87,8 +206,37 @@ func main() {
 		}
 	}
 
+	// Shut down milter server
+	if milterSrv != nil {
+		logger.Info("Shutting down milter server...")
+		if err := milterSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Milter graceful shutdown timed out, closed remaining sessions", zap.Error(err))
+		}
+	}
+
+	// Shut down clamd-protocol listener
+	if clamdSrv != nil {
+		logger.Info("Shutting down clamd listener...")
+		if err := clamdSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("clamd listener graceful shutdown timed out, closed remaining sessions", zap.Error(err))
+		}
+	}
+
+	// Stop watch-folder mode
+	if watcher != nil {
+		logger.Info("Stopping folder watcher...")
+		if err := watcher.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Folder watcher did not stop in time", zap.Error(err))
+		}
+	}
+
 	logger.Info("All servers stopped")
 
+	// Flush spans of the requests that just finished
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Warn("Failed to flush traces", zap.Error(err))
+	}
+
 	if serverErr != nil {
 		os.Exit(1)
 	}
@@ -99,16 +247,61 @@ func startRESTServer(errChan chan<- error) *http.Server {
 
 	// Initialize router
 	router := gin.Default()
+	router.Use(otelgin.Middleware(tracerName, otelgin.WithGinFilter(func(c *gin.Context) bool {
+		return c.FullPath() != "/metrics"
+	})))
+	router.Use(requestIDMiddleware())
 	router.Use(metricsMiddleware())
 
 	// Set maximum multipart memory
 	router.MaxMultipartMemory = config.MaxContentLength
 
-	// Register routes
-	router.POST("/api/scan", handleScan)
-	router.POST("/api/stream-scan", handleStreamScan)
+	// Register routes. Scans take an optional API key selecting the policy.
+	router.POST("/api/scan", apiKeyAuth(), handleScan)
+	router.POST("/api/stream-scan", apiKeyAuth(), handleStreamScan)
+	router.POST("/api/scan-message", apiKeyAuth(), handleScanMessage)
 	router.GET("/api/health-check", handleHealthCheck)
+	router.GET("/api/health", handleHealthReport)
+	router.GET("/livez", handleLivez)
+	router.GET("/readyz", handleReadyz)
+
+	// S3 object scanning, only when an object store is configured
+	if config.S3Endpoint != "" {
+		s3Scanner, err := NewS3Scanner(&config)
+		if err != nil {
+			logger.Error("Failed to create S3 scanner", zap.Error(err))
+			errChan <- err
+			return nil
+		}
+		registerReloader("rest-s3", s3Scanner)
+		router.POST("/api/scan-s3", apiKeyAuth(), s3Scanner.handleScanObject)
+		router.POST("/api/s3-events", s3Scanner.handleEvents)
+	}
+
+	// Scan-by-URL, only when explicitly enabled
+	if config.EnableURLScan {
+		urlScanner := NewURLScanner(&config)
+		registerReloader("rest-url-scan", urlScanner)
+		router.POST("/api/scan-url", apiKeyAuth(), urlScanner.handleScanURL)
+	}
+
 	router.GET("/api/version", handleVersion)
+
+	// Runtime administration, disabled until an admin token is configured
+	admin := router.Group("/api/admin", adminAuth())
+	admin.GET("/log-level", handleGetLogLevel)
+	admin.PUT("/log-level", handleSetLogLevel)
+	admin.GET("/scans", handleListScans)
+	admin.DELETE("/scans/:id", handleCancelScan)
+	admin.GET("/allowlist", handleListAllowlist)
+	admin.POST("/allowlist", handleAddAllowlistEntry)
+	admin.DELETE("/allowlist/:id", handleDeleteAllowlistEntry)
+	admin.GET("/signatures", handleListSignatures)
+	admin.POST("/signatures/validate/:file", handleValidateSignatures)
+	admin.PUT("/signatures/:set/:file", handleInstallSignatures)
+	admin.DELETE("/signatures/:set", handleDeleteSignatures)
+	admin.DELETE("/signatures/:set/:file", handleDeleteSignatures)
+
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// Create HTTP server
@@ -129,7 +322,38 @@ func startRESTServer(errChan chan<- error) *http.Server {
 	return srv
 }
 
-func startGRPCServer(errChan chan<- error) *grpc.Server {
+func startProxyServer(errChan chan<- error) *http.Server {
+	logger := GetLogger()
+
+	gateway, err := NewUploadGateway(&config)
+	if err != nil {
+		logger.Error("Failed to create upload-gateway proxy", zap.Error(err))
+		errChan <- err
+		return nil
+	}
+	registerReloader("proxy", gateway)
+
+	addr := fmt.Sprintf("%s:%s", config.Host, config.ProxyPort)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: gateway,
+	}
+
+	logger.Info("Starting upload-gateway proxy",
+		zap.String("address", addr),
+		zap.String("upstream", config.ProxyUpstream),
+		zap.Strings("routes", config.ProxyRoutes))
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Upload-gateway proxy error", zap.Error(err))
+			errChan <- fmt.Errorf("upload-gateway proxy error: %w", err)
+		}
+	}()
+
+	return srv
+}
+
+func startGRPCServer(errChan chan<- error) (*grpc.Server, *GRPCHealth) {
 	logger := GetLogger()
 
 	// Create TCP listener
@@ -140,7 +364,7 @@ func startGRPCServer(errChan chan<- error) *grpc.Server {
 			zap.String("address", addr),
 			zap.Error(err))
 		errChan <- fmt.Errorf("failed to listen on %s: %w", addr, err)
-		return nil
+		return nil, nil
 	}
 
 	// Create gRPC server with options
@@ -148,10 +372,22 @@ func startGRPCServer(errChan chan<- error) *grpc.Server {
 	grpcServer := grpc.NewServer(
 		grpc.MaxRecvMsgSize(maxMsgSize),
 		grpc.MaxSendMsgSize(maxMsgSize),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(metricsUnaryInterceptor, requestIDUnaryInterceptor, apiKeyUnaryInterceptor),
+		grpc.ChainStreamInterceptor(metricsStreamInterceptor, requestIDStreamInterceptor, apiKeyStreamInterceptor),
 	)
 
-	// Register service
-	pb.RegisterClamAVScannerServer(grpcServer, NewGRPCServer(&config))
+	// Register service. The message size limits keep their startup value
+	// when max-size is reloaded; the handlers enforce the new limit.
+	service := NewGRPCServer(&config)
+	registerReloader("grpc", service)
+	pb.RegisterClamAVScannerServer(grpcServer, service)
+	pb.RegisterClamAVAdminServer(grpcServer, NewAdminServer())
+
+	// Standard health service for Kubernetes gRPC probes and Envoy
+	grpcHealth := NewGRPCHealth()
+	healthgrpc.RegisterHealthServer(grpcServer, grpcHealth)
+	healthProber.Subscribe(grpcHealth.setReady)
 
 	// Only enable reflection in debug mode (exposes service schema)
 	if config.Debug {
@@ -170,5 +406,98 @@ func startGRPCServer(errChan chan<- error) *grpc.Server {
 		}
 	}()
 
-	return grpcServer
+	return grpcServer, grpcHealth
+}
+
+func startMilterServer(errChan chan<- error) *MilterServer {
+	logger := GetLogger()
+
+	addr := fmt.Sprintf("%s:%s", config.Host, config.MilterPort)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("Failed to create milter listener",
+			zap.String("address", addr),
+			zap.Error(err))
+		errChan <- fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return nil
+	}
+
+	milterServer := NewMilterServer(&config)
+	registerReloader("milter", milterServer)
+
+	logger.Info("Starting milter server",
+		zap.String("address", addr),
+		zap.String("infected_action", config.MilterInfectedAction),
+		zap.String("error_action", config.MilterErrorAction))
+
+	go func() {
+		if err := milterServer.Serve(lis); err != nil {
+			logger.Error("Milter server error", zap.Error(err))
+			errChan <- fmt.Errorf("milter server error: %w", err)
+		}
+	}()
+
+	return milterServer
+}
+
+func startClamdServer(errChan chan<- error) *ClamdServer {
+	logger := GetLogger()
+
+	clamdServer, err := NewClamdServer(&config)
+	if err != nil {
+		logger.Error("Failed to create clamd listener", zap.Error(err))
+		errChan <- err
+		return nil
+	}
+	registerReloader("clamd-listener", clamdServer)
+
+	addr := fmt.Sprintf("%s:%s", config.Host, config.ClamdListenerPort)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("Failed to create clamd listener",
+			zap.String("address", addr),
+			zap.Error(err))
+		errChan <- fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return nil
+	}
+
+	logger.Info("Starting clamd listener",
+		zap.String("address", addr),
+		zap.Strings("allowed_nets", config.ClamdAllowedNets))
+
+	go func() {
+		if err := clamdServer.Serve(lis); err != nil {
+			logger.Error("clamd listener error", zap.Error(err))
+			errChan <- fmt.Errorf("clamd listener error: %w", err)
+		}
+	}()
+
+	return clamdServer
+}
+
+func startWatcher(errChan chan<- error) *Watcher {
+	logger := GetLogger()
+
+	watcher, err := NewWatcher(&config)
+	if err != nil {
+		logger.Error("Failed to create folder watcher", zap.Error(err))
+		errChan <- err
+		return nil
+	}
+	registerReloader("watcher", watcher)
+
+	logger.Info("Starting folder watcher",
+		zap.Strings("directories", config.WatchDirs),
+		zap.Duration("settle", config.WatchSettle),
+		zap.Bool("polling", config.WatchUsePolling),
+		zap.Bool("sidecar", config.WatchSidecar))
+
+	go func() {
+		if err := watcher.Watch(); err != nil {
+			logger.Error("Folder watcher error", zap.Error(err))
+			errChan <- fmt.Errorf("folder watcher error: %w", err)
+		}
+	}()
+
+	return watcher
 }
@@ -17,6 +17,7 @@ import (
 func setupRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
+	router.Use(requestIDMiddleware())
 	router.POST("/api/scan", handleScan)
 	router.POST("/api/stream-scan", handleStreamScan)
 	router.GET("/api/health-check", handleHealthCheck)
@@ -1,13 +1,36 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Transports and reasons labelling clamav_rejected_requests_total. The
+// transports also tell where an in-flight scan comes from.
+const (
+	transportREST     = "rest"
+	transportGRPC     = "grpc"
+	transportProxy    = "proxy"
+	transportMilter   = "milter"
+	transportClamd    = "clamd"
+	transportWatch    = "watch"
+	transportInternal = "internal"
+
+	rejectTooLarge     = "too_large"
+	rejectInvalid      = "invalid_request"
+	rejectUnauthorized = "unauthorized"
+	rejectDraining     = "draining"
 )
 
 var (
@@ -19,14 +42,7 @@ var (
 		[]string{"method", "status"},
 	)
 
-	scanDurationSeconds = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "clamav_scan_duration_seconds",
-			Help:    "Duration of scan operations in seconds",
-			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
-		},
-		[]string{"method"},
-	)
+	scanDurationSeconds = newScanDurationHistogram(defaultConfig().ScanDurationBuckets)
 
 	scansInProgress = promauto.NewGauge(
 		prometheus.GaugeOpts{
@@ -58,14 +74,144 @@ var (
 			Help: "Whether ClamAV is healthy (1) or unhealthy (0)",
 		},
 	)
+
+	scanSizeBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "clamav_scan_size_bytes",
+			Help:    "Size of scanned payloads in bytes",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 11),
+		},
+		[]string{"method"},
+	)
+
+	rejectedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_rejected_requests_total",
+			Help: "Total number of requests rejected before scanning by transport and reason",
+		},
+		[]string{"transport", "reason"},
+	)
+
+	grpcRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_grpc_requests_total",
+			Help: "Total number of gRPC requests by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+
+	grpcRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "clamav_grpc_request_duration_seconds",
+			Help:    "Duration of gRPC requests in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+
+	grpcReceivedBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_grpc_received_bytes_total",
+			Help: "Total size of gRPC request messages in bytes by method",
+		},
+		[]string{"method"},
+	)
+
+	grpcSentBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_grpc_sent_bytes_total",
+			Help: "Total size of gRPC response messages in bytes by method",
+		},
+		[]string{"method"},
+	)
+
+	spoolMemoryBytes = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "clamav_spool_memory_bytes",
+			Help: "Bytes of buffered payloads held in memory against the memory budget",
+		},
+		func() float64 { return float64(spoolBudget.Used()) },
+	)
+
+	spoolMemoryBudgetBytes = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "clamav_spool_memory_budget_bytes",
+			Help: "Memory budget for buffered payloads in bytes (0 is unlimited)",
+		},
+		func() float64 { return float64(currentConfig().MemoryBudget) },
+	)
+
+	spoolFiles = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "clamav_spool_files",
+			Help: "Number of buffered payloads spilled to disk",
+		},
+	)
+
+	spoolSpillsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_spool_spills_total",
+			Help: "Total number of buffered payloads spilled to disk by reason",
+		},
+		[]string{"reason"},
+	)
+
+	policyActionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_policy_actions_total",
+			Help: "Total number of scan results by method, policy and action",
+		},
+		[]string{"method", "policy", "action"},
+	)
+
+	allowlistOverridesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_allowlist_overrides_total",
+			Help: "Total number of detections cleared by the allowlist, by entry kind",
+		},
+		[]string{"kind"},
+	)
+
+	clamdReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_clamd_reloads_total",
+			Help: "Total number of clamd database reloads after custom signature changes, by result",
+		},
+		[]string{"result"},
+	)
+
+	engineVerdictsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_engine_verdicts_total",
+			Help: "Total number of verdicts by scan engine and status when several engines scan",
+		},
+		[]string{"engine", "status"},
+	)
+
+	ruleMatchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_rule_matches_total",
+			Help: "Total number of rule matches of the rules engine, by rule file",
+		},
+		[]string{"file"},
+	)
+
+	hashListHitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clamav_hash_list_hits_total",
+			Help: "Total number of payloads decided by a hash list, by list and action",
+		},
+		[]string{"list", "action"},
+	)
 )
 
 // metricsMiddleware records HTTP request metrics for all endpoints.
-// Skips /metrics (self-referential) and /api/health-check (high-frequency Docker probe).
+// Skips /metrics (self-referential) and the high-frequency Docker and
+// Kubernetes probes.
 func metricsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		path := c.FullPath()
-		if path == "/metrics" || path == "/api/health-check" {
+		if path == "/metrics" || path == "/api/health-check" || path == "/livez" || path == "/readyz" {
 			c.Next()
 			return
 		}
@@ -82,7 +228,8 @@ func metricsMiddleware() gin.HandlerFunc {
 	}
 }
 
-// recordScanMetrics records scan-specific metrics (duration and request count)
+// recordScanMetrics records scan-specific metrics (duration, size, request
+// count and policy action)
 func recordScanMetrics(method string, result *ScanResult, err error) {
 	var engineErr *ScanEngineError
 	var timeoutErr *ScanTimeoutError
@@ -103,9 +250,104 @@ func recordScanMetrics(method string, result *ScanResult, err error) {
 
 	scanRequestsTotal.WithLabelValues(method, status).Inc()
 
+	if result != nil && result.Action != "" {
+		policyActionsTotal.WithLabelValues(method, result.Policy, result.Action).Inc()
+	}
+
 	if result != nil {
 		scanDurationSeconds.WithLabelValues(method).Observe(result.ScanTime)
+		scanSizeBytes.WithLabelValues(method).Observe(float64(result.Size))
 	} else if engineErr != nil && engineErr.ScanTime > 0 {
 		scanDurationSeconds.WithLabelValues(method).Observe(engineErr.ScanTime)
 	}
 }
+
+// recordRejection counts a request refused before it reached clamd
+func recordRejection(transport, reason string) {
+	rejectedRequestsTotal.WithLabelValues(transport, reason).Inc()
+}
+
+// messageSize returns the encoded size of a gRPC message
+func messageSize(msg any) int {
+	if m, ok := msg.(proto.Message); ok {
+		return proto.Size(m)
+	}
+	return 0
+}
+
+// recordGRPCMetrics records the outcome and latency of a gRPC call
+func recordGRPCMetrics(method string, start time.Time, err error) {
+	grpcRequestsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpcRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// metricsUnaryInterceptor records gRPC request metrics for unary RPCs,
+// the counterpart of metricsMiddleware
+func metricsUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	grpcReceivedBytesTotal.WithLabelValues(info.FullMethod).Add(float64(messageSize(req)))
+
+	resp, err := handler(ctx, req)
+
+	if err == nil {
+		grpcSentBytesTotal.WithLabelValues(info.FullMethod).Add(float64(messageSize(resp)))
+	}
+	recordGRPCMetrics(info.FullMethod, start, err)
+	return resp, err
+}
+
+// metricsStreamInterceptor records gRPC request metrics for streaming RPCs.
+// A stream counts as one request; its bytes are summed over all messages.
+func metricsStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, &metricsStream{ServerStream: ss, method: info.FullMethod})
+	recordGRPCMetrics(info.FullMethod, start, err)
+	return err
+}
+
+// metricsStream counts the bytes of the messages passing through a stream,
+// and messages grpc refuses for exceeding the maximum message size
+type metricsStream struct {
+	grpc.ServerStream
+	method string
+}
+
+func (s *metricsStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	switch {
+	case err == nil:
+		grpcReceivedBytesTotal.WithLabelValues(s.method).Add(float64(messageSize(m)))
+	case status.Code(err) == codes.ResourceExhausted:
+		recordRejection(transportGRPC, rejectTooLarge)
+	}
+	return err
+}
+
+func (s *metricsStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		grpcSentBytesTotal.WithLabelValues(s.method).Add(float64(messageSize(m)))
+	}
+	return err
+}
+
+func newScanDurationHistogram(buckets []float64) *prometheus.HistogramVec {
+	return promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "clamav_scan_duration_seconds",
+			Help:    "Duration of scan operations in seconds",
+			Buckets: buckets,
+		},
+		[]string{"method"},
+	)
+}
+
+// setScanDurationBuckets replaces the scan duration histogram when the
+// configured buckets differ from the defaults. Call it before serving.
+func setScanDurationBuckets(buckets []float64) {
+	if slices.Equal(buckets, defaultConfig().ScanDurationBuckets) {
+		return
+	}
+	prometheus.Unregister(scanDurationSeconds)
+	scanDurationSeconds = newScanDurationHistogram(buckets)
+}
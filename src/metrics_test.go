@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	pb "clamav-api/proto"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	io_prometheus_client "github.com/prometheus/client_model/go"
@@ -122,3 +126,103 @@ func TestRecordScanMetricsEngineErrorWithScanTime(t *testing.T) {
 	assert.Equal(t, baseCounter+1, getCounterValue(t, scanRequestsTotal, "test_engine_time", "engine_error"))
 	assert.Equal(t, baseCount+1, getHistogramCount(t, scanDurationSeconds, "test_engine_time"))
 }
+
+func TestRecordScanMetricsSize(t *testing.T) {
+	base := getHistogramCount(t, scanSizeBytes, "test_size")
+	recordScanMetrics("test_size", &ScanResult{Status: "OK", Size: 4096}, nil)
+	recordScanMetrics("test_size", nil, errors.New("generic"))
+	assert.Equal(t, base+1, getHistogramCount(t, scanSizeBytes, "test_size"))
+}
+
+func TestGRPCMetricsUnary(t *testing.T) {
+	client := getTestClient(t)
+	const method = "/clamav.ClamAVScanner/ScanFile"
+
+	baseRequests := getCounterValue(t, grpcRequestsTotal, method, "InvalidArgument")
+	baseDuration := getHistogramCount(t, grpcRequestDuration, method)
+	baseReceived := getCounterValue(t, grpcReceivedBytesTotal, method)
+	baseRejected := getCounterValue(t, rejectedRequestsTotal, transportGRPC, rejectInvalid)
+
+	_, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Filename: "empty.txt"})
+	require.Error(t, err)
+
+	assert.Equal(t, baseRequests+1, getCounterValue(t, grpcRequestsTotal, method, "InvalidArgument"))
+	assert.Equal(t, baseDuration+1, getHistogramCount(t, grpcRequestDuration, method))
+	assert.Greater(t, getCounterValue(t, grpcReceivedBytesTotal, method), baseReceived)
+	assert.Equal(t, baseRejected+1, getCounterValue(t, rejectedRequestsTotal, transportGRPC, rejectInvalid))
+}
+
+func TestGRPCMetricsStream(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	client := getTestClient(t)
+	const method = "/clamav.ClamAVScanner/ScanStream"
+
+	baseRequests := getCounterValue(t, grpcRequestsTotal, method, "OK")
+	baseReceived := getCounterValue(t, grpcReceivedBytesTotal, method)
+	baseSent := getCounterValue(t, grpcSentBytesTotal, method)
+	baseSize := getHistogramCount(t, scanSizeBytes, "grpc_stream_scan")
+
+	stream, err := client.ScanStream(context.Background())
+	require.NoError(t, err)
+	chunk := &pb.ScanStreamRequest{Chunk: bytes.Repeat([]byte("a"), 100)}
+	require.NoError(t, stream.Send(chunk))
+	last := &pb.ScanStreamRequest{Chunk: bytes.Repeat([]byte("b"), 100), IsLast: true}
+	require.NoError(t, stream.Send(last))
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+
+	assert.Equal(t, baseRequests+1, getCounterValue(t, grpcRequestsTotal, method, "OK"))
+	assert.GreaterOrEqual(t, getCounterValue(t, grpcReceivedBytesTotal, method), baseReceived+200)
+	assert.Greater(t, getCounterValue(t, grpcSentBytesTotal, method), baseSent)
+	assert.Equal(t, baseSize+1, getHistogramCount(t, scanSizeBytes, "grpc_stream_scan"))
+}
+
+func TestRESTRejectionMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/stream-scan", handleStreamScan)
+
+	baseInvalid := getCounterValue(t, rejectedRequestsTotal, transportREST, rejectInvalid)
+	baseTooLarge := getCounterValue(t, rejectedRequestsTotal, transportREST, rejectTooLarge)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/stream-scan", bytes.NewReader([]byte("data")))
+	req.ContentLength = currentConfig().MaxContentLength + 1
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	assert.Equal(t, baseInvalid+1, getCounterValue(t, rejectedRequestsTotal, transportREST, rejectInvalid))
+	assert.Equal(t, baseTooLarge+1, getCounterValue(t, rejectedRequestsTotal, transportREST, rejectTooLarge))
+}
+
+func TestSetScanDurationBuckets(t *testing.T) {
+	orig := scanDurationSeconds
+	defer func() {
+		prometheus.Unregister(scanDurationSeconds)
+		scanDurationSeconds = orig
+		prometheus.MustRegister(orig)
+	}()
+
+	setScanDurationBuckets(defaultConfig().ScanDurationBuckets)
+	assert.Same(t, orig, scanDurationSeconds, "default buckets keep the histogram")
+
+	setScanDurationBuckets([]float64{1, 10})
+	scanDurationSeconds.WithLabelValues("test_buckets").Observe(5)
+
+	m := &io_prometheus_client.Metric{}
+	obs, err := scanDurationSeconds.GetMetricWithLabelValues("test_buckets")
+	require.NoError(t, err)
+	require.NoError(t, obs.(prometheus.Metric).Write(m))
+	buckets := m.GetHistogram().GetBucket()
+	require.Len(t, buckets, 2)
+	assert.Equal(t, 1.0, buckets[0].GetUpperBound())
+	assert.Equal(t, uint64(0), buckets[0].GetCumulativeCount())
+	assert.Equal(t, 10.0, buckets[1].GetUpperBound())
+	assert.Equal(t, uint64(1), buckets[1].GetCumulativeCount())
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sendmail milter protocol constants (libmilter mfdef.h)
+const (
+	milterProtocolVersion = 6
+
+	// Commands sent by the MTA
+	smficAbort   = 'A'
+	smficBody    = 'B'
+	smficConnect = 'C'
+	smficMacro   = 'D'
+	smficBodyEOB = 'E'
+	smficHelo    = 'H'
+	smficQuitNC  = 'K'
+	smficHeader  = 'L'
+	smficMail    = 'M'
+	smficEOH     = 'N'
+	smficOptNeg  = 'O'
+	smficQuit    = 'Q'
+	smficRcpt    = 'R'
+	smficData    = 'T'
+	smficUnknown = 'U'
+
+	// Replies sent back to the MTA
+	smfirAddHeader = 'h'
+	smfirContinue  = 'c'
+	smfirDiscard   = 'd'
+	smfirReplyCode = 'y'
+
+	// Actions we may perform (SMFIF_*)
+	smfifAddHeaders = 0x01
+
+	// Protocol steps we ask the MTA to skip (SMFIP_*)
+	smfipNoConnect = 0x01
+	smfipNoHelo    = 0x02
+	smfipNoRcpt    = 0x08
+	smfipNoUnknown = 0x100
+	smfipNoData    = 0x200
+
+	// maxMilterPacket bounds a single protocol packet (body chunks are at most 1 MiB)
+	maxMilterPacket = 2 << 20
+)
+
+// Milter policy actions
+const (
+	milterActionAccept   = "accept"
+	milterActionReject   = "reject"
+	milterActionTempfail = "tempfail"
+	milterActionDiscard  = "discard"
+)
+
+// validMilterAction reports whether action is a supported milter policy action
+func validMilterAction(action string) bool {
+	switch action {
+	case milterActionAccept, milterActionReject, milterActionTempfail, milterActionDiscard:
+		return true
+	}
+	return false
+}
+
+// MilterServer implements the Sendmail milter protocol so MTAs such as Postfix
+// can scan mail attachments through this service.
+type MilterServer struct {
+	config *liveConfig
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewMilterServer creates a new milter server with the given config
+func NewMilterServer(cfg *Config) *MilterServer {
+	return &MilterServer{
+		config: newLiveConfig(cfg),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Reload applies a reloaded configuration to new and running sessions
+func (s *MilterServer) Reload(cfg *Config) error {
+	s.config.Store(cfg)
+	return nil
+}
+
+// Serve accepts MTA connections on lis until Shutdown is called
+func (s *MilterServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	s.listener = lis
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for active sessions to finish.
+// Sessions still running when ctx expires are closed forcibly.
+func (s *MilterServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// milterSession holds per-connection and per-message state
+type milterSession struct {
+	server *MilterServer
+	conn   net.Conn
+	reader *bufio.Reader
+
+	queueID  string
+	sender   string
+	message  bytes.Buffer
+	inBody   bool
+	oversize bool
+}
+
+func (s *MilterServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &milterSession{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	if err := sess.run(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		GetLogger().Warn("Milter session ended with error",
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+			zap.Error(err))
+	}
+}
+
+// run processes commands until the MTA quits or the connection fails
+func (m *milterSession) run() error {
+	for {
+		// The MTA may idle between commands, waiting on the SMTP client
+		m.conn.SetReadDeadline(time.Now().Add(m.server.config.Load().MilterIdleTimeout))
+
+		cmd, data, err := readMilterPacket(m.reader)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case smficOptNeg:
+			if err := m.negotiate(data); err != nil {
+				return err
+			}
+		case smficMacro:
+			m.readMacros(data)
+		case smficMail:
+			m.reset()
+			if args := splitMilterStrings(data); len(args) > 0 {
+				m.sender = args[0]
+			}
+			err = m.reply(smfirContinue, nil)
+		case smficHeader:
+			m.addHeader(data)
+			err = m.reply(smfirContinue, nil)
+		case smficEOH:
+			m.message.WriteString("\r\n")
+			m.inBody = true
+			err = m.reply(smfirContinue, nil)
+		case smficBody:
+			m.addBody(data)
+			err = m.reply(smfirContinue, nil)
+		case smficBodyEOB:
+			m.addBody(data)
+			err = m.endOfMessage()
+			m.reset()
+		case smficAbort:
+			m.reset()
+		case smficQuit:
+			return nil
+		case smficQuitNC:
+			m.reset()
+			m.queueID = ""
+		case smficConnect, smficHelo, smficRcpt, smficData, smficUnknown:
+			err = m.reply(smfirContinue, nil)
+		default:
+			return fmt.Errorf("unknown milter command %q", cmd)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// negotiate answers SMFIC_OPTNEG, requesting only the steps we need
+func (m *milterSession) negotiate(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("short option negotiation packet (%d bytes)", len(data))
+	}
+	mtaVersion := binary.BigEndian.Uint32(data[0:4])
+	mtaActions := binary.BigEndian.Uint32(data[4:8])
+	mtaProtocol := binary.BigEndian.Uint32(data[8:12])
+
+	version := uint32(milterProtocolVersion)
+	if mtaVersion < version {
+		version = mtaVersion
+	}
+	skip := uint32(smfipNoConnect | smfipNoHelo | smfipNoRcpt | smfipNoUnknown | smfipNoData)
+
+	resp := make([]byte, 12)
+	binary.BigEndian.PutUint32(resp[0:4], version)
+	binary.BigEndian.PutUint32(resp[4:8], mtaActions&smfifAddHeaders)
+	binary.BigEndian.PutUint32(resp[8:12], mtaProtocol&skip)
+	return m.reply(smficOptNeg, resp)
+}
+
+// readMacros records the macros we log; the MTA expects no reply
+func (m *milterSession) readMacros(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	pairs := splitMilterStrings(data[1:])
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == "i" || pairs[i] == "{i}" {
+			m.queueID = pairs[i+1]
+		}
+	}
+}
+
+func (m *milterSession) addHeader(data []byte) {
+	fields := splitMilterStrings(data)
+	if len(fields) < 2 {
+		return
+	}
+	m.write([]byte(fields[0] + ": " + strings.TrimLeft(fields[1], " ") + "\r\n"))
+}
+
+func (m *milterSession) addBody(data []byte) {
+	if !m.inBody {
+		// Some MTAs skip SMFIC_EOH when there are no headers
+		m.message.WriteString("\r\n")
+		m.inBody = true
+	}
+	m.write(data)
+}
+
+// write appends to the message buffer, enforcing MaxContentLength
+func (m *milterSession) write(data []byte) {
+	if m.oversize {
+		return
+	}
+	if int64(m.message.Len()+len(data)) > m.server.config.Load().MaxContentLength {
+		m.oversize = true
+		m.message.Reset()
+		return
+	}
+	m.message.Write(data)
+}
+
+func (m *milterSession) reset() {
+	m.message.Reset()
+	m.sender = ""
+	m.inBody = false
+	m.oversize = false
+}
+
+func (m *milterSession) reply(cmd byte, data []byte) error {
+	m.conn.SetWriteDeadline(time.Now().Add(m.server.config.Load().ScanTimeout))
+	return writeMilterPacket(m.conn, cmd, data)
+}
+
+// milterDecision is the final policy outcome for one message
+type milterDecision struct {
+	Action string
+	// Status is the X-Virus-Status header value
+	Status string
+	// Reply is the SMTP reply used for reject and tempfail
+	Reply string
+}
+
+// endOfMessage scans the accumulated message and applies the configured policy
+func (m *milterSession) endOfMessage() error {
+	logger := GetLogger()
+	cfg := m.server.config.Load()
+
+	var decision milterDecision
+	var parts int
+	if m.oversize {
+		decision = milterDecision{
+			Action: cfg.MilterOversizeAction,
+			Status: "Unscanned (message too large)",
+			Reply:  fmt.Sprintf("552 5.3.4 Message exceeds maximum scan size of %d bytes", cfg.MaxContentLength),
+		}
+	} else {
+		ctx := withScanSource(context.Background(), transportMilter, m.conn.RemoteAddr().String())
+		ctx, cancel := context.WithTimeout(ctx, cfg.ScanTimeout)
+		results := m.scanMessage(ctx)
+		cancel()
+		parts = len(results)
+		decision = decideMilterAction(cfg, results)
+	}
+
+	logger.Info("Milter scan completed",
+		zap.String("queue_id", m.queueID),
+		zap.String("sender", m.sender),
+		zap.Int("parts", parts),
+		zap.String("status", decision.Status),
+		zap.String("action", decision.Action),
+		zap.String("remote_addr", m.conn.RemoteAddr().String()))
+
+	switch decision.Action {
+	case milterActionReject, milterActionTempfail:
+		return m.reply(smfirReplyCode, append([]byte(decision.Reply), 0))
+	case milterActionDiscard:
+		return m.reply(smfirDiscard, nil)
+	default:
+		if cfg.MilterAddHeader {
+			if err := m.addResponseHeader("X-Virus-Scanned", "clamav-api "+Version); err != nil {
+				return err
+			}
+			if err := m.addResponseHeader("X-Virus-Status", decision.Status); err != nil {
+				return err
+			}
+		}
+		return m.reply(smfirContinue, nil)
+	}
+}
+
+// scanMessage parses the buffered message and scans each part. A message
+// that cannot be parsed as MIME is scanned as a single opaque blob.
+func (m *milterSession) scanMessage(ctx context.Context) []PartScanResult {
+	raw := m.message.Bytes()
+	msg, err := parseMessage(bytes.NewReader(raw), m.server.config.Load().MaxContentLength)
+	if err != nil {
+		GetLogger().Debug("Milter message is not valid MIME, scanning raw message",
+			zap.String("queue_id", m.queueID),
+			zap.Error(err))
+		msg = &ParsedMessage{Parts: []MessagePart{{Path: "1", Data: raw}}}
+	}
+	return scanMessageParts(ctx, msg, "milter", m.server.config.Load().ScanTimeout)
+}
+
+func (m *milterSession) addResponseHeader(name, value string) error {
+	data := append([]byte(name), 0)
+	data = append(data, value...)
+	data = append(data, 0)
+	return m.reply(smfirAddHeader, data)
+}
+
+// decideMilterAction maps per-part scan results to the configured policy.
+// A blocked detection wins over scan errors, which win over detections the
+// policy lets through and over a clean verdict.
+func decideMilterAction(cfg *Config, results []PartScanResult) milterDecision {
+	summary, err := summarizeMessageResults(results)
+	switch {
+	case err != nil:
+		return milterDecision{
+			Action: cfg.MilterErrorAction,
+			Status: "Unscanned (scan error)",
+			Reply:  errorReply(cfg.MilterErrorAction),
+		}
+	case summary.Blocked():
+		return milterDecision{
+			Action: cfg.MilterInfectedAction,
+			Status: "Infected (" + summary.Description + ")",
+			Reply:  infectedReply(cfg.MilterInfectedAction, summary.Description),
+		}
+	case summary.Status == "FOUND" && summary.Action == actionWarn:
+		return milterDecision{Action: milterActionAccept, Status: "Warning (" + summary.Description + ")"}
+	default:
+		return milterDecision{Action: milterActionAccept, Status: "Clean"}
+	}
+}
+
+func infectedReply(action, virus string) string {
+	if action == milterActionTempfail {
+		return "451 4.7.1 Message temporarily rejected: virus found: " + virus
+	}
+	return "550 5.7.1 Message rejected: virus found: " + virus
+}
+
+func errorReply(action string) string {
+	if action == milterActionReject {
+		return "554 5.7.0 Message could not be scanned"
+	}
+	return "451 4.3.0 Virus scan temporarily unavailable"
+}
+
+// readMilterPacket reads one length-prefixed milter packet
+func readMilterPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > maxMilterPacket {
+		return 0, nil, fmt.Errorf("invalid milter packet length %d", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// writeMilterPacket writes one length-prefixed milter packet
+func writeMilterPacket(w io.Writer, cmd byte, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(data)))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// splitMilterStrings splits a sequence of NUL-terminated strings
+func splitMilterStrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMilterConfig() *Config {
+	cfg := config
+	cfg.MaxContentLength = 1 << 20
+	cfg.ScanTimeout = 5 * time.Second
+	cfg.MilterInfectedAction = milterActionReject
+	cfg.MilterErrorAction = milterActionTempfail
+	cfg.MilterOversizeAction = milterActionReject
+	cfg.MilterAddHeader = true
+	cfg.MilterIdleTimeout = time.Minute
+	return &cfg
+}
+
+// startTestMilterSession runs a milter session over an in-memory pipe and
+// returns the MTA side of the connection.
+func startTestMilterSession(t *testing.T, cfg *Config) net.Conn {
+	t.Helper()
+	server, client := net.Pipe()
+	srv := NewMilterServer(cfg)
+	go srv.handleConn(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func sendMilter(t *testing.T, conn net.Conn, cmd byte, data []byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, writeMilterPacket(conn, cmd, data))
+}
+
+func recvMilter(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	cmd, data, err := readMilterPacket(conn)
+	require.NoError(t, err)
+	return cmd, data
+}
+
+func negotiateMilter(t *testing.T, conn net.Conn) {
+	t.Helper()
+	opts := make([]byte, 12)
+	binary.BigEndian.PutUint32(opts[0:4], 6)
+	binary.BigEndian.PutUint32(opts[4:8], 0x1ff)
+	binary.BigEndian.PutUint32(opts[8:12], 0x1fffff)
+	sendMilter(t, conn, smficOptNeg, opts)
+
+	cmd, data := recvMilter(t, conn)
+	require.Equal(t, byte(smficOptNeg), cmd)
+	require.Len(t, data, 12)
+	assert.Equal(t, uint32(6), binary.BigEndian.Uint32(data[0:4]))
+	assert.Equal(t, uint32(smfifAddHeaders), binary.BigEndian.Uint32(data[4:8]))
+	assert.NotZero(t, binary.BigEndian.Uint32(data[8:12])&smfipNoConnect)
+}
+
+func sendMilterMessage(t *testing.T, conn net.Conn, body string) {
+	t.Helper()
+	sendMilter(t, conn, smficMacro, []byte("Mi\x00ABC123\x00"))
+	sendMilter(t, conn, smficMail, []byte("<sender@example.com>\x00"))
+	cmd, _ := recvMilter(t, conn)
+	assert.Equal(t, byte(smfirContinue), cmd)
+
+	sendMilter(t, conn, smficHeader, []byte("Subject\x00 test\x00"))
+	cmd, _ = recvMilter(t, conn)
+	assert.Equal(t, byte(smfirContinue), cmd)
+
+	sendMilter(t, conn, smficEOH, nil)
+	cmd, _ = recvMilter(t, conn)
+	assert.Equal(t, byte(smfirContinue), cmd)
+
+	sendMilter(t, conn, smficBody, []byte(body))
+	cmd, _ = recvMilter(t, conn)
+	assert.Equal(t, byte(smfirContinue), cmd)
+
+	sendMilter(t, conn, smficBodyEOB, nil)
+}
+
+func TestMilterPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeMilterPacket(&buf, smficHeader, []byte("From\x00a@b\x00")))
+
+	cmd, data, err := readMilterPacket(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, byte(smficHeader), cmd)
+	assert.Equal(t, []string{"From", "a@b"}, splitMilterStrings(data))
+}
+
+func TestMilterPacketInvalidLength(t *testing.T) {
+	_, _, err := readMilterPacket(bytes.NewReader([]byte{0, 0, 0, 0}))
+	assert.Error(t, err)
+
+	_, _, err = readMilterPacket(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.Error(t, err)
+}
+
+func TestValidMilterAction(t *testing.T) {
+	for _, action := range []string{"accept", "reject", "tempfail", "discard"} {
+		assert.True(t, validMilterAction(action), action)
+	}
+	assert.False(t, validMilterAction("quarantine"))
+	assert.False(t, validMilterAction(""))
+}
+
+func TestDecideMilterAction(t *testing.T) {
+	cfg := testMilterConfig()
+	clean := &ScanResult{Status: "OK"}
+	infected := &ScanResult{Status: "FOUND", Description: "Eicar-Test-Signature"}
+	warned := &ScanResult{Status: "FOUND", Description: "PUA.Win.Tool.Packed", Action: actionWarn}
+	scanErr := errors.New("clamd unavailable")
+
+	tests := []struct {
+		name       string
+		results    []PartScanResult
+		wantAction string
+		wantStatus string
+		wantReply  string
+	}{
+		{
+			name:       "all clean accepts",
+			results:    []PartScanResult{{Result: clean}, {Result: clean}},
+			wantAction: milterActionAccept,
+			wantStatus: "Clean",
+		},
+		{
+			name:       "detection rejects",
+			results:    []PartScanResult{{Result: clean}, {Result: infected}},
+			wantAction: milterActionReject,
+			wantStatus: "Infected (Eicar-Test-Signature)",
+			wantReply:  "550 5.7.1",
+		},
+		{
+			name:       "detection wins over scan error",
+			results:    []PartScanResult{{Err: scanErr}, {Result: infected}},
+			wantAction: milterActionReject,
+			wantStatus: "Infected (Eicar-Test-Signature)",
+			wantReply:  "550 5.7.1",
+		},
+		{
+			name:       "warned detection accepts",
+			results:    []PartScanResult{{Result: clean}, {Result: warned}},
+			wantAction: milterActionAccept,
+			wantStatus: "Warning (PUA.Win.Tool.Packed)",
+		},
+		{
+			name:       "scan error tempfails",
+			results:    []PartScanResult{{Result: clean}, {Err: scanErr}},
+			wantAction: milterActionTempfail,
+			wantStatus: "Unscanned (scan error)",
+			wantReply:  "451 4.3.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := decideMilterAction(cfg, tt.results)
+			assert.Equal(t, tt.wantAction, decision.Action)
+			assert.Equal(t, tt.wantStatus, decision.Status)
+			if tt.wantReply != "" {
+				assert.Contains(t, decision.Reply, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestMilterSessionNegotiation(t *testing.T) {
+	conn := startTestMilterSession(t, testMilterConfig())
+	negotiateMilter(t, conn)
+	sendMilter(t, conn, smficQuit, nil)
+}
+
+func TestMilterSessionIdleTimeout(t *testing.T) {
+	cfg := testMilterConfig()
+	cfg.MilterIdleTimeout = 50 * time.Millisecond
+	cfg.ScanTimeout = time.Hour
+	conn := startTestMilterSession(t, cfg)
+	negotiateMilter(t, conn)
+
+	// An MTA that stays silent past the idle timeout is disconnected even
+	// though the scan timeout is much longer
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := readMilterPacket(conn)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestMilterSessionScanErrorTempfails(t *testing.T) {
+	withInvalidSocket(t)
+
+	conn := startTestMilterSession(t, testMilterConfig())
+	negotiateMilter(t, conn)
+	sendMilterMessage(t, conn, "hello world\r\n")
+
+	cmd, data := recvMilter(t, conn)
+	assert.Equal(t, byte(smfirReplyCode), cmd)
+	assert.Contains(t, string(data), "451 4.3.0")
+}
+
+func TestMilterSessionScanErrorAcceptAddsHeaders(t *testing.T) {
+	withInvalidSocket(t)
+
+	cfg := testMilterConfig()
+	cfg.MilterErrorAction = milterActionAccept
+	conn := startTestMilterSession(t, cfg)
+	negotiateMilter(t, conn)
+	sendMilterMessage(t, conn, "hello world\r\n")
+
+	cmd, data := recvMilter(t, conn)
+	assert.Equal(t, byte(smfirAddHeader), cmd)
+	assert.Equal(t, "X-Virus-Scanned", splitMilterStrings(data)[0])
+
+	cmd, data = recvMilter(t, conn)
+	assert.Equal(t, byte(smfirAddHeader), cmd)
+	assert.Equal(t, []string{"X-Virus-Status", "Unscanned (scan error)"}, splitMilterStrings(data))
+
+	cmd, _ = recvMilter(t, conn)
+	assert.Equal(t, byte(smfirContinue), cmd)
+}
+
+func TestMilterSessionOversizeRejects(t *testing.T) {
+	cfg := testMilterConfig()
+	cfg.MaxContentLength = 16
+	conn := startTestMilterSession(t, cfg)
+	negotiateMilter(t, conn)
+	sendMilterMessage(t, conn, "this body is larger than sixteen bytes\r\n")
+
+	cmd, data := recvMilter(t, conn)
+	assert.Equal(t, byte(smfirReplyCode), cmd)
+	assert.Contains(t, string(data), "552 5.3.4")
+}
+
+func TestMilterSessionAbortResetsMessage(t *testing.T) {
+	cfg := testMilterConfig()
+	cfg.MaxContentLength = 32
+	conn := startTestMilterSession(t, cfg)
+	negotiateMilter(t, conn)
+
+	sendMilter(t, conn, smficMail, []byte("<a@example.com>\x00"))
+	recvMilter(t, conn)
+	sendMilter(t, conn, smficBody, []byte("this body is larger than thirty-two bytes"))
+	recvMilter(t, conn)
+	sendMilter(t, conn, smficAbort, nil)
+
+	// The aborted oversize body must not leak into the next message
+	withInvalidSocket(t)
+	sendMilterMessage(t, conn, "small\r\n")
+	cmd, data := recvMilter(t, conn)
+	assert.Equal(t, byte(smfirReplyCode), cmd)
+	assert.Contains(t, string(data), "451 4.3.0")
+}
+
+func TestMilterServerShutdown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := NewMilterServer(testMilterConfig())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(lis) }()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	negotiateMilter(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// The idle session is still open, so shutdown must force-close it
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	assert.NoError(t, <-served)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxMIMEDepth bounds multipart/message nesting to defend against MIME bombs
+	maxMIMEDepth = 16
+	// maxMIMEParts bounds the number of leaf parts extracted from one message
+	maxMIMEParts = 1000
+)
+
+// errMessageTooLarge indicates the decoded message exceeded MaxContentLength
+var errMessageTooLarge = errors.New("message exceeds maximum allowed size")
+
+// ParsedMessage is an RFC 5322 message split into its decoded leaf parts
+type ParsedMessage struct {
+	From      string
+	To        string
+	Subject   string
+	MessageID string
+	Date      string
+	Parts     []MessagePart
+}
+
+// MessagePart is a single decoded leaf part of a MIME message
+type MessagePart struct {
+	// Path identifies the part within the MIME tree, e.g. "1.2"
+	Path        string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// PartScanResult is the verdict for a single message part
+type PartScanResult struct {
+	Part   *MessagePart
+	Result *ScanResult
+	Err    error
+}
+
+// messageParser walks a MIME tree while tracking the decoded byte budget
+type messageParser struct {
+	remaining int64
+	parts     []MessagePart
+}
+
+// parseMessage reads an RFC 5322 message and decodes every leaf part.
+// maxSize bounds the total number of decoded bytes kept in memory.
+func parseMessage(r io.Reader, maxSize int64) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	parsed := &ParsedMessage{
+		From:      decodeHeader(msg.Header.Get("From")),
+		To:        decodeHeader(msg.Header.Get("To")),
+		Subject:   decodeHeader(msg.Header.Get("Subject")),
+		MessageID: msg.Header.Get("Message-Id"),
+		Date:      msg.Header.Get("Date"),
+	}
+
+	p := &messageParser{remaining: maxSize}
+	if err := p.walk(mimeHeader(msg.Header), msg.Body, "1", 0); err != nil {
+		return nil, err
+	}
+	parsed.Parts = p.parts
+
+	return parsed, nil
+}
+
+// mimeHeader adapts mail.Header to the textproto-style accessor used by multipart
+type mimeHeader map[string][]string
+
+func (h mimeHeader) Get(key string) string {
+	return mail.Header(h).Get(key)
+}
+
+// walk recursively descends into multipart and message/rfc822 entities,
+// collecting decoded leaf parts.
+func (p *messageParser) walk(header mimeHeader, body io.Reader, path string, depth int) error {
+	if depth > maxMIMEDepth {
+		return fmt.Errorf("MIME nesting deeper than %d levels", maxMIMEDepth)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045: a missing or malformed Content-Type defaults to text/plain
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		boundary := params["boundary"]
+		if boundary == "" {
+			return p.addLeaf(header, body, path, mediaType)
+		}
+		mr := multipart.NewReader(body, boundary)
+		for i := 1; ; i++ {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body at %s: %w", path, err)
+			}
+			if err := p.walk(mimeHeader(part.Header), part, path+"."+strconv.Itoa(i), depth+1); err != nil {
+				return err
+			}
+		}
+
+	case mediaType == "message/rfc822":
+		decoded, err := p.decodeBody(header, body)
+		if err != nil {
+			return err
+		}
+		inner, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(decoded)))
+		if err != nil {
+			// Not a well-formed message; scan it as an opaque part instead
+			return p.addData(header, decoded, path, mediaType)
+		}
+		p.remaining += int64(len(decoded))
+		return p.walk(mimeHeader(inner.Header), inner.Body, path+".1", depth+1)
+
+	default:
+		return p.addLeaf(header, body, path, mediaType)
+	}
+}
+
+// addLeaf decodes a leaf body and records it as a message part
+func (p *messageParser) addLeaf(header mimeHeader, body io.Reader, path, mediaType string) error {
+	data, err := p.decodeBody(header, body)
+	if err != nil {
+		return err
+	}
+	return p.addData(header, data, path, mediaType)
+}
+
+func (p *messageParser) addData(header mimeHeader, data []byte, path, mediaType string) error {
+	if len(p.parts) >= maxMIMEParts {
+		return fmt.Errorf("message has more than %d parts", maxMIMEParts)
+	}
+	filename := partFilename(header)
+	p.parts = append(p.parts, MessagePart{
+		Path:        path,
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+	})
+
+	// Outlook wraps attachments in winmail.dat; scan each embedded file as
+	// well as the container itself. Extracted data aliases the container.
+	if isTNEF(mediaType, filename, data) {
+		attachments, err := decodeTNEF(data)
+		if err != nil {
+			// Keep the container; clamd can still inspect it as a whole
+			return nil
+		}
+		for i, att := range attachments {
+			if len(p.parts) >= maxMIMEParts {
+				return fmt.Errorf("message has more than %d parts", maxMIMEParts)
+			}
+			p.parts = append(p.parts, MessagePart{
+				Path:        path + "." + strconv.Itoa(i+1),
+				Filename:    att.Filename,
+				ContentType: "application/octet-stream",
+				Data:        att.Data,
+			})
+		}
+	}
+	return nil
+}
+
+// decodeBody reads a part body, undoing its Content-Transfer-Encoding and
+// charging the decoded size against the parser's byte budget.
+func (p *messageParser) decodeBody(header mimeHeader, body io.Reader) ([]byte, error) {
+	var reader io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(body)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, p.remaining+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode part: %w", err)
+	}
+	if int64(len(data)) > p.remaining {
+		return nil, errMessageTooLarge
+	}
+	p.remaining -= int64(len(data))
+	return data, nil
+}
+
+// base64Cleaner strips whitespace and line breaks that base64.NewDecoder rejects
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			switch b {
+			case '\r', '\n', ' ', '\t':
+			default:
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// partFilename extracts the filename from Content-Disposition or Content-Type
+func partFilename(header mimeHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if name := params["filename"]; name != "" {
+			return decodeHeader(name)
+		}
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		if name := params["name"]; name != "" {
+			return decodeHeader(name)
+		}
+	}
+	return ""
+}
+
+// decodeHeader decodes RFC 2047 encoded-words, returning the raw value on failure
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// scanMessageParts scans every part of a parsed message through performScan.
+// Scanning stops early if the context is canceled.
+func scanMessageParts(ctx context.Context, msg *ParsedMessage, method string, timeout time.Duration) []PartScanResult {
+	logger := loggerFromContext(ctx)
+	results := make([]PartScanResult, 0, len(msg.Parts))
+
+	for i := range msg.Parts {
+		part := &msg.Parts[i]
+		if ctx.Err() != nil {
+			results = append(results, PartScanResult{Part: part, Err: ctx.Err()})
+			continue
+		}
+
+		name := part.Filename
+		if name == "" {
+			name = "part " + part.Path
+		}
+		scansInProgress.Inc()
+		result, err := performScan(withScanFilename(ctx, name), bytes.NewReader(part.Data), timeout)
+		scansInProgress.Dec()
+		recordScanMetrics(method, result, err)
+
+		if err != nil {
+			logger.Warn("Message part scan failed",
+				zap.String("part", part.Path),
+				zap.String("filename", part.Filename),
+				zap.Error(err))
+		} else {
+			logger.Debug("Message part scanned",
+				zap.String("part", part.Path),
+				zap.String("filename", part.Filename),
+				zap.String("status", result.Status),
+				zap.String("result", result.Description))
+		}
+
+		results = append(results, PartScanResult{Part: part, Result: result, Err: err})
+	}
+
+	return results
+}
+
+// summarizeMessageResults reduces per-part results to a single verdict.
+// A detection in any part makes the message FOUND, with the action of the
+// most severe one. Unless a part is blocked, the first scan error is
+// returned so callers can map it like a single-file scan error.
+func summarizeMessageResults(results []PartScanResult) (*ScanResult, error) {
+	summary := &ScanResult{Status: "OK", Action: actionAllow}
+	var firstErr error
+
+	for _, r := range results {
+		if r.Err != nil {
+			if firstErr == nil {
+				firstErr = r.Err
+			}
+			continue
+		}
+		mergeVerdict(summary, r.Result)
+	}
+
+	if !summary.Blocked() && firstErr != nil {
+		return nil, firstErr
+	}
+	return summary, nil
+}
+
+// partVerdict returns the status, message and scan time reported for a part.
+// Parts that failed to scan are reported with status ERROR.
+func partVerdict(r PartScanResult) (string, string, float64) {
+	if r.Err != nil {
+		return "ERROR", r.Err.Error(), 0
+	}
+	return r.Result.Status, r.Result.Description, r.Result.ScanTime
+}
+
+// partPolicy returns the action and policy applied to a part, or empty
+// strings for a part that failed to scan
+func partPolicy(r PartScanResult) (string, string) {
+	if r.Err != nil {
+		return "", ""
+	}
+	return r.Result.Action, r.Result.Policy
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMultipartMessage = "From: =?UTF-8?Q?J=C3=B6rg?= <jorg@example.com>\r\n" +
+	"To: ops@example.com\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"Message-Id: <123@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>hello</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"report.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8g\r\n" +
+	"d29ybGQ=\r\n" +
+	"--outer--\r\n"
+
+func TestParseMessageMultipart(t *testing.T) {
+	msg, err := parseMessage(strings.NewReader(testMultipartMessage), 1<<20)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Jörg <jorg@example.com>", msg.From)
+	assert.Equal(t, "ops@example.com", msg.To)
+	assert.Equal(t, "Quarterly report", msg.Subject)
+	assert.Equal(t, "<123@example.com>", msg.MessageID)
+
+	require.Len(t, msg.Parts, 3)
+	assert.Equal(t, "1.1.1", msg.Parts[0].Path)
+	assert.Equal(t, "café", string(msg.Parts[0].Data))
+	assert.Equal(t, "text/html", msg.Parts[1].ContentType)
+	assert.Equal(t, "1.2", msg.Parts[2].Path)
+	assert.Equal(t, "report.bin", msg.Parts[2].Filename)
+	assert.Equal(t, "hello world", string(msg.Parts[2].Data))
+}
+
+func TestParseMessageNestedRFC822(t *testing.T) {
+	raw := "Subject: outer\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: inner\r\n" +
+		"Content-Type: application/zip; name=inner.zip\r\n" +
+		"\r\n" +
+		"PK\r\n" +
+		"--b--\r\n"
+
+	msg, err := parseMessage(strings.NewReader(raw), 1<<20)
+	require.NoError(t, err)
+	require.Len(t, msg.Parts, 1)
+	assert.Equal(t, "1.1.1", msg.Parts[0].Path)
+	assert.Equal(t, "inner.zip", msg.Parts[0].Filename)
+	assert.Equal(t, "PK", string(msg.Parts[0].Data))
+}
+
+func TestParseMessageSinglePart(t *testing.T) {
+	msg, err := parseMessage(strings.NewReader("Subject: plain\r\n\r\nbody text"), 1<<20)
+	require.NoError(t, err)
+	require.Len(t, msg.Parts, 1)
+	assert.Equal(t, "text/plain", msg.Parts[0].ContentType)
+	assert.Equal(t, "body text", string(msg.Parts[0].Data))
+}
+
+func TestParseMessageTooLarge(t *testing.T) {
+	_, err := parseMessage(strings.NewReader(testMultipartMessage), 8)
+	assert.ErrorIs(t, err, errMessageTooLarge)
+}
+
+func TestParseMessageTooDeep(t *testing.T) {
+	// Build a chain of nested multiparts, each with a unique boundary
+	var b strings.Builder
+	b.WriteString("Content-Type: multipart/mixed; boundary=x\r\n\r\n")
+	for i := 1; i <= maxMIMEDepth+2; i++ {
+		b.WriteString("--" + strings.Repeat("x", i) + "\r\n")
+		b.WriteString("Content-Type: multipart/mixed; boundary=" + strings.Repeat("x", i+1) + "\r\n\r\n")
+	}
+
+	_, err := parseMessage(strings.NewReader(b.String()), 1<<20)
+	assert.ErrorContains(t, err, "nesting")
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	_, err := parseMessage(strings.NewReader(""), 1<<20)
+	assert.Error(t, err)
+}
+
+func TestScanMessagePartsWithInvalidSocket(t *testing.T) {
+	withInvalidSocket(t)
+
+	msg, err := parseMessage(strings.NewReader(testMultipartMessage), 1<<20)
+	require.NoError(t, err)
+
+	results := scanMessageParts(context.Background(), msg, "test_message", 5*time.Second)
+	require.Len(t, results, len(msg.Parts))
+	for _, r := range results {
+		assert.Error(t, r.Err)
+		assert.Nil(t, r.Result)
+	}
+}
+
+func TestScanMessagePartsCanceledContext(t *testing.T) {
+	msg := &ParsedMessage{Parts: []MessagePart{{Path: "1", Data: []byte("a")}, {Path: "2", Data: []byte("b")}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := scanMessageParts(ctx, msg, "test_message", 5*time.Second)
+	require.Len(t, results, 2)
+	for _, r := range results {
+		assert.ErrorIs(t, r.Err, context.Canceled)
+	}
+}
+
+func TestSummarizeMessageResults(t *testing.T) {
+	clean := &ScanResult{Status: "OK", ScanTime: 0.5}
+	infected := &ScanResult{Status: "FOUND", Description: "Eicar-Test-Signature", ScanTime: 0.25}
+	scanErr := &ScanTimeoutError{Timeout: time.Second}
+
+	summary, err := summarizeMessageResults([]PartScanResult{{Result: clean}, {Result: clean}})
+	require.NoError(t, err)
+	assert.Equal(t, "OK", summary.Status)
+	assert.Equal(t, 1.0, summary.ScanTime)
+
+	summary, err = summarizeMessageResults([]PartScanResult{{Err: scanErr}, {Result: infected}})
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", summary.Status)
+	assert.Equal(t, "Eicar-Test-Signature", summary.Description)
+
+	_, err = summarizeMessageResults([]PartScanResult{{Result: clean}, {Err: scanErr}})
+	assert.ErrorAs(t, err, &scanErr)
+}
+
+func TestPartVerdict(t *testing.T) {
+	status, message, scanTime := partVerdict(PartScanResult{Result: &ScanResult{Status: "FOUND", Description: "X", ScanTime: 1}})
+	assert.Equal(t, "FOUND", status)
+	assert.Equal(t, "X", message)
+	assert.Equal(t, 1.0, scanTime)
+
+	status, message, _ = partVerdict(PartScanResult{Err: context.Canceled})
+	assert.Equal(t, "ERROR", status)
+	assert.Equal(t, "context canceled", message)
+}
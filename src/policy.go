@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pelletier/go-toml/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Actions a policy maps a scan result to. Only block stops the payload;
+// allow and warn let it through like a clean one.
+const (
+	actionAllow = "allow"
+	actionWarn  = "warn"
+	actionBlock = "block"
+)
+
+// defaultPolicyName is the policy for callers without an API key. Unless
+// the policy file defines it, it blocks every detection.
+const defaultPolicyName = "default"
+
+// API keys select a caller's policy on REST and gRPC scans
+const (
+	apiKeyHeader      = "X-API-Key"
+	apiKeyMetadataKey = "x-api-key"
+)
+
+// scannerServicePrefix prefixes the methods of the ClamAVScanner service,
+// the only one API keys apply to
+const scannerServicePrefix = "/clamav.ClamAVScanner/"
+
+// errInvalidAPIKey rejects a request whose API key is not configured
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// PolicyRule maps the detections it matches to an action. Every condition
+// that is set must match: the lists hold glob patterns, at least one of
+// which must match, and a size bound of 0 is unset.
+type PolicyRule struct {
+	Virus    []string `yaml:"virus" toml:"virus"`
+	Filename []string `yaml:"filename" toml:"filename"`
+	FileType []string `yaml:"file_type" toml:"file_type"`
+	Caller   []string `yaml:"caller" toml:"caller"`
+	MinSize  int64    `yaml:"min_size" toml:"min_size"`
+	MaxSize  int64    `yaml:"max_size" toml:"max_size"`
+	Action   string   `yaml:"action" toml:"action"`
+}
+
+// Policy is an ordered list of rules; the first one matching a detection
+// decides its action
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules" toml:"rules"`
+	// Default is the action for detections no rule matches (block if empty)
+	Default string `yaml:"default" toml:"default"`
+}
+
+// APIKey identifies a caller and selects its policy
+type APIKey struct {
+	Name   string `yaml:"name" toml:"name"`
+	Key    string `yaml:"key" toml:"key"`
+	Policy string `yaml:"policy" toml:"policy"`
+}
+
+// PolicySet is the content of the policy file
+type PolicySet struct {
+	// DefaultPolicy applies to callers without an API key
+	DefaultPolicy string            `yaml:"default_policy" toml:"default_policy"`
+	Policies      map[string]Policy `yaml:"policies" toml:"policies"`
+	APIKeys       []APIKey          `yaml:"api_keys" toml:"api_keys"`
+}
+
+// policySubject is what policy rules match a detection against
+type policySubject struct {
+	Virus    string
+	Filename string
+	FileType string
+	Caller   string
+	Size     int64
+}
+
+// loadPolicyFile reads a YAML or TOML policy file, chosen by extension.
+// Unknown keys are rejected so a misspelt condition cannot widen a rule.
+func loadPolicyFile(filename string) (*PolicySet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &PolicySet{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(set)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(set); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	default:
+		return nil, fmt.Errorf("policy file %s: unsupported format, use .yaml, .yml or .toml", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", filename, err)
+	}
+
+	if set.DefaultPolicy == "" {
+		set.DefaultPolicy = defaultPolicyName
+	}
+	if err := set.validate(); err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", filename, err)
+	}
+	return set, nil
+}
+
+// validate checks that actions and patterns are valid and that every
+// policy referred to exists
+func (s *PolicySet) validate() error {
+	for name, policy := range s.Policies {
+		if name == "" {
+			return fmt.Errorf("policy names must not be empty")
+		}
+		if policy.Default != "" && !validPolicyAction(policy.Default) {
+			return fmt.Errorf("policy %q: default action must be one of allow, warn, block, got %q", name, policy.Default)
+		}
+		for i, rule := range policy.Rules {
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("policy %q: rule %d: %w", name, i+1, err)
+			}
+		}
+	}
+	if !s.hasPolicy(s.DefaultPolicy) {
+		return fmt.Errorf("default policy %q is not defined", s.DefaultPolicy)
+	}
+
+	names := make(map[string]bool, len(s.APIKeys))
+	keys := make(map[string]bool, len(s.APIKeys))
+	for _, key := range s.APIKeys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("API keys need a name and a key")
+		}
+		if names[key.Name] {
+			return fmt.Errorf("API key name %q is used more than once", key.Name)
+		}
+		if keys[key.Key] {
+			return fmt.Errorf("API key %q: key is used more than once", key.Name)
+		}
+		names[key.Name], keys[key.Key] = true, true
+		if key.Policy != "" && !s.hasPolicy(key.Policy) {
+			return fmt.Errorf("API key %q: policy %q is not defined", key.Name, key.Policy)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) validate() error {
+	if !validPolicyAction(r.Action) {
+		return fmt.Errorf("action must be one of allow, warn, block, got %q", r.Action)
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MaxSize < r.MinSize) {
+		return fmt.Errorf("size bounds must be >= 0 and max_size must not be below min_size")
+	}
+	for _, patterns := range [][]string{r.Virus, r.Filename, r.FileType, r.Caller} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validPolicyAction(action string) bool {
+	switch action {
+	case actionAllow, actionWarn, actionBlock:
+		return true
+	}
+	return false
+}
+
+// hasPolicy reports whether name is defined or is the built-in default
+func (s *PolicySet) hasPolicy(name string) bool {
+	_, ok := s.Policies[name]
+	return ok || name == defaultPolicyName
+}
+
+// apiKey returns the API key matching key, or nil
+func (s *PolicySet) apiKey(key string) *APIKey {
+	if s == nil {
+		return nil
+	}
+	for i := range s.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(s.APIKeys[i].Key), []byte(key)) == 1 {
+			return &s.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// policyFor returns the name of the policy for the caller with the given
+// API key name, or the default policy for an unknown or empty one
+func (s *PolicySet) policyFor(caller string) string {
+	if s == nil {
+		return defaultPolicyName
+	}
+	for _, key := range s.APIKeys {
+		if key.Name == caller && caller != "" && key.Policy != "" {
+			return key.Policy
+		}
+	}
+	return s.DefaultPolicy
+}
+
+// action returns the action the named policy takes on a detection. A
+// policy that is not defined, such as the built-in default, blocks it.
+func (s *PolicySet) action(name string, subject policySubject) string {
+	var policy Policy
+	if s != nil {
+		policy = s.Policies[name]
+	}
+	for _, rule := range policy.Rules {
+		if rule.matches(subject) {
+			return rule.Action
+		}
+	}
+	if policy.Default != "" {
+		return policy.Default
+	}
+	return actionBlock
+}
+
+// matches reports whether every condition of the rule holds for subject.
+// Filenames are matched without their directory.
+func (r *PolicyRule) matches(subject policySubject) bool {
+	filename := subject.Filename
+	if filename != "" {
+		filename = path.Base(filename)
+	}
+	return matchAnyPattern(r.Virus, subject.Virus) &&
+		matchAnyPattern(r.Filename, filename) &&
+		matchAnyPattern(r.FileType, subject.FileType) &&
+		matchAnyPattern(r.Caller, subject.Caller) &&
+		(r.MinSize == 0 || subject.Size >= r.MinSize) &&
+		(r.MaxSize == 0 || subject.Size <= r.MaxSize)
+}
+
+// matchAnyPattern reports whether value matches one of patterns. An empty
+// list matches anything.
+func matchAnyPattern(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// actionRank orders actions by severity. Results without an action come
+// from before policies existed and block like any detection did.
+func actionRank(action string) int {
+	switch action {
+	case actionAllow:
+		return 0
+	case actionWarn:
+		return 1
+	}
+	return 2
+}
+
+// applyPolicy sets the action and policy of a scan result. Clean results
+// are always allowed; detections go through the policy selected by the
+// caller's API key in ctx.
+func applyPolicy(ctx context.Context, result *ScanResult) {
+	set := currentConfig().Policies
+	caller := callerFromContext(ctx)
+	result.Policy = set.policyFor(caller)
+	if result.Status != "FOUND" {
+		result.Action = actionAllow
+		return
+	}
+
+	source, _ := ctx.Value(scanSourceKey{}).(scanSource)
+	result.Action = set.action(result.Policy, policySubject{
+		Virus:    result.Description,
+		Filename: source.filename,
+		FileType: result.FileType,
+		Caller:   caller,
+		Size:     result.Size,
+	})
+	if result.Action != actionBlock {
+		loggerFromContext(ctx).Info("Detection let through by policy",
+			zap.String("policy", result.Policy),
+			zap.String("action", result.Action),
+			zap.String("virus", result.Description),
+			zap.String("filename", source.filename),
+			zap.String("caller", caller))
+	}
+}
+
+// mergeVerdict folds the result of one part of a multi-part scan into the
+// summary. The most severe detection decides the summary's verdict.
+func mergeVerdict(summary, result *ScanResult) {
+	summary.ScanTime += result.ScanTime
+	if summary.Policy == "" {
+		summary.Policy = result.Policy
+	}
+	if result.Status != "FOUND" {
+		return
+	}
+	if summary.Status != "FOUND" || actionRank(result.Action) > actionRank(summary.Action) {
+		summary.Status = "FOUND"
+		summary.Description = result.Description
+		summary.Action = result.Action
+	}
+}
+
+// callerKey keys the API key name stored in a request context
+type callerKey struct{}
+
+// withCaller returns ctx identifying the caller by its API key name
+func withCaller(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callerKey{}, name)
+}
+
+// callerFromContext returns the API key name of the caller, or ""
+func callerFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(callerKey{}).(string)
+	return name
+}
+
+// checkAPIKey returns the caller name for an API key. Requests without a
+// key are anonymous; a key that is not configured is rejected.
+func checkAPIKey(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	apiKey := currentConfig().Policies.apiKey(key)
+	if apiKey == nil {
+		return "", errInvalidAPIKey
+	}
+	return apiKey.Name, nil
+}
+
+// apiKeyAuth identifies REST scan callers by the X-API-Key header
+func apiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, err := checkAPIKey(c.GetHeader(apiKeyHeader))
+		if err != nil {
+			requestLogger(c).Warn("Scan rejected: invalid API key",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("client_ip", c.ClientIP()))
+			recordRejection(transportREST, rejectUnauthorized)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message":    err.Error(),
+				"request_id": requestID(c),
+			})
+			return
+		}
+		c.Request = c.Request.WithContext(withCaller(c.Request.Context(), caller))
+		c.Next()
+	}
+}
+
+// grpcCaller identifies a ClamAVScanner caller by the x-api-key metadata
+func grpcCaller(ctx context.Context) (context.Context, error) {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(apiKeyMetadataKey); len(values) > 0 {
+			key = values[0]
+		}
+	}
+	caller, err := checkAPIKey(key)
+	if err != nil {
+		loggerFromContext(ctx).Warn("gRPC scan rejected: invalid API key",
+			zap.String("peer", peerAddress(ctx)))
+		recordRejection(transportGRPC, rejectUnauthorized)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return withCaller(ctx, caller), nil
+}
+
+// apiKeyUnaryInterceptor applies grpcCaller to unary ClamAVScanner RPCs
+func apiKeyUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !strings.HasPrefix(info.FullMethod, scannerServicePrefix) {
+		return handler(ctx, req)
+	}
+	ctx, err := grpcCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// apiKeyStreamInterceptor is apiKeyUnaryInterceptor for streams
+func apiKeyStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !strings.HasPrefix(info.FullMethod, scannerServicePrefix) {
+		return handler(srv, ss)
+	}
+	ctx, err := grpcCaller(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+}
+
+// sniffLen is how much of a payload is kept to detect its file type
+const sniffLen = 512
+
+// sniffReader keeps the first bytes read through it to detect the file
+// type of a scanned payload
+type sniffReader struct {
+	reader io.Reader
+	head   []byte
+}
+
+func (r *sniffReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if missing := sniffLen - len(r.head); missing > 0 {
+		r.head = append(r.head, p[:min(n, missing)]...)
+	}
+	return n, err
+}
+
+// fileType returns the media type of the payload, without parameters
+func (r *sniffReader) fileType() string {
+	mediaType, _, _ := strings.Cut(http.DetectContentType(r.head), ";")
+	return mediaType
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testPolicyYAML = `
+default_policy: strict
+policies:
+  strict:
+    rules:
+      - virus: ["PUA.*"]
+        action: warn
+  design:
+    default: warn
+    rules:
+      - virus: ["Heuristics.Encrypted.*"]
+        action: allow
+      - file_type: ["application/x-msdownload"]
+        filename: ["*.exe"]
+        action: block
+api_keys:
+  - name: design-team
+    key: design-secret
+    policy: design
+  - name: ci
+    key: ci-secret
+`
+
+// writePolicyFile writes a policy file with the given name and content
+func writePolicyFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// withPolicies makes set the policies in effect for the duration of a test
+func withPolicies(t *testing.T, set *PolicySet) {
+	t.Helper()
+	original := config.Policies
+	config.Policies = set
+	t.Cleanup(func() { config.Policies = original })
+}
+
+func testPolicySet(t *testing.T) *PolicySet {
+	t.Helper()
+	set, err := loadPolicyFile(writePolicyFile(t, "policy.yaml", testPolicyYAML))
+	require.NoError(t, err)
+	return set
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	set := testPolicySet(t)
+	assert.Equal(t, "strict", set.DefaultPolicy)
+	require.Contains(t, set.Policies, "design")
+	assert.Equal(t, actionWarn, set.Policies["design"].Default)
+	assert.Len(t, set.Policies["design"].Rules, 2)
+	assert.Equal(t, []APIKey{
+		{Name: "design-team", Key: "design-secret", Policy: "design"},
+		{Name: "ci", Key: "ci-secret"},
+	}, set.APIKeys)
+
+	toml := writePolicyFile(t, "policy.toml", `
+[[policies.pua.rules]]
+virus = ["PUA.*"]
+action = "allow"
+
+[[api_keys]]
+name = "team"
+key = "secret"
+policy = "pua"
+`)
+	set, err := loadPolicyFile(toml)
+	require.NoError(t, err)
+	assert.Equal(t, defaultPolicyName, set.DefaultPolicy)
+	assert.Equal(t, []PolicyRule{{Virus: []string{"PUA.*"}, Action: actionAllow}}, set.Policies["pua"].Rules)
+}
+
+func TestLoadPolicyFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown condition", "policies:\n  p:\n    rules:\n      - virsu: [\"PUA.*\"]\n        action: allow\n", "virsu"},
+		{"bad action", "policies:\n  p:\n    rules:\n      - action: ignore\n", "action must be one of"},
+		{"bad default action", "policies:\n  p:\n    default: ignore\n", "default action must be one of"},
+		{"bad pattern", "policies:\n  p:\n    rules:\n      - virus: [\"[\"]\n        action: allow\n", "invalid pattern"},
+		{"bad size bounds", "policies:\n  p:\n    rules:\n      - min_size: 10\n        max_size: 5\n        action: allow\n", "size bounds"},
+		{"undefined default policy", "default_policy: missing\n", `default policy "missing" is not defined`},
+		{"undefined key policy", "api_keys:\n  - name: a\n    key: k\n    policy: missing\n", `policy "missing" is not defined`},
+		{"key without a name", "api_keys:\n  - key: k\n", "need a name and a key"},
+		{"duplicate key", "api_keys:\n  - name: a\n    key: k\n  - name: b\n    key: k\n", "key is used more than once"},
+		{"duplicate name", "api_keys:\n  - name: a\n    key: k1\n  - name: a\n    key: k2\n", `name "a" is used more than once`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadPolicyFile(writePolicyFile(t, "policy.yaml", tt.content))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	_, err := loadPolicyFile(writePolicyFile(t, "policy.json", "{}"))
+	assert.ErrorContains(t, err, "unsupported format")
+}
+
+func TestPolicySetAction(t *testing.T) {
+	set := testPolicySet(t)
+
+	tests := []struct {
+		name    string
+		policy  string
+		subject policySubject
+		want    string
+	}{
+		{"rule matches the virus name", "strict", policySubject{Virus: "PUA.Win.Tool.Packed"}, actionWarn},
+		{"unmatched detection is blocked", "strict", policySubject{Virus: "Eicar-Test-Signature"}, actionBlock},
+		{"first matching rule wins", "design", policySubject{Virus: "Heuristics.Encrypted.Zip"}, actionAllow},
+		{"all conditions must match", "design", policySubject{Virus: "Win.Trojan", Filename: "setup.exe", FileType: "text/plain"}, actionWarn},
+		{"filename matched without directory", "design", policySubject{Virus: "Win.Trojan", Filename: "dl/setup.exe", FileType: "application/x-msdownload"}, actionBlock},
+		{"policy default action", "design", policySubject{Virus: "Eicar-Test-Signature"}, actionWarn},
+		{"built-in default blocks", defaultPolicyName, policySubject{Virus: "PUA.Win.Tool.Packed"}, actionBlock},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, set.action(tt.policy, tt.subject))
+		})
+	}
+
+	var none *PolicySet
+	assert.Equal(t, actionBlock, none.action(defaultPolicyName, policySubject{Virus: "PUA.Win.Tool.Packed"}))
+	assert.Equal(t, defaultPolicyName, none.policyFor("design-team"))
+	assert.Equal(t, "design", set.policyFor("design-team"))
+	assert.Equal(t, "strict", set.policyFor("ci"))
+	assert.Equal(t, "strict", set.policyFor(""))
+}
+
+func TestPolicyRuleSizeAndCaller(t *testing.T) {
+	rule := PolicyRule{Caller: []string{"design-*"}, MinSize: 10, MaxSize: 100, Action: actionAllow}
+	assert.True(t, rule.matches(policySubject{Caller: "design-team", Size: 50}))
+	assert.False(t, rule.matches(policySubject{Caller: "design-team", Size: 5}))
+	assert.False(t, rule.matches(policySubject{Caller: "design-team", Size: 500}))
+	assert.False(t, rule.matches(policySubject{Caller: "", Size: 50}))
+}
+
+func TestMergeVerdict(t *testing.T) {
+	summary := &ScanResult{Status: "OK", Action: actionAllow}
+	mergeVerdict(summary, &ScanResult{Status: "OK", Action: actionAllow, Policy: "strict", ScanTime: 0.5})
+	mergeVerdict(summary, &ScanResult{Status: "FOUND", Description: "PUA.Win.Tool.Packed", Action: actionWarn, ScanTime: 0.25})
+	assert.Equal(t, &ScanResult{Status: "FOUND", Description: "PUA.Win.Tool.Packed", Action: actionWarn, Policy: "strict", ScanTime: 0.75}, summary)
+	assert.False(t, summary.Blocked())
+
+	mergeVerdict(summary, &ScanResult{Status: "FOUND", Description: "Eicar-Test-Signature", Action: actionBlock})
+	assert.Equal(t, "Eicar-Test-Signature", summary.Description)
+	assert.True(t, summary.Blocked())
+
+	// A warned part cannot vouch for a part that failed to scan
+	scanErr := &ScanTimeoutError{Timeout: time.Second}
+	warned := &ScanResult{Status: "FOUND", Description: "PUA.Win.Tool.Packed", Action: actionWarn}
+	_, err := summarizeMessageResults([]PartScanResult{{Result: warned}, {Err: scanErr}})
+	assert.ErrorAs(t, err, &scanErr)
+}
+
+func TestSniffReaderFileType(t *testing.T) {
+	sniff := &sniffReader{reader: bytes.NewReader(append([]byte("%PDF-1.7\n"), make([]byte, 4096)...))}
+	_, err := bytes.NewBuffer(nil).ReadFrom(sniff)
+	require.NoError(t, err)
+	assert.Len(t, sniff.head, sniffLen)
+	assert.Equal(t, "application/pdf", sniff.fileType())
+}
+
+func TestRESTScanPolicyByAPIKey(t *testing.T) {
+	withFakeClamd(t, "stream: PUA.Win.Tool.Packed FOUND")
+	withPolicies(t, testPolicySet(t))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	router.POST("/api/stream-scan", apiKeyAuth(), handleStreamScan)
+
+	scan := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", bytes.NewReader([]byte("payload")))
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	before := getCounterValue(t, policyActionsTotal, "rest_stream_scan", "design", actionWarn)
+	w := scan("design-secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"action":"warn"`)
+	assert.Contains(t, w.Body.String(), `"policy":"design"`)
+	assert.Contains(t, w.Body.String(), `"status":"FOUND"`)
+	assert.Equal(t, before+1, getCounterValue(t, policyActionsTotal, "rest_stream_scan", "design", actionWarn))
+
+	w = scan("")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"policy":"strict"`)
+
+	rejected := getCounterValue(t, rejectedRequestsTotal, transportREST, rejectUnauthorized)
+	w = scan("wrong-secret")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid API key")
+	assert.Equal(t, rejected+1, getCounterValue(t, rejectedRequestsTotal, transportREST, rejectUnauthorized))
+}
+
+func TestGRPCScanPolicyByAPIKey(t *testing.T) {
+	withFakeClamd(t, "stream: Heuristics.Encrypted.Zip FOUND")
+	withPolicies(t, testPolicySet(t))
+	client := getTestClient(t)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadataKey, "design-secret")
+	resp, err := client.ScanFile(ctx, &pb.ScanFileRequest{Data: []byte("payload"), Filename: "archive.zip"})
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", resp.Status)
+	assert.Equal(t, actionAllow, resp.Action)
+	assert.Equal(t, "design", resp.Policy)
+
+	resp, err = client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte("payload"), Filename: "archive.zip"})
+	require.NoError(t, err)
+	assert.Equal(t, actionBlock, resp.Action)
+	assert.Equal(t, "strict", resp.Policy)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadataKey, "wrong-secret")
+	_, err = client.ScanFile(ctx, &pb.ScanFileRequest{Data: []byte("payload"), Filename: "archive.zip"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
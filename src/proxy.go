@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// errInvalidUpload indicates an intercepted multipart body could not be parsed
+var errInvalidUpload = errors.New("invalid multipart body")
+
+// scanFunc scans a single payload; it matches performScan with the
+// configured timeout applied
+type scanFunc func(ctx context.Context, reader io.Reader) (*ScanResult, error)
+
+// UploadGateway is a reverse proxy that scans upload bodies on configured
+// routes before forwarding them to the upstream application.
+type UploadGateway struct {
+	config   *liveConfig
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+	scan     scanFunc
+}
+
+// NewUploadGateway creates a gateway forwarding to cfg.ProxyUpstream
+func NewUploadGateway(cfg *Config) (*UploadGateway, error) {
+	upstream, err := url.Parse(cfg.ProxyUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy upstream %q: %w", cfg.ProxyUpstream, err)
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" {
+		return nil, fmt.Errorf("proxy upstream must be an http or https URL, got %q", cfg.ProxyUpstream)
+	}
+
+	live := newLiveConfig(cfg)
+	g := &UploadGateway{
+		config:   live,
+		upstream: upstream,
+		scan:     live.scan,
+	}
+	g.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+		},
+		// The gateway already set the response's request ID
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del(requestIDHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			loggerFromContext(r.Context()).Error("Upstream request failed",
+				zap.String("path", r.URL.Path),
+				zap.String("upstream", upstream.String()),
+				zap.Error(err))
+			writeGatewayJSON(w, http.StatusBadGateway, map[string]string{
+				"message":    "Upstream service unavailable",
+				"request_id": requestIDFromContext(r.Context()),
+			})
+		},
+	}
+	return g, nil
+}
+
+// Reload applies a reloaded configuration. The upstream is kept.
+func (g *UploadGateway) Reload(cfg *Config) error {
+	g.config.Store(cfg)
+	return nil
+}
+
+// ServeHTTP scans intercepted uploads and forwards everything else untouched
+func (g *UploadGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Never trust a scan verdict supplied by the client
+	r.Header.Del("X-Virus-Status")
+
+	// Forward the request ID so the upstream can log it too
+	id := requestIDOrNew(r.Header.Get(requestIDHeader))
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	r = r.WithContext(withScanSource(withRequestID(r.Context(), id), transportProxy, r.RemoteAddr))
+
+	if !g.intercepts(r) {
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	logger := loggerFromContext(r.Context())
+
+	if r.ContentLength > g.config.Load().MaxContentLength {
+		g.rejectTooLarge(w, r)
+		return
+	}
+
+	spool, err := spoolReader(r.Body, g.config.Load().MaxContentLength, g.config.Load().ProxySpillThreshold, g.config.Load().ProxyTempDir)
+	r.Body.Close()
+	if errors.Is(err, errPayloadTooLarge) {
+		g.rejectTooLarge(w, r)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to buffer upload body",
+			zap.String("path", r.URL.Path),
+			zap.String("client_ip", r.RemoteAddr),
+			zap.Error(err))
+		writeGatewayJSON(w, http.StatusBadRequest, map[string]string{
+			"message":    "Failed to read request body",
+			"request_id": id,
+		})
+		return
+	}
+	defer spool.Close()
+
+	result, filename, err := g.scanBody(r.Context(), r.Header.Get("Content-Type"), spool)
+	if err != nil {
+		logger.Error("Upload scan failed, request not forwarded",
+			zap.String("path", r.URL.Path),
+			zap.String("filename", filename),
+			zap.String("client_ip", r.RemoteAddr),
+			zap.Error(err))
+		status, body := gatewayScanErrorResponse(err)
+		body["request_id"] = id
+		writeGatewayJSON(w, status, body)
+		return
+	}
+
+	if result.Blocked() {
+		logger.Warn("Upload rejected: virus found",
+			zap.String("path", r.URL.Path),
+			zap.String("filename", filename),
+			zap.String("virus", result.Description),
+			zap.String("client_ip", r.RemoteAddr))
+		writeGatewayJSON(w, g.config.Load().ProxyRejectStatus, map[string]string{
+			"status":     "FOUND",
+			"message":    result.Description,
+			"filename":   filename,
+			"request_id": id,
+		})
+		return
+	}
+
+	// Replay the consumed body to the upstream
+	body, err := spool.Reader()
+	if err != nil {
+		logger.Error("Failed to rewind upload body", zap.Error(err))
+		writeGatewayJSON(w, http.StatusInternalServerError, map[string]string{
+			"message":    "Failed to forward request",
+			"request_id": id,
+		})
+		return
+	}
+	r.Body = io.NopCloser(body)
+	r.ContentLength = spool.Size()
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.FormatInt(spool.Size(), 10))
+	r.Header.Set("X-Virus-Status", gatewayVirusStatus(result))
+
+	logger.Info("Upload scanned and forwarded",
+		zap.String("path", r.URL.Path),
+		zap.Int64("size", spool.Size()),
+		zap.Bool("spilled_to_disk", spool.OnDisk()),
+		zap.String("action", result.Action),
+		zap.Float64("elapsed_seconds", result.ScanTime),
+		zap.String("client_ip", r.RemoteAddr))
+
+	g.proxy.ServeHTTP(w, r)
+}
+
+// intercepts reports whether r carries an upload body on a configured route
+func (g *UploadGateway) intercepts(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return false
+	}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return false
+	}
+	for _, route := range g.config.Load().ProxyRoutes {
+		if r.URL.Path == route || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(route, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// scanBody scans each non-empty part of a multipart body, form fields
+// included, or the raw body for any other content type. It stops at the
+// first blocked detection and returns the name of the part that was being
+// scanned: its filename, or its form field name if it has none.
+func (g *UploadGateway) scanBody(ctx context.Context, contentType string, spool *Spool) (*ScanResult, string, error) {
+	body, err := spool.Reader()
+	if err != nil {
+		return nil, "", err
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		result, err := g.scanPart(ctx, body, "body")
+		return result, "body", err
+	}
+
+	summary := &ScanResult{Status: "OK", Action: actionAllow}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return summary, "", nil
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", errInvalidUpload, err)
+		}
+
+		// A part without a filename is still scanned: clients can send file
+		// content as a plain form field
+		data := bufio.NewReader(part)
+		if _, err := data.Peek(1); err == io.EOF {
+			continue
+		}
+		filename, name := part.FileName(), part.FileName()
+		if name == "" {
+			name = part.FormName()
+		}
+
+		result, err := g.scanPart(ctx, data, filename)
+		if err != nil {
+			return nil, name, err
+		}
+		mergeVerdict(summary, result)
+		if result.Blocked() {
+			result.ScanTime = summary.ScanTime
+			return result, name, nil
+		}
+	}
+}
+
+func (g *UploadGateway) scanPart(ctx context.Context, reader io.Reader, filename string) (*ScanResult, error) {
+	scansInProgress.Inc()
+	defer scansInProgress.Dec()
+
+	result, err := g.scan(withScanFilename(ctx, filename), reader)
+	recordScanMetrics("proxy", result, err)
+
+	if err == nil {
+		loggerFromContext(ctx).Debug("Upload part scanned",
+			zap.String("filename", filename),
+			zap.String("status", result.Status))
+	}
+	return result, err
+}
+
+// gatewayVirusStatus is the X-Virus-Status header sent upstream with a
+// forwarded upload. Detections the policy allows are forwarded as clean.
+func gatewayVirusStatus(result *ScanResult) string {
+	if result.Status == "FOUND" && result.Action == actionWarn {
+		return "Warning"
+	}
+	return "Clean"
+}
+
+func (g *UploadGateway) rejectTooLarge(w http.ResponseWriter, r *http.Request) {
+	loggerFromContext(r.Context()).Warn("Upload rejected: body too large",
+		zap.String("path", r.URL.Path),
+		zap.Int64("content_length", r.ContentLength),
+		zap.Int64("max_allowed", g.config.Load().MaxContentLength),
+		zap.String("client_ip", r.RemoteAddr))
+	writeGatewayJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+		"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", g.config.Load().MaxContentLength),
+		"request_id": requestIDFromContext(r.Context()),
+	})
+}
+
+// gatewayScanErrorResponse mirrors respondScanError for the plain net/http gateway
+func gatewayScanErrorResponse(err error) (int, map[string]string) {
+	var timeoutErr *ScanTimeoutError
+	var engineErr *ScanEngineError
+	var canceledErr *ScanCanceledError
+
+	switch {
+	case errors.Is(err, errServerDraining):
+		return http.StatusServiceUnavailable, map[string]string{
+			"status":  "Service unavailable",
+			"message": err.Error(),
+		}
+	case errors.As(err, &canceledErr):
+		return http.StatusServiceUnavailable, map[string]string{
+			"status":  "Scan canceled",
+			"message": canceledErr.Error(),
+		}
+	case errors.As(err, &timeoutErr):
+		return http.StatusGatewayTimeout, map[string]string{
+			"status":  "Scan timeout",
+			"message": timeoutErr.Error(),
+		}
+	case errors.As(err, &engineErr):
+		return http.StatusBadGateway, map[string]string{
+			"status":  "Clamd service down",
+			"message": engineErr.Description,
+		}
+	case errors.Is(err, context.Canceled):
+		return 499, map[string]string{
+			"status":  "Client closed request",
+			"message": "request canceled by client",
+		}
+	case errors.Is(err, errInvalidUpload):
+		return http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		}
+	default:
+		return http.StatusBadGateway, map[string]string{
+			"status":  "Clamd service down",
+			"message": "Scanning service unavailable",
+		}
+	}
+}
+
+func writeGatewayJSON(w http.ResponseWriter, status int, body map[string]string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
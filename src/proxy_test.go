@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamRecord captures what the fake upstream received
+type upstreamRecord struct {
+	called bool
+	body   []byte
+	header http.Header
+}
+
+func newTestGateway(t *testing.T, scan scanFunc) (*UploadGateway, *upstreamRecord) {
+	t.Helper()
+	record := &upstreamRecord{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record.called = true
+		record.body, _ = io.ReadAll(r.Body)
+		record.header = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "stored")
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := config
+	cfg.ProxyUpstream = upstream.URL
+	cfg.ProxyRoutes = []string{"/upload"}
+	cfg.ProxyRejectStatus = 422
+	cfg.ProxySpillThreshold = 16
+	cfg.ProxyTempDir = t.TempDir()
+	cfg.MaxContentLength = 1 << 20
+	cfg.ScanTimeout = 5 * time.Second
+
+	gateway, err := NewUploadGateway(&cfg)
+	require.NoError(t, err)
+	if scan != nil {
+		gateway.scan = scan
+	}
+	return gateway, record
+}
+
+// fakeScan flags any payload containing "EICAR" and reads the rest
+func fakeScan(ctx context.Context, reader io.Reader) (*ScanResult, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte("EICAR")) {
+		return &ScanResult{Status: "FOUND", Description: "Eicar-Test-Signature"}, nil
+	}
+	return &ScanResult{Status: "OK"}, nil
+}
+
+func multipartUpload(t *testing.T, fields map[string]string, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	for name, content := range files {
+		part, _ := writer.CreateFormFile("file", name)
+		io.WriteString(part, content)
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func TestNewUploadGatewayInvalidUpstream(t *testing.T) {
+	cfg := config
+	cfg.ProxyUpstream = "ftp://example.com"
+	_, err := NewUploadGateway(&cfg)
+	assert.Error(t, err)
+}
+
+func TestUploadGatewayForwardsCleanMultipart(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+
+	body, contentType := multipartUpload(t,
+		map[string]string{"title": "Quarterly report", "empty": ""},
+		map[string]string{"report.pdf": strings.Repeat("clean content ", 10)})
+	sent := body.Bytes()
+
+	req := httptest.NewRequest("POST", "/upload/files", bytes.NewReader(sent))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Virus-Status", "Clean")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "stored", w.Body.String())
+	assert.True(t, record.called)
+	assert.Equal(t, sent, record.body, "upstream must receive the original body")
+	assert.Equal(t, "Clean", record.header.Get("X-Virus-Status"))
+}
+
+func TestUploadGatewayForwardsWarnedUpload(t *testing.T) {
+	gateway, record := newTestGateway(t, func(ctx context.Context, reader io.Reader) (*ScanResult, error) {
+		io.Copy(io.Discard, reader)
+		return &ScanResult{Status: "FOUND", Description: "PUA.Win.Tool.Packed", Action: actionWarn}, nil
+	})
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("packed tool"))
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.True(t, record.called)
+	assert.Equal(t, "Warning", record.header.Get("X-Virus-Status"))
+}
+
+func TestUploadGatewayRejectsInfectedPart(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+
+	body, contentType := multipartUpload(t, nil, map[string]string{"invoice.zip": "EICAR"})
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, 422, w.Code)
+	assert.False(t, record.called)
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "FOUND", response["status"])
+	assert.Equal(t, "Eicar-Test-Signature", response["message"])
+	assert.Equal(t, "invoice.zip", response["filename"])
+	assert.Equal(t, w.Header().Get(requestIDHeader), response["request_id"])
+	assert.NotEmpty(t, response["request_id"])
+}
+
+func TestUploadGatewayRejectsInfectedFormField(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+
+	body, contentType := multipartUpload(t, map[string]string{"attachment": "EICAR"}, nil)
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, 422, w.Code)
+	assert.False(t, record.called, "a part without a filename must be scanned too")
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "FOUND", response["status"])
+	assert.Equal(t, "attachment", response["filename"])
+}
+
+func TestUploadGatewayScansRawBody(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+
+	req := httptest.NewRequest("PUT", "/upload/blob", strings.NewReader("raw EICAR body"))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, 422, w.Code)
+	assert.False(t, record.called)
+}
+
+func TestUploadGatewayPassesThroughOtherRoutes(t *testing.T) {
+	scanned := false
+	gateway, record := newTestGateway(t, func(ctx context.Context, r io.Reader) (*ScanResult, error) {
+		scanned = true
+		return fakeScan(ctx, r)
+	})
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/api/other"},
+		{"POST", "/uploads-not-a-prefix-match"},
+		{"GET", "/upload"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("EICAR"))
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code, "%s %s", tt.method, tt.path)
+	}
+	assert.False(t, scanned)
+	assert.True(t, record.called)
+}
+
+func TestUploadGatewayTooLarge(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+	gateway.config.Load().MaxContentLength = 8
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("this is more than eight bytes"))
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.False(t, record.called)
+}
+
+func TestUploadGatewayChunkedTooLarge(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+	gateway.config.Load().MaxContentLength = 8
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("this is more than eight bytes"))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.False(t, record.called)
+}
+
+func TestUploadGatewayScanErrorFailsClosed(t *testing.T) {
+	withInvalidSocket(t)
+	gateway, record := newTestGateway(t, nil)
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.False(t, record.called)
+}
+
+func TestUploadGatewayInvalidMultipart(t *testing.T) {
+	gateway, record := newTestGateway(t, fakeScan)
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("not multipart"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, record.called)
+}
+
+func TestGatewayScanErrorResponse(t *testing.T) {
+	status, _ := gatewayScanErrorResponse(&ScanTimeoutError{Timeout: time.Second})
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+
+	status, _ = gatewayScanErrorResponse(&ScanEngineError{Description: "boom"})
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	status, _ = gatewayScanErrorResponse(context.Canceled)
+	assert.Equal(t, 499, status)
+
+	status, _ = gatewayScanErrorResponse(errServerDraining)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	status, _ = gatewayScanErrorResponse(&ScanCanceledError{Reason: "shutdown"})
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// liveConfig holds a configuration that is replaced as a whole on reload,
+// so readers never see a mix of old and new settings
+type liveConfig struct {
+	ptr atomic.Pointer[Config]
+}
+
+func newLiveConfig(cfg *Config) *liveConfig {
+	l := &liveConfig{}
+	l.ptr.Store(cfg)
+	return l
+}
+
+// Load returns the configuration in effect
+func (l *liveConfig) Load() *Config {
+	return l.ptr.Load()
+}
+
+// Store replaces the configuration in effect
+func (l *liveConfig) Store(cfg *Config) {
+	l.ptr.Store(cfg)
+}
+
+// scan runs performScan with the scan timeout in effect
+func (l *liveConfig) scan(ctx context.Context, reader io.Reader) (*ScanResult, error) {
+	return performScan(ctx, reader, l.Load().ScanTimeout)
+}
+
+// serverConfig is the configuration read by the REST handlers and the
+// clamd client. It starts out pointing at the global config.
+var serverConfig = newLiveConfig(&config)
+
+// currentConfig returns the configuration in effect, including reloads
+func currentConfig() *Config {
+	return serverConfig.Load()
+}
+
+// setting describes one configuration setting. name is both the
+// command-line flag and the config file key.
+type setting struct {
+	name string
+	env  string
+	// restart is set for settings that are only read at startup
+	restart bool
+	// field returns a pointer to the setting's field in c
+	field func(c *Config) any
+}
+
+// settings lists every configuration setting. Secrets have no flag, so
+// they can only be set in the config file or the environment.
+var settings = []setting{
+	{"debug", "CLAMAV_DEBUG", false, func(c *Config) any { return &c.Debug }},
+	{"socket", "CLAMAV_SOCKET", false, func(c *Config) any { return &c.ClamdUnixSocket }},
+	{"max-size", "CLAMAV_MAX_SIZE", false, func(c *Config) any { return &c.MaxContentLength }},
+	{"host", "CLAMAV_HOST", true, func(c *Config) any { return &c.Host }},
+	{"port", "CLAMAV_PORT", true, func(c *Config) any { return &c.Port }},
+	{"grpc-port", "CLAMAV_GRPC_PORT", true, func(c *Config) any { return &c.GRPCPort }},
+	{"scan-timeout", "CLAMAV_SCAN_TIMEOUT", false, func(c *Config) any { return &c.ScanTimeout }},
+	{"shutdown-timeout", "CLAMAV_SHUTDOWN_TIMEOUT", false, func(c *Config) any { return &c.ShutdownTimeout }},
+	{"drain-delay", "CLAMAV_DRAIN_DELAY", false, func(c *Config) any { return &c.DrainDelay }},
+	{"drain-timeout", "CLAMAV_DRAIN_TIMEOUT", false, func(c *Config) any { return &c.DrainTimeout }},
+	{"scan-duration-buckets", "CLAMAV_SCAN_DURATION_BUCKETS", true, func(c *Config) any { return &c.ScanDurationBuckets }},
+	{"enable-grpc", "CLAMAV_ENABLE_GRPC", true, func(c *Config) any { return &c.EnableGRPC }},
+	{"spool-threshold", "CLAMAV_SPOOL_THRESHOLD", false, func(c *Config) any { return &c.SpoolThreshold }},
+	{"spool-dir", "CLAMAV_SPOOL_DIR", true, func(c *Config) any { return &c.SpoolDir }},
+	{"memory-budget", "CLAMAV_MEMORY_BUDGET", false, func(c *Config) any { return &c.MemoryBudget }},
+	// Compares the parsed policies, so edits to the file count as a change
+	{"policy-file", "CLAMAV_POLICY_FILE", false, func(c *Config) any { return &c.Policies }},
+	{"allowlist-file", "CLAMAV_ALLOWLIST_FILE", true, func(c *Config) any { return &c.AllowlistFile }},
+	{"signature-dir", "CLAMAV_SIGNATURE_DIR", false, func(c *Config) any { return &c.SignatureDir }},
+	{"engines", "CLAMAV_ENGINES", false, func(c *Config) any { return &c.Engines }},
+	{"engine-mode", "CLAMAV_ENGINE_MODE", false, func(c *Config) any { return &c.EngineMode }},
+	{"engine-strategy", "CLAMAV_ENGINE_STRATEGY", false, func(c *Config) any { return &c.EngineStrategy }},
+	// Compares the parsed rules, so edits to the files count as a change
+	{"rule-files", "CLAMAV_RULE_FILES", false, func(c *Config) any { return &c.Rules }},
+	{"hash-blocklists", "CLAMAV_HASH_BLOCKLISTS", false, func(c *Config) any { return &c.HashBlocklists }},
+	{"hash-allowlists", "CLAMAV_HASH_ALLOWLISTS", false, func(c *Config) any { return &c.HashAllowlists }},
+	{"hash-list-interval", "CLAMAV_HASH_LIST_INTERVAL", false, func(c *Config) any { return &c.HashListInterval }},
+
+	{"log-format", "CLAMAV_LOG_FORMAT", true, func(c *Config) any { return &c.LogFormat }},
+	{"log-file", "CLAMAV_LOG_FILE", true, func(c *Config) any { return &c.LogFile }},
+	{"log-max-size", "CLAMAV_LOG_MAX_SIZE", true, func(c *Config) any { return &c.LogMaxSize }},
+	{"log-max-backups", "CLAMAV_LOG_MAX_BACKUPS", true, func(c *Config) any { return &c.LogMaxBackups }},
+	{"log-max-age", "CLAMAV_LOG_MAX_AGE", true, func(c *Config) any { return &c.LogMaxAge }},
+	{"admin-token", "CLAMAV_ADMIN_TOKEN", false, func(c *Config) any { return &c.AdminToken }},
+
+	{"otlp-endpoint", "CLAMAV_OTLP_ENDPOINT", true, func(c *Config) any { return &c.OTLPEndpoint }},
+	{"otlp-insecure", "CLAMAV_OTLP_INSECURE", true, func(c *Config) any { return &c.OTLPInsecure }},
+	{"trace-sample-ratio", "CLAMAV_TRACE_SAMPLE_RATIO", true, func(c *Config) any { return &c.TraceSampleRatio }},
+
+	{"health-probe-interval", "CLAMAV_HEALTH_PROBE_INTERVAL", false, func(c *Config) any { return &c.HealthProbeInterval }},
+	{"health-failure-threshold", "CLAMAV_HEALTH_FAILURE_THRESHOLD", false, func(c *Config) any { return &c.HealthFailureThreshold }},
+	{"health-success-threshold", "CLAMAV_HEALTH_SUCCESS_THRESHOLD", false, func(c *Config) any { return &c.HealthSuccessThreshold }},
+	{"health-max-signature-age", "CLAMAV_HEALTH_MAX_SIGNATURE_AGE", false, func(c *Config) any { return &c.HealthMaxSignatureAge }},
+	{"health-max-scans", "CLAMAV_HEALTH_MAX_SCANS", false, func(c *Config) any { return &c.HealthMaxScans }},
+
+	{"enable-milter", "CLAMAV_ENABLE_MILTER", true, func(c *Config) any { return &c.EnableMilter }},
+	{"milter-port", "CLAMAV_MILTER_PORT", true, func(c *Config) any { return &c.MilterPort }},
+	{"milter-infected-action", "CLAMAV_MILTER_INFECTED_ACTION", false, func(c *Config) any { return &c.MilterInfectedAction }},
+	{"milter-error-action", "CLAMAV_MILTER_ERROR_ACTION", false, func(c *Config) any { return &c.MilterErrorAction }},
+	{"milter-oversize-action", "CLAMAV_MILTER_OVERSIZE_ACTION", false, func(c *Config) any { return &c.MilterOversizeAction }},
+	{"milter-add-header", "CLAMAV_MILTER_ADD_HEADER", false, func(c *Config) any { return &c.MilterAddHeader }},
+	{"milter-idle-timeout", "CLAMAV_MILTER_IDLE_TIMEOUT", false, func(c *Config) any { return &c.MilterIdleTimeout }},
+
+	{"proxy-upstream", "CLAMAV_PROXY_UPSTREAM", true, func(c *Config) any { return &c.ProxyUpstream }},
+	{"proxy-port", "CLAMAV_PROXY_PORT", true, func(c *Config) any { return &c.ProxyPort }},
+	{"proxy-routes", "CLAMAV_PROXY_ROUTES", false, func(c *Config) any { return &c.ProxyRoutes }},
+	{"proxy-reject-status", "CLAMAV_PROXY_REJECT_STATUS", false, func(c *Config) any { return &c.ProxyRejectStatus }},
+	{"proxy-spill-threshold", "CLAMAV_PROXY_SPILL_THRESHOLD", false, func(c *Config) any { return &c.ProxySpillThreshold }},
+	{"proxy-temp-dir", "CLAMAV_PROXY_TEMP_DIR", false, func(c *Config) any { return &c.ProxyTempDir }},
+
+	{"enable-clamd-listener", "CLAMAV_ENABLE_CLAMD_LISTENER", true, func(c *Config) any { return &c.EnableClamdListener }},
+	{"clamd-listener-port", "CLAMAV_CLAMD_LISTENER_PORT", true, func(c *Config) any { return &c.ClamdListenerPort }},
+	{"clamd-allowed-nets", "CLAMAV_CLAMD_ALLOWED_NETS", false, func(c *Config) any { return &c.ClamdAllowedNets }},
+
+	{"watch-dirs", "CLAMAV_WATCH_DIRS", true, func(c *Config) any { return &c.WatchDirs }},
+	{"watch-clean-dir", "CLAMAV_WATCH_CLEAN_DIR", true, func(c *Config) any { return &c.WatchCleanDir }},
+	{"watch-infected-dir", "CLAMAV_WATCH_INFECTED_DIR", true, func(c *Config) any { return &c.WatchInfectedDir }},
+	{"watch-sidecar", "CLAMAV_WATCH_SIDECAR", false, func(c *Config) any { return &c.WatchSidecar }},
+	{"watch-settle", "CLAMAV_WATCH_SETTLE", false, func(c *Config) any { return &c.WatchSettle }},
+	{"watch-poll-interval", "CLAMAV_WATCH_POLL_INTERVAL", true, func(c *Config) any { return &c.WatchPollInterval }},
+	{"watch-use-polling", "CLAMAV_WATCH_USE_POLLING", true, func(c *Config) any { return &c.WatchUsePolling }},
+
+	{"s3-endpoint", "CLAMAV_S3_ENDPOINT", true, func(c *Config) any { return &c.S3Endpoint }},
+	{"s3-region", "CLAMAV_S3_REGION", false, func(c *Config) any { return &c.S3Region }},
+	{"s3-access-key", "CLAMAV_S3_ACCESS_KEY", false, func(c *Config) any { return &c.S3AccessKey }},
+	{"s3-secret-key", "CLAMAV_S3_SECRET_KEY", false, func(c *Config) any { return &c.S3SecretKey }},
+	{"s3-path-style", "CLAMAV_S3_PATH_STYLE", false, func(c *Config) any { return &c.S3PathStyle }},
+	{"s3-verdict-mode", "CLAMAV_S3_VERDICT_MODE", false, func(c *Config) any { return &c.S3VerdictMode }},
+	{"s3-quarantine-bucket", "CLAMAV_S3_QUARANTINE_BUCKET", false, func(c *Config) any { return &c.S3QuarantineBucket }},
+	{"s3-webhook-token", "CLAMAV_S3_WEBHOOK_TOKEN", false, func(c *Config) any { return &c.S3WebhookToken }},
+	{"s3-allowed-buckets", "CLAMAV_S3_ALLOWED_BUCKETS", false, func(c *Config) any { return &c.S3AllowedBuckets }},
+
+	{"enable-url-scan", "CLAMAV_ENABLE_URL_SCAN", true, func(c *Config) any { return &c.EnableURLScan }},
+	{"url-scan-schemes", "CLAMAV_URL_SCAN_SCHEMES", false, func(c *Config) any { return &c.URLScanSchemes }},
+	{"url-scan-allowed-hosts", "CLAMAV_URL_SCAN_ALLOWED_HOSTS", false, func(c *Config) any { return &c.URLScanAllowedHosts }},
+	{"url-scan-max-redirects", "CLAMAV_URL_SCAN_MAX_REDIRECTS", false, func(c *Config) any { return &c.URLScanMaxRedirects }},
+	{"url-scan-fetch-timeout", "CLAMAV_URL_SCAN_FETCH_TIMEOUT", false, func(c *Config) any { return &c.URLScanFetchTimeout }},
+}
+
+// secretSettings can only come from the config file or the environment,
+// so they stay out of ps output
+var secretSettings = map[string]bool{
+	"s3-secret-key":    true,
+	"s3-webhook-token": true,
+	"admin-token":      true,
+}
+
+// mergeReload returns next with its restart-only settings replaced by the
+// values in effect, along with the names of the settings that changed and
+// of the restart-only ones that were held back
+func mergeReload(current, next *Config) (merged Config, changed, restart []string) {
+	merged = *next
+	for _, s := range settings {
+		old := reflect.ValueOf(s.field(current)).Elem()
+		value := reflect.ValueOf(s.field(&merged)).Elem()
+		if reflect.DeepEqual(old.Interface(), value.Interface()) {
+			continue
+		}
+		if s.restart {
+			restart = append(restart, s.name)
+			value.Set(old)
+			continue
+		}
+		changed = append(changed, s.name)
+	}
+	return merged, changed, restart
+}
+
+// configReloader is a running component that applies reloaded settings
+type configReloader interface {
+	Reload(cfg *Config) error
+}
+
+// reloadTargets are the components started by serve
+var reloadTargets struct {
+	mu      sync.Mutex
+	targets map[string]configReloader
+}
+
+// registerReloader adds a component to be updated on reload
+func registerReloader(name string, r configReloader) {
+	reloadTargets.mu.Lock()
+	defer reloadTargets.mu.Unlock()
+	if reloadTargets.targets == nil {
+		reloadTargets.targets = make(map[string]configReloader)
+	}
+	reloadTargets.targets[name] = r
+}
+
+// reloadConfig re-reads the config file, environment and flags, and
+// applies the settings that can change at runtime. An invalid
+// configuration is rejected as a whole and the current one is kept.
+func reloadConfig(args []string) error {
+	logger := GetLogger()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	next, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	current := currentConfig()
+	merged, changed, restart := mergeReload(current, &next)
+	if len(restart) > 0 {
+		logger.Warn("Some changed settings need a restart to take effect",
+			zap.Strings("settings", restart))
+	}
+	if len(changed) == 0 {
+		logger.Info("Configuration reloaded, no changes to apply")
+		return nil
+	}
+
+	serverConfig.Store(&merged)
+	if merged.ClamdUnixSocket != current.ClamdUnixSocket {
+		resetClamdClient()
+	}
+	SetLogLevel(merged.Debug, logEnv())
+
+	reloadTargets.mu.Lock()
+	defer reloadTargets.mu.Unlock()
+	for name, target := range reloadTargets.targets {
+		if err := target.Reload(&merged); err != nil {
+			logger.Error("Failed to apply reloaded configuration",
+				zap.String("component", name),
+				zap.Error(err))
+		}
+	}
+
+	logger.Info("Configuration reloaded", zap.Strings("changed", changed))
+	return nil
+}
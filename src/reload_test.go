@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReloader records the configurations it is given
+type fakeReloader struct {
+	reloaded []*Config
+}
+
+func (f *fakeReloader) Reload(cfg *Config) error {
+	f.reloaded = append(f.reloaded, cfg)
+	return nil
+}
+
+// withReloadState restores the served configuration and the reload targets
+// after a test that reloads
+func withReloadState(t *testing.T) *fakeReloader {
+	t.Helper()
+	fake := &fakeReloader{}
+	registerReloader("test", fake)
+	t.Cleanup(func() {
+		reloadTargets.mu.Lock()
+		delete(reloadTargets.targets, "test")
+		reloadTargets.mu.Unlock()
+		serverConfig.Store(&config)
+		resetClamdClient()
+		SetLogLevel(config.Debug, logEnv())
+	})
+	return fake
+}
+
+// writeConfigFile writes content to a YAML config file named by CLAMAV_CONFIG
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clamav-api.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	t.Setenv("CLAMAV_CONFIG", path)
+}
+
+func TestMergeReloadKeepsRestartOnlySettings(t *testing.T) {
+	current := defaultConfig()
+	next := defaultConfig()
+	next.Port = "7100"
+	next.EnableMilter = true
+	next.MaxContentLength = 1024
+	next.ClamdAllowedNets = []string{"10.0.0.0/8"}
+
+	merged, changed, restart := mergeReload(&current, &next)
+
+	assert.Equal(t, []string{"max-size", "clamd-allowed-nets"}, changed)
+	assert.Equal(t, []string{"port", "enable-milter"}, restart)
+	assert.Equal(t, current.Port, merged.Port)
+	assert.False(t, merged.EnableMilter)
+	assert.Equal(t, int64(1024), merged.MaxContentLength)
+	assert.Equal(t, []string{"10.0.0.0/8"}, merged.ClamdAllowedNets)
+}
+
+func TestReloadConfigAppliesChanges(t *testing.T) {
+	fake := withReloadState(t)
+	writeConfigFile(t, `
+socket: /tmp/reloaded.sock
+max-size: 1024
+scan-timeout: 7
+port: "7100"
+`)
+
+	err := reloadConfig(nil)
+	require.NoError(t, err)
+
+	cfg := currentConfig()
+	assert.Equal(t, "/tmp/reloaded.sock", cfg.ClamdUnixSocket)
+	assert.Equal(t, int64(1024), cfg.MaxContentLength)
+	assert.Equal(t, 7*time.Second, cfg.ScanTimeout)
+	assert.Equal(t, config.Port, cfg.Port, "port needs a restart")
+	require.Len(t, fake.reloaded, 1)
+	assert.Same(t, cfg, fake.reloaded[0])
+}
+
+func TestReloadConfigRejectsInvalidConfig(t *testing.T) {
+	fake := withReloadState(t)
+	writeConfigFile(t, "max-size: 1024\nscan-timeout: 0\n")
+	before := currentConfig()
+
+	err := reloadConfig(nil)
+	assert.ErrorContains(t, err, "scan timeout must be > 0")
+	assert.Same(t, before, currentConfig())
+	assert.Empty(t, fake.reloaded)
+}
+
+func TestReloadConfigRereadsPolicyFile(t *testing.T) {
+	withReloadState(t)
+	policyFile := writePolicyFile(t, "policy.yaml", "default_policy: pua\npolicies:\n  pua:\n    rules:\n      - virus: [\"PUA.*\"]\n        action: warn\n")
+	writeConfigFile(t, "policy-file: "+policyFile+"\n")
+
+	require.NoError(t, reloadConfig(nil))
+	require.NotNil(t, currentConfig().Policies)
+	assert.Equal(t, actionWarn, currentConfig().Policies.Policies["pua"].Rules[0].Action)
+
+	// Only the file changes, not the setting pointing at it
+	require.NoError(t, os.WriteFile(policyFile, []byte("default_policy: pua\npolicies:\n  pua:\n    rules:\n      - virus: [\"PUA.*\"]\n        action: allow\n"), 0600))
+	require.NoError(t, reloadConfig(nil))
+	assert.Equal(t, actionAllow, currentConfig().Policies.Policies["pua"].Rules[0].Action)
+}
+
+func TestClamdServerReload(t *testing.T) {
+	cfg := defaultConfig()
+	server, err := NewClamdServer(&cfg)
+	require.NoError(t, err)
+
+	next := cfg
+	next.ClamdAllowedNets = []string{"192.0.2.0/24"}
+	require.NoError(t, server.Reload(&next))
+	assert.True(t, server.isAllowed(tcpAddr("192.0.2.7")))
+	assert.False(t, server.isAllowed(tcpAddr("127.0.0.1")))
+
+	invalid := cfg
+	invalid.ClamdAllowedNets = []string{"intranet"}
+	assert.Error(t, server.Reload(&invalid))
+	assert.True(t, server.isAllowed(tcpAddr("192.0.2.7")), "invalid nets keep the current ones")
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
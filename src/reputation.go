@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// What a hash list does with the payloads it lists
+const (
+	hashListBlock = "block"
+	hashListAllow = "allow"
+)
+
+// engineHashList names the hash lists in the verdict of a listed payload
+const engineHashList = "hash-list"
+
+// HashListHit is the hash list entry a payload's hash matched
+type HashListHit struct {
+	List   string `json:"list"`
+	Action string `json:"action"`
+	Hash   string `json:"hash"`
+	Label  string `json:"label,omitempty"`
+}
+
+// verdict is the verdict a hit stands for: FOUND with the list's name for
+// a blocklist, OK for an allowlist
+func (h *HashListHit) verdict() *EngineVerdict {
+	if h.Action == hashListBlock {
+		return &EngineVerdict{Engine: engineHashList, Status: "FOUND", Description: h.List}
+	}
+	return &EngineVerdict{Engine: engineHashList, Status: "OK"}
+}
+
+// HashList is one hash list file. Its name is the file name without
+// extension.
+type HashList struct {
+	Name   string
+	Path   string
+	Action string
+	// hashes maps lowercase SHA-256 and MD5 hex digests to their label
+	hashes  map[string]string
+	sha256  bool
+	md5     bool
+	modTime time.Time
+	size    int64
+}
+
+// HashReputation holds the hash blocklists and allowlists from the
+// configuration and reloads a list file when it changes. Payloads are
+// only hashed with the algorithms the lists use.
+type HashReputation struct {
+	config *liveConfig
+
+	mu    sync.RWMutex
+	lists []*HashList
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// hashReputation is checked by every scan before the engines run
+var hashReputation = NewHashReputation(serverConfig)
+
+// NewHashReputation creates a reputation stage with no lists loaded
+func NewHashReputation(cfg *liveConfig) *HashReputation {
+	return &HashReputation{config: cfg, stop: make(chan struct{})}
+}
+
+// Run checks the list files for changes every HashListInterval until
+// Stop. The interval is read before each wait so reloads take effect.
+func (r *HashReputation) Run() {
+	for {
+		timer := time.NewTimer(r.config.Load().HashListInterval)
+		select {
+		case <-timer.C:
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+		if err := r.Reload(r.config.Load()); err != nil {
+			GetLogger().Error("Failed to reload hash lists, keeping the previous ones", zap.Error(err))
+		}
+	}
+}
+
+// Stop ends Run
+func (r *HashReputation) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// Reload implements configReloader. It loads the lists named in cfg that
+// are new or whose file changed. A list that fails to load keeps its
+// previous content, if it had any; the errors are returned together.
+func (r *HashReputation) Reload(cfg *Config) error {
+	r.mu.RLock()
+	current := make(map[string]*HashList, len(r.lists))
+	for _, list := range r.lists {
+		current[list.Action+":"+list.Path] = list
+	}
+	r.mu.RUnlock()
+
+	var lists []*HashList
+	var errs []error
+	add := func(paths []string, action string) {
+		for _, path := range paths {
+			previous := current[action+":"+path]
+			list, err := loadHashList(path, action, previous)
+			if err != nil {
+				errs = append(errs, err)
+				list = previous
+			}
+			if list != nil {
+				lists = append(lists, list)
+			}
+		}
+	}
+	// Blocklists come first, so a hash on both kinds of list is blocked
+	add(cfg.HashBlocklists, hashListBlock)
+	add(cfg.HashAllowlists, hashListAllow)
+
+	r.mu.Lock()
+	r.lists = lists
+	r.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// algorithms reports which digests the loaded lists hold
+func (r *HashReputation) algorithms() (sha256, md5 bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, list := range r.lists {
+		sha256 = sha256 || list.sha256
+		md5 = md5 || list.md5
+	}
+	return sha256, md5
+}
+
+// lookup returns the first list entry matching one of the digests, nil if
+// none does. Empty digests were not computed.
+func (r *HashReputation) lookup(sha256, md5 string) *HashListHit {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, list := range r.lists {
+		for _, sum := range []string{sha256, md5} {
+			if sum == "" {
+				continue
+			}
+			if label, ok := list.hashes[sum]; ok {
+				return &HashListHit{List: list.Name, Action: list.Action, Hash: sum, Label: label}
+			}
+		}
+	}
+	return nil
+}
+
+// loadHashList reads a hash list file: one SHA-256 or MD5 hex digest per
+// line, or CSV records of a digest and a label. Lines starting with # and
+// a CSV header are skipped. previous is returned as is while the file is
+// unchanged.
+func loadHashList(path, action string, previous *HashList) (*HashList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("hash list %s: %w", path, err)
+	}
+	if previous != nil && info.ModTime().Equal(previous.modTime) && info.Size() == previous.size {
+		return previous, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("hash list %s: %w", path, err)
+	}
+	defer file.Close()
+
+	list := &HashList{
+		Name:    strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Path:    path,
+		Action:  action,
+		hashes:  make(map[string]string),
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("hash list %s: %w", path, err)
+		}
+		sum := strings.ToLower(strings.TrimSpace(record[0]))
+		if _, err := hex.DecodeString(sum); err != nil || (len(sum) != 64 && len(sum) != 32) {
+			if first {
+				continue
+			}
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("hash list %s: line %d: %q is not a SHA-256 or MD5 hash", path, line, record[0])
+		}
+		label := ""
+		if len(record) > 1 {
+			label = strings.TrimSpace(record[1])
+		}
+		list.hashes[sum] = label
+		if len(sum) == 64 {
+			list.sha256 = true
+		} else {
+			list.md5 = true
+		}
+	}
+
+	GetLogger().Info("Hash list loaded",
+		zap.String("list", list.Name),
+		zap.String("path", path),
+		zap.String("action", action),
+		zap.Int("hashes", len(list.hashes)))
+	return list, nil
+}
+
+// hexSum returns the hex digest of h, empty if h is nil
+func hexSum(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeHashList writes a hash list file, moving its modification time on
+// so a rewrite within the same second still counts as a change
+func writeHashList(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	stamp := time.Now().Add(time.Duration(len(content)) * time.Second)
+	require.NoError(t, os.Chtimes(path, stamp, stamp))
+}
+
+// withHashLists makes scans check the given lists for the duration of a
+// test
+func withHashLists(t *testing.T, blocklists, allowlists []string) *HashReputation {
+	t.Helper()
+	cfg := &Config{HashBlocklists: blocklists, HashAllowlists: allowlists, HashListInterval: 10 * time.Millisecond}
+	reputation := NewHashReputation(newLiveConfig(cfg))
+	require.NoError(t, reputation.Reload(cfg))
+	original := hashReputation
+	hashReputation = reputation
+	t.Cleanup(func() { hashReputation = original })
+	return reputation
+}
+
+func TestLoadHashList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "intel-daily.csv")
+	writeHashList(t, path, "# daily feed\n"+
+		"sha256,label\n"+
+		strings.ToUpper(sha256Hex("dropper"))+", Win.Dropper.Agent\n"+
+		"\n"+
+		md5Hex("loader")+"\n")
+
+	list, err := loadHashList(path, hashListBlock, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "intel-daily", list.Name)
+	assert.Equal(t, map[string]string{sha256Hex("dropper"): "Win.Dropper.Agent", md5Hex("loader"): ""}, list.hashes)
+	assert.True(t, list.sha256)
+	assert.True(t, list.md5)
+
+	unchanged, err := loadHashList(path, hashListBlock, list)
+	require.NoError(t, err)
+	assert.Same(t, list, unchanged)
+
+	writeHashList(t, path, md5Hex("loader")+"\nnot-a-hash,label\n")
+	_, err = loadHashList(path, hashListBlock, list)
+	assert.ErrorContains(t, err, `line 2: "not-a-hash" is not a SHA-256 or MD5 hash`)
+
+	_, err = loadHashList(filepath.Join(t.TempDir(), "missing.txt"), hashListBlock, nil)
+	assert.ErrorContains(t, err, "hash list")
+}
+
+func TestHashReputationReload(t *testing.T) {
+	dir := t.TempDir()
+	block, allow := filepath.Join(dir, "blocked.txt"), filepath.Join(dir, "vetted.txt")
+	writeHashList(t, block, sha256Hex("dropper")+"\n")
+	writeHashList(t, allow, sha256Hex("dropper")+"\n"+sha256Hex("installer")+"\n")
+	reputation := withHashLists(t, []string{block}, []string{allow})
+
+	assert.Equal(t, &HashListHit{List: "blocked", Action: hashListBlock, Hash: sha256Hex("dropper")}, reputation.lookup(sha256Hex("dropper"), ""),
+		"a hash on both kinds of list is blocked")
+	assert.Equal(t, hashListAllow, reputation.lookup(sha256Hex("installer"), "").Action)
+	assert.Nil(t, reputation.lookup(sha256Hex("other"), md5Hex("other")))
+	sha, md := reputation.algorithms()
+	assert.True(t, sha)
+	assert.False(t, md)
+
+	// A changed file is reloaded; an invalid one keeps its previous content
+	writeHashList(t, block, md5Hex("loader")+",Loader\n")
+	cfg := &Config{HashBlocklists: []string{block}, HashAllowlists: []string{allow}}
+	require.NoError(t, reputation.Reload(cfg))
+	assert.Equal(t, "Loader", reputation.lookup("", md5Hex("loader")).Label)
+	assert.Equal(t, hashListAllow, reputation.lookup(sha256Hex("dropper"), "").Action)
+
+	writeHashList(t, block, "garbage\n"+"more garbage\n")
+	assert.ErrorContains(t, reputation.Reload(cfg), "is not a SHA-256 or MD5 hash")
+	assert.NotNil(t, reputation.lookup("", md5Hex("loader")))
+
+	// A list that never loaded is left out
+	broken := filepath.Join(dir, "broken.txt")
+	writeHashList(t, broken, "x\ny\n")
+	cfg.HashBlocklists = []string{broken}
+	assert.Error(t, reputation.Reload(cfg))
+	assert.Nil(t, reputation.lookup("", md5Hex("loader")))
+}
+
+func TestHashReputationRunPicksUpChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	writeHashList(t, path, sha256Hex("dropper")+"\n")
+	reputation := withHashLists(t, []string{path}, nil)
+	go reputation.Run()
+	defer reputation.Stop()
+
+	writeHashList(t, path, sha256Hex("dropper")+"\n"+sha256Hex("second-stage")+"\n")
+	assert.Eventually(t, func() bool {
+		return reputation.lookup(sha256Hex("second-stage"), "") != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestScanHashReputation(t *testing.T) {
+	withFakeClamd(t, "stream: Win.Trojan.Agent FOUND")
+	dir := t.TempDir()
+	block, allow := filepath.Join(dir, "intel-blocklist.csv"), filepath.Join(dir, "vetted.txt")
+	writeHashList(t, block, "md5,label\n"+md5Hex("dropper")+",Emotet\n")
+	writeHashList(t, allow, sha256Hex("installer")+"\n")
+	withHashLists(t, []string{block}, []string{allow})
+
+	before := getCounterValue(t, hashListHitsTotal, "intel-blocklist", hashListBlock)
+	result, err := performScan(context.Background(), strings.NewReader("dropper"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", result.Status)
+	assert.Equal(t, "intel-blocklist", result.Description)
+	assert.Equal(t, int64(7), result.Size)
+	assert.Equal(t, &HashListHit{List: "intel-blocklist", Action: hashListBlock, Hash: md5Hex("dropper"), Label: "Emotet"}, result.Reputation)
+	assert.Equal(t, before+1, getCounterValue(t, hashListHitsTotal, "intel-blocklist", hashListBlock))
+
+	// clamd would report the allowlisted installer
+	result, err = performScan(context.Background(), strings.NewReader("installer"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "OK", result.Status)
+	assert.Equal(t, hashListAllow, result.Reputation.Action)
+
+	// Unlisted payloads are replayed to clamd
+	result, err = performScan(context.Background(), strings.NewReader("something else"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", result.Status)
+	assert.Equal(t, "Win.Trojan.Agent", result.Description)
+	assert.Nil(t, result.Reputation)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/stream-scan", handleStreamScan)
+	req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", strings.NewReader("dropper"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"message":"intel-blocklist"`)
+	assert.Contains(t, w.Body.String(), `"reputation":{"list":"intel-blocklist","action":"block","hash":"`+md5Hex("dropper")+`","label":"Emotet"}`)
+
+	client := getTestClient(t)
+	resp, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte("installer"), Filename: "setup.exe"})
+	require.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+	require.NotNil(t, resp.Reputation)
+	assert.Equal(t, "vetted", resp.Reputation.List)
+	assert.Equal(t, sha256Hex("installer"), resp.Reputation.Hash)
+}
+
+func TestScanHashReputationSkipsEngines(t *testing.T) {
+	dir := t.TempDir()
+	block, allow := filepath.Join(dir, "blocked.txt"), filepath.Join(dir, "vetted.txt")
+	writeHashList(t, block, sha256Hex("dropper")+"\n")
+	writeHashList(t, allow, sha256Hex("installer")+"\n")
+	withHashLists(t, []string{block}, []string{allow})
+
+	// Listed payloads never reach the engines, not even failing ones
+	reader := failing("broken")
+	withEngines(t, engineModeParallel, engineStrategyAny, reader)
+	for _, payload := range []string{"dropper", "installer"} {
+		digest := sha256.New()
+		verdict, hit, err := scanWithReputation(context.Background(), io.TeeReader(strings.NewReader(payload), digest), time.Second, true, digest, nil)
+		require.NoError(t, err)
+		assert.Equal(t, engineHashList, verdict.Engine)
+		assert.NotNil(t, hit)
+		assert.Nil(t, reader.payload)
+	}
+
+	// Unlisted payloads are replayed to the engines in full
+	replayed := found("reader", "Incident.Other")
+	withEngines(t, engineModeParallel, engineStrategyAny, replayed)
+	result, err := performScan(context.Background(), strings.NewReader("something else"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Incident.Other", result.Description)
+	assert.Equal(t, "something else", string(replayed.payload))
+
+	// The spool is capped like other buffered payloads
+	origMax := config.MaxContentLength
+	config.MaxContentLength = 8
+	t.Cleanup(func() { config.MaxContentLength = origMax })
+	_, err = performScan(context.Background(), strings.NewReader("something else"), time.Second)
+	assert.ErrorIs(t, err, errPayloadTooLarge)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// requestIDHeader carries the request ID over HTTP, and
+// requestIDMetadataKey in gRPC headers and trailers
+const (
+	requestIDHeader      = "X-Request-ID"
+	requestIDMetadataKey = "x-request-id"
+)
+
+// maxRequestIDLength bounds client-supplied IDs, which are logged verbatim
+const maxRequestIDLength = 128
+
+// requestContextKey keys the requestInfo stored in a request context
+type requestContextKey struct{}
+
+// requestInfo is the request ID and the logger tagged with it
+type requestInfo struct {
+	id     string
+	logger *zap.Logger
+}
+
+// newRequestID returns a random 128-bit ID in hex
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so a client
+// cannot inject control characters or padding into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDOrNew keeps a valid client-supplied ID and generates one otherwise
+func requestIDOrNew(id string) string {
+	if validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// withRequestID returns ctx carrying id and a child logger that adds it,
+// and the trace ID when the request is traced, to every entry
+func withRequestID(ctx context.Context, id string) context.Context {
+	fields := []zap.Field{zap.String("request_id", id)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = append(fields, zap.Stringer("trace_id", sc.TraceID()))
+	}
+	return context.WithValue(ctx, requestContextKey{}, &requestInfo{
+		id:     id,
+		logger: GetLogger().With(fields...),
+	})
+}
+
+// requestIDFromContext returns the request ID in ctx, or "" outside a request
+func requestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestContextKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// loggerFromContext returns the request's logger, or the global logger
+// outside a request
+func loggerFromContext(ctx context.Context) *zap.Logger {
+	if info, ok := ctx.Value(requestContextKey{}).(*requestInfo); ok {
+		return info.logger
+	}
+	return GetLogger()
+}
+
+// requestIDMiddleware assigns every REST request an ID, taken from the
+// X-Request-ID header when the client sends a valid one, and echoes it in
+// the response header. Scans of the request are reported with the client
+// address.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := requestIDOrNew(c.GetHeader(requestIDHeader))
+		c.Header(requestIDHeader, id)
+		tagRequestSpan(c.Request.Context(), id)
+		ctx := withScanSource(withRequestID(c.Request.Context(), id), transportREST, c.ClientIP())
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requestLogger returns the logger of a REST request
+func requestLogger(c *gin.Context) *zap.Logger {
+	return loggerFromContext(c.Request.Context())
+}
+
+// requestID returns the ID of a REST request
+func requestID(c *gin.Context) string {
+	return requestIDFromContext(c.Request.Context())
+}
+
+// incomingRequestID takes the request ID from gRPC metadata or generates one
+func incomingRequestID(ctx context.Context) string {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	return requestIDOrNew(id)
+}
+
+// requestIDUnaryInterceptor assigns unary RPCs an ID and returns it in both
+// the response headers and trailers, so it reaches clients that only read
+// trailers on failure. Scans of the RPC are reported with the peer
+// address.
+func requestIDUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	id := incomingRequestID(ctx)
+	md := metadata.Pairs(requestIDMetadataKey, id)
+	_ = grpc.SetHeader(ctx, md)
+	grpc.SetTrailer(ctx, md)
+	tagRequestSpan(ctx, id)
+	return handler(withScanSource(withRequestID(ctx, id), transportGRPC, peerAddress(ctx)), req)
+}
+
+// requestIDStreamInterceptor is requestIDUnaryInterceptor for streams. All
+// messages of a stream share its ID.
+func requestIDStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := incomingRequestID(ss.Context())
+	md := metadata.Pairs(requestIDMetadataKey, id)
+	_ = ss.SetHeader(md)
+	ss.SetTrailer(md)
+	tagRequestSpan(ss.Context(), id)
+	ctx := withScanSource(withRequestID(ss.Context(), id), transportGRPC, peerAddress(ss.Context()))
+	return handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+}
+
+// peerAddress returns the address of the gRPC client, or "" if unknown
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// requestIDStream overrides the context of a server stream
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRequestIDOrNew(t *testing.T) {
+	assert.Equal(t, "client-42", requestIDOrNew("client-42"))
+
+	for _, id := range []string{"", "has space", "line\nbreak", strings.Repeat("a", maxRequestIDLength+1)} {
+		generated := requestIDOrNew(id)
+		assert.NotEqual(t, id, generated)
+		assert.Len(t, generated, 32)
+	}
+	assert.NotEqual(t, newRequestID(), newRequestID())
+}
+
+func TestRequestLoggerAddsRequestID(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	original := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = original })
+
+	ctx := withRequestID(context.Background(), "abc123")
+	loggerFromContext(ctx).Info("scan finished")
+	loggerFromContext(context.Background()).Info("no request")
+
+	entries := logs.All()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "abc123", entries[0].ContextMap()["request_id"])
+	assert.NotContains(t, entries[1].ContextMap(), "request_id")
+	assert.Equal(t, "abc123", requestIDFromContext(ctx))
+	assert.Empty(t, requestIDFromContext(context.Background()))
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	router.GET("/id", func(c *gin.Context) {
+		c.String(http.StatusOK, requestID(c))
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/id", nil)
+	req.Header.Set(requestIDHeader, "client-42")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "client-42", w.Header().Get(requestIDHeader))
+	assert.Equal(t, "client-42", w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/id", nil))
+	generated := w.Header().Get(requestIDHeader)
+	assert.Len(t, generated, 32)
+	assert.Equal(t, generated, w.Body.String())
+}
+
+func TestRespondScanErrorIncludesRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	router.POST("/scan", func(c *gin.Context) {
+		respondScanError(c, requestLogger(c), &ScanTimeoutError{Timeout: time.Second}, "eicar.txt")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/scan", nil)
+	req.Header.Set(requestIDHeader, "client-42")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "client-42", body["request_id"])
+}
+
+func TestRejectionsIncludeRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, objectServer := newFakeS3(t)
+	withHealthProber(t, newTestProber(nil))
+	withAdminToken(t, "s3cret")
+	router := gin.New()
+	router.Use(requestIDMiddleware())
+	router.POST("/api/scan", handleScan)
+	router.POST("/api/stream-scan", handleStreamScan)
+	router.POST("/api/scan-message", handleScanMessage)
+	router.POST("/api/scan-url", newTestURLScanner(t, nil).handleScanURL)
+	router.POST("/api/scan-s3", newTestS3Scanner(t, objectServer.URL, nil).handleScanObject)
+	// A prober that has not yet probed clamd reports it unavailable
+	router.GET("/api/health-check", handleHealthCheck)
+	router.GET("/readyz", handleReadyz)
+	admin := router.Group("/api/admin", adminAuth())
+	admin.PUT("/log-level", handleSetLogLevel)
+	admin.DELETE("/scans/:id", handleCancelScan)
+	admin.DELETE("/allowlist/:id", handleDeleteAllowlistEntry)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"scan without file", http.MethodPost, "/api/scan", "text/plain", "data", http.StatusBadRequest},
+		{"stream without length", http.MethodPost, "/api/stream-scan", "", "", http.StatusBadRequest},
+		{"message too large", http.MethodPost, "/api/scan-message", "message/rfc822", "Subject: x\r\n\r\n" + strings.Repeat("x", int(config.MaxContentLength)), http.StatusRequestEntityTooLarge},
+		{"invalid message", http.MethodPost, "/api/scan-message", "message/rfc822", "no headers here", http.StatusBadRequest},
+		{"url not allowed", http.MethodPost, "/api/scan-url", "application/json", `{"url":"ftp://example.com/file"}`, http.StatusBadRequest},
+		{"object not found", http.MethodPost, "/api/scan-s3", "application/json", `{"bucket":"uploads","key":"missing"}`, http.StatusNotFound},
+		{"clamd unavailable", http.MethodGet, "/api/health-check", "", "", http.StatusBadGateway},
+		{"not ready", http.MethodGet, "/readyz", "", "", http.StatusServiceUnavailable},
+		{"scan not found", http.MethodDelete, "/api/admin/scans/999999", "", "", http.StatusNotFound},
+		{"allowlist entry not found", http.MethodDelete, "/api/admin/allowlist/missing", "", "", http.StatusNotFound},
+		{"invalid log level", http.MethodPut, "/api/admin/log-level", "application/json", "not json", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			req.Header.Set(requestIDHeader, "client-42")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, "client-42", body["request_id"])
+		})
+	}
+}
+
+func TestMapScanErrorToGRPCIncludesRequestID(t *testing.T) {
+	ctx := withRequestID(context.Background(), "abc123")
+	st := status.Convert(mapScanErrorToGRPC(ctx, &ScanEngineError{Description: "boom"}))
+
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.RequestInfo)
+	require.True(t, ok)
+	assert.Equal(t, "abc123", info.RequestId)
+
+	st = status.Convert(mapScanErrorToGRPC(context.Background(), &ScanEngineError{Description: "boom"}))
+	assert.Empty(t, st.Details())
+}
+
+func TestGRPCRequestIDHeaderAndTrailer(t *testing.T) {
+	withInvalidSocket(t)
+	client := getTestClient(t)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), requestIDMetadataKey, "client-42")
+	var header, trailer metadata.MD
+	_, err := client.ScanFile(ctx, &pb.ScanFileRequest{Data: []byte("test data")},
+		grpc.Header(&header), grpc.Trailer(&trailer))
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"client-42"}, header.Get(requestIDMetadataKey))
+	assert.Equal(t, []string{"client-42"}, trailer.Get(requestIDMetadataKey))
+	info, ok := status.Convert(err).Details()[0].(*errdetails.RequestInfo)
+	require.True(t, ok)
+	assert.Equal(t, "client-42", info.RequestId)
+
+	// Streams get a generated ID when the client sends none
+	stream, err := client.ScanStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.ScanStreamRequest{Chunk: []byte("test data"), IsLast: true}))
+	_, err = stream.CloseAndRecv()
+	require.Error(t, err)
+	assert.Len(t, stream.Trailer().Get(requestIDMetadataKey), 1)
+}
@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// engineRules is the built-in engine matching the rules of rule-files
+const engineRules = "rules"
+
+// Kinds of rule strings
+const (
+	ruleStringText  = "text"
+	ruleStringHex   = "hex"
+	ruleStringRegex = "regex"
+)
+
+// ruleRegexWindow is how many bytes of data already seen regexes are
+// matched against again with each new chunk, so a match may span chunks
+// as long as it fits in this window
+const ruleRegexWindow = 4096
+
+// RuleMatch is a rule that matched a payload
+type RuleMatch struct {
+	Rule string   `json:"rule"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Rule is one rule of a rule file: named strings to look for, and a
+// condition over which of them were found
+type Rule struct {
+	Name      string
+	File      string
+	Tags      []string
+	Meta      map[string]string
+	Strings   []*RuleString
+	condition ruleExpr
+}
+
+// RuleString is one of a rule's strings. index numbers it across the
+// rule set, so matches are counted in one slice.
+type RuleString struct {
+	ID     string
+	Kind   string
+	Nocase bool
+	Wide   bool
+	ASCII  bool
+	index  int
+	// patterns are the byte sequences a text or hex string matches, and
+	// re the compiled regex
+	patterns []rulePattern
+	re       *regexp.Regexp
+}
+
+// RuleSet is the compiled content of the rule files. Text and hex strings
+// are found with one Aho-Corasick automaton over case-folded data, each
+// hit then checked against the full string; regexes are matched on a
+// sliding window.
+type RuleSet struct {
+	Rules    []*Rule
+	strings  int
+	patterns []rulePattern
+	regexes  []ruleRegex
+	ac       *ahoCorasick
+	// keep is how much of the data already seen a scan holds on to
+	keep int
+}
+
+// rulePattern is a byte sequence a text or hex string matches. The atom
+// is the part looked up with the automaton.
+type rulePattern struct {
+	str        int
+	data       []byte
+	mask       []byte
+	nocase     bool
+	atom       []byte
+	atomOffset int
+}
+
+type ruleRegex struct {
+	str int
+	re  *regexp.Regexp
+}
+
+// RuleError reports an invalid rule file
+type RuleError struct {
+	File string
+	Line int
+	Err  string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule file %s: line %d: %s", e.File, e.Line, e.Err)
+}
+
+// loadRuleFiles reads and compiles the rule files, each entry a path or a
+// glob. Rule names must be unique across the files.
+func loadRuleFiles(patterns []string) (*RuleSet, error) {
+	var rules []*Rule
+	names := make(map[string]string)
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule files %q: %w", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("rule files %q: no such file", pattern)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("rule file %s: %w", file, err)
+			}
+			parsed, err := parseRules(file, string(data))
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range parsed {
+				if other, ok := names[rule.Name]; ok {
+					return nil, fmt.Errorf("rule file %s: rule %s is already defined in %s", file, rule.Name, other)
+				}
+				names[rule.Name] = file
+			}
+			rules = append(rules, parsed...)
+		}
+	}
+	return compileRules(rules), nil
+}
+
+// compileRules numbers the strings of rules and builds their matcher
+func compileRules(rules []*Rule) *RuleSet {
+	set := &RuleSet{Rules: rules}
+	var atoms [][]byte
+	for _, rule := range rules {
+		for _, s := range rule.Strings {
+			s.index = set.strings
+			set.strings++
+			if s.re != nil {
+				set.regexes = append(set.regexes, ruleRegex{str: s.index, re: s.re})
+				set.keep = max(set.keep, ruleRegexWindow)
+			}
+			for _, pattern := range s.patterns {
+				pattern.str = s.index
+				set.patterns = append(set.patterns, pattern)
+				atoms = append(atoms, foldBytes(pattern.atom))
+				set.keep = max(set.keep, len(pattern.data)-1)
+			}
+		}
+	}
+	set.ac = newAhoCorasick(atoms)
+	return set
+}
+
+// ruleEngine matches payloads against the rule set in effect
+type ruleEngine struct {
+	rules *RuleSet
+}
+
+// Name implements ScanEngine
+func (ruleEngine) Name() string {
+	return engineRules
+}
+
+// Scan implements ScanEngine. The payload is matched as it streams; the
+// verdict is ready once it has been read, so timeout does not apply.
+func (e ruleEngine) Scan(ctx context.Context, r io.Reader, timeout time.Duration) (*EngineVerdict, error) {
+	startTime := time.Now()
+	scanner := e.rules.newScanner()
+	if _, err := io.Copy(scanner, r); err != nil {
+		return nil, err
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		return nil, cause
+	}
+
+	verdict := &EngineVerdict{Engine: engineRules, Status: "OK"}
+	for _, rule := range scanner.matches() {
+		verdict.Matches = append(verdict.Matches, RuleMatch{Rule: rule.Name, Tags: rule.Tags})
+		ruleMatchesTotal.WithLabelValues(rule.File).Inc()
+	}
+	if len(verdict.Matches) > 0 {
+		verdict.Status = "FOUND"
+		verdict.Description = verdict.Matches[0].Rule
+	}
+	verdict.ScanTime = time.Since(startTime).Seconds()
+	return verdict, nil
+}
+
+// ruleScanner counts the rule strings found in a stream written to it
+type ruleScanner struct {
+	set   *RuleSet
+	state int32
+	// buf is the tail of the data already seen followed by the chunk
+	// being scanned, and base the stream offset of its first byte
+	buf  []byte
+	base int64
+	// pending hits need more data before they can be checked
+	pending  []ruleCandidate
+	counts   []int
+	regexEnd []int64
+}
+
+// ruleCandidate is an atom hit whose pattern would start at start
+type ruleCandidate struct {
+	pattern int
+	start   int64
+}
+
+func (s *RuleSet) newScanner() *ruleScanner {
+	return &ruleScanner{
+		set:      s,
+		counts:   make([]int, s.strings),
+		regexEnd: make([]int64, len(s.regexes)),
+	}
+}
+
+// Write implements io.Writer
+func (s *ruleScanner) Write(p []byte) (int, error) {
+	seen := s.base + int64(len(s.buf))
+	s.buf = append(s.buf, p...)
+	end := seen + int64(len(p))
+
+	waiting := s.pending[:0]
+	for _, c := range s.pending {
+		if !s.check(c, end) {
+			waiting = append(waiting, c)
+		}
+	}
+	s.pending = waiting
+
+	for i, b := range p {
+		var hits []int
+		s.state, hits = s.set.ac.step(s.state, foldByte(b))
+		for _, hit := range hits {
+			pattern := &s.set.patterns[hit]
+			start := seen + int64(i+1-len(pattern.atom)-pattern.atomOffset)
+			if start < 0 {
+				continue
+			}
+			if c := (ruleCandidate{pattern: hit, start: start}); !s.check(c, end) {
+				s.pending = append(s.pending, c)
+			}
+		}
+	}
+
+	for i, regex := range s.set.regexes {
+		for _, loc := range regex.re.FindAllIndex(s.buf, -1) {
+			start, stop := s.base+int64(loc[0]), s.base+int64(loc[1])
+			// Skip matches found with earlier chunks
+			if stop <= seen || start < s.regexEnd[i] {
+				continue
+			}
+			s.counts[regex.str]++
+			s.regexEnd[i] = stop
+		}
+	}
+
+	if drop := len(s.buf) - s.set.keep; drop > 0 {
+		s.base += int64(drop)
+		s.buf = append(s.buf[:0], s.buf[drop:]...)
+	}
+	return len(p), nil
+}
+
+// check counts c if its pattern matches, and reports false when the
+// data up to end is too short to tell yet
+func (s *ruleScanner) check(c ruleCandidate, end int64) bool {
+	pattern := &s.set.patterns[c.pattern]
+	if c.start+int64(len(pattern.data)) > end {
+		return false
+	}
+	if pattern.matches(s.buf[c.start-s.base:]) {
+		s.counts[pattern.str]++
+	}
+	return true
+}
+
+// matches evaluates the rules over the strings found and returns those
+// that match, in rule order. Hits still waiting for data ran past the end
+// of the payload.
+func (s *ruleScanner) matches() []*Rule {
+	eval := &ruleEval{counts: s.counts, size: s.base + int64(len(s.buf))}
+	var matched []*Rule
+	for _, rule := range s.set.Rules {
+		if rule.condition.eval(eval) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+func (p *rulePattern) matches(data []byte) bool {
+	for i, want := range p.data {
+		got := data[i]
+		if p.nocase {
+			got, want = foldByte(got), foldByte(want)
+		}
+		if got&p.mask[i] != want&p.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compileText sets the patterns of a text string: its ASCII form, its
+// UTF-16LE form when wide, or both when wide and ascii
+func (s *RuleString) compileText(text string) error {
+	if text == "" {
+		return errors.New("text strings must not be empty")
+	}
+	var forms [][]byte
+	if !s.Wide || s.ASCII {
+		forms = append(forms, []byte(text))
+	}
+	if s.Wide {
+		wide := make([]byte, 0, 2*len(text))
+		for i := 0; i < len(text); i++ {
+			wide = append(wide, text[i], 0)
+		}
+		forms = append(forms, wide)
+	}
+	for _, data := range forms {
+		s.patterns = append(s.patterns, rulePattern{
+			data:   data,
+			mask:   bytes.Repeat([]byte{0xff}, len(data)),
+			nocase: s.Nocase,
+			atom:   data,
+		})
+	}
+	return nil
+}
+
+// compileHex sets the pattern of a hex string such as { 4D 5A ?? 00 3? },
+// where ?? matches any byte and ? any nibble. Its longest run of whole
+// bytes is the atom.
+func (s *RuleString) compileHex(text string) error {
+	if s.Nocase || s.Wide || s.ASCII {
+		return errors.New("hex strings take no modifiers")
+	}
+	digits := strings.Join(strings.Fields(text), "")
+	if strings.ContainsAny(digits, "[]()|") {
+		return errors.New("jumps and alternatives are not supported in hex strings")
+	}
+	if digits == "" || len(digits)%2 != 0 {
+		return errors.New("hex strings must be whole bytes")
+	}
+
+	pattern := rulePattern{}
+	for i := 0; i < len(digits); i += 2 {
+		var b, mask byte
+		for _, c := range []byte(digits[i : i+2]) {
+			b, mask = b<<4, mask<<4
+			if c == '?' {
+				continue
+			}
+			nibble, err := strconv.ParseUint(string(c), 16, 8)
+			if err != nil {
+				return fmt.Errorf("invalid hex digit %q", c)
+			}
+			b, mask = b|byte(nibble), mask|0xf
+		}
+		pattern.data = append(pattern.data, b)
+		pattern.mask = append(pattern.mask, mask)
+	}
+
+	for i := 0; i < len(pattern.mask); {
+		if pattern.mask[i] != 0xff {
+			i++
+			continue
+		}
+		j := i
+		for j < len(pattern.mask) && pattern.mask[j] == 0xff {
+			j++
+		}
+		if j-i > len(pattern.atom) {
+			pattern.atom, pattern.atomOffset = pattern.data[i:j], i
+		}
+		i = j
+	}
+	if len(pattern.atom) == 0 {
+		return errors.New("hex strings need at least one byte without wildcards")
+	}
+	s.patterns = []rulePattern{pattern}
+	return nil
+}
+
+// compileRegex compiles a regex string. The i and s flags after the
+// closing slash are already part of expr.
+func (s *RuleString) compileRegex(expr string) error {
+	if s.Wide || s.ASCII {
+		return errors.New("regexes take no wide or ascii modifier")
+	}
+	if s.Nocase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	if re.MatchString("") {
+		return errors.New("regex matches empty data")
+	}
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	if hasAssertion(parsed) {
+		return errors.New("regex anchors and word boundaries are not supported")
+	}
+	s.re = re
+	return nil
+}
+
+// hasAssertion reports whether re holds an anchor or a word boundary.
+// Regexes are matched against a window of the stream, whose edges are not
+// the payload's, so these would match in the wrong places.
+func hasAssertion(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasAssertion(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func foldByte(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func foldBytes(data []byte) []byte {
+	folded := make([]byte, len(data))
+	for i, b := range data {
+		folded[i] = foldByte(b)
+	}
+	return folded
+}
+
+// ruleEval is what conditions are evaluated against
+type ruleEval struct {
+	counts []int
+	size   int64
+}
+
+// ruleExpr is a node of a rule condition
+type ruleExpr interface {
+	eval(e *ruleEval) bool
+}
+
+type ruleBool bool
+
+func (b ruleBool) eval(*ruleEval) bool { return bool(b) }
+
+type ruleAnd struct{ left, right ruleExpr }
+
+func (n ruleAnd) eval(e *ruleEval) bool { return n.left.eval(e) && n.right.eval(e) }
+
+type ruleOr struct{ left, right ruleExpr }
+
+func (n ruleOr) eval(e *ruleEval) bool { return n.left.eval(e) || n.right.eval(e) }
+
+type ruleNot struct{ expr ruleExpr }
+
+func (n ruleNot) eval(e *ruleEval) bool { return !n.expr.eval(e) }
+
+// ruleFound is $id: the string was found at least once
+type ruleFound struct{ str *RuleString }
+
+func (n ruleFound) eval(e *ruleEval) bool { return e.counts[n.str.index] > 0 }
+
+// ruleCompare is #id, or filesize when str is nil, compared with a number
+type ruleCompare struct {
+	str   *RuleString
+	op    string
+	value int64
+}
+
+func (n ruleCompare) eval(e *ruleEval) bool {
+	left := e.size
+	if n.str != nil {
+		left = int64(e.counts[n.str.index])
+	}
+	switch n.op {
+	case "<":
+		return left < n.value
+	case "<=":
+		return left <= n.value
+	case ">":
+		return left > n.value
+	case ">=":
+		return left >= n.value
+	case "==":
+		return left == n.value
+	}
+	return left != n.value
+}
+
+// ruleOf is "N of (...)": at least min of the strings were found
+type ruleOf struct {
+	min  int
+	strs []*RuleString
+}
+
+func (n ruleOf) eval(e *ruleEval) bool {
+	found := 0
+	for _, str := range n.strs {
+		if e.counts[str.index] > 0 {
+			found++
+		}
+	}
+	return found >= n.min
+}
+
+// parseRules parses the rules of one file
+func parseRules(file, src string) ([]*Rule, error) {
+	tokens, err := lexRules(src)
+	if err != nil {
+		return nil, &RuleError{File: file, Line: err.line, Err: err.msg}
+	}
+	p := &ruleParser{tokens: tokens}
+	var rules []*Rule
+	for p.peek().kind != tokEOF {
+		rule, err := p.rule()
+		if err != nil {
+			return nil, &RuleError{File: file, Line: err.line, Err: err.msg}
+		}
+		rule.File = file
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Kinds of rule file tokens
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokHex
+	tokRegex
+	tokNumber
+	tokStringID
+	tokCount
+	tokPunct
+)
+
+type ruleToken struct {
+	kind int
+	text string
+	num  int64
+	line int
+}
+
+// ruleSyntaxError is a parse error at a line of a rule file
+type ruleSyntaxError struct {
+	line int
+	msg  string
+}
+
+func syntaxErrorf(line int, format string, args ...any) *ruleSyntaxError {
+	return &ruleSyntaxError{line: line, msg: fmt.Sprintf(format, args...)}
+}
+
+// lexRules splits a rule file into tokens. Braces and slashes right
+// after "=" open a hex string and a regex.
+func lexRules(src string) ([]ruleToken, *ruleSyntaxError) {
+	var tokens []ruleToken
+	line := 1
+	afterAssign := func() bool {
+		return len(tokens) > 0 && tokens[len(tokens)-1].kind == tokPunct && tokens[len(tokens)-1].text == "="
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '/' && !afterAssign() && strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && !afterAssign() && strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, syntaxErrorf(line, "unterminated comment")
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			text, n, err := lexQuoted(src[i:])
+			if err != "" {
+				return nil, syntaxErrorf(line, "%s", err)
+			}
+			tokens = append(tokens, ruleToken{kind: tokString, text: text, line: line})
+			i += n
+		case c == '{' && afterAssign():
+			end := strings.IndexByte(src[i:], '}')
+			if end < 0 {
+				return nil, syntaxErrorf(line, "unterminated hex string")
+			}
+			tokens = append(tokens, ruleToken{kind: tokHex, text: src[i+1 : i+end], line: line})
+			line += strings.Count(src[i:i+end], "\n")
+			i += end + 1
+		case c == '/' && afterAssign():
+			j := i + 1
+			var expr strings.Builder
+			for ; j < len(src) && src[j] != '/'; j++ {
+				if src[j] == '\n' {
+					return nil, syntaxErrorf(line, "unterminated regex")
+				}
+				if src[j] == '\\' && j+1 < len(src) && src[j+1] == '/' {
+					j++
+				}
+				expr.WriteByte(src[j])
+			}
+			if j == len(src) {
+				return nil, syntaxErrorf(line, "unterminated regex")
+			}
+			j++
+			flags := j
+			for j < len(src) && (src[j] == 'i' || src[j] == 's') {
+				j++
+			}
+			text := expr.String()
+			if j > flags {
+				text = "(?" + src[flags:j] + ")" + text
+			}
+			tokens = append(tokens, ruleToken{kind: tokRegex, text: text, line: line})
+			i = j
+		case c == '$' || c == '#':
+			j := i + 1
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			if c == '$' && j < len(src) && src[j] == '*' {
+				j++
+			}
+			if j == i+1 {
+				return nil, syntaxErrorf(line, "%c must be followed by a string name", c)
+			}
+			kind := tokStringID
+			if c == '#' {
+				kind = tokCount
+			}
+			tokens = append(tokens, ruleToken{kind: kind, text: "$" + src[i+1:j], line: line})
+			i = j
+		case '0' <= c && c <= '9':
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			num, err := parseRuleNumber(src[i:j])
+			if err != nil {
+				return nil, syntaxErrorf(line, "invalid number %q", src[i:j])
+			}
+			tokens = append(tokens, ruleToken{kind: tokNumber, text: src[i:j], num: num, line: line})
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			tokens = append(tokens, ruleToken{kind: tokIdent, text: src[i:j], line: line})
+			i = j
+		default:
+			op := string(c)
+			if two := src[i:min(i+2, len(src))]; two == "<=" || two == ">=" || two == "==" || two == "!=" {
+				op = two
+			} else if !strings.ContainsRune("{}():=,<>", rune(c)) {
+				return nil, syntaxErrorf(line, "unexpected character %q", c)
+			}
+			tokens = append(tokens, ruleToken{kind: tokPunct, text: op, line: line})
+			i += len(op)
+		}
+	}
+	return append(tokens, ruleToken{kind: tokEOF, line: line}), nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// lexQuoted reads a double-quoted string with \" \\ \n \r \t and \xHH
+// escapes, returning its value and length in src
+func lexQuoted(src string) (string, int, string) {
+	var value strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch src[i] {
+		case '"':
+			return value.String(), i + 1, ""
+		case '\n':
+			return "", 0, "unterminated string"
+		case '\\':
+			if i+1 == len(src) {
+				return "", 0, "unterminated string"
+			}
+			i++
+			switch src[i] {
+			case '"', '\\':
+				value.WriteByte(src[i])
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'x':
+				if i+2 >= len(src) {
+					return "", 0, "invalid \\x escape"
+				}
+				b, err := strconv.ParseUint(src[i+1:i+3], 16, 8)
+				if err != nil {
+					return "", 0, "invalid \\x escape"
+				}
+				value.WriteByte(byte(b))
+				i += 2
+			default:
+				return "", 0, fmt.Sprintf("unknown escape \\%c", src[i])
+			}
+		default:
+			value.WriteByte(src[i])
+		}
+	}
+	return "", 0, "unterminated string"
+}
+
+// parseRuleNumber parses a decimal or 0x number with an optional KB or MB
+// suffix
+func parseRuleNumber(text string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(text, "KB"):
+		multiplier, text = 1024, strings.TrimSuffix(text, "KB")
+	case strings.HasSuffix(text, "MB"):
+		multiplier, text = 1024*1024, strings.TrimSuffix(text, "MB")
+	}
+	num, err := strconv.ParseInt(text, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	return num * multiplier, nil
+}
+
+// ruleParser parses the tokens of a rule file
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+	// strings are the current rule's strings by ID
+	strings map[string]*RuleString
+	order   []*RuleString
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is reports whether the next token is the punctuation or keyword text
+func (p *ruleParser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokPunct || tok.kind == tokIdent) && tok.text == text
+}
+
+func (p *ruleParser) expect(text string) *ruleSyntaxError {
+	if !p.is(text) {
+		return p.unexpected(fmt.Sprintf("%q", text))
+	}
+	p.next()
+	return nil
+}
+
+func (p *ruleParser) unexpected(want string) *ruleSyntaxError {
+	tok := p.peek()
+	got := fmt.Sprintf("%q", tok.text)
+	if tok.kind == tokEOF {
+		got = "end of file"
+	}
+	return syntaxErrorf(tok.line, "expected %s, got %s", want, got)
+}
+
+// section reports whether the next tokens open the named rule section
+func (p *ruleParser) section(name string) bool {
+	return p.is(name) && p.tokens[p.pos+1].kind == tokPunct && p.tokens[p.pos+1].text == ":"
+}
+
+// rule parses "rule name : tags { meta: ... strings: ... condition: ... }"
+func (p *ruleParser) rule() (*Rule, *ruleSyntaxError) {
+	if err := p.expect("rule"); err != nil {
+		return nil, err
+	}
+	name := p.next()
+	if name.kind != tokIdent {
+		return nil, syntaxErrorf(name.line, "expected a rule name, got %q", name.text)
+	}
+	rule := &Rule{Name: name.text}
+	if p.is(":") {
+		p.next()
+		for p.peek().kind == tokIdent {
+			rule.Tags = append(rule.Tags, p.next().text)
+		}
+		if len(rule.Tags) == 0 {
+			return nil, p.unexpected("a tag")
+		}
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	p.strings, p.order = make(map[string]*RuleString), nil
+
+	if p.section("meta") {
+		p.pos += 2
+		rule.Meta = make(map[string]string)
+		for p.peek().kind == tokIdent && !p.section("strings") && !p.section("condition") {
+			key := p.next().text
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			value := p.next()
+			if value.kind != tokString && value.kind != tokNumber && !(value.kind == tokIdent && (value.text == "true" || value.text == "false")) {
+				return nil, syntaxErrorf(value.line, "meta %s: expected a string, number or boolean", key)
+			}
+			rule.Meta[key] = value.text
+		}
+	}
+	if p.section("strings") {
+		p.pos += 2
+		for p.peek().kind == tokStringID {
+			if err := p.ruleString(); err != nil {
+				return nil, err
+			}
+		}
+		if len(p.order) == 0 {
+			return nil, p.unexpected("a string")
+		}
+	}
+	if !p.section("condition") {
+		return nil, p.unexpected(`"condition:"`)
+	}
+	p.pos += 2
+	condition, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	rule.Strings, rule.condition = p.order, condition
+	return rule, nil
+}
+
+// ruleString parses "$id = value modifiers"
+func (p *ruleParser) ruleString() *ruleSyntaxError {
+	id := p.next()
+	if strings.HasSuffix(id.text, "*") || id.text == "$" {
+		return syntaxErrorf(id.line, "invalid string name %s", id.text)
+	}
+	if p.strings[id.text] != nil {
+		return syntaxErrorf(id.line, "string %s is defined more than once", id.text)
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	value := p.next()
+	s := &RuleString{ID: id.text}
+	for p.peek().kind == tokIdent && !p.section("condition") {
+		switch modifier := p.next(); modifier.text {
+		case "nocase":
+			s.Nocase = true
+		case "wide":
+			s.Wide = true
+		case "ascii":
+			s.ASCII = true
+		default:
+			return syntaxErrorf(modifier.line, "string %s: unsupported modifier %s", id.text, modifier.text)
+		}
+	}
+	var err error
+	switch value.kind {
+	case tokString:
+		s.Kind = ruleStringText
+		err = s.compileText(value.text)
+	case tokHex:
+		s.Kind = ruleStringHex
+		err = s.compileHex(value.text)
+	case tokRegex:
+		s.Kind = ruleStringRegex
+		err = s.compileRegex(value.text)
+	default:
+		return syntaxErrorf(value.line, "string %s: expected a text, hex or regex string", id.text)
+	}
+	if err != nil {
+		return syntaxErrorf(value.line, "string %s: %v", id.text, err)
+	}
+	p.strings[s.ID] = s
+	p.order = append(p.order, s)
+	return nil
+}
+
+// expr parses a condition: or of ands of nots of primaries
+func (p *ruleParser) expr() (ruleExpr, *ruleSyntaxError) {
+	left, err := p.and()
+	for err == nil && p.is("or") {
+		p.next()
+		var right ruleExpr
+		if right, err = p.and(); err == nil {
+			left = ruleOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *ruleParser) and() (ruleExpr, *ruleSyntaxError) {
+	left, err := p.not()
+	for err == nil && p.is("and") {
+		p.next()
+		var right ruleExpr
+		if right, err = p.not(); err == nil {
+			left = ruleAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *ruleParser) not() (ruleExpr, *ruleSyntaxError) {
+	if p.is("not") {
+		p.next()
+		expr, err := p.not()
+		return ruleNot{expr}, err
+	}
+	return p.primary()
+}
+
+func (p *ruleParser) primary() (ruleExpr, *ruleSyntaxError) {
+	tok := p.peek()
+	switch {
+	case p.is("("):
+		p.next()
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case p.is("true"), p.is("false"):
+		p.next()
+		return ruleBool(tok.text == "true"), nil
+	case tok.kind == tokStringID:
+		p.next()
+		s := p.strings[tok.text]
+		if s == nil {
+			return nil, syntaxErrorf(tok.line, "undefined string %s", tok.text)
+		}
+		return ruleFound{s}, nil
+	case tok.kind == tokCount, p.is("filesize"):
+		p.next()
+		compare := ruleCompare{}
+		if tok.kind == tokCount {
+			if compare.str = p.strings[tok.text]; compare.str == nil {
+				return nil, syntaxErrorf(tok.line, "undefined string %s", tok.text)
+			}
+		}
+		op := p.next()
+		if op.kind != tokPunct || !isComparison(op.text) {
+			return nil, syntaxErrorf(op.line, "expected a comparison after %s", tok.text)
+		}
+		value := p.next()
+		if value.kind != tokNumber {
+			return nil, syntaxErrorf(value.line, "expected a number after %s %s", tok.text, op.text)
+		}
+		compare.op, compare.value = op.text, value.num
+		return compare, nil
+	case tok.kind == tokNumber, p.is("any"), p.is("all"):
+		p.next()
+		return p.of(tok)
+	}
+	return nil, p.unexpected("a condition")
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// of parses the rest of "N of them" or "N of ($a, $b*)"
+func (p *ruleParser) of(quantifier ruleToken) (ruleExpr, *ruleSyntaxError) {
+	if err := p.expect("of"); err != nil {
+		return nil, err
+	}
+	var strs []*RuleString
+	if p.is("them") {
+		p.next()
+		strs = p.order
+	} else {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			tok := p.next()
+			if tok.kind != tokStringID {
+				return nil, syntaxErrorf(tok.line, "expected a string name, got %q", tok.text)
+			}
+			matched := false
+			for _, s := range p.order {
+				if s.ID == tok.text || strings.HasSuffix(tok.text, "*") && strings.HasPrefix(s.ID, strings.TrimSuffix(tok.text, "*")) {
+					strs = append(strs, s)
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, syntaxErrorf(tok.line, "undefined string %s", tok.text)
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if len(strs) == 0 {
+		return nil, syntaxErrorf(quantifier.line, "%s of them: the rule has no strings", quantifier.text)
+	}
+
+	of := ruleOf{strs: strs}
+	switch quantifier.text {
+	case "any":
+		of.min = 1
+	case "all":
+		of.min = len(strs)
+	default:
+		if quantifier.num < 1 || quantifier.num > int64(len(strs)) {
+			return nil, syntaxErrorf(quantifier.line, "%d of %d strings can never match", quantifier.num, len(strs))
+		}
+		of.min = int(quantifier.num)
+	}
+	return of, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	pb "clamav-api/proto"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+// In-house threats
+rule InHouse_Dropper : dropper windows
+{
+    meta:
+        author = "threat-intel"
+        severity = 3
+    strings:
+        $mz = { 4D 5A ?? 00 }
+        $url = "http://c2.example" nocase
+        $name = "dropper" wide ascii
+    condition:
+        $mz and ($url or $name)
+}
+
+rule Macro_Loader : office
+{
+    strings:
+        $auto = /Auto(Open|Exec)/i
+        $shell = "Shell("
+    condition:
+        all of them
+}
+
+/* Several hits of a marker, in a small file */
+rule Repeated_Marker
+{
+    strings:
+        $m = { DE AD B? EF }
+    condition:
+        #m >= 3 and filesize < 1KB
+}
+
+rule Any_Two
+{
+    strings:
+        $a1 = "alpha"
+        $a2 = "beta"
+        $b = "gamma"
+    condition:
+        2 of ($a*, $b) and not $b
+}
+`
+
+// ruleNames scans payload with set, reading it in the chunks r returns
+func ruleNames(t *testing.T, set *RuleSet, r io.Reader) []string {
+	t.Helper()
+	verdict, err := ruleEngine{rules: set}.Scan(context.Background(), r, time.Second)
+	require.NoError(t, err)
+	var names []string
+	for _, match := range verdict.Matches {
+		names = append(names, match.Rule)
+	}
+	return names
+}
+
+func mustCompileRules(t *testing.T, src string) *RuleSet {
+	t.Helper()
+	rules, err := parseRules("test.yar", src)
+	require.NoError(t, err)
+	return compileRules(rules)
+}
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([][]byte{[]byte("he"), []byte("she"), []byte("his"), []byte("hers"), nil})
+	type hit struct {
+		pattern int
+		end     int
+	}
+	var hits []hit
+	state := int32(0)
+	for i, b := range []byte("ushers his") {
+		var out []int
+		state, out = ac.step(state, b)
+		for _, pattern := range out {
+			hits = append(hits, hit{pattern, i + 1})
+		}
+	}
+	assert.Equal(t, []hit{{1, 4}, {0, 4}, {3, 6}, {2, 10}}, hits)
+}
+
+func TestRuleMatching(t *testing.T) {
+	set := mustCompileRules(t, testRules)
+	wide := func(s string) string {
+		var b strings.Builder
+		for _, c := range []byte(s) {
+			b.WriteByte(c)
+			b.WriteByte(0)
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    []string
+	}{
+		{"hex wildcard and nocase text", "MZ\x90\x00 fetch HTTP://C2.EXAMPLE/p", []string{"InHouse_Dropper"}},
+		{"wide text", "MZ\x01\x00" + wide("a dropper"), []string{"InHouse_Dropper"}},
+		{"hex needs every fixed byte", "MZ\x90\x01 dropper", nil},
+		{"regex and text", "Sub autoopen()\n Shell(\"cmd\")", []string{"Macro_Loader"}},
+		{"all of them needs every string", "Sub AutoExec()", nil},
+		{"nibble wildcard counted", "\xde\xad\xbe\xef \xde\xad\xb0\xef \xde\xad\xbf\xef", []string{"Repeated_Marker"}},
+		{"count too low", "\xde\xad\xbe\xef \xde\xad\xce\xef \xde\xad\xbf\xef", nil},
+		{"filesize too large", strings.Repeat("\xde\xad\xbe\xef", 300), nil},
+		{"n of set with not", "alpha beta", []string{"Any_Two"}},
+		{"n of set excluded", "alpha beta gamma", nil},
+		{"several rules in order", "Shell( AutoOpen alpha beta MZ\x00\x00dropper", []string{"InHouse_Dropper", "Macro_Loader", "Any_Two"}},
+		{"clean", "nothing to see here", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ruleNames(t, set, strings.NewReader(tt.payload)))
+			// Strings split across chunks are found all the same
+			assert.Equal(t, tt.want, ruleNames(t, set, iotest.OneByteReader(strings.NewReader(tt.payload))))
+		})
+	}
+}
+
+func TestRuleMatchingAcrossChunks(t *testing.T) {
+	set := mustCompileRules(t, `
+rule Split
+{
+    strings:
+        $hex = { 00 11 ?? ?? 44 55 66 }
+        $re = /begin[0-9]+end/
+    condition:
+        $hex and $re
+}`)
+	payload := bytes.Repeat([]byte("x"), 100000)
+	copy(payload[32760:], "\x00\x11\x22\x33\x44\x55\x66")
+	copy(payload[65530:], "begin123456end")
+
+	assert.Equal(t, []string{"Split"}, ruleNames(t, set, bytes.NewReader(payload)))
+	// A hex string cut off by the end of the payload does not match
+	assert.Nil(t, ruleNames(t, set, bytes.NewReader(payload[:32765])))
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{"no condition", `rule A { strings: $a = "x" }`, `line 1: expected "condition:"`},
+		{"undefined string", "rule A {\n condition:\n  $b\n}", `line 3: undefined string $b`},
+		{"duplicate string", `rule A { strings: $a = "x" $a = "y" condition: $a }`, "string $a is defined more than once"},
+		{"hex jump", `rule A { strings: $a = { 4D [2-4] 5A } condition: $a }`, "jumps and alternatives are not supported"},
+		{"hex all wildcards", `rule A { strings: $a = { ?? ?? } condition: $a }`, "at least one byte without wildcards"},
+		{"hex half byte", `rule A { strings: $a = { 4D 5 } condition: $a }`, "whole bytes"},
+		{"hex modifier", `rule A { strings: $a = { 4D 5A } nocase condition: $a }`, "hex strings take no modifiers"},
+		{"bad regex", `rule A { strings: $a = /a(b/ condition: $a }`, "missing closing )"},
+		{"empty regex match", `rule A { strings: $a = /x*/ condition: $a }`, "regex matches empty data"},
+		{"regex start anchor", `rule A { strings: $a = /^MZ/ condition: $a }`, "anchors and word boundaries are not supported"},
+		{"regex text anchor", `rule A { strings: $a = /(a|\Ab)c/ condition: $a }`, "anchors and word boundaries are not supported"},
+		{"regex end anchor", `rule A { strings: $a = /end$/ condition: $a }`, "anchors and word boundaries are not supported"},
+		{"regex word boundary", `rule A { strings: $a = /\bcmd/ condition: $a }`, "anchors and word boundaries are not supported"},
+		{"unknown modifier", `rule A { strings: $a = "x" fullword condition: $a }`, "unsupported modifier fullword"},
+		{"unterminated string", `rule A { strings: $a = "x condition: $a }`, "unterminated string"},
+		{"too many of", `rule A { strings: $a = "x" condition: 2 of them }`, "2 of 1 strings can never match"},
+		{"bad comparison", `rule A { strings: $a = "x" condition: #a = 2 }`, "expected a comparison after $a"},
+		{"missing brace", `rule A { condition: true`, `expected "}", got end of file`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRules("test.yar", tt.src)
+			var ruleErr *RuleError
+			require.ErrorAs(t, err, &ruleErr)
+			assert.Contains(t, err.Error(), "rule file test.yar: ")
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadRuleFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(src), 0600))
+		return path
+	}
+	write("a.yar", `rule A : first { strings: $a = "alpha" condition: $a }`)
+	write("b.yar", `rule B { condition: filesize > 0 }`)
+
+	set, err := loadRuleFiles([]string{filepath.Join(dir, "*.yar")})
+	require.NoError(t, err)
+	require.Len(t, set.Rules, 2)
+	assert.Equal(t, "A", set.Rules[0].Name)
+	assert.Equal(t, []string{"first"}, set.Rules[0].Tags)
+	assert.Equal(t, filepath.Join(dir, "a.yar"), set.Rules[0].File)
+
+	again, err := loadRuleFiles([]string{filepath.Join(dir, "*.yar")})
+	require.NoError(t, err)
+	assert.Equal(t, set, again, "unchanged files compare equal on reload")
+
+	duplicate := write("c.rules", `rule A { condition: true }`)
+	_, err = loadRuleFiles([]string{filepath.Join(dir, "*.yar"), duplicate})
+	assert.ErrorContains(t, err, "rule A is already defined in")
+
+	_, err = loadRuleFiles([]string{filepath.Join(dir, "*.missing")})
+	assert.ErrorContains(t, err, "no such file")
+}
+
+func TestScanWithRulesEngine(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	origEngines, origRules := config.Engines, config.Rules
+	config.Engines, config.Rules = []string{engineClamd, engineRules}, mustCompileRules(t, testRules)
+	t.Cleanup(func() { config.Engines, config.Rules = origEngines, origRules })
+	payload := "Sub AutoOpen()\n Shell(\"powershell\")"
+
+	before := getCounterValue(t, ruleMatchesTotal, "test.yar")
+	result, err := performScan(context.Background(), strings.NewReader(payload), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", result.Status)
+	assert.Equal(t, "Macro_Loader", result.Description)
+	assert.Equal(t, []RuleMatch{{Rule: "Macro_Loader", Tags: []string{"office"}}}, result.Matches)
+	require.Len(t, result.Engines, 2)
+	assert.Equal(t, "OK", result.Engines[0].Status)
+	assert.Equal(t, result.Matches, result.Engines[1].Matches)
+	assert.Equal(t, before+1, getCounterValue(t, ruleMatchesTotal, "test.yar"))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/stream-scan", handleStreamScan)
+	req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", strings.NewReader(payload))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"matches":[{"rule":"Macro_Loader","tags":["office"]}]`)
+
+	client := getTestClient(t)
+	resp, err := client.ScanFile(context.Background(), &pb.ScanFileRequest{Data: []byte(payload), Filename: "invoice.docm"})
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", resp.Status)
+	require.Len(t, resp.Matches, 1)
+	assert.Equal(t, "Macro_Loader", resp.Matches[0].Rule)
+	assert.Equal(t, []string{"office"}, resp.Matches[0].Tags)
+	require.Len(t, resp.Engines, 2)
+	assert.Len(t, resp.Engines[1].Matches, 1)
+}
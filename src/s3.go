@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Error is an error response returned by the object store
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 %s (HTTP %d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// S3Object is an object body being streamed from the store
+type S3Object struct {
+	Body        io.ReadCloser
+	Size        int64
+	ETag        string
+	ContentType string
+	Metadata    map[string]string
+}
+
+// S3Client is a minimal S3-compatible client signing requests with AWS
+// Signature Version 4. It covers only the calls the scanner needs.
+type S3Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3Client creates a client for the S3-compatible endpoint in cfg
+func NewS3Client(cfg *Config) (*S3Client, error) {
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", cfg.S3Endpoint, err)
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint must be an http or https URL, got %q", cfg.S3Endpoint)
+	}
+	return &S3Client{
+		endpoint:   endpoint,
+		region:     cfg.S3Region,
+		accessKey:  cfg.S3AccessKey,
+		secretKey:  cfg.S3SecretKey,
+		pathStyle:  cfg.S3PathStyle,
+		httpClient: &http.Client{},
+		now:        time.Now,
+	}, nil
+}
+
+// GetObject starts streaming an object. The caller must close the body.
+func (c *S3Client) GetObject(ctx context.Context, bucket, key string) (*S3Object, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &S3Object{
+		Body:        resp.Body,
+		Size:        resp.ContentLength,
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Metadata:    make(map[string]string),
+	}
+	for name, values := range resp.Header {
+		if meta, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok && len(values) > 0 {
+			obj.Metadata[meta] = values[0]
+		}
+	}
+	return obj, nil
+}
+
+// s3Tagging is the XML document used by the object tagging API
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// GetObjectTagging returns the tags currently set on an object
+func (c *S3Client) GetObjectTagging(ctx context.Context, bucket, key string) (map[string]string, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, url.Values{"tagging": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tagging s3Tagging
+	if err := xml.NewDecoder(resp.Body).Decode(&tagging); err != nil {
+		return nil, fmt.Errorf("invalid tagging response: %w", err)
+	}
+	tags := make(map[string]string, len(tagging.TagSet))
+	for _, tag := range tagging.TagSet {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+// PutObjectTagging replaces the tag set of an object
+func (c *S3Client) PutObjectTagging(ctx context.Context, bucket, key string, tags map[string]string) error {
+	tagging := s3Tagging{}
+	for _, k := range sortedKeys(tags) {
+		tagging.TagSet = append(tagging.TagSet, s3Tag{Key: k, Value: tags[k]})
+	}
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, url.Values{"tagging": {""}}, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3CopyResult is the response body of a CopyObject call
+type s3CopyResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// CopyObject copies an object server-side and returns the new ETag. A
+// non-nil metadata map replaces the destination's metadata and content type.
+func (c *S3Client) CopyObject(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey, contentType string, metadata map[string]string) (string, error) {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+srcBucket+"/"+s3EscapePath(srcKey))
+	if metadata != nil {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		for k, v := range metadata {
+			header.Set("X-Amz-Meta-"+k, v)
+		}
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, dstBucket, dstKey, nil, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a copy failure in a 200 response body
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return "", parseS3Error(resp.StatusCode, data)
+	}
+	var result s3CopyResult
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("invalid copy response: %w", err)
+	}
+	return result.ETag, nil
+}
+
+// do sends a signed request and converts non-2xx responses to *S3Error
+func (c *S3Client) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	escapedPath := strings.TrimSuffix(u.EscapedPath(), "/")
+	if c.pathStyle {
+		escapedPath += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	escapedPath += "/" + s3EscapePath(key)
+
+	u.Path, _ = url.PathUnescape(escapedPath)
+	u.RawPath = escapedPath
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	if body == nil {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, escapedPath, c.accessKey, c.secretKey, c.region, "s3", payloadHash, c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return nil, parseS3Error(resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+func parseS3Error(status int, data []byte) error {
+	s3Err := &S3Error{StatusCode: status}
+	xml.Unmarshal(data, s3Err)
+	return s3Err
+}
+
+// signV4 adds AWS Signature Version 4 headers to req. The host,
+// content-type and x-amz-* headers are signed.
+func signV4(req *http.Request, canonicalURI, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.Join(values, ",")
+		}
+	}
+	names := sortedKeys(headers)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes an object key for use in a URL path,
+// leaving "/" separators intact
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Escape percent-encodes everything except RFC 3986 unreserved characters
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name as SigV4 requires
+func s3CanonicalQuery(query url.Values) string {
+	parts := make([]string, 0, len(query))
+	for _, k := range sortedKeys(query) {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// S3 verdict modes
+const (
+	s3VerdictTags     = "tags"
+	s3VerdictMetadata = "metadata"
+	s3VerdictNone     = "none"
+)
+
+// Tag and metadata keys the verdict is written under
+const (
+	s3VerdictStatusKey    = "clamav-status"
+	s3VerdictSignatureKey = "clamav-signature"
+	s3VerdictScannedAtKey = "clamav-scanned-at"
+)
+
+// errObjectStorage marks failures talking to the object store rather than clamd
+var errObjectStorage = errors.New("object storage error")
+
+// errBucketNotAllowed rejects buckets missing from S3AllowedBuckets
+var errBucketNotAllowed = errors.New("bucket is not allowed")
+
+// ownWriteTTL bounds how long an in-place metadata copy is remembered so
+// the notification it triggers is not scanned again
+const ownWriteTTL = 10 * time.Minute
+
+// validS3VerdictMode reports whether mode is a supported verdict mode
+func validS3VerdictMode(mode string) bool {
+	switch mode {
+	case s3VerdictTags, s3VerdictMetadata, s3VerdictNone:
+		return true
+	}
+	return false
+}
+
+// S3ScanResult is the outcome of scanning one object
+type S3ScanResult struct {
+	Bucket      string
+	Key         string
+	Size        int64
+	Result      *ScanResult
+	Quarantined bool
+}
+
+// S3Scanner streams objects from an S3-compatible store into clamd and
+// writes the verdict back to the object.
+type S3Scanner struct {
+	config *liveConfig
+	client atomic.Pointer[S3Client]
+	scan   scanFunc
+	now    func() time.Time
+
+	mu        sync.Mutex
+	ownWrites map[string]time.Time
+}
+
+// NewS3Scanner creates a scanner for the object store configured in cfg
+func NewS3Scanner(cfg *Config) (*S3Scanner, error) {
+	client, err := NewS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	live := newLiveConfig(cfg)
+	s := &S3Scanner{
+		config:    live,
+		scan:      live.scan,
+		now:       time.Now,
+		ownWrites: make(map[string]time.Time),
+	}
+	s.client.Store(client)
+	return s, nil
+}
+
+// Reload applies a reloaded configuration. The client is rebuilt so new
+// credentials and signing settings take effect; the endpoint is kept.
+func (s *S3Scanner) Reload(cfg *Config) error {
+	client, err := NewS3Client(cfg)
+	if err != nil {
+		return err
+	}
+	s.client.Store(client)
+	s.config.Store(cfg)
+	return nil
+}
+
+// countingReader tracks how much was read and the first read error, since
+// the clamd client treats any read error as end of stream
+type countingReader struct {
+	reader io.Reader
+	n      int64
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// bucketAllowed reports whether bucket is one of S3AllowedBuckets
+func (s *S3Scanner) bucketAllowed(bucket string) bool {
+	return slices.Contains(s.config.Load().S3AllowedBuckets, bucket)
+}
+
+// ScanObject streams bucket/key into clamd without buffering it, records
+// the verdict on the object and copies infected objects to the quarantine
+// bucket when one is configured. Buckets missing from S3AllowedBuckets
+// fail with errBucketNotAllowed before the object is read.
+func (s *S3Scanner) ScanObject(ctx context.Context, bucket, key string) (*S3ScanResult, error) {
+	logger := loggerFromContext(ctx)
+	maxSize := s.config.Load().MaxContentLength
+
+	if !s.bucketAllowed(bucket) {
+		return nil, errBucketNotAllowed
+	}
+
+	obj, err := s.client.Load().GetObject(ctx, bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errObjectStorage, err)
+	}
+	defer obj.Body.Close()
+
+	if obj.Size > maxSize {
+		return nil, errPayloadTooLarge
+	}
+
+	reader := &countingReader{reader: io.LimitReader(obj.Body, maxSize+1)}
+	scansInProgress.Inc()
+	result, err := s.scan(withScanFilename(ctx, "s3://"+bucket+"/"+key), reader)
+	scansInProgress.Dec()
+
+	// A short or failed read would otherwise be reported as a clean scan
+	switch {
+	case err != nil:
+	case reader.err != nil:
+		err = fmt.Errorf("%w: failed to read object: %w", errObjectStorage, reader.err)
+	case reader.n > maxSize:
+		err = errPayloadTooLarge
+	case obj.Size >= 0 && reader.n != obj.Size:
+		err = fmt.Errorf("%w: failed to read object: got %d of %d bytes", errObjectStorage, reader.n, obj.Size)
+	}
+	if errors.Is(err, errPayloadTooLarge) {
+		return nil, err
+	}
+	recordScanMetrics("s3", result, err)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned := &S3ScanResult{Bucket: bucket, Key: key, Size: reader.n, Result: result}
+
+	if err := s.writeVerdict(ctx, bucket, key, obj, result); err != nil {
+		logger.Error("Failed to record S3 verdict",
+			zap.String("bucket", bucket),
+			zap.String("key", key),
+			zap.String("status", result.Status),
+			zap.String("result", result.Description),
+			zap.Error(err))
+		return nil, fmt.Errorf("%w: failed to record verdict: %w", errObjectStorage, err)
+	}
+
+	if result.Blocked() && s.config.Load().S3QuarantineBucket != "" {
+		if _, err := s.client.Load().CopyObject(ctx, bucket, key, s.config.Load().S3QuarantineBucket, key, "", nil); err != nil {
+			logger.Error("Failed to copy infected object to quarantine",
+				zap.String("bucket", bucket),
+				zap.String("key", key),
+				zap.String("quarantine_bucket", s.config.Load().S3QuarantineBucket),
+				zap.Error(err))
+			return nil, fmt.Errorf("%w: failed to quarantine object: %w", errObjectStorage, err)
+		}
+		scanned.Quarantined = true
+	}
+
+	logger.Info("S3 object scanned",
+		zap.String("bucket", bucket),
+		zap.String("key", key),
+		zap.Int64("size", scanned.Size),
+		zap.String("status", result.Status),
+		zap.String("result", result.Description),
+		zap.Bool("quarantined", scanned.Quarantined),
+		zap.Float64("elapsed_seconds", result.ScanTime))
+
+	return scanned, nil
+}
+
+// writeVerdict stores the scan result as object tags or metadata
+func (s *S3Scanner) writeVerdict(ctx context.Context, bucket, key string, obj *S3Object, result *ScanResult) error {
+	verdict := map[string]string{
+		s3VerdictStatusKey:    result.Status,
+		s3VerdictScannedAtKey: s.now().UTC().Format(time.RFC3339),
+	}
+	if result.Status == "FOUND" {
+		verdict[s3VerdictSignatureKey] = s3SafeValue(result.Description)
+	}
+
+	switch s.config.Load().S3VerdictMode {
+	case s3VerdictTags:
+		// PutObjectTagging replaces the whole set, so keep unrelated tags
+		tags, err := s.client.Load().GetObjectTagging(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		delete(tags, s3VerdictSignatureKey)
+		for k, v := range verdict {
+			tags[k] = v
+		}
+		return s.client.Load().PutObjectTagging(ctx, bucket, key, tags)
+
+	case s3VerdictMetadata:
+		// Metadata can only be changed by copying the object onto itself
+		metadata := make(map[string]string, len(obj.Metadata)+len(verdict))
+		for k, v := range obj.Metadata {
+			if k != s3VerdictSignatureKey {
+				metadata[k] = v
+			}
+		}
+		for k, v := range verdict {
+			metadata[k] = v
+		}
+		etag, err := s.client.Load().CopyObject(ctx, bucket, key, bucket, key, obj.ContentType, metadata)
+		if err != nil {
+			return err
+		}
+		s.rememberOwnWrite(bucket, key, etag)
+		return nil
+	}
+	return nil
+}
+
+// rememberOwnWrite records an object version created by writeVerdict
+func (s *S3Scanner) rememberOwnWrite(bucket, key, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for k, expires := range s.ownWrites {
+		if now.After(expires) {
+			delete(s.ownWrites, k)
+		}
+	}
+	s.ownWrites[bucket+"/"+key+"@"+strings.Trim(etag, `"`)] = now.Add(ownWriteTTL)
+}
+
+// isOwnWrite reports whether an event was caused by writeVerdict
+func (s *S3Scanner) isOwnWrite(bucket, key, etag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.ownWrites[bucket+"/"+key+"@"+strings.Trim(etag, `"`)]
+	return ok && s.now().Before(expires)
+}
+
+// s3SafeValue replaces characters S3 does not allow in tag values
+func s3SafeValue(value string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return '_'
+	}, value)
+	if len(safe) > 256 {
+		safe = safe[:256]
+	}
+	return safe
+}
+
+// handleScanObject scans a single object named in the request body
+func (s *S3Scanner) handleScanObject(c *gin.Context) {
+	logger := requestLogger(c)
+
+	var req struct {
+		Bucket string `json:"bucket"`
+		Key    string `json:"key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Bucket == "" || req.Key == "" {
+		recordRejection(transportREST, rejectInvalid)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "bucket and key are required", "request_id": requestID(c)})
+		return
+	}
+
+	scanned, err := s.ScanObject(c.Request.Context(), req.Bucket, req.Key)
+	if err != nil {
+		s.respondError(c, logger, err, req.Bucket, req.Key)
+		return
+	}
+
+	c.JSON(http.StatusOK, withScanDetails(gin.H{
+		"status":      scanned.Result.Status,
+		"message":     scanned.Result.Description,
+		"time":        scanned.Result.ScanTime,
+		"action":      scanned.Result.Action,
+		"policy":      scanned.Result.Policy,
+		"bucket":      scanned.Bucket,
+		"key":         scanned.Key,
+		"size":        scanned.Size,
+		"quarantined": scanned.Quarantined,
+		"request_id":  requestID(c),
+	}, scanned.Result))
+}
+
+// s3EventNotification is the subset of an S3/MinIO event notification we use
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// handleEvents scans the objects named in an S3 event notification webhook.
+// It answers 502 if any object could not be scanned so the sender retries.
+// The webhook is disabled while no webhook token is configured.
+func (s *S3Scanner) handleEvents(c *gin.Context) {
+	logger := requestLogger(c)
+
+	token := s.config.Load().S3WebhookToken
+	if token == "" {
+		c.JSON(http.StatusNotFound, gin.H{"message": "S3 event webhook is disabled", "request_id": requestID(c)})
+		return
+	}
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		logger.Warn("S3 event webhook rejected: invalid token",
+			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectUnauthorized)
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "invalid webhook token", "request_id": requestID(c)})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 1<<20)
+	var event s3EventNotification
+	if err := c.ShouldBindJSON(&event); err != nil {
+		recordRejection(transportREST, rejectInvalid)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid event notification", "request_id": requestID(c)})
+		return
+	}
+
+	// The whole notification is refused if it names a bucket the scanner
+	// may not touch, before any object is scanned
+	for _, record := range event.Records {
+		bucket := record.S3.Bucket.Name
+		if s.scannable(record.EventName, bucket) && !s.bucketAllowed(bucket) {
+			logger.Warn("S3 event webhook rejected: bucket not allowed",
+				zap.String("bucket", bucket),
+				zap.String("client_ip", c.ClientIP()))
+			recordRejection(transportREST, rejectUnauthorized)
+			c.JSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("bucket %q is not allowed", bucket), "request_id": requestID(c)})
+			return
+		}
+	}
+
+	failed := false
+	results := make([]gin.H, 0, len(event.Records))
+	for _, record := range event.Records {
+		bucket := record.S3.Bucket.Name
+		// Keys in notifications are URL-encoded with '+' for spaces
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+
+		if !s.scannable(record.EventName, bucket) || s.isOwnWrite(bucket, key, record.S3.Object.ETag) {
+			logger.Debug("S3 event ignored",
+				zap.String("event", record.EventName),
+				zap.String("bucket", bucket),
+				zap.String("key", key))
+			continue
+		}
+
+		scanned, err := s.ScanObject(c.Request.Context(), bucket, key)
+		if err != nil {
+			logger.Error("S3 event scan failed",
+				zap.String("bucket", bucket),
+				zap.String("key", key),
+				zap.Error(err))
+			failed = true
+			results = append(results, gin.H{
+				"bucket":  bucket,
+				"key":     key,
+				"status":  "ERROR",
+				"message": err.Error(),
+			})
+			continue
+		}
+		results = append(results, gin.H{
+			"bucket":      bucket,
+			"key":         key,
+			"status":      scanned.Result.Status,
+			"message":     scanned.Result.Description,
+			"time":        scanned.Result.ScanTime,
+			"action":      scanned.Result.Action,
+			"quarantined": scanned.Quarantined,
+		})
+	}
+
+	status := http.StatusOK
+	if failed {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, gin.H{"results": results, "request_id": requestID(c)})
+}
+
+// scannable reports whether an event is an object creation outside the
+// quarantine bucket
+func (s *S3Scanner) scannable(eventName, bucket string) bool {
+	return strings.Contains(eventName, "ObjectCreated:") && bucket != s.config.Load().S3QuarantineBucket
+}
+
+// respondError maps S3 and scan errors to HTTP responses
+func (s *S3Scanner) respondError(c *gin.Context, logger *zap.Logger, err error, bucket, key string) {
+	var s3Err *S3Error
+	switch {
+	case errors.Is(err, errPayloadTooLarge):
+		logger.Warn("S3 scan rejected: object too large",
+			zap.String("bucket", bucket),
+			zap.String("key", key),
+			zap.Int64("max_allowed", s.config.Load().MaxContentLength))
+		recordRejection(transportREST, rejectTooLarge)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", s.config.Load().MaxContentLength),
+			"request_id": requestID(c),
+		})
+	case errors.Is(err, errBucketNotAllowed):
+		logger.Warn("S3 scan rejected: bucket not allowed",
+			zap.String("bucket", bucket),
+			zap.String("key", key))
+		recordRejection(transportREST, rejectUnauthorized)
+		c.JSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("bucket %q is not allowed", bucket), "request_id": requestID(c)})
+	case errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"message": "object not found", "request_id": requestID(c)})
+	case errors.Is(err, errObjectStorage):
+		logger.Error("S3 request failed",
+			zap.String("bucket", bucket),
+			zap.String("key", key),
+			zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status":     "Object storage error",
+			"message":    err.Error(),
+			"request_id": requestID(c),
+		})
+	default:
+		respondScanError(c, logger, err, key)
+	}
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 // ScanResult holds the outcome of a ClamAV scan
@@ -12,6 +17,26 @@ type ScanResult struct {
 	Status      string
 	Description string
 	ScanTime    float64
+	Size        int64
+	// FileType is the media type detected from the start of the payload
+	FileType string
+	// Action is what the caller's Policy does with the result: allow,
+	// warn or block
+	Action string
+	Policy string
+	// Override is the allowlist entry that cleared a detection, if any
+	Override *AllowlistOverride
+	// Engines holds each engine's verdict when several engines scanned
+	Engines []EngineVerdict
+	// Matches are the rules the rules engine matched
+	Matches []RuleMatch
+	// Reputation is the hash list entry that decided the verdict, if any
+	Reputation *HashListHit
+}
+
+// Blocked reports whether the result is a detection its policy blocks
+func (r *ScanResult) Blocked() bool {
+	return r.Status == "FOUND" && actionRank(r.Action) == actionRank(actionBlock)
 }
 
 // ScanTimeoutError indicates the scan exceeded the configured timeout
@@ -33,9 +58,114 @@ func (e *ScanEngineError) Error() string {
 	return e.Description
 }
 
-// performScan executes a ClamAV scan on the given reader.
-// It respects both the configured timeout and context cancellation.
-func performScan(ctx context.Context, reader io.Reader, timeout time.Duration) (*ScanResult, error) {
+// performScan executes a scan of the given reader with the configured
+// engines. It respects both the configured timeout and context
+// cancellation, and logs through the request's logger carried by ctx. The
+// scan is traced as a clamav.scan span; the clamd engine adds
+// clamd.connect, scan.body_receive and clamd.verdict children. The scan
+// is tracked by scanTracker: it fails with errServerDraining once shutdown
+// has begun, and with a ScanCanceledError when shutdown cancels it. A hash
+// on a hash list decides the verdict without the engines. The allowlist
+// may clear a detection, and the caller's policy sets the action of the
+// result.
+func performScan(ctx context.Context, reader io.Reader, timeout time.Duration) (result *ScanResult, err error) {
+	ctx, tracked, err := scanTracker.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer scanTracker.end(tracked)
+
+	ctx, span := tracer().Start(ctx, "clamav.scan")
+	defer func() { endScanSpan(span, result, err) }()
+
+	startTime := time.Now()
+
+	// Files are only hashed with the algorithms the allowlist and the hash
+	// lists use
+	var source io.Reader = &scanReader{ctx: ctx, scan: tracked, reader: reader}
+	listsSHA256, listsMD5 := hashReputation.algorithms()
+	var sha256Digest, md5Digest hash.Hash
+	if listsSHA256 || allowlist.hasHashes() {
+		sha256Digest = sha256.New()
+		source = io.TeeReader(source, sha256Digest)
+	}
+	if listsMD5 {
+		md5Digest = md5.New()
+		source = io.TeeReader(source, md5Digest)
+	}
+	sniff := &sniffReader{reader: source}
+
+	verdict, hit, err := scanWithReputation(ctx, sniff, timeout, listsSHA256 || listsMD5, sha256Digest, md5Digest)
+	size := tracked.bytes.Load()
+	span.SetAttributes(attrScanSize.Int64(size))
+	if err != nil {
+		return nil, err
+	}
+
+	scanned := &ScanResult{
+		Status:      verdict.Status,
+		Description: verdict.Description,
+		ScanTime:    time.Since(startTime).Seconds(),
+		Size:        size,
+		FileType:    sniff.fileType(),
+		Engines:     verdict.Engines,
+		Matches:     verdict.Matches,
+		Reputation:  hit,
+	}
+	applyAllowlist(ctx, scanned, hexSum(sha256Digest))
+	applyPolicy(ctx, scanned)
+	return scanned, nil
+}
+
+// scanWithReputation runs the engines on r, unless hash lists are loaded
+// and list the payload. To check them before the engines, the payload is
+// spooled while it is hashed, like other buffered payloads, and only
+// replayed to the engines when it is on no list. A payload over
+// MaxContentLength fails with errPayloadTooLarge.
+func scanWithReputation(ctx context.Context, r io.Reader, timeout time.Duration, lists bool, sha256Digest, md5Digest hash.Hash) (*EngineVerdict, *HashListHit, error) {
+	cfg := currentConfig()
+	engine := newScanEngine(cfg)
+	if !lists {
+		verdict, err := engine.Scan(ctx, r, timeout)
+		return verdict, nil, err
+	}
+
+	spool, err := spoolReader(r, cfg.MaxContentLength, cfg.SpoolThreshold, cfg.SpoolDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer spool.Close()
+
+	if hit := hashReputation.lookup(hexSum(sha256Digest), hexSum(md5Digest)); hit != nil {
+		hashListHitsTotal.WithLabelValues(hit.List, hit.Action).Inc()
+		loggerFromContext(ctx).Info("Payload hash is on a hash list, skipping the scan engines",
+			zap.String("list", hit.List),
+			zap.String("action", hit.Action),
+			zap.String("hash", hit.Hash),
+			zap.String("label", hit.Label))
+		return hit.verdict(), hit, nil
+	}
+
+	payload, err := spool.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	verdict, err := engine.Scan(ctx, payload, timeout)
+	return verdict, nil, err
+}
+
+// clamdEngine scans with the configured clamd
+type clamdEngine struct{}
+
+// Name implements ScanEngine
+func (clamdEngine) Name() string {
+	return engineClamd
+}
+
+// Scan implements ScanEngine. The timeout starts once the payload has
+// been sent to clamd.
+func (clamdEngine) Scan(ctx context.Context, reader io.Reader, timeout time.Duration) (*EngineVerdict, error) {
+	logger := loggerFromContext(ctx)
 	clam := getClamdClient()
 
 	startTime := time.Now()
@@ -43,14 +173,28 @@ func performScan(ctx context.Context, reader io.Reader, timeout time.Duration) (
 	done := make(chan bool)
 	defer close(done)
 
-	response, err := clam.ScanStream(reader, done)
+	body := newScanSpanReader(ctx, reader)
+	response, err := clam.ScanStream(body, done)
+	body.finish(err)
 	if err != nil {
+		logger.Debug("clamd scan could not start", zap.Error(err))
 		return nil, fmt.Errorf("clamd unavailable: %w", err)
 	}
 
+	// A scan canceled while its body was sent only has a verdict on part of it
+	if cause := context.Cause(ctx); cause != nil {
+		go func() { for range response {} }()
+		logger.Debug("Abandoning clamd scan: canceled while sending the body",
+			zap.Error(cause))
+		return nil, cause
+	}
+
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
+	_, wait := tracer().Start(ctx, "clamd.verdict")
+	defer wait.End()
+
 	select {
 	case result := <-response:
 		elapsed := time.Since(startTime).Seconds()
@@ -62,7 +206,8 @@ func performScan(ctx context.Context, reader io.Reader, timeout time.Duration) (
 			}
 		}
 
-		return &ScanResult{
+		return &EngineVerdict{
+			Engine:      engineClamd,
 			Status:      result.Status,
 			Description: result.Description,
 			ScanTime:    elapsed,
@@ -70,10 +215,14 @@ func performScan(ctx context.Context, reader io.Reader, timeout time.Duration) (
 
 	case <-timer.C:
 		go func() { for range response {} }()
+		logger.Debug("Abandoning clamd scan: timeout",
+			zap.Duration("timeout", timeout))
 		return nil, &ScanTimeoutError{Timeout: timeout}
 
 	case <-ctx.Done():
 		go func() { for range response {} }()
-		return nil, ctx.Err()
+		logger.Debug("Abandoning clamd scan: request ended",
+			zap.Error(context.Cause(ctx)))
+		return nil, context.Cause(ctx)
 	}
 }
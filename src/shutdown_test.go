@@ -83,7 +83,8 @@ func TestGRPCServerGracefulShutdown(t *testing.T) {
 	}()
 
 	errChan := make(chan error, 1)
-	srv := startGRPCServer(errChan)
+	srv, grpcHealth := startGRPCServer(errChan)
+	defer grpcHealth.Shutdown()
 	assert.NotNil(t, srv)
 
 	// Give the server time to start
@@ -126,7 +127,8 @@ func TestGRPCServerGracefulShutdownCompletesWithinTimeout(t *testing.T) {
 	}()
 
 	errChan := make(chan error, 1)
-	srv := startGRPCServer(errChan)
+	srv, grpcHealth := startGRPCServer(errChan)
+	defer grpcHealth.Shutdown()
 	assert.NotNil(t, srv)
 
 	time.Sleep(100 * time.Millisecond)
@@ -158,8 +160,9 @@ func TestStartGRPCServerWithInvalidPort(t *testing.T) {
 	}()
 
 	errChan := make(chan error, 1)
-	srv := startGRPCServer(errChan)
+	srv, grpcHealth := startGRPCServer(errChan)
 	assert.Nil(t, srv, "Server should be nil when port is invalid")
+	assert.Nil(t, grpcHealth)
 
 	// Should receive an error
 	select {
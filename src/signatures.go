@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureFilePrefix marks the files in the clamd database directory that
+// the admin API manages, named clamav-api.<set>.<name>.<ext>
+const signatureFilePrefix = "clamav-api."
+
+// signatureFormats are the database formats custom signatures may use:
+// extended body (.ndb), MD5 (.hdb), SHA-1/SHA-256 (.hsb) and logical (.ldb)
+var signatureFormats = map[string]func(line string) error{
+	"ndb": validateNDB,
+	"hdb": func(line string) error { return validateHashSignature(line, 32) },
+	"hsb": func(line string) error { return validateHashSignature(line, 40, 64) },
+	"ldb": validateLDB,
+}
+
+var (
+	signatureNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	signatureFilePattern = regexp.MustCompile(`^clamav-api\.([A-Za-z0-9_-]+)\.([A-Za-z0-9_-]+)\.(ndb|hdb|hsb|ldb)$`)
+	signatureOffset      = regexp.MustCompile(`^(\*|VI|(EP[+-]|EOF-|SL\+|S\d+\+|SE\d+)?\d+(,\d+)?)$`)
+	signatureJump        = regexp.MustCompile(`^(\d+|-\d+|\d+-|\d+-\d+)$`)
+	signatureHex         = regexp.MustCompile(`^[0-9a-fA-F?]*$`)
+	logicalExpression    = regexp.MustCompile(`^[0-9&|()=<>,]+$`)
+	logicalIndex         = regexp.MustCompile(`\d+`)
+)
+
+// ldbTargetKeys are the keys a logical signature's target description
+// block may use
+var ldbTargetKeys = map[string]bool{
+	"Engine": true, "Target": true, "FileSize": true, "EntryPoint": true,
+	"NumberOfSections": true, "Container": true, "Intermediates": true,
+	"IconGroup1": true, "IconGroup2": true, "HandlerType": true,
+}
+
+// SignatureFile is an installed custom signature file
+type SignatureFile struct {
+	Set        string    `json:"set"`
+	Name       string    `json:"name"`
+	Signatures int       `json:"signatures"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// SignatureSet groups the custom signature files installed under a name
+type SignatureSet struct {
+	Name       string          `json:"name"`
+	Signatures int             `json:"signatures"`
+	Files      []SignatureFile `json:"files"`
+}
+
+// SignatureError is a syntax error in an uploaded signature file
+type SignatureError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e SignatureError) String() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// SignatureValidationError lists the syntax errors that kept a signature
+// file from being installed
+type SignatureValidationError struct {
+	Errors []SignatureError
+}
+
+func (e *SignatureValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return "invalid signature file: " + e.Errors[0].String()
+	}
+	return fmt.Sprintf("invalid signature file: %s (and %d more errors)", e.Errors[0], len(e.Errors)-1)
+}
+
+// DatabaseState is what clamd reports after a reload
+type DatabaseState struct {
+	Version          string `json:"version"`
+	DatabaseVersion  string `json:"database_version"`
+	CustomSignatures int    `json:"custom_signatures"`
+}
+
+// SignatureReloadError is a signature change that was written to disk but
+// that clamd failed to load
+type SignatureReloadError struct {
+	Err error
+}
+
+func (e *SignatureReloadError) Error() string {
+	return "signatures changed but clamd reload failed: " + e.Err.Error()
+}
+
+func (e *SignatureReloadError) Unwrap() error {
+	return e.Err
+}
+
+// errSignatureNotFound is reported when deleting a file or set that is not
+// installed
+var errSignatureNotFound = errors.New("not installed")
+
+// signatureMu serializes signature changes and the reloads that follow
+var signatureMu sync.Mutex
+
+// parseSignatureFileName splits a file name such as incident-42.ndb into
+// its name and format
+func parseSignatureFileName(file string) (string, string, error) {
+	name, ext, ok := strings.Cut(file, ".")
+	if !ok || signatureFormats[ext] == nil {
+		return "", "", fmt.Errorf("file must end in .ndb, .hdb, .hsb or .ldb, got %q", file)
+	}
+	if !signatureNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("file name must be 1-64 letters, digits, '-' or '_', got %q", name)
+	}
+	return name, ext, nil
+}
+
+// validateSignatureSetName checks the name of a signature set
+func validateSignatureSetName(set string) error {
+	if !signatureNamePattern.MatchString(set) {
+		return fmt.Errorf("set name must be 1-64 letters, digits, '-' or '_', got %q", set)
+	}
+	return nil
+}
+
+// validateSignatures syntax-checks a signature file of the given format.
+// It returns the file as it is installed, with surrounding whitespace and
+// blank lines removed, and the number of signatures.
+func validateSignatures(format string, data []byte) ([]byte, int, []SignatureError) {
+	validate := signatureFormats[format]
+	var normalized bytes.Buffer
+	var errs []SignatureError
+	count := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := validate(line); err != nil {
+			errs = append(errs, SignatureError{Line: n, Message: err.Error()})
+			continue
+		}
+		normalized.WriteString(line)
+		normalized.WriteByte('\n')
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, SignatureError{Message: err.Error()})
+	}
+	if count == 0 && len(errs) == 0 {
+		errs = append(errs, SignatureError{Message: "file has no signatures"})
+	}
+	return normalized.Bytes(), count, errs
+}
+
+// validateHashSignature checks a HashString:FileSize:MalwareName line
+// whose hash has one of the given lengths in hex digits
+func validateHashSignature(line string, hashLengths ...int) error {
+	fields := strings.Split(line, ":")
+	if len(fields) < 3 || len(fields) > 5 {
+		return errors.New("want HashString:FileSize:MalwareName[:MinFL[:MaxFL]]")
+	}
+	if !validHash(fields[0], hashLengths) {
+		return fmt.Errorf("hash must be %s hex digits, got %q", joinInts(hashLengths), fields[0])
+	}
+	if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil && fields[1] != "*" {
+		return fmt.Errorf("file size must be a number or *, got %q", fields[1])
+	}
+	if fields[2] == "" {
+		return errors.New("malware name is empty")
+	}
+	return validateFunctionalityLevels(fields[3:])
+}
+
+// validateNDB checks a MalwareName:TargetType:Offset:HexSignature line
+func validateNDB(line string) error {
+	fields := strings.Split(line, ":")
+	if len(fields) < 4 || len(fields) > 6 {
+		return errors.New("want MalwareName:TargetType:Offset:HexSignature[:MinFL[:MaxFL]]")
+	}
+	if fields[0] == "" {
+		return errors.New("malware name is empty")
+	}
+	if target, err := strconv.Atoi(fields[1]); err != nil || target < 0 || target > 14 {
+		return fmt.Errorf("target type must be 0-14, got %q", fields[1])
+	}
+	if !signatureOffset.MatchString(fields[2]) {
+		return fmt.Errorf("invalid offset %q", fields[2])
+	}
+	if err := validateHexSignature(fields[3]); err != nil {
+		return err
+	}
+	return validateFunctionalityLevels(fields[4:])
+}
+
+// validateLDB checks a Name;TargetDescription;LogicalExpression;Subsig0...
+// line
+func validateLDB(line string) error {
+	fields := strings.Split(line, ";")
+	if len(fields) < 4 {
+		return errors.New("want SignatureName;TargetDescriptionBlock;LogicalExpression;Subsig0[;Subsig1...]")
+	}
+	if fields[0] == "" {
+		return errors.New("signature name is empty")
+	}
+
+	hasTarget := false
+	for _, attr := range strings.Split(fields[1], ",") {
+		key, _, ok := strings.Cut(attr, ":")
+		if !ok || !ldbTargetKeys[key] {
+			return fmt.Errorf("invalid target description %q", attr)
+		}
+		hasTarget = hasTarget || key == "Target"
+	}
+	if !hasTarget {
+		return errors.New("target description needs a Target")
+	}
+
+	subsigs := fields[3:]
+	expression := fields[2]
+	if !logicalExpression.MatchString(expression) || strings.Count(expression, "(") != strings.Count(expression, ")") {
+		return fmt.Errorf("invalid logical expression %q", expression)
+	}
+	// Numbers after a comparison are counts, not subsignature indexes
+	for _, ref := range logicalIndex.FindAllStringIndex(expression, -1) {
+		if ref[0] > 0 && strings.ContainsAny(expression[ref[0]-1:ref[0]], "=<>,") {
+			continue
+		}
+		if index, _ := strconv.Atoi(expression[ref[0]:ref[1]]); index >= len(subsigs) {
+			return fmt.Errorf("logical expression refers to subsignature %d of %d", index, len(subsigs))
+		}
+	}
+
+	for i, subsig := range subsigs {
+		if err := validateSubsignature(subsig); err != nil {
+			return fmt.Errorf("subsignature %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateSubsignature checks a logical signature's [Offset:]HexSignature
+// [::Modifiers] subsignature. PCRE subsignatures are left to clamd.
+func validateSubsignature(subsig string) error {
+	if trigger, _, ok := strings.Cut(subsig, "/"); ok && logicalExpression.MatchString(trigger) {
+		return nil
+	}
+	body, modifiers, _ := strings.Cut(subsig, "::")
+	if strings.Trim(modifiers, "iawf") != "" {
+		return fmt.Errorf("invalid modifiers %q", modifiers)
+	}
+	if offset, hex, ok := strings.Cut(body, ":"); ok {
+		if !signatureOffset.MatchString(offset) {
+			return fmt.Errorf("invalid offset %q", offset)
+		}
+		body = hex
+	}
+	return validateHexSignature(body)
+}
+
+// validateHexSignature checks a body-based signature: hex bytes with ??
+// and nibble wildcards, * and {n-m} jumps, and (aa|bb) alternatives
+func validateHexSignature(sig string) error {
+	if sig == "" {
+		return errors.New("hex signature is empty")
+	}
+	digits := 0
+	run := func(hex string) error {
+		if !signatureHex.MatchString(hex) || len(hex)%2 != 0 {
+			return fmt.Errorf("invalid hex bytes %q", hex)
+		}
+		digits += len(strings.ReplaceAll(hex, "?", ""))
+		return nil
+	}
+
+	for rest := sig; rest != ""; {
+		i := strings.IndexAny(rest, "*{[(!")
+		if i < 0 {
+			i = len(rest)
+		}
+		if err := run(rest[:i]); err != nil {
+			return err
+		}
+		if i == len(rest) {
+			break
+		}
+		rest = rest[i:]
+
+		switch rest[0] {
+		case '*', '!':
+			rest = rest[1:]
+		case '{', '[':
+			closing := map[byte]string{'{': "}", '[': "]"}[rest[0]]
+			end := strings.Index(rest, closing)
+			if end < 0 || !signatureJump.MatchString(rest[1:end]) {
+				return fmt.Errorf("invalid jump in %q", rest)
+			}
+			rest = rest[end+1:]
+		case '(':
+			end := strings.Index(rest, ")")
+			if end < 0 {
+				return fmt.Errorf("unclosed alternative in %q", rest)
+			}
+			group := rest[1:end]
+			if group != "B" && group != "L" && group != "W" {
+				for _, alt := range strings.Split(group, "|") {
+					if alt == "" {
+						return fmt.Errorf("empty alternative in %q", rest[:end+1])
+					}
+					if err := run(alt); err != nil {
+						return err
+					}
+				}
+			}
+			rest = rest[end+1:]
+		}
+	}
+	if digits < 4 {
+		return fmt.Errorf("hex signature %q needs at least two fixed bytes", sig)
+	}
+	return nil
+}
+
+// validateFunctionalityLevels checks the optional MinFL and MaxFL fields
+func validateFunctionalityLevels(levels []string) error {
+	for _, level := range levels {
+		if _, err := strconv.ParseUint(level, 10, 32); err != nil && level != "" {
+			return fmt.Errorf("functionality level must be a number, got %q", level)
+		}
+	}
+	return nil
+}
+
+func validHash(hash string, lengths []int) bool {
+	for _, n := range lengths {
+		if len(hash) == n && strings.Trim(strings.ToLower(hash), "0123456789abcdef") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, " or ")
+}
+
+// listSignatureSets returns the custom signature sets installed in dir,
+// by name
+func listSignatureSets(dir string) ([]SignatureSet, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bySet := make(map[string]*SignatureSet)
+	for _, entry := range dirEntries {
+		match := signatureFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		file := SignatureFile{
+			Set:        match[1],
+			Name:       match[2] + "." + match[3],
+			Signatures: bytes.Count(data, []byte("\n")),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().UTC(),
+		}
+		set := bySet[file.Set]
+		if set == nil {
+			set = &SignatureSet{Name: file.Set}
+			bySet[file.Set] = set
+		}
+		set.Files = append(set.Files, file)
+		set.Signatures += file.Signatures
+	}
+
+	sets := make([]SignatureSet, 0, len(bySet))
+	for _, set := range bySet {
+		sets = append(sets, *set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Name < sets[j].Name })
+	return sets, nil
+}
+
+// signatureFilePath is where the file of a set is installed
+func signatureFilePath(dir, set, file string) string {
+	return filepath.Join(dir, signatureFilePrefix+set+"."+file)
+}
+
+// installSignatures validates a signature file and writes it into the set,
+// replacing any file of the same name, then reloads clamd
+func installSignatures(dir, set, file string, data []byte) (SignatureFile, DatabaseState, error) {
+	if err := validateSignatureSetName(set); err != nil {
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	_, format, err := parseSignatureFileName(file)
+	if err != nil {
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	normalized, count, errs := validateSignatures(format, data)
+	if len(errs) > 0 {
+		return SignatureFile{}, DatabaseState{}, &SignatureValidationError{Errors: errs}
+	}
+
+	signatureMu.Lock()
+	defer signatureMu.Unlock()
+
+	path := signatureFilePath(dir, set, file)
+	// The temporary name has no database extension, so a reload that
+	// happens meanwhile never loads a partial file
+	tmp, err := os.CreateTemp(dir, ".clamav-api-*.tmp")
+	if err != nil {
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(normalized); err != nil {
+		tmp.Close()
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return SignatureFile{}, DatabaseState{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return SignatureFile{}, DatabaseState{}, err
+	}
+
+	installed := SignatureFile{Set: set, Name: file, Signatures: count, Size: int64(len(normalized)), ModifiedAt: time.Now().UTC()}
+	state, err := reloadSignatures(dir)
+	return installed, state, err
+}
+
+// deleteSignatures removes one file of a set, or the whole set when file
+// is empty, then reloads clamd
+func deleteSignatures(dir, set, file string) ([]SignatureFile, DatabaseState, error) {
+	if err := validateSignatureSetName(set); err != nil {
+		return nil, DatabaseState{}, err
+	}
+	if file != "" {
+		if _, _, err := parseSignatureFileName(file); err != nil {
+			return nil, DatabaseState{}, err
+		}
+	}
+
+	signatureMu.Lock()
+	defer signatureMu.Unlock()
+
+	sets, err := listSignatureSets(dir)
+	if err != nil {
+		return nil, DatabaseState{}, err
+	}
+	var removed []SignatureFile
+	for _, s := range sets {
+		if s.Name != set {
+			continue
+		}
+		for _, f := range s.Files {
+			if file != "" && f.Name != file {
+				continue
+			}
+			if err := os.Remove(signatureFilePath(dir, set, f.Name)); err != nil {
+				return removed, DatabaseState{}, err
+			}
+			removed = append(removed, f)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, DatabaseState{}, errSignatureNotFound
+	}
+
+	state, err := reloadSignatures(dir)
+	return removed, state, err
+}
+
+// reloadSignatures has clamd reload its database and reports the database
+// version clamd answers with and the custom signatures now installed
+func reloadSignatures(dir string) (DatabaseState, error) {
+	var state DatabaseState
+	if sets, err := listSignatureSets(dir); err == nil {
+		for _, set := range sets {
+			state.CustomSignatures += set.Signatures
+		}
+	}
+
+	if err := getClamdClient().Reload(); err != nil {
+		clamdReloadsTotal.WithLabelValues("error").Inc()
+		return state, &SignatureReloadError{Err: err}
+	}
+	clamdReloadsTotal.WithLabelValues("ok").Inc()
+
+	version, err := clamdVersion()
+	if err != nil {
+		return state, &SignatureReloadError{Err: err}
+	}
+	state.Version = version
+	if fields := strings.Split(version, "/"); len(fields) >= 2 {
+		state.DatabaseVersion = fields[1]
+	}
+	return state, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "clamav-api/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testNDB = "Incident.Dropper.42:0:*:4d5a9000??0300000004{2-8}ffff(aa|bb)cc\n\nIncident.Script.42:7:EOF-100:6576616c28*6261736536345f6465636f6465:51\n"
+
+// withSignatureDir installs custom signatures into a temporary directory
+// for the duration of a test
+func withSignatureDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	original := config.SignatureDir
+	config.SignatureDir = dir
+	t.Cleanup(func() { config.SignatureDir = original })
+	return dir
+}
+
+func TestValidateSignatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		line    string
+		wantErr string
+	}{
+		{"ndb", "ndb", "Incident.Dropper.42:1:EP+0,20:e8????????5d{-4}81ed", ""},
+		{"ndb anchored alternatives", "ndb", "Incident.Doc:0:0:d0cf11e0(B)a1b1!(00|01)1ae1", ""},
+		{"ndb bad target", "ndb", "Incident:15:*:4d5a9000", "target type must be 0-14"},
+		{"ndb bad offset", "ndb", "Incident:0:EOF+10:4d5a9000", "invalid offset"},
+		{"ndb odd hex", "ndb", "Incident:0:*:4d5a900", "invalid hex bytes"},
+		{"ndb bad jump", "ndb", "Incident:0:*:4d5a{x}9000", "invalid jump"},
+		{"ndb too short", "ndb", "Incident:0:*:4d??", "at least two fixed bytes"},
+		{"ndb missing fields", "ndb", "Incident:0:4d5a9000", "want MalwareName"},
+		{"hdb", "hdb", "44d88612fea8a8f36de82e1278abb02f:68:Incident.Eicar", ""},
+		{"hdb any size", "hdb", "44d88612fea8a8f36de82e1278abb02f:*:Incident.Eicar:73", ""},
+		{"hdb sha256 hash", "hdb", strings.Repeat("a", 64) + ":68:Incident", "hash must be 32 hex digits"},
+		{"hdb bad size", "hdb", "44d88612fea8a8f36de82e1278abb02f:big:Incident", "file size must be a number"},
+		{"hdb no name", "hdb", "44d88612fea8a8f36de82e1278abb02f:68:", "malware name is empty"},
+		{"hsb sha256", "hsb", strings.Repeat("a", 64) + ":68:Incident", ""},
+		{"hsb sha1", "hsb", strings.Repeat("b", 40) + ":68:Incident", ""},
+		{"hsb md5", "hsb", "44d88612fea8a8f36de82e1278abb02f:68:Incident", "hash must be 40 or 64 hex digits"},
+		{"ldb", "ldb", "Incident.Macro;Engine:81-255,Target:2;(0&1)|2>1,1;41555f4f70656e;0:d0cf11e0::i;2/eval\\(/", ""},
+		{"ldb no target", "ldb", "Incident.Macro;Engine:81-255;0;41555f4f70656e", "needs a Target"},
+		{"ldb unknown key", "ldb", "Incident.Macro;Target:0,Color:red;0;41555f4f70656e", "invalid target description"},
+		{"ldb undefined subsignature", "ldb", "Incident.Macro;Target:0;0&2;41555f4f70656e;d0cf11e0", "refers to subsignature 2 of 2"},
+		{"ldb bad expression", "ldb", "Incident.Macro;Target:0;(0&1;41555f4f70656e;d0cf11e0", "invalid logical expression"},
+		{"ldb bad modifier", "ldb", "Incident.Macro;Target:0;0;41555f4f70656e::x", "subsignature 0: invalid modifiers"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, count, errs := validateSignatures(tt.format, []byte(tt.line+"\n"))
+			if tt.wantErr == "" {
+				assert.Empty(t, errs)
+				assert.Equal(t, 1, count)
+				return
+			}
+			require.Len(t, errs, 1)
+			assert.Equal(t, 1, errs[0].Line)
+			assert.Contains(t, errs[0].Message, tt.wantErr)
+		})
+	}
+
+	normalized, count, errs := validateSignatures("ndb", []byte(strings.ReplaceAll(testNDB, "\n", "\r\n")))
+	assert.Empty(t, errs)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, strings.Replace(testNDB, "\n\n", "\n", 1), string(normalized))
+
+	_, _, errs = validateSignatures("hdb", []byte("\n\n"))
+	assert.Equal(t, []SignatureError{{Message: "file has no signatures"}}, errs)
+}
+
+func TestParseSignatureFileName(t *testing.T) {
+	name, format, err := parseSignatureFileName("incident-42.ndb")
+	require.NoError(t, err)
+	assert.Equal(t, "incident-42", name)
+	assert.Equal(t, "ndb", format)
+
+	for _, file := range []string{"incident.cvd", "incident", "../main.ndb", "a.b.ndb", ".ndb"} {
+		_, _, err := parseSignatureFileName(file)
+		assert.Error(t, err, file)
+	}
+	assert.Error(t, validateSignatureSetName("../x"))
+}
+
+func TestInstallAndDeleteSignatures(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "daily.cld"), []byte("official"), 0644))
+
+	reloads := getCounterValue(t, clamdReloadsTotal, "ok")
+	file, state, err := installSignatures(dir, "incident-42", "droppers.ndb", []byte(testNDB))
+	require.NoError(t, err)
+	assert.Equal(t, SignatureFile{Set: "incident-42", Name: "droppers.ndb", Signatures: 2, Size: file.Size, ModifiedAt: file.ModifiedAt}, file)
+	assert.True(t, strings.HasPrefix(state.Version, "ClamAV 1.4.1/27400/"))
+	assert.Equal(t, "27400", state.DatabaseVersion)
+	assert.Equal(t, 2, state.CustomSignatures)
+	assert.Equal(t, reloads+1, getCounterValue(t, clamdReloadsTotal, "ok"))
+
+	info, err := os.Stat(filepath.Join(dir, "clamav-api.incident-42.droppers.ndb"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	_, state, err = installSignatures(dir, "incident-42", "eicar.hdb", []byte("44d88612fea8a8f36de82e1278abb02f:68:Incident.Eicar\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, state.CustomSignatures)
+	_, _, err = installSignatures(dir, "phishing", "kits.hsb", []byte(strings.Repeat("c", 64)+":1024:Incident.Kit\n"))
+	require.NoError(t, err)
+
+	sets, err := listSignatureSets(dir)
+	require.NoError(t, err)
+	require.Len(t, sets, 2)
+	assert.Equal(t, "incident-42", sets[0].Name)
+	assert.Equal(t, 3, sets[0].Signatures)
+	assert.Len(t, sets[0].Files, 2)
+	assert.Equal(t, "phishing", sets[1].Name)
+
+	_, _, err = installSignatures(dir, "incident-42", "broken.ndb", []byte("Incident:0:*:zz\n"))
+	var invalid *SignatureValidationError
+	require.ErrorAs(t, err, &invalid)
+	assert.NoFileExists(t, filepath.Join(dir, "clamav-api.incident-42.broken.ndb"))
+
+	removed, state, err := deleteSignatures(dir, "incident-42", "eicar.hdb")
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "eicar.hdb", removed[0].Name)
+	assert.Equal(t, 3, state.CustomSignatures)
+
+	removed, _, err = deleteSignatures(dir, "incident-42", "")
+	require.NoError(t, err)
+	assert.Len(t, removed, 1)
+	_, _, err = deleteSignatures(dir, "incident-42", "")
+	assert.ErrorIs(t, err, errSignatureNotFound)
+	assert.FileExists(t, filepath.Join(dir, "daily.cld"))
+}
+
+func TestInstallSignaturesReloadFails(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	config.ClamdUnixSocket = filepath.Join(t.TempDir(), "missing.sock")
+	resetClamdClient()
+	dir := t.TempDir()
+
+	failed := getCounterValue(t, clamdReloadsTotal, "error")
+	file, state, err := installSignatures(dir, "incident-42", "droppers.ndb", []byte(testNDB))
+	var reload *SignatureReloadError
+	require.ErrorAs(t, err, &reload)
+	assert.Equal(t, "droppers.ndb", file.Name)
+	assert.Equal(t, 2, state.CustomSignatures)
+	assert.FileExists(t, filepath.Join(dir, "clamav-api.incident-42.droppers.ndb"))
+	assert.Equal(t, failed+1, getCounterValue(t, clamdReloadsTotal, "error"))
+}
+
+func TestAdminSignaturesREST(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withFakeClamd(t, "stream: OK")
+	withSignatureDir(t)
+	router := newAdminRouter()
+	router.GET("/api/admin/signatures", adminAuth(), handleListSignatures)
+	router.POST("/api/admin/signatures/validate/:file", adminAuth(), handleValidateSignatures)
+	router.PUT("/api/admin/signatures/:set/:file", adminAuth(), handleInstallSignatures)
+	router.DELETE("/api/admin/signatures/:set", adminAuth(), handleDeleteSignatures)
+	router.DELETE("/api/admin/signatures/:set/:file", adminAuth(), handleDeleteSignatures)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/api/admin/signatures/validate/droppers.ndb", "Incident:0:*:4d5a9000\nIncident:0:*:zz\n")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"valid":false,"signatures":1,"errors":[{"line":2,"message":"invalid hex bytes \"zz\""}]}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/admin/signatures/validate/droppers.cvd", "x").Code)
+
+	w = request(http.MethodPut, "/api/admin/signatures/incident-42/droppers.ndb", "Incident:0:*:zz\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"errors":[{"line":1`)
+
+	w = request(http.MethodPut, "/api/admin/signatures/incident-42/droppers.ndb", testNDB)
+	require.Equal(t, http.StatusOK, w.Code)
+	var installed struct {
+		File     SignatureFile `json:"file"`
+		Database DatabaseState `json:"database"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &installed))
+	assert.Equal(t, 2, installed.File.Signatures)
+	assert.Equal(t, "27400", installed.Database.DatabaseVersion)
+	assert.Equal(t, 2, installed.Database.CustomSignatures)
+
+	w = request(http.MethodGet, "/api/admin/signatures", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"count":1`)
+	assert.Contains(t, w.Body.String(), `"name":"droppers.ndb"`)
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/api/admin/signatures/incident-42/other.ndb", "").Code)
+	w = request(http.MethodDelete, "/api/admin/signatures/incident-42", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"custom_signatures":0`)
+
+	config.SignatureDir = ""
+	w = request(http.MethodGet, "/api/admin/signatures", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "signature management is disabled")
+}
+
+func TestAdminSignaturesGRPC(t *testing.T) {
+	withAdminToken(t, "s3cret")
+	withFakeClamd(t, "stream: OK")
+	withSignatureDir(t)
+	server := NewAdminServer()
+	authed := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer s3cret"))
+
+	_, err := server.ListSignatures(context.Background(), &pb.ListSignaturesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	validated, err := server.ValidateSignatures(authed, &pb.ValidateSignaturesRequest{File: "eicar.hdb", Data: []byte("nothex:68:Incident\n")})
+	require.NoError(t, err)
+	assert.False(t, validated.Valid)
+	require.Len(t, validated.Errors, 1)
+	assert.Equal(t, int64(1), validated.Errors[0].Line)
+
+	_, err = server.InstallSignatures(authed, &pb.InstallSignaturesRequest{Set: "incident-42", File: "eicar.hdb", Data: []byte("nothex:68:Incident\n")})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	installed, err := server.InstallSignatures(authed, &pb.InstallSignaturesRequest{
+		Set: "incident-42", File: "eicar.hdb", Data: []byte("44d88612fea8a8f36de82e1278abb02f:68:Incident.Eicar\n"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), installed.File.Signatures)
+	assert.Equal(t, int64(1), installed.Database.CustomSignatures)
+
+	list, err := server.ListSignatures(authed, &pb.ListSignaturesRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Sets, 1)
+	assert.Equal(t, "incident-42", list.Sets[0].Name)
+
+	deleted, err := server.DeleteSignatures(authed, &pb.DeleteSignaturesRequest{Set: "incident-42", File: "eicar.hdb"})
+	require.NoError(t, err)
+	assert.Len(t, deleted.Removed, 1)
+	_, err = server.DeleteSignatures(authed, &pb.DeleteSignaturesRequest{Set: "incident-42"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	config.SignatureDir = ""
+	_, err = server.ListSignatures(authed, &pb.ListSignaturesRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
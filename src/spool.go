@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// errPayloadTooLarge indicates a spooled payload exceeded MaxContentLength
+var errPayloadTooLarge = errors.New("payload exceeds maximum allowed size")
+
+// spoolFilePrefix starts the name of every spool file, so files left by a
+// crash can be told apart from anything else in the spool directory
+const spoolFilePrefix = "clamav-api-spool-"
+
+// Reasons labelling clamav_spool_spills_total
+const (
+	spillThreshold = "threshold"
+	spillBudget    = "budget"
+)
+
+// MemoryBudget bounds the bytes all spools hold in memory at once. A spool
+// that would go over it spills to disk instead.
+type MemoryBudget struct {
+	config *liveConfig
+	used   atomic.Int64
+}
+
+// spoolBudget is shared by every spool
+var spoolBudget = NewMemoryBudget(serverConfig)
+
+// NewMemoryBudget creates a budget of MemoryBudget bytes; 0 is unlimited
+func NewMemoryBudget(cfg *liveConfig) *MemoryBudget {
+	return &MemoryBudget{config: cfg}
+}
+
+// reserve takes n bytes from the budget, or reports false if they do not
+// fit in what remains
+func (b *MemoryBudget) reserve(n int64) bool {
+	limit := b.config.Load().MemoryBudget
+	for {
+		used := b.used.Load()
+		if limit > 0 && used+n > limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// hold takes n bytes that are already in memory, even beyond the limit, so
+// spools spill while they are held
+func (b *MemoryBudget) hold(n int64) {
+	b.used.Add(n)
+}
+
+// release returns n reserved or held bytes to the budget
+func (b *MemoryBudget) release(n int64) {
+	b.used.Add(-n)
+}
+
+// Used returns the bytes reserved or held
+func (b *MemoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// Spool buffers a payload in memory up to a threshold and spills the rest to
+// a temporary file, so large bodies can be consumed and replayed without
+// holding them entirely in memory. The memory it holds counts against
+// spoolBudget; it also spills once the budget runs out.
+type Spool struct {
+	threshold int64
+	dir       string
+	budget    *MemoryBudget
+
+	mem      bytes.Buffer
+	reserved int64
+	file     *os.File
+	// unlinked is set once the file is removed from the directory
+	unlinked bool
+	size     int64
+}
+
+// NewSpool creates an empty spool that spills to dir once threshold bytes
+// have been written. An empty dir uses the configured spool directory.
+func NewSpool(threshold int64, dir string) *Spool {
+	return &Spool{threshold: threshold, dir: dir, budget: spoolBudget}
+}
+
+// spoolDirectory is where spools without a directory of their own spill:
+// spool-dir, or clamav-api-spool in the system temp directory
+func spoolDirectory(cfg *Config) string {
+	if cfg.SpoolDir != "" {
+		return cfg.SpoolDir
+	}
+	return filepath.Join(os.TempDir(), "clamav-api-spool")
+}
+
+// prepareSpoolDir creates the spool directory readable by this user only
+// and removes the spool files a crash left behind
+func prepareSpoolDir(dir string) (removed int, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check spool directory: %w", err)
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("spool directory %s is not a directory", dir)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return 0, fmt.Errorf("failed to restrict spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), spoolFilePrefix) {
+			if os.Remove(filepath.Join(dir, entry.Name())) == nil {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// spoolReader copies r into a new spool, failing with errPayloadTooLarge if
+// more than maxSize bytes are read.
+func spoolReader(r io.Reader, maxSize, threshold int64, dir string) (*Spool, error) {
+	s := NewSpool(threshold, dir)
+	n, err := io.Copy(s, io.LimitReader(r, maxSize+1))
+	if err == nil && n > maxSize {
+		err = errPayloadTooLarge
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write appends p, moving the buffered data to disk when the threshold is
+// crossed or the memory budget runs out
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil {
+		n := int64(len(p))
+		switch {
+		case s.size+n > s.threshold:
+			if err := s.spill(spillThreshold); err != nil {
+				return 0, err
+			}
+		case !s.budget.reserve(n):
+			if err := s.spill(spillBudget); err != nil {
+				return 0, err
+			}
+		default:
+			s.reserved += n
+		}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// spill moves the buffered data to a new spool file and returns its memory
+// to the budget. The file is created 0600 and unlinked right away where the
+// platform allows it, so it disappears with the process.
+func (s *Spool) spill(reason string) error {
+	dir := s.dir
+	if dir == "" {
+		dir = spoolDirectory(currentConfig())
+	}
+	f, err := os.CreateTemp(dir, spoolFilePrefix+"*")
+	if errors.Is(err, os.ErrNotExist) && s.dir == "" {
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			f, err = os.CreateTemp(dir, spoolFilePrefix+"*")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	s.unlinked = os.Remove(f.Name()) == nil
+	if _, err := f.Write(s.mem.Bytes()); err != nil {
+		f.Close()
+		if !s.unlinked {
+			os.Remove(f.Name())
+		}
+		return fmt.Errorf("failed to write spool file: %w", err)
+	}
+
+	s.file = f
+	s.mem = bytes.Buffer{}
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	spoolSpillsTotal.WithLabelValues(reason).Inc()
+	spoolFiles.Inc()
+	return nil
+}
+
+// Size returns the number of bytes written to the spool
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// OnDisk reports whether the spool has spilled to a temporary file
+func (s *Spool) OnDisk() bool {
+	return s.file != nil
+}
+
+// Reader returns a reader positioned at the start of the spooled payload.
+// Each call rewinds; readers from earlier calls must no longer be used.
+func (s *Spool) Reader() (io.ReadSeeker, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.mem.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// Close releases the buffer and its budget, and removes the temporary
+// file, if any. The spool can be written again afterwards.
+func (s *Spool) Close() error {
+	s.mem = bytes.Buffer{}
+	s.budget.release(s.reserved)
+	s.reserved = 0
+	s.size = 0
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	if !s.unlinked {
+		if rmErr := os.Remove(name); err == nil {
+			err = rmErr
+		}
+	}
+	s.file = nil
+	s.unlinked = false
+	spoolFiles.Dec()
+	return err
+}
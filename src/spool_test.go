@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "clamav-api/proto"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolInMemory(t *testing.T) {
+	spool, err := spoolReader(strings.NewReader("small payload"), 1024, 64, t.TempDir())
+	require.NoError(t, err)
+	defer spool.Close()
+
+	assert.False(t, spool.OnDisk())
+	assert.Equal(t, int64(13), spool.Size())
+
+	reader, err := spool.Reader()
+	require.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	assert.Equal(t, "small payload", string(data))
+}
+
+func TestSpoolSpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+
+	spool, err := spoolReader(bytes.NewReader(payload), 4096, 64, dir)
+	require.NoError(t, err)
+
+	assert.True(t, spool.OnDisk())
+	assert.Equal(t, int64(len(payload)), spool.Size())
+
+	info, err := spool.file.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries, "spool file should be unlinked once open")
+
+	// The payload can be replayed more than once
+	for i := 0; i < 2; i++ {
+		reader, err := spool.Reader()
+		require.NoError(t, err)
+		data, _ := io.ReadAll(reader)
+		assert.Equal(t, payload, data)
+	}
+
+	require.NoError(t, spool.Close())
+	entries, _ = os.ReadDir(dir)
+	assert.Empty(t, entries, "spool file should be removed on close")
+}
+
+func TestSpoolTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	_, err := spoolReader(strings.NewReader(strings.Repeat("x", 200)), 100, 10, dir)
+	assert.ErrorIs(t, err, errPayloadTooLarge)
+
+	entries, _ := os.ReadDir(dir)
+	assert.Empty(t, entries, "spool file should be removed on failure")
+}
+
+func TestSpoolInvalidDir(t *testing.T) {
+	_, err := spoolReader(strings.NewReader(strings.Repeat("x", 200)), 1024, 10, "/nonexistent/spool/dir")
+	assert.Error(t, err)
+}
+
+// withMemoryBudget makes spools draw from a budget of limit bytes
+func withMemoryBudget(t *testing.T, limit int64) *MemoryBudget {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.MemoryBudget = limit
+	budget := NewMemoryBudget(newLiveConfig(&cfg))
+	original := spoolBudget
+	spoolBudget = budget
+	t.Cleanup(func() { spoolBudget = original })
+	return budget
+}
+
+func TestSpoolMemoryBudget(t *testing.T) {
+	budget := withMemoryBudget(t, 100)
+	dir := t.TempDir()
+	baseSpills := getCounterValue(t, spoolSpillsTotal, spillBudget)
+
+	first, err := spoolReader(strings.NewReader(strings.Repeat("a", 80)), 1024, 1024, dir)
+	require.NoError(t, err)
+	assert.False(t, first.OnDisk())
+	assert.Equal(t, int64(80), budget.Used())
+
+	// Under its own threshold, but over what remains of the budget
+	second, err := spoolReader(strings.NewReader(strings.Repeat("b", 40)), 1024, 1024, dir)
+	require.NoError(t, err)
+	assert.True(t, second.OnDisk())
+	assert.Equal(t, int64(80), budget.Used(), "a spilled spool holds no memory")
+	assert.Equal(t, baseSpills+1, getCounterValue(t, spoolSpillsTotal, spillBudget))
+
+	reader, err := second.Reader()
+	require.NoError(t, err)
+	data, _ := io.ReadAll(reader)
+	assert.Equal(t, strings.Repeat("b", 40), string(data))
+
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+	assert.Zero(t, budget.Used())
+
+	// Held payloads count against the budget even beyond it
+	budget.hold(150)
+	assert.False(t, budget.reserve(1))
+	budget.release(150)
+	assert.True(t, budget.reserve(100))
+	budget.release(100)
+}
+
+func TestSpoolUnlimitedBudget(t *testing.T) {
+	budget := withMemoryBudget(t, 0)
+	spool, err := spoolReader(strings.NewReader(strings.Repeat("x", 4096)), 8192, 8192, t.TempDir())
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.False(t, spool.OnDisk())
+	assert.Equal(t, int64(4096), budget.Used())
+}
+
+func TestPrepareSpoolDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	removed, err := prepareSpoolDir(dir)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Files a crash left behind are removed, anything else is kept
+	require.NoError(t, os.WriteFile(filepath.Join(dir, spoolFilePrefix+"123"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("x"), 0600))
+	require.NoError(t, os.Chmod(dir, 0755))
+	removed, err = prepareSpoolDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	entries, _ := os.ReadDir(dir)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "keep.txt", entries[0].Name())
+	info, _ = os.Stat(dir)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = prepareSpoolDir(file)
+	assert.Error(t, err)
+}
+
+func TestGRPCScanStreamSpillsOverBudget(t *testing.T) {
+	withFakeClamd(t, "stream: OK")
+	withMemoryBudget(t, 1)
+	client := getTestClient(t)
+	baseSpills := getCounterValue(t, spoolSpillsTotal, spillBudget)
+
+	stream, err := client.ScanStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.ScanStreamRequest{Chunk: []byte("first chunk"), Filename: "big.bin"}))
+	require.NoError(t, stream.Send(&pb.ScanStreamRequest{Chunk: []byte("last chunk"), IsLast: true}))
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, "OK", resp.Status)
+	assert.Equal(t, baseSpills+1, getCounterValue(t, spoolSpillsTotal, spillBudget))
+
+	var m dto.Metric
+	require.NoError(t, spoolFiles.Write(&m))
+	assert.Zero(t, m.GetGauge().GetValue(), "spool file closed after the scan")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// TNEF (winmail.dat) constants, see [MS-OXTNEF]
+const (
+	tnefSignature = 0x223E9F78
+
+	tnefLevelAttachment = 0x02
+
+	tnefAttAttachRendData = 0x00069002
+	tnefAttAttachTitle    = 0x00018010
+	tnefAttAttachData     = 0x0006800F
+	tnefAttAttachment     = 0x00069005
+
+	mapiAttachLongFilename = 0x3707
+)
+
+var errInvalidTNEF = errors.New("invalid TNEF stream")
+
+// tnefAttachment is a file embedded in a TNEF stream
+type tnefAttachment struct {
+	Filename string
+	Data     []byte
+}
+
+// isTNEF reports whether a part looks like a TNEF container
+func isTNEF(mediaType, filename string, data []byte) bool {
+	if mediaType == "application/ms-tnef" || mediaType == "application/vnd.ms-tnef" ||
+		strings.EqualFold(filename, "winmail.dat") {
+		return len(data) >= 6 && binary.LittleEndian.Uint32(data) == tnefSignature
+	}
+	return false
+}
+
+// decodeTNEF extracts the attachments from a TNEF stream. Returned data
+// slices alias the input buffer so extraction does not copy payloads.
+func decodeTNEF(data []byte) ([]tnefAttachment, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, errInvalidTNEF
+	}
+
+	var attachments []tnefAttachment
+	var current *tnefAttachment
+
+	// Skip signature and legacy key
+	pos := 6
+	for pos < len(data) {
+		// level (1) + attribute id (4) + length (4)
+		if len(data)-pos < 9 {
+			return nil, errInvalidTNEF
+		}
+		level := data[pos]
+		attr := binary.LittleEndian.Uint32(data[pos+1:])
+		length := int(binary.LittleEndian.Uint32(data[pos+5:]))
+		pos += 9
+
+		// value + checksum (2)
+		if length < 0 || length > len(data)-pos-2 {
+			return nil, errInvalidTNEF
+		}
+		value := data[pos : pos+length]
+		pos += length + 2
+
+		if level != tnefLevelAttachment {
+			continue
+		}
+
+		switch attr {
+		case tnefAttAttachRendData:
+			attachments = append(attachments, tnefAttachment{})
+			current = &attachments[len(attachments)-1]
+		case tnefAttAttachTitle:
+			if current != nil && current.Filename == "" {
+				current.Filename = strings.TrimRight(string(value), "\x00")
+			}
+		case tnefAttAttachData:
+			if current != nil {
+				current.Data = value
+			}
+		case tnefAttAttachment:
+			if current != nil {
+				if name := mapiLongFilename(value); name != "" {
+					current.Filename = name
+				}
+			}
+		}
+	}
+
+	return attachments, nil
+}
+
+// mapiLongFilename scans a MAPI property list for PR_ATTACH_LONG_FILENAME.
+// Malformed property lists yield an empty name rather than an error.
+func mapiLongFilename(data []byte) string {
+	r := &mapiReader{data: data}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.ok(); i++ {
+		propType := r.uint16()
+		propID := r.uint16()
+
+		// Named properties carry a GUID and a numeric or string name
+		if propID >= 0x8000 {
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(pad4(int(r.uint32())))
+			}
+		}
+
+		values := uint32(1)
+		multi := propType&0x1000 != 0
+		baseType := propType &^ 0x1000
+		if multi || isVariableMAPIType(baseType) {
+			values = r.uint32()
+		}
+
+		for v := uint32(0); v < values && r.ok(); v++ {
+			if isVariableMAPIType(baseType) {
+				n := int(r.uint32())
+				value := r.bytes(n)
+				r.skip(pad4(n) - n)
+				if propID == mapiAttachLongFilename && !multi {
+					return decodeMAPIString(baseType, value)
+				}
+				continue
+			}
+			r.skip(fixedMAPITypeSize(baseType))
+		}
+	}
+	return ""
+}
+
+func isVariableMAPIType(t uint16) bool {
+	switch t {
+	case 0x001E, 0x001F, 0x0102, 0x000D: // PT_STRING8, PT_UNICODE, PT_BINARY, PT_OBJECT
+		return true
+	}
+	return false
+}
+
+func fixedMAPITypeSize(t uint16) int {
+	switch t {
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040: // double, currency, apptime, int64, systime
+		return 8
+	case 0x0048: // CLSID
+		return 16
+	default: // short, long, float, error, boolean are padded to 4 bytes
+		return 4
+	}
+}
+
+func decodeMAPIString(t uint16, value []byte) string {
+	if t == 0x001F {
+		u := make([]uint16, len(value)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(value[2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	}
+	return strings.TrimRight(string(value), "\x00")
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// mapiReader is a bounds-checked little-endian cursor; once a read runs past
+// the end every subsequent read returns zero values.
+type mapiReader struct {
+	data []byte
+	pos  int
+	err  bool
+}
+
+func (r *mapiReader) ok() bool {
+	return !r.err
+}
+
+func (r *mapiReader) bytes(n int) []byte {
+	if r.err || n < 0 || n > len(r.data)-r.pos {
+		r.err = true
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *mapiReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *mapiReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *mapiReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tnefBuilder assembles TNEF streams for tests
+type tnefBuilder struct {
+	buf bytes.Buffer
+}
+
+func newTNEFBuilder() *tnefBuilder {
+	b := &tnefBuilder{}
+	binary.Write(&b.buf, binary.LittleEndian, uint32(tnefSignature))
+	binary.Write(&b.buf, binary.LittleEndian, uint16(0x0001))
+	return b
+}
+
+func (b *tnefBuilder) attr(level byte, id uint32, value []byte) *tnefBuilder {
+	b.buf.WriteByte(level)
+	binary.Write(&b.buf, binary.LittleEndian, id)
+	binary.Write(&b.buf, binary.LittleEndian, uint32(len(value)))
+	b.buf.Write(value)
+	var sum uint16
+	for _, c := range value {
+		sum += uint16(c)
+	}
+	binary.Write(&b.buf, binary.LittleEndian, sum)
+	return b
+}
+
+func (b *tnefBuilder) bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// mapiUnicodeFilename encodes a MAPI property list holding PR_ATTACH_LONG_FILENAME
+func mapiUnicodeFilename(name string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+
+	// A fixed-size property that must be skipped: PR_ATTACH_METHOD (PT_LONG)
+	binary.Write(&buf, binary.LittleEndian, uint16(0x0003))
+	binary.Write(&buf, binary.LittleEndian, uint16(0x3705))
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+
+	encoded := utf16.Encode([]rune(name + "\x00"))
+	binary.Write(&buf, binary.LittleEndian, uint16(0x001F))
+	binary.Write(&buf, binary.LittleEndian, uint16(mapiAttachLongFilename))
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(encoded)*2))
+	for _, u := range encoded {
+		binary.Write(&buf, binary.LittleEndian, u)
+	}
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func testTNEF() []byte {
+	return newTNEFBuilder().
+		attr(0x01, 0x00018004, []byte("IPM.Microsoft Mail.Note\x00")).
+		attr(tnefLevelAttachment, tnefAttAttachRendData, make([]byte, 14)).
+		attr(tnefLevelAttachment, tnefAttAttachTitle, []byte("REPORT~1.DOC\x00")).
+		attr(tnefLevelAttachment, tnefAttAttachData, []byte("first attachment")).
+		attr(tnefLevelAttachment, tnefAttAttachment, mapiUnicodeFilename("Quarterly report.docx")).
+		attr(tnefLevelAttachment, tnefAttAttachRendData, make([]byte, 14)).
+		attr(tnefLevelAttachment, tnefAttAttachTitle, []byte("notes.txt\x00")).
+		attr(tnefLevelAttachment, tnefAttAttachData, []byte("second")).
+		bytes()
+}
+
+func TestDecodeTNEF(t *testing.T) {
+	attachments, err := decodeTNEF(testTNEF())
+	require.NoError(t, err)
+	require.Len(t, attachments, 2)
+
+	assert.Equal(t, "Quarterly report.docx", attachments[0].Filename)
+	assert.Equal(t, "first attachment", string(attachments[0].Data))
+	assert.Equal(t, "notes.txt", attachments[1].Filename)
+	assert.Equal(t, "second", string(attachments[1].Data))
+}
+
+func TestDecodeTNEFInvalid(t *testing.T) {
+	_, err := decodeTNEF([]byte("not tnef"))
+	assert.ErrorIs(t, err, errInvalidTNEF)
+
+	// Attribute length pointing past the end of the stream
+	truncated := testTNEF()
+	_, err = decodeTNEF(truncated[:len(truncated)-4])
+	assert.ErrorIs(t, err, errInvalidTNEF)
+}
+
+func TestMAPILongFilenameMalformed(t *testing.T) {
+	assert.Equal(t, "", mapiLongFilename(nil))
+	assert.Equal(t, "", mapiLongFilename([]byte{0xff, 0xff, 0xff, 0xff, 0x1f, 0x00}))
+}
+
+func TestIsTNEF(t *testing.T) {
+	data := testTNEF()
+	assert.True(t, isTNEF("application/ms-tnef", "", data))
+	assert.True(t, isTNEF("application/octet-stream", "WINMAIL.DAT", data))
+	assert.False(t, isTNEF("application/octet-stream", "report.dat", data))
+	assert.False(t, isTNEF("application/ms-tnef", "", []byte("garbage")))
+}
+
+func TestParseMessageWithTNEF(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testTNEF())
+	raw := "Subject: from outlook\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/ms-tnef; name=\"winmail.dat\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		strings.TrimSpace(encoded) + "\r\n" +
+		"--b--\r\n"
+
+	msg, err := parseMessage(strings.NewReader(raw), 1<<20)
+	require.NoError(t, err)
+	require.Len(t, msg.Parts, 4)
+
+	assert.Equal(t, "winmail.dat", msg.Parts[1].Filename)
+	assert.Equal(t, "1.2.1", msg.Parts[2].Path)
+	assert.Equal(t, "Quarterly report.docx", msg.Parts[2].Filename)
+	assert.Equal(t, "1.2.2", msg.Parts[3].Path)
+	assert.Equal(t, "second", string(msg.Parts[3].Data))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// tracerName identifies this service's spans and is its default
+// service.name
+const tracerName = "clamav-api"
+
+// Span attributes describing a scan
+const (
+	attrScanSize    = attribute.Key("clamav.scan.size")
+	attrScanVerdict = attribute.Key("clamav.scan.verdict")
+	attrScanEngine  = attribute.Key("clamav.scan.engine")
+	attrVirusName   = attribute.Key("clamav.virus.name")
+	attrRequestID   = attribute.Key("request.id")
+)
+
+// tracer returns the tracer of the installed provider. It is looked up on
+// every use so spans follow a provider installed after startup.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// initTracing installs the W3C trace context propagator and, when an OTLP
+// endpoint is configured, a tracer provider that exports to it. Incoming
+// sampling decisions are honored; new traces are sampled at
+// TraceSampleRatio. The returned function flushes pending spans.
+func initTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName(tracerName),
+			semconv.ServiceVersion(Version),
+		),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		GetLogger().Warn("Trace export failed", zap.Error(err))
+	}))
+	return provider.Shutdown, nil
+}
+
+// tagRequestSpan records the request ID on the span of the request in ctx
+func tagRequestSpan(ctx context.Context, id string) {
+	trace.SpanFromContext(ctx).SetAttributes(attrRequestID.String(id))
+}
+
+// endScanSpan records the outcome of performScan on its span
+func endScanSpan(span trace.Span, result *ScanResult, err error) {
+	var timeoutErr *ScanTimeoutError
+	switch {
+	case err == nil:
+		span.SetAttributes(attrScanVerdict.String(result.Status))
+		if result.Status == "FOUND" {
+			span.SetAttributes(attrVirusName.String(result.Description))
+		}
+	case errors.As(err, &timeoutErr):
+		span.SetAttributes(attrScanVerdict.String("TIMEOUT"))
+		span.SetStatus(codes.Error, err.Error())
+	default:
+		span.SetAttributes(attrScanVerdict.String("ERROR"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// scanSpanReader splits the time go-clamd spends in ScanStream into the
+// clamd.connect span, which ends when it first reads the body, and the
+// scan.body_receive span covering the body being read and sent to clamd
+type scanSpanReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	connect trace.Span
+	receive trace.Span
+	n       int64
+}
+
+// newScanSpanReader starts the clamd.connect span as a child of ctx
+func newScanSpanReader(ctx context.Context, reader io.Reader) *scanSpanReader {
+	_, connect := tracer().Start(ctx, "clamd.connect")
+	return &scanSpanReader{ctx: ctx, reader: reader, connect: connect}
+}
+
+func (r *scanSpanReader) Read(p []byte) (int, error) {
+	if r.receive == nil {
+		r.connect.End()
+		_, r.receive = tracer().Start(r.ctx, "scan.body_receive")
+	}
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// finish ends the span still open once ScanStream returns err
+func (r *scanSpanReader) finish(err error) {
+	span := r.connect
+	if r.receive != nil {
+		span = r.receive
+		span.SetAttributes(attrScanSize.Int64(r.n))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// withTestTracing installs a tracer provider that records every span
+func withTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	originalProvider := otel.GetTracerProvider()
+	originalPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(originalProvider)
+		otel.SetTextMapPropagator(originalPropagator)
+	})
+	return recorder
+}
+
+// withFakeClamd serves PING, VERSION and INSTREAM on a Unix socket,
+// answering every scan with reply, and points the clamd client at it.
+// VERSION reports signatures dated now.
+func withFakeClamd(t *testing.T, reply string) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch command {
+				case "nPING\n":
+					io.WriteString(conn, "PONG\n")
+					return
+				case "nVERSION\n":
+					io.WriteString(conn, "ClamAV 1.4.1/27400/"+time.Now().Format(signatureDateLayout)+"\n")
+					return
+				case "nRELOAD\n":
+					io.WriteString(conn, "RELOADING\n")
+					return
+				}
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+						return
+					}
+				}
+				io.WriteString(conn, reply+"\n")
+			}()
+		}
+	}()
+
+	originalSocket := config.ClamdUnixSocket
+	config.ClamdUnixSocket = socket
+	resetClamdClient()
+	t.Cleanup(func() {
+		config.ClamdUnixSocket = originalSocket
+		resetClamdClient()
+	})
+}
+
+// spansByName indexes recorded spans by name
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	byName := make(map[string]sdktrace.ReadOnlySpan, len(spans))
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	return byName
+}
+
+// spanAttribute returns the value of key on span
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestPerformScanSpans(t *testing.T) {
+	recorder := withTestTracing(t)
+	withFakeClamd(t, "stream: Eicar-Test-Signature FOUND")
+
+	result, err := performScan(context.Background(), bytes.NewReader([]byte("infected payload")), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", result.Status)
+
+	spans := spansByName(recorder.Ended())
+	scan := spans["clamav.scan"]
+	require.NotNil(t, scan)
+	assert.Equal(t, "FOUND", spanAttribute(scan, attrScanVerdict).AsString())
+	assert.Equal(t, "Eicar-Test-Signature", spanAttribute(scan, attrVirusName).AsString())
+	assert.Equal(t, int64(16), spanAttribute(scan, attrScanSize).AsInt64())
+
+	for _, name := range []string{"clamd.connect", "scan.body_receive", "clamd.verdict"} {
+		child := spans[name]
+		require.NotNil(t, child, name)
+		assert.Equal(t, scan.SpanContext().SpanID(), child.Parent().SpanID(), name)
+	}
+	assert.Equal(t, int64(16), spanAttribute(spans["scan.body_receive"], attrScanSize).AsInt64())
+	assert.False(t, spans["clamd.connect"].EndTime().After(spans["scan.body_receive"].StartTime()))
+}
+
+func TestPerformScanSpanRecordsError(t *testing.T) {
+	recorder := withTestTracing(t)
+	withInvalidSocket(t)
+
+	_, err := performScan(context.Background(), bytes.NewReader([]byte("data")), 5*time.Second)
+	require.Error(t, err)
+
+	spans := spansByName(recorder.Ended())
+	require.Contains(t, spans, "clamav.scan")
+	assert.Equal(t, codes.Error, spans["clamav.scan"].Status().Code)
+	assert.Equal(t, "ERROR", spanAttribute(spans["clamav.scan"], attrScanVerdict).AsString())
+	assert.Equal(t, codes.Error, spans["clamd.connect"].Status().Code)
+	assert.NotContains(t, spans, "scan.body_receive")
+	assert.NotContains(t, spans, "clamd.verdict")
+}
+
+func TestGinHonorsIncomingTraceContext(t *testing.T) {
+	recorder := withTestTracing(t)
+	withFakeClamd(t, "stream: OK")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(otelgin.Middleware(tracerName))
+	router.Use(requestIDMiddleware())
+	router.POST("/api/stream-scan", handleStreamScan)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/stream-scan", bytes.NewReader([]byte("clean")))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(requestIDHeader, "client-42")
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	spans := spansByName(recorder.Ended())
+	server := spans["POST /api/stream-scan"]
+	require.NotNil(t, server)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, "client-42", spanAttribute(server, attrRequestID).AsString())
+
+	scan := spans["clamav.scan"]
+	require.NotNil(t, scan)
+	assert.Equal(t, server.SpanContext().SpanID(), scan.Parent().SpanID())
+	assert.Equal(t, "OK", spanAttribute(scan, attrScanVerdict).AsString())
+}
+
+// fakeCollector is an OTLP/gRPC trace collector that keeps what it receives
+type fakeCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+	mu    sync.Mutex
+	spans []*tracepb.ResourceSpans
+}
+
+func (c *fakeCollector) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, req.ResourceSpans...)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func TestInitTracingExportsOverOTLP(t *testing.T) {
+	collector := &fakeCollector{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(server, collector)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	originalProvider := otel.GetTracerProvider()
+	originalPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(originalProvider)
+		otel.SetTextMapPropagator(originalPropagator)
+	})
+
+	cfg := defaultConfig()
+	cfg.OTLPEndpoint = lis.Addr().String()
+	cfg.OTLPInsecure = true
+	shutdown, err := initTracing(context.Background(), &cfg)
+	require.NoError(t, err)
+
+	_, span := tracer().Start(context.Background(), "clamav.scan")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	require.Len(t, collector.spans, 1)
+	var serviceName string
+	for _, kv := range collector.spans[0].Resource.Attributes {
+		if kv.Key == "service.name" {
+			serviceName = kv.Value.GetStringValue()
+		}
+	}
+	assert.Equal(t, tracerName, serviceName)
+	require.Len(t, collector.spans[0].ScopeSpans, 1)
+	require.Len(t, collector.spans[0].ScopeSpans[0].Spans, 1)
+	assert.Equal(t, "clamav.scan", collector.spans[0].ScopeSpans[0].Spans[0].Name)
+}
+
+func TestInitTracingWithoutEndpoint(t *testing.T) {
+	originalPropagator := otel.GetTextMapPropagator()
+	t.Cleanup(func() { otel.SetTextMapPropagator(originalPropagator) })
+
+	cfg := defaultConfig()
+	shutdown, err := initTracing(context.Background(), &cfg)
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Contains(t, otel.GetTextMapPropagator().Fields(), "traceparent")
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var (
+	// errURLNotAllowed marks URLs rejected by the scheme, host or address policy
+	errURLNotAllowed = errors.New("URL not allowed")
+
+	// errURLFetch marks failures downloading the URL rather than scanning it
+	errURLFetch = errors.New("failed to fetch URL")
+
+	// errURLFetchTimeout marks downloads that exceeded the fetch timeout
+	errURLFetchTimeout = errors.New("URL fetch timed out")
+)
+
+// blockedPrefixes are address ranges that are never fetched in addition to
+// loopback, private, link-local, multicast and unspecified addresses
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, incl. broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may map to private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001::/32"),      // Teredo, may embed private IPv4
+	netip.MustParsePrefix("2002::/16"),      // 6to4, may embed private IPv4
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+}
+
+// isBlockedAddr reports whether addr must not be contacted by the URL fetcher
+func isBlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// URLScanResult is the outcome of scanning a URL
+type URLScanResult struct {
+	URL    string
+	Size   int64
+	Result *ScanResult
+}
+
+// URLScanner downloads URLs and streams the body into clamd. Every hop is
+// checked against the scheme and host allowlists, and the resolved address
+// of every connection against the blocked ranges.
+type URLScanner struct {
+	config  *liveConfig
+	client  *http.Client
+	scan    scanFunc
+	blocked func(netip.Addr) bool
+}
+
+// NewURLScanner creates a URL scanner using the policy in cfg
+func NewURLScanner(cfg *Config) *URLScanner {
+	live := newLiveConfig(cfg)
+	s := &URLScanner{
+		config:  live,
+		scan:    live.scan,
+		blocked: isBlockedAddr,
+	}
+
+	// The address is checked after DNS resolution, right before connecting,
+	// so a hostname cannot be re-resolved to an internal address later
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: unexpected dial address %q", errURLNotAllowed, address)
+			}
+			if s.blocked(addrPort.Addr()) {
+				return fmt.Errorf("%w: destination address %s is not public", errURLNotAllowed, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			// Never use HTTP_PROXY: the proxy would connect on our behalf
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			// Scan exactly the bytes the server sends
+			DisableCompression: true,
+			MaxIdleConns:       10,
+			IdleConnTimeout:    90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects := s.config.Load().URLScanMaxRedirects; len(via) > maxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects", errURLFetch, maxRedirects)
+			}
+			return s.checkURL(req.URL)
+		},
+	}
+	return s
+}
+
+// Reload applies a reloaded URL policy and limits
+func (s *URLScanner) Reload(cfg *Config) error {
+	s.config.Store(cfg)
+	return nil
+}
+
+// checkURL applies the scheme and host allowlists to u
+func (s *URLScanner) checkURL(u *url.URL) error {
+	if !slices.Contains(s.config.Load().URLScanSchemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("%w: scheme %q is not allowed", errURLNotAllowed, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: missing host", errURLNotAllowed)
+	}
+	if len(s.config.Load().URLScanAllowedHosts) > 0 && !hostAllowed(host, s.config.Load().URLScanAllowedHosts) {
+		return fmt.Errorf("%w: host %q is not allowed", errURLNotAllowed, host)
+	}
+	return nil
+}
+
+// hostAllowed reports whether host matches an allowlist entry. Entries
+// starting with "*." or "." match any subdomain; others match exactly.
+func hostAllowed(host string, allowed []string) bool {
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if suffix, ok := strings.CutPrefix(entry, "*"); ok {
+			entry = suffix
+		}
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+			continue
+		}
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL drops the query string and credentials, which for presigned
+// links carry the signature, so URLs can be logged and returned safely
+func redactURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// ScanURL downloads rawURL and streams the body into clamd, enforcing
+// MaxContentLength while reading. The scan is recorded in the scan metrics
+// under method.
+func (s *URLScanner) ScanURL(ctx context.Context, rawURL, method string) (*URLScanResult, error) {
+	logger := loggerFromContext(ctx)
+	maxSize := s.config.Load().MaxContentLength
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errURLNotAllowed, err)
+	}
+	if err := s.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	// The fetch timeout bounds the download only; the scan keeps its own
+	fetchCtx, cancel := context.WithTimeout(ctx, s.config.Load().URLScanFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errURLNotAllowed, err)
+	}
+	req.Header.Set("User-Agent", "clamav-api/"+Version)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, s.fetchError(fetchCtx, err)
+	}
+	defer resp.Body.Close()
+
+	finalURL := redactURL(resp.Request.URL)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%w: server returned HTTP %d", errURLFetch, resp.StatusCode)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, errPayloadTooLarge
+	}
+
+	logger.Debug("URL scan started",
+		zap.String("url", finalURL),
+		zap.Int64("content_length", resp.ContentLength))
+
+	reader := &countingReader{reader: io.LimitReader(resp.Body, maxSize+1)}
+	scansInProgress.Inc()
+	result, err := s.scan(withScanFilename(ctx, finalURL), reader)
+	scansInProgress.Dec()
+
+	// A failed download would otherwise be reported as a clean scan of
+	// whatever arrived before the error, and is the root cause of any
+	// scan error it triggered
+	switch {
+	case reader.err != nil:
+		err = s.fetchError(fetchCtx, reader.err)
+	case err != nil:
+	case reader.n > maxSize:
+		err = errPayloadTooLarge
+	case resp.ContentLength >= 0 && reader.n != resp.ContentLength:
+		err = fmt.Errorf("%w: got %d of %d bytes", errURLFetch, reader.n, resp.ContentLength)
+	}
+	if errors.Is(err, errPayloadTooLarge) {
+		return nil, err
+	}
+	recordScanMetrics(method, result, err)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("URL scanned",
+		zap.String("url", finalURL),
+		zap.Int64("size", reader.n),
+		zap.String("status", result.Status),
+		zap.String("result", result.Description),
+		zap.Float64("elapsed_seconds", result.ScanTime))
+
+	return &URLScanResult{URL: finalURL, Size: reader.n, Result: result}, nil
+}
+
+// fetchError classifies a download error, keeping policy rejections
+// distinguishable from network failures and timeouts
+func (s *URLScanner) fetchError(fetchCtx context.Context, err error) error {
+	// *url.Error quotes the full URL, which may carry a presigned signature
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	switch {
+	case errors.Is(err, errURLNotAllowed), errors.Is(err, errURLFetch):
+		return err
+	case errors.Is(fetchCtx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w after %.0f seconds", errURLFetchTimeout, s.config.Load().URLScanFetchTimeout.Seconds())
+	case errors.Is(err, context.Canceled):
+		return err
+	}
+	return fmt.Errorf("%w: %w", errURLFetch, err)
+}
+
+// handleScanURL scans the URL named in the request body
+func (s *URLScanner) handleScanURL(c *gin.Context) {
+	logger := requestLogger(c)
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		recordRejection(transportREST, rejectInvalid)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "url is required", "request_id": requestID(c)})
+		return
+	}
+
+	scanned, err := s.ScanURL(c.Request.Context(), req.URL, "rest_url")
+	if err != nil {
+		s.respondError(c, logger, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, withScanDetails(gin.H{
+		"status":     scanned.Result.Status,
+		"message":    scanned.Result.Description,
+		"time":       scanned.Result.ScanTime,
+		"action":     scanned.Result.Action,
+		"policy":     scanned.Result.Policy,
+		"url":        scanned.URL,
+		"size":       scanned.Size,
+		"request_id": requestID(c),
+	}, scanned.Result))
+}
+
+// respondError maps URL fetch and scan errors to HTTP responses
+func (s *URLScanner) respondError(c *gin.Context, logger *zap.Logger, err error) {
+	switch {
+	case errors.Is(err, errURLNotAllowed):
+		logger.Warn("URL scan rejected",
+			zap.String("client_ip", c.ClientIP()),
+			zap.Error(err))
+		recordRejection(transportREST, rejectInvalid)
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "request_id": requestID(c)})
+	case errors.Is(err, errPayloadTooLarge):
+		logger.Warn("URL scan rejected: file too large",
+			zap.Int64("max_allowed", s.config.Load().MaxContentLength),
+			zap.String("client_ip", c.ClientIP()))
+		recordRejection(transportREST, rejectTooLarge)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"message":    fmt.Sprintf("File too large. Maximum size is %d bytes", s.config.Load().MaxContentLength),
+			"request_id": requestID(c),
+		})
+	case errors.Is(err, errURLFetchTimeout):
+		logger.Warn("URL fetch timeout", zap.Error(err))
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"status":     "Fetch timeout",
+			"message":    err.Error(),
+			"request_id": requestID(c),
+		})
+	case errors.Is(err, errURLFetch):
+		logger.Warn("URL fetch failed", zap.Error(err))
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status":     "Fetch failed",
+			"message":    err.Error(),
+			"request_id": requestID(c),
+		})
+	default:
+		respondScanError(c, logger, err, "url")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestURLScanner returns a scanner that may reach loopback test servers
+// but otherwise applies the normal address policy
+func newTestURLScanner(t *testing.T, mutate func(*Config)) *URLScanner {
+	t.Helper()
+	cfg := config
+	cfg.EnableURLScan = true
+	cfg.URLScanSchemes = []string{"http", "https"}
+	cfg.URLScanAllowedHosts = nil
+	cfg.URLScanMaxRedirects = 3
+	cfg.URLScanFetchTimeout = 5 * time.Second
+	cfg.MaxContentLength = 1 << 20
+	cfg.ScanTimeout = 5 * time.Second
+	if mutate != nil {
+		mutate(&cfg)
+	}
+
+	scanner := NewURLScanner(&cfg)
+	scanner.scan = fakeScan
+	scanner.blocked = func(addr netip.Addr) bool {
+		return !addr.IsLoopback() && isBlockedAddr(addr)
+	}
+	return scanner
+}
+
+func newFileServer(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestIsBlockedAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"255.255.255.255", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"2002:a00:1::", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.blocked, isBlockedAddr(netip.MustParseAddr(tt.addr)))
+		})
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"files.example.com", "*.s3.amazonaws.com", ".storage.example.net"}
+
+	assert.True(t, hostAllowed("files.example.com", allowed))
+	assert.True(t, hostAllowed("bucket.s3.amazonaws.com", allowed))
+	assert.True(t, hostAllowed("a.b.storage.example.net", allowed))
+	assert.False(t, hostAllowed("example.com", allowed))
+	assert.False(t, hostAllowed("evil-files.example.com", allowed))
+	assert.False(t, hostAllowed("s3.amazonaws.com", allowed))
+	assert.False(t, hostAllowed("s3.amazonaws.com.evil.org", allowed))
+}
+
+func TestRedactURL(t *testing.T) {
+	u, _ := http.NewRequest(http.MethodGet, "https://user:pw@bucket.s3.amazonaws.com/a/b.pdf?X-Amz-Signature=abc#frag", nil)
+	assert.Equal(t, "https://bucket.s3.amazonaws.com/a/b.pdf", redactURL(u.URL))
+}
+
+func TestURLScannerScansBody(t *testing.T) {
+	server, _ := newFileServer(t, "harmless EICAR payload")
+	scanner := newTestURLScanner(t, nil)
+
+	scanned, err := scanner.ScanURL(context.Background(), server.URL+"/file.bin?X-Amz-Signature=secret", "rest_url")
+	require.NoError(t, err)
+	assert.Equal(t, "FOUND", scanned.Result.Status)
+	assert.Equal(t, "Eicar-Test-Signature", scanned.Result.Description)
+	assert.Equal(t, int64(len("harmless EICAR payload")), scanned.Size)
+	assert.Equal(t, server.URL+"/file.bin", scanned.URL)
+}
+
+func TestURLScannerPolicy(t *testing.T) {
+	server, hits := newFileServer(t, "data")
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	tests := []struct {
+		name   string
+		url    string
+		mutate func(*Config)
+	}{
+		{"scheme not allowed", "ftp://127.0.0.1/file", nil},
+		{"http disabled", server.URL, func(cfg *Config) { cfg.URLScanSchemes = []string{"https"} }},
+		{"host not allowlisted", server.URL, func(cfg *Config) { cfg.URLScanAllowedHosts = []string{"files.example.com"} }},
+		{"missing host", "http:///file", nil},
+		{"unparseable", "http://[::1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTestURLScanner(t, tt.mutate).ScanURL(context.Background(), tt.url, "rest_url")
+			assert.ErrorIs(t, err, errURLNotAllowed)
+		})
+	}
+
+	t.Run("resolved address blocked", func(t *testing.T) {
+		scanner := newTestURLScanner(t, nil)
+		scanner.blocked = isBlockedAddr
+
+		// The hostname passes the allowlist but resolves to loopback
+		_, err := scanner.ScanURL(context.Background(), "http://localhost:"+port+"/file", "rest_url")
+		assert.ErrorIs(t, err, errURLNotAllowed)
+		assert.Contains(t, err.Error(), "is not public")
+	})
+
+	assert.Zero(t, hits.Load(), "no request may reach the server")
+}
+
+func TestURLScannerRedirects(t *testing.T) {
+	target, targetHits := newFileServer(t, "data")
+	targetPort := target.URL[strings.LastIndex(target.URL, ":")+1:]
+
+	var mux http.ServeMux
+	redirector := httptest.NewServer(&mux)
+	t.Cleanup(redirector.Close)
+	mux.HandleFunc("/loop/{n}", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscan(r.PathValue("n"), &n)
+		http.Redirect(w, r, fmt.Sprintf("/loop/%d", n+1), http.StatusFound)
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/file", http.StatusFound)
+	})
+	mux.HandleFunc("/other-host", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+targetPort+"/file", http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://127.0.0.1/file", http.StatusFound)
+	})
+
+	t.Run("followed", func(t *testing.T) {
+		scanned, err := newTestURLScanner(t, nil).ScanURL(context.Background(), redirector.URL+"/ok", "rest_url")
+		require.NoError(t, err)
+		assert.Equal(t, target.URL+"/file", scanned.URL)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		_, err := newTestURLScanner(t, func(cfg *Config) {
+			cfg.URLScanMaxRedirects = 2
+		}).ScanURL(context.Background(), redirector.URL+"/loop/0", "rest_url")
+		assert.ErrorIs(t, err, errURLFetch)
+		assert.Contains(t, err.Error(), "stopped after 2 redirects")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, err := newTestURLScanner(t, func(cfg *Config) {
+			cfg.URLScanMaxRedirects = 0
+		}).ScanURL(context.Background(), redirector.URL+"/ok", "rest_url")
+		assert.ErrorIs(t, err, errURLFetch)
+	})
+
+	t.Run("host not allowlisted", func(t *testing.T) {
+		before := targetHits.Load()
+		_, err := newTestURLScanner(t, func(cfg *Config) {
+			cfg.URLScanAllowedHosts = []string{"127.0.0.1"}
+		}).ScanURL(context.Background(), redirector.URL+"/other-host", "rest_url")
+		assert.ErrorIs(t, err, errURLNotAllowed)
+		assert.Equal(t, before, targetHits.Load())
+	})
+
+	t.Run("scheme not allowed", func(t *testing.T) {
+		_, err := newTestURLScanner(t, nil).ScanURL(context.Background(), redirector.URL+"/ftp", "rest_url")
+		assert.ErrorIs(t, err, errURLNotAllowed)
+	})
+}
+
+func TestURLScannerSizeLimit(t *testing.T) {
+	declared := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("a", 100))
+	}))
+	t.Cleanup(declared.Close)
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, strings.Repeat("a", 10))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(chunked.Close)
+
+	for name, server := range map[string]*httptest.Server{"content-length": declared, "chunked": chunked} {
+		t.Run(name, func(t *testing.T) {
+			scanned := false
+			scanner := newTestURLScanner(t, func(cfg *Config) { cfg.MaxContentLength = 50 })
+			scanner.scan = func(ctx context.Context, reader io.Reader) (*ScanResult, error) {
+				scanned = true
+				return fakeScan(ctx, reader)
+			}
+
+			_, err := scanner.ScanURL(context.Background(), server.URL, "rest_url")
+			assert.ErrorIs(t, err, errPayloadTooLarge)
+			assert.Equal(t, name == "chunked", scanned, "a declared oversize body must be rejected before scanning")
+		})
+	}
+}
+
+func TestURLScannerFetchFailures(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(notFound.Close)
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nonly a few bytes")
+		buf.Flush()
+		conn.Close()
+	}))
+	t.Cleanup(truncated.Close)
+
+	for name, server := range map[string]*httptest.Server{"not found": notFound, "truncated": truncated} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newTestURLScanner(t, nil).ScanURL(context.Background(), server.URL, "rest_url")
+			assert.ErrorIs(t, err, errURLFetch)
+		})
+	}
+}
+
+func TestURLScannerFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		slow.Close()
+	})
+
+	scanner := newTestURLScanner(t, func(cfg *Config) {
+		cfg.URLScanFetchTimeout = 100 * time.Millisecond
+	})
+	_, err := scanner.ScanURL(context.Background(), slow.URL, "rest_url")
+	assert.ErrorIs(t, err, errURLFetchTimeout)
+}
+
+func urlScanRouter(s *URLScanner) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/scan-url", s.handleScanURL)
+	return router
+}
+
+func postScanURL(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/scan-url", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleScanURL(t *testing.T) {
+	server, _ := newFileServer(t, "clean data")
+	router := urlScanRouter(newTestURLScanner(t, nil))
+
+	before := getCounterValue(t, scanRequestsTotal, "rest_url", "ok")
+	w := postScanURL(router, `{"url":"`+server.URL+`/doc.pdf?sig=secret"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, before+1, getCounterValue(t, scanRequestsTotal, "rest_url", "ok"))
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "OK", resp["status"])
+	assert.Equal(t, server.URL+"/doc.pdf", resp["url"])
+	assert.Equal(t, float64(len("clean data")), resp["size"])
+	assert.NotContains(t, w.Body.String(), "secret")
+}
+
+func TestHandleScanURLErrors(t *testing.T) {
+	big, _ := newFileServer(t, strings.Repeat("a", 100))
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(notFound.Close)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(slow.Close)
+
+	router := urlScanRouter(newTestURLScanner(t, func(cfg *Config) {
+		cfg.MaxContentLength = 50
+		cfg.URLScanFetchTimeout = 100 * time.Millisecond
+	}))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"missing url", `{}`, http.StatusBadRequest},
+		{"invalid json", `nope`, http.StatusBadRequest},
+		{"scheme not allowed", `{"url":"file:///etc/passwd"}`, http.StatusBadRequest},
+		{"too large", `{"url":"` + big.URL + `"}`, http.StatusRequestEntityTooLarge},
+		{"upstream error", `{"url":"` + notFound.URL + `"}`, http.StatusBadGateway},
+		{"fetch timeout", `{"url":"` + slow.URL + `"}`, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postScanURL(router, tt.body)
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dirNotifier signals that something changed in one of the watched
+// directories. Events carry no detail; the watcher rescans on each one.
+type dirNotifier interface {
+	Events() <-chan struct{}
+	Close() error
+}
+
+// WatchVerdict is the sidecar JSON written next to a sorted file
+type WatchVerdict struct {
+	File      string    `json:"file"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	Action    string    `json:"action,omitempty"`
+	Size      int64     `json:"size"`
+	ScanTime  float64   `json:"scan_time"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// watchedFile tracks a file until it has stopped changing
+type watchedFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+	skipped     bool
+}
+
+// Watcher scans files dropped into inbox directories once they stop
+// changing and moves them to clean or infected target directories. Files
+// left in an inbox across a restart are picked up on the first pass.
+type Watcher struct {
+	config *liveConfig
+	scan   scanFunc
+	now    func() time.Time
+
+	// Files seen in the inboxes keyed by path, only touched by the watch loop
+	files map[string]*watchedFile
+
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewWatcher creates a watcher for cfg.WatchDirs and ensures the target
+// directories exist
+func NewWatcher(cfg *Config) (*Watcher, error) {
+	for _, inbox := range cfg.WatchDirs {
+		info, err := os.Stat(inbox)
+		if err != nil {
+			return nil, fmt.Errorf("watch directory %q: %w", inbox, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("watch directory %q is not a directory", inbox)
+		}
+		for _, dir := range []string{watchCleanDir(cfg, inbox), watchInfectedDir(cfg, inbox)} {
+			if filepath.Clean(dir) == filepath.Clean(inbox) {
+				return nil, fmt.Errorf("target directory %q must differ from watch directory", dir)
+			}
+			if err := os.MkdirAll(dir, 0750); err != nil {
+				return nil, fmt.Errorf("failed to create target directory: %w", err)
+			}
+		}
+	}
+
+	live := newLiveConfig(cfg)
+	return &Watcher{
+		config:  live,
+		scan:    live.scan,
+		now:     time.Now,
+		files:   make(map[string]*watchedFile),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// Reload applies a reloaded configuration. The watched and target
+// directories are kept.
+func (w *Watcher) Reload(cfg *Config) error {
+	w.config.Store(cfg)
+	return nil
+}
+
+// watchCleanDir returns where clean files from inbox are moved
+func watchCleanDir(cfg *Config, inbox string) string {
+	if cfg.WatchCleanDir != "" {
+		return cfg.WatchCleanDir
+	}
+	return filepath.Join(inbox, "clean")
+}
+
+// watchInfectedDir returns where infected files from inbox are moved
+func watchInfectedDir(cfg *Config, inbox string) string {
+	if cfg.WatchInfectedDir != "" {
+		return cfg.WatchInfectedDir
+	}
+	return filepath.Join(inbox, "infected")
+}
+
+// Watch processes the inboxes until Shutdown is called. It uses inotify
+// where available and falls back to polling every WatchPollInterval.
+func (w *Watcher) Watch() error {
+	defer close(w.stopped)
+	logger := GetLogger()
+
+	interval := w.config.Load().WatchPollInterval
+	var events <-chan struct{}
+	if !w.config.Load().WatchUsePolling {
+		notifier, err := newDirNotifier(w.config.Load().WatchDirs)
+		if err != nil {
+			logger.Warn("inotify unavailable, falling back to polling", zap.Error(err))
+		} else {
+			defer notifier.Close()
+			events = notifier.Events()
+			// Events only announce changes; the ticker confirms files have settled
+			interval = w.config.Load().WatchSettle
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.scanInboxes()
+
+		select {
+		case <-w.stop:
+			return nil
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops the watch loop, waiting for the file being scanned to be
+// sorted or for ctx to expire
+func (w *Watcher) Shutdown(ctx context.Context) error {
+	w.once.Do(func() { close(w.stop) })
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scanInboxes makes one pass over every inbox, processing settled files
+func (w *Watcher) scanInboxes() {
+	seen := make(map[string]bool)
+	for _, inbox := range w.config.Load().WatchDirs {
+		entries, err := os.ReadDir(inbox)
+		if err != nil {
+			GetLogger().Error("Failed to read watch directory",
+				zap.String("directory", inbox),
+				zap.Error(err))
+			continue
+		}
+
+		for _, entry := range entries {
+			// Directories (including clean/ and infected/) and dotfiles,
+			// the usual in-progress upload convention, are never touched
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+
+			path := filepath.Join(inbox, entry.Name())
+			seen[path] = true
+			if w.settled(path) {
+				w.processFile(inbox, path)
+			}
+		}
+	}
+
+	// Forget files that were removed by someone else
+	for path := range w.files {
+		if !seen[path] {
+			delete(w.files, path)
+		}
+	}
+}
+
+// settled reports whether path has kept the same size and modification
+// time for at least WatchSettle
+func (w *Watcher) settled(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(w.files, path)
+		return false
+	}
+
+	now := w.now()
+	tracked, ok := w.files[path]
+	if !ok || tracked.size != info.Size() || !tracked.modTime.Equal(info.ModTime()) {
+		w.files[path] = &watchedFile{
+			size:        info.Size(),
+			modTime:     info.ModTime(),
+			stableSince: now,
+		}
+		return false
+	}
+	return !tracked.skipped && now.Sub(tracked.stableSince) >= w.config.Load().WatchSettle
+}
+
+// processFile scans a settled file and moves it to its target directory.
+// Files that fail to scan stay in the inbox and are retried on a later pass.
+func (w *Watcher) processFile(inbox, path string) {
+	logger := GetLogger()
+	tracked := w.files[path]
+
+	if tracked.size > w.config.Load().MaxContentLength {
+		logger.Warn("Watched file skipped: file too large",
+			zap.String("path", path),
+			zap.Int64("size", tracked.size),
+			zap.Int64("max_allowed", w.config.Load().MaxContentLength))
+		tracked.skipped = true
+		return
+	}
+
+	result, err := w.scanFile(path)
+	if err != nil {
+		logger.Error("Watched file scan failed, will retry",
+			zap.String("path", path),
+			zap.Error(err))
+		// Restart the settle period so a failing backend is not hammered
+		tracked.stableSince = w.now()
+		return
+	}
+
+	targetDir := watchCleanDir(w.config.Load(), inbox)
+	if result.Blocked() {
+		targetDir = watchInfectedDir(w.config.Load(), inbox)
+	}
+
+	target, err := moveFile(path, targetDir)
+	if err != nil {
+		logger.Error("Failed to move watched file",
+			zap.String("path", path),
+			zap.String("target_dir", targetDir),
+			zap.Error(err))
+		return
+	}
+	delete(w.files, path)
+
+	if w.config.Load().WatchSidecar {
+		verdict := WatchVerdict{
+			File:      filepath.Base(path),
+			Status:    result.Status,
+			Message:   result.Description,
+			Action:    result.Action,
+			Size:      tracked.size,
+			ScanTime:  result.ScanTime,
+			ScannedAt: w.now().UTC(),
+		}
+		if err := writeSidecar(target+".json", verdict); err != nil {
+			logger.Error("Failed to write verdict sidecar",
+				zap.String("path", target),
+				zap.Error(err))
+		}
+	}
+
+	fields := []zap.Field{
+		zap.String("file", filepath.Base(path)),
+		zap.String("moved_to", target),
+		zap.Int64("size", tracked.size),
+		zap.String("status", result.Status),
+		zap.String("result", result.Description),
+		zap.String("action", result.Action),
+		zap.Float64("elapsed_seconds", result.ScanTime),
+	}
+	if result.Blocked() {
+		logger.Warn("Watched file infected", fields...)
+	} else {
+		logger.Info("Watched file clean", fields...)
+	}
+}
+
+func (w *Watcher) scanFile(path string) (*ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scansInProgress.Inc()
+	defer scansInProgress.Dec()
+
+	ctx := withScanFilename(withScanSource(context.Background(), transportWatch, ""), path)
+	result, err := w.scan(ctx, f)
+	recordScanMetrics("watch", result, err)
+	return result, err
+}
+
+// moveFile moves path into dir without overwriting an existing file and
+// returns the new path. Moves across filesystems fall back to copying.
+func moveFile(path, dir string) (string, error) {
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	target := filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s.%d%s", stem, i, ext))
+	}
+
+	err := os.Rename(path, target)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return target, err
+	}
+
+	if err := copyFile(path, target); err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	return target, os.Remove(path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeSidecar writes the verdict atomically so readers never see a partial file
+func writeSidecar(path string, verdict WatchVerdict) error {
+	data, err := json.MarshalIndent(verdict, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
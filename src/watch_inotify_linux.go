@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inotifyMask covers files being created, written, closed or moved in
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// inotifyNotifier watches directories with Linux inotify
+type inotifyNotifier struct {
+	file   *os.File
+	events chan struct{}
+}
+
+// newDirNotifier watches dirs (non-recursively) for new or changed files
+func newDirNotifier(dirs []string) (dirNotifier, error) {
+	// A non-blocking descriptor lets the runtime poller unblock Read on Close
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	for _, dir := range dirs {
+		if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("inotify_add_watch %q: %w", dir, err)
+		}
+	}
+
+	n := &inotifyNotifier{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+	go n.readLoop()
+	return n, nil
+}
+
+func (n *inotifyNotifier) readLoop() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := n.file.Read(buf); err != nil {
+			return
+		}
+		// Coalesce bursts of events into a single wakeup
+		select {
+		case n.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *inotifyNotifier) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
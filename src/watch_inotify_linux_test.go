@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInotifyNotifier(t *testing.T) {
+	dir := t.TempDir()
+	notifier, err := newDirNotifier([]string{dir})
+	require.NoError(t, err)
+	defer notifier.Close()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new.txt"), []byte("data"), 0644))
+
+	select {
+	case <-notifier.Events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an inotify event")
+	}
+}
+
+func TestInotifyNotifierInvalidDir(t *testing.T) {
+	_, err := newDirNotifier([]string{"/nonexistent/inbox"})
+	assert.Error(t, err)
+}
+
+func TestWatcherWithInotify(t *testing.T) {
+	inbox := t.TempDir()
+	cfg := config
+	cfg.WatchDirs = []string{inbox}
+	cfg.WatchSettle = 100 * time.Millisecond
+	// A long poll interval shows the inotify path is the one doing the work
+	cfg.WatchPollInterval = time.Hour
+	w, err := NewWatcher(&cfg)
+	require.NoError(t, err)
+	w.scan = fakeScan
+
+	go w.Watch()
+	defer w.Shutdown(context.Background())
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.WriteFile(filepath.Join(inbox, "eicar.com"), []byte("EICAR"), 0644))
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(inbox, "infected", "eicar.com"))
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newDirNotifier is unavailable outside Linux; the watcher polls instead
+func newDirNotifier(dirs []string) (dirNotifier, error) {
+	return nil, errors.New("inotify is only supported on Linux")
+}
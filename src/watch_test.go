@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWatcher creates a watcher on a fresh inbox with a controllable clock
+func newTestWatcher(t *testing.T, mutate func(cfg *Config)) (*Watcher, string, *time.Time) {
+	t.Helper()
+	inbox := t.TempDir()
+
+	cfg := config
+	cfg.WatchDirs = []string{inbox}
+	cfg.WatchCleanDir = ""
+	cfg.WatchInfectedDir = ""
+	cfg.WatchSidecar = false
+	cfg.WatchSettle = 2 * time.Second
+	cfg.MaxContentLength = 1024
+	if mutate != nil {
+		mutate(&cfg)
+	}
+
+	w, err := NewWatcher(&cfg)
+	require.NoError(t, err)
+	w.scan = fakeScan
+
+	clock := time.Now()
+	w.now = func() time.Time { return clock }
+	return w, inbox, &clock
+}
+
+func writeInboxFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestNewWatcherCreatesTargetDirs(t *testing.T) {
+	_, inbox, _ := newTestWatcher(t, nil)
+	assert.DirExists(t, filepath.Join(inbox, "clean"))
+	assert.DirExists(t, filepath.Join(inbox, "infected"))
+}
+
+func TestNewWatcherInvalidDirs(t *testing.T) {
+	cfg := config
+	cfg.WatchDirs = []string{"/nonexistent/inbox"}
+	_, err := NewWatcher(&cfg)
+	assert.Error(t, err)
+
+	inbox := t.TempDir()
+	cfg.WatchDirs = []string{inbox}
+	cfg.WatchCleanDir = inbox
+	_, err = NewWatcher(&cfg)
+	assert.Error(t, err, "target directory must not be the inbox")
+}
+
+func TestWatcherWaitsForFileToSettle(t *testing.T) {
+	w, inbox, clock := newTestWatcher(t, nil)
+	path := writeInboxFile(t, inbox, "report.pdf", "partial")
+
+	// First sighting only starts the settle period
+	w.scanInboxes()
+	assert.FileExists(t, path)
+
+	// The file keeps growing, restarting the settle period
+	*clock = clock.Add(3 * time.Second)
+	require.NoError(t, os.WriteFile(path, []byte("partial and complete"), 0644))
+	w.scanInboxes()
+	assert.FileExists(t, path)
+
+	*clock = clock.Add(time.Second)
+	w.scanInboxes()
+	assert.FileExists(t, path)
+
+	*clock = clock.Add(time.Second)
+	w.scanInboxes()
+	assert.NoFileExists(t, path)
+	assert.FileExists(t, filepath.Join(inbox, "clean", "report.pdf"))
+}
+
+func TestWatcherSortsFiles(t *testing.T) {
+	w, inbox, clock := newTestWatcher(t, func(cfg *Config) { cfg.WatchSidecar = true })
+	writeInboxFile(t, inbox, "clean.txt", "harmless")
+	writeInboxFile(t, inbox, "eicar.com", "X5O!P%@AP EICAR")
+	writeInboxFile(t, inbox, ".upload.part", "EICAR in progress")
+
+	w.scanInboxes()
+	*clock = clock.Add(3 * time.Second)
+	w.scanInboxes()
+
+	assert.FileExists(t, filepath.Join(inbox, "clean", "clean.txt"))
+	assert.FileExists(t, filepath.Join(inbox, "infected", "eicar.com"))
+	assert.FileExists(t, filepath.Join(inbox, ".upload.part"), "dotfiles are left alone")
+
+	data, err := os.ReadFile(filepath.Join(inbox, "infected", "eicar.com.json"))
+	require.NoError(t, err)
+	var verdict WatchVerdict
+	require.NoError(t, json.Unmarshal(data, &verdict))
+	assert.Equal(t, "eicar.com", verdict.File)
+	assert.Equal(t, "FOUND", verdict.Status)
+	assert.Equal(t, "Eicar-Test-Signature", verdict.Message)
+	assert.Equal(t, int64(15), verdict.Size)
+}
+
+func TestWatcherSharedTargetDirs(t *testing.T) {
+	clean := t.TempDir()
+	infected := t.TempDir()
+	w, inbox, clock := newTestWatcher(t, func(cfg *Config) {
+		cfg.WatchCleanDir = clean
+		cfg.WatchInfectedDir = infected
+	})
+	writeInboxFile(t, inbox, "a.txt", "ok")
+
+	w.scanInboxes()
+	*clock = clock.Add(3 * time.Second)
+	w.scanInboxes()
+
+	assert.FileExists(t, filepath.Join(clean, "a.txt"))
+	assert.NoDirExists(t, filepath.Join(inbox, "clean"))
+}
+
+func TestWatcherRetriesScanErrors(t *testing.T) {
+	w, inbox, clock := newTestWatcher(t, nil)
+	failing := true
+	w.scan = func(ctx context.Context, r io.Reader) (*ScanResult, error) {
+		if failing {
+			return nil, errors.New("clamd unavailable")
+		}
+		return fakeScan(ctx, r)
+	}
+	path := writeInboxFile(t, inbox, "data.bin", "payload")
+
+	w.scanInboxes()
+	*clock = clock.Add(3 * time.Second)
+	w.scanInboxes()
+	assert.FileExists(t, path, "file stays in the inbox when scanning fails")
+
+	failing = false
+	*clock = clock.Add(3 * time.Second)
+	w.scanInboxes()
+	assert.FileExists(t, filepath.Join(inbox, "clean", "data.bin"))
+}
+
+func TestWatcherSkipsOversizeFiles(t *testing.T) {
+	w, inbox, clock := newTestWatcher(t, func(cfg *Config) { cfg.MaxContentLength = 4 })
+	scanned := false
+	w.scan = func(ctx context.Context, r io.Reader) (*ScanResult, error) {
+		scanned = true
+		return fakeScan(ctx, r)
+	}
+	path := writeInboxFile(t, inbox, "big.bin", "more than four bytes")
+
+	for i := 0; i < 3; i++ {
+		w.scanInboxes()
+		*clock = clock.Add(3 * time.Second)
+	}
+	assert.FileExists(t, path)
+	assert.False(t, scanned)
+}
+
+func TestMoveFileAvoidsOverwrite(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeInboxFile(t, dst, "report.pdf", "existing")
+	path := writeInboxFile(t, src, "report.pdf", "new")
+
+	target, err := moveFile(path, dst)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dst, "report.1.pdf"), target)
+
+	existing, _ := os.ReadFile(filepath.Join(dst, "report.pdf"))
+	assert.Equal(t, "existing", string(existing))
+	moved, _ := os.ReadFile(target)
+	assert.Equal(t, "new", string(moved))
+}
+
+func TestWatcherResumesAfterRestart(t *testing.T) {
+	inbox := t.TempDir()
+	// Files present before the watcher starts produce no inotify events
+	writeInboxFile(t, inbox, "left-over.txt", "dropped before restart")
+
+	cfg := config
+	cfg.WatchDirs = []string{inbox}
+	cfg.WatchSettle = 50 * time.Millisecond
+	cfg.WatchPollInterval = 50 * time.Millisecond
+	cfg.WatchUsePolling = true
+	w, err := NewWatcher(&cfg)
+	require.NoError(t, err)
+	w.scan = fakeScan
+
+	go w.Watch()
+	defer w.Shutdown(context.Background())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(inbox, "clean", "left-over.txt"))
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestWatcherShutdown(t *testing.T) {
+	w, _, _ := newTestWatcher(t, nil)
+	done := make(chan error, 1)
+	go func() { done <- w.Watch() }()
+
+	require.NoError(t, w.Shutdown(context.Background()))
+	assert.NoError(t, <-done)
+	// Shutdown is idempotent
+	assert.NoError(t, w.Shutdown(context.Background()))
+}